@@ -1,4 +0,0 @@
-drop table if exists public.history;
-drop table if exists public.context;
-drop table if exists public.user;
-
@@ -14,9 +14,16 @@ import (
 
 type CliResponseHandler struct {
 	Repository data.HistoryRepository
+	Agent      string
+	// Quiet stores the answer without printing it, -schema prints the
+	// validated JSON instead
+	Quiet bool
 }
 
 func (cli CliResponseHandler) RecievedText(text string, useColor *string) {
+	if cli.Quiet {
+		return
+	}
 	if useColor != nil {
 		color.RGB(150, 150, 150).Print(text)
 	} else {
@@ -25,7 +32,7 @@ func (cli CliResponseHandler) RecievedText(text string, useColor *string) {
 }
 
 // All models should call this regardless of if they stream or not.
-func (cli CliResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
+func (cli CliResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	history := data.History{
 		ContextId:    contextId,
 		Prompt:       prompt,
@@ -33,7 +40,10 @@ func (cli CliResponseHandler) FinalText(contextId int64, prompt string, response
 		Abbreviation: "",
 		TokenCount:   0,
 		Model:        modelName,
+		Agent:        cli.Agent,
 		ToolUse:      toolUse,
+		Thinking:     thinking,
+		Attachments:  attachments,
 	}
 
 	if usage != nil {
@@ -43,11 +53,15 @@ func (cli CliResponseHandler) FinalText(contextId int64, prompt string, response
 		history.CacheWriteTokens = usage.CacheWriteTokens
 	}
 
-	_, err := cli.Repository.InsertHistory(history)
+	_, err := services.SaveHistory(cli.Repository, history)
 	if err != nil {
 		println(fmt.Sprintf("Error while trying to save history: %s", err))
 	}
 
+	if cli.Quiet {
+		return
+	}
+
 	code := services.ExtractCodeBlocks(response)
 	allCode := strings.Join(code, "\n\n")
 
@@ -1,6 +1,7 @@
 package commontypes
 
 import (
+	"context"
 	"net/http"
 	"owl/data"
 )
@@ -24,17 +25,99 @@ type PayloadModifiers struct {
 	Web              bool
 	Image            bool
 	ToolGroupFilters []string
+	// Schema is the JSON Schema the answer must match, nil for a free answer
+	Schema map[string]interface{}
+	// Attachments are the files sent with the prompt, stored with its turn
+	Attachments []data.Attachment
 }
 
+// StructuredOutputTool is the tool Claude is forced to call with the answer
+// of a structured query.
+const StructuredOutputTool = "structured_output"
+
 type ResponseHandler interface {
 	RecievedText(text string, color *string)
-	FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *TokenUsage)
+	FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *TokenUsage, thinking []data.Thinking, attachments []data.Attachment)
 	// func recievedImage(encoded string)
 }
 
+// ThinkingColor is the color thinking is shown in by response handlers that
+// do not keep it apart from the answer.
+const ThinkingColor = "grey"
+
+// ThinkingHandler is implemented by response handlers that keep streamed
+// thinking apart from the answer.
+type ThinkingHandler interface {
+	RecievedThinking(text string)
+}
+
+// ToolEventHandler is implemented by response handlers that report Owl's tool
+// calls while the turn runs: before the tool runs and once it has answered.
+type ToolEventHandler interface {
+	ToolCalled(toolUse data.ToolUse)
+	ToolAnswered(toolUse data.ToolUse)
+}
+
+// SendThinking passes thinking to the handler, as text in ThinkingColor when
+// it does not keep thinking apart.
+func SendThinking(handler ResponseHandler, text string) {
+	if thinkingHandler, ok := handler.(ThinkingHandler); ok {
+		thinkingHandler.RecievedThinking(text)
+		return
+	}
+	color := ThinkingColor
+	handler.RecievedText(text, &color)
+}
+
+// SendToolCalled reports a tool call to handlers that take tool events.
+func SendToolCalled(handler ResponseHandler, toolUse data.ToolUse) {
+	if toolHandler, ok := handler.(ToolEventHandler); ok {
+		toolHandler.ToolCalled(toolUse)
+	}
+}
+
+// SendToolAnswered reports the result of a tool call to handlers that take
+// tool events.
+func SendToolAnswered(handler ResponseHandler, toolUse data.ToolUse) {
+	if toolHandler, ok := handler.(ToolEventHandler); ok {
+		toolHandler.ToolAnswered(toolUse)
+	}
+}
+
 type Model interface {
-	CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *PayloadModifiers) *http.Request
+	CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *PayloadModifiers) (*http.Request, error)
 	HandleStreamedLine(line []byte)
 	HandleBodyBytes(bytes []byte)
 	SetResponseHandler(responseHandler ResponseHandler)
 }
+
+// PartialResponder is implemented by models that can report the prompt and
+// answer of the turn in flight, used to save an interrupted history row when a
+// query is cancelled. Both are empty once the turn has reached FinalText.
+type PartialResponder interface {
+	PartialResponse() (prompt string, response string)
+}
+
+// StreamedOutputReporter is implemented by models that know whether the turn
+// in flight passed anything to the ResponseHandler: answer text, thinking or
+// tool events. Such a turn is never retried, the handler would get the output
+// twice. Models without it are judged by their PartialResponse.
+type StreamedOutputReporter interface {
+	HasStreamedOutput() bool
+}
+
+// PartialThinker is implemented by models that can report the thinking of
+// the turn in flight, saved with an interrupted history row.
+type PartialThinker interface {
+	PartialThinking() []data.Thinking
+}
+
+// FallbackModel is a chain of models tried in order. The query pipeline calls
+// Fallback when the active model fails before any tokens have streamed.
+type FallbackModel interface {
+	Model
+	ActiveModel() Model
+	ActiveModelName() string
+	// Fallback moves to the next model in the chain, false once it is exhausted
+	Fallback() bool
+}
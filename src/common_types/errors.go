@@ -0,0 +1,305 @@
+package commontypes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindAuth           ErrorKind = "auth"
+	ErrorKindRateLimit      ErrorKind = "rate_limit"
+	ErrorKindQuota          ErrorKind = "quota"
+	ErrorKindOverloaded     ErrorKind = "overloaded"
+	ErrorKindBadRequest     ErrorKind = "bad_request"
+	ErrorKindContextTooLong ErrorKind = "context_too_long"
+	ErrorKindUnknown        ErrorKind = "unknown"
+)
+
+// ProviderError is a failed call to a model provider, classified from the
+// status code and the provider's error body.
+type ProviderError struct {
+	Kind       ErrorKind
+	Provider   string
+	StatusCode int
+	Type       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	description := e.describe()
+	if e.Provider != "" {
+		description = fmt.Sprintf("%s: %s", e.Provider, description)
+	}
+	if e.StatusCode != 0 {
+		description = fmt.Sprintf("%s (%d)", description, e.StatusCode)
+	}
+	if e.Message != "" {
+		description = fmt.Sprintf("%s: %s", description, e.Message)
+	}
+	return description
+}
+
+func (e *ProviderError) describe() string {
+	switch e.Kind {
+	case ErrorKindAuth:
+		return "authentication failed"
+	case ErrorKindRateLimit:
+		return "rate limited"
+	case ErrorKindQuota:
+		return "quota exceeded"
+	case ErrorKindOverloaded:
+		return "provider overloaded"
+	case ErrorKindBadRequest:
+		return "bad request"
+	case ErrorKindContextTooLong:
+		return "context too long"
+	default:
+		return "request failed"
+	}
+}
+
+// Hint is a short suggestion shown next to the error in the CLI and TUI.
+func (e *ProviderError) Hint() string {
+	switch e.Kind {
+	case ErrorKindAuth:
+		return "check the API key for this provider"
+	case ErrorKindRateLimit:
+		if e.RetryAfter > 0 {
+			return fmt.Sprintf("try again in %s", e.RetryAfter.Round(time.Second))
+		}
+		return "wait a moment and try again"
+	case ErrorKindQuota:
+		return "check the plan and billing of this provider or pick another model"
+	case ErrorKindOverloaded:
+		return "the provider is busy, try again or pick another model"
+	case ErrorKindContextTooLong:
+		return "lower -history or archive old messages in this context"
+	default:
+		return ""
+	}
+}
+
+// Retryable reports whether the same request may succeed when sent again.
+func (e *ProviderError) Retryable() bool {
+	switch e.Kind {
+	case ErrorKindRateLimit, ErrorKindOverloaded:
+		return true
+	case ErrorKindUnknown:
+		return e.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+// HTTPStatus is the status the owl server answers with. A rejected API key is
+// the server's problem, not the caller's, so auth maps to 502.
+func (e *ProviderError) HTTPStatus() int {
+	switch e.Kind {
+	case ErrorKindRateLimit:
+		return http.StatusTooManyRequests
+	case ErrorKindOverloaded:
+		return http.StatusServiceUnavailable
+	case ErrorKindBadRequest:
+		return http.StatusBadRequest
+	case ErrorKindContextTooLong:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// AsProviderError unwraps err to a ProviderError if it is one.
+func AsProviderError(err error) (*ProviderError, bool) {
+	var providerError *ProviderError
+	if errors.As(err, &providerError) {
+		return providerError, true
+	}
+	return nil, false
+}
+
+// MissingApiKeyError is returned by CreateRequest when the provider key is not configured.
+func MissingApiKeyError(provider string, envVar string) *ProviderError {
+	return &ProviderError{
+		Kind:     ErrorKindAuth,
+		Provider: provider,
+		Message:  fmt.Sprintf("%s is not set", envVar),
+	}
+}
+
+type providerErrorDetail struct {
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+}
+
+type providerErrorBody struct {
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+	Message string          `json:"message"`
+	Error   json.RawMessage `json:"error"`
+}
+
+// ParseProviderError classifies a non-200 response. It understands the error
+// bodies of Anthropic ({"error":{"type","message"}}), OpenAI and xAI
+// ({"error":{"message","type","code"}} or {"code","error"}), Gemini
+// ({"error":{"code","status","message"}}, possibly wrapped in an array) and
+// Ollama ({"error":"..."}), and falls back to the status code.
+func ParseProviderError(provider string, statusCode int, header http.Header, body []byte) *ProviderError {
+	detail := parseProviderErrorDetail(body)
+
+	providerError := &ProviderError{
+		Kind:       classifyProviderError(statusCode, detail),
+		Provider:   provider,
+		StatusCode: statusCode,
+		Type:       detail.Type,
+		Message:    detail.Message,
+		RetryAfter: parseRetryAfter(header),
+	}
+	if providerError.Type == "" {
+		providerError.Type = detail.Status
+	}
+	if providerError.Type == "" {
+		providerError.Type = rawCode(detail.Code)
+	}
+	if providerError.Message == "" {
+		providerError.Message = truncateErrorBody(body)
+	}
+	return providerError
+}
+
+func parseProviderErrorDetail(body []byte) providerErrorDetail {
+	trimmed := strings.TrimSpace(string(body))
+
+	// Gemini's OpenAI compatible endpoint wraps the error in an array
+	if strings.HasPrefix(trimmed, "[") {
+		var wrapped []json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &wrapped); err == nil && len(wrapped) > 0 {
+			trimmed = string(wrapped[0])
+		}
+	}
+
+	var envelope providerErrorBody
+	if err := json.Unmarshal([]byte(trimmed), &envelope); err != nil {
+		return providerErrorDetail{}
+	}
+
+	detail := providerErrorDetail{}
+	if len(envelope.Error) > 0 {
+		var message string
+		if err := json.Unmarshal(envelope.Error, &message); err == nil {
+			detail.Message = message
+		} else {
+			json.Unmarshal(envelope.Error, &detail)
+		}
+	}
+
+	if detail.Message == "" {
+		detail.Message = envelope.Message
+	}
+	if len(detail.Code) == 0 {
+		detail.Code = envelope.Code
+	}
+	if detail.Type == "" && envelope.Type != "error" {
+		detail.Type = envelope.Type
+	}
+	return detail
+}
+
+func classifyProviderError(statusCode int, detail providerErrorDetail) ErrorKind {
+	code := rawCode(detail.Code)
+	message := strings.ToLower(detail.Message)
+
+	for _, value := range []string{detail.Type, detail.Status, code} {
+		switch value {
+		case "authentication_error", "permission_error", "invalid_api_key", "UNAUTHENTICATED", "PERMISSION_DENIED":
+			return ErrorKindAuth
+		case "insufficient_quota", "billing_hard_limit_reached", "billing_not_active":
+			return ErrorKindQuota
+		case "rate_limit_error", "rate_limit_exceeded", "RESOURCE_EXHAUSTED":
+			return ErrorKindRateLimit
+		case "overloaded_error", "server_overloaded", "engine_overloaded", "UNAVAILABLE":
+			return ErrorKindOverloaded
+		case "context_length_exceeded", "request_too_large", "string_above_max_length":
+			return ErrorKindContextTooLong
+		}
+	}
+
+	// Anthropic answers an empty credit balance as a bad request
+	if strings.Contains(message, "credit balance is too low") {
+		return ErrorKindQuota
+	}
+
+	if strings.Contains(message, "prompt is too long") ||
+		strings.Contains(message, "context length") ||
+		strings.Contains(message, "context window") ||
+		strings.Contains(message, "maximum number of tokens") {
+		return ErrorKindContextTooLong
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorKindAuth
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorKindRateLimit
+	case statusCode == http.StatusServiceUnavailable || statusCode == 529:
+		return ErrorKindOverloaded
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return ErrorKindContextTooLong
+	case statusCode >= 400 && statusCode < 500:
+		return ErrorKindBadRequest
+	}
+	return ErrorKindUnknown
+}
+
+func rawCode(code json.RawMessage) string {
+	if len(code) == 0 || string(code) == "null" {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(code, &text); err == nil {
+		return text
+	}
+	return string(code)
+}
+
+func parseRetryAfter(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	// OpenAI sends a millisecond precise variant next to Retry-After
+	if value := strings.TrimSpace(header.Get("Retry-After-Ms")); value != "" {
+		if milliseconds, err := strconv.ParseFloat(value, 64); err == nil && milliseconds > 0 {
+			return time.Duration(milliseconds * float64(time.Millisecond))
+		}
+	}
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func truncateErrorBody(body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > 300 {
+		return text[:300] + "..."
+	}
+	return text
+}
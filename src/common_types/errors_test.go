@@ -0,0 +1,163 @@
+package commontypes
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseProviderErrorClassifiesProviderBodies(t *testing.T) {
+	cases := []struct {
+		name       string
+		statusCode int
+		body       string
+		kind       ErrorKind
+		message    string
+	}{
+		{
+			name:       "anthropic rate limit",
+			statusCode: 429,
+			body:       `{"type":"error","error":{"type":"rate_limit_error","message":"Number of request tokens has exceeded your per-minute rate limit"}}`,
+			kind:       ErrorKindRateLimit,
+			message:    "Number of request tokens has exceeded your per-minute rate limit",
+		},
+		{
+			name:       "anthropic overloaded",
+			statusCode: 529,
+			body:       `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			kind:       ErrorKindOverloaded,
+			message:    "Overloaded",
+		},
+		{
+			name:       "anthropic prompt too long",
+			statusCode: 400,
+			body:       `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`,
+			kind:       ErrorKindContextTooLong,
+			message:    "prompt is too long: 210000 tokens > 200000 maximum",
+		},
+		{
+			name:       "anthropic auth",
+			statusCode: 401,
+			body:       `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`,
+			kind:       ErrorKindAuth,
+			message:    "invalid x-api-key",
+		},
+		{
+			name:       "openai context length",
+			statusCode: 400,
+			body:       `{"error":{"message":"This model's maximum context length is 128000 tokens.","type":"invalid_request_error","param":"messages","code":"context_length_exceeded"}}`,
+			kind:       ErrorKindContextTooLong,
+			message:    "This model's maximum context length is 128000 tokens.",
+		},
+		{
+			name:       "openai invalid key",
+			statusCode: 401,
+			body:       `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","param":null,"code":"invalid_api_key"}}`,
+			kind:       ErrorKindAuth,
+			message:    "Incorrect API key provided",
+		},
+		{
+			name:       "openai bad request",
+			statusCode: 400,
+			body:       `{"error":{"message":"Invalid value for 'temperature'","type":"invalid_request_error","param":"temperature","code":null}}`,
+			kind:       ErrorKindBadRequest,
+			message:    "Invalid value for 'temperature'",
+		},
+		{
+			name:       "xai string error",
+			statusCode: 400,
+			body:       `{"code":"Client specified an invalid argument","error":"Incorrect API key provided: xa***. You can obtain an API key from https://console.x.ai."}`,
+			kind:       ErrorKindBadRequest,
+			message:    "Incorrect API key provided: xa***. You can obtain an API key from https://console.x.ai.",
+		},
+		{
+			name:       "openai insufficient quota",
+			statusCode: 429,
+			body:       `{"error":{"message":"You exceeded your current quota, please check your plan and billing details.","type":"insufficient_quota","param":null,"code":"insufficient_quota"}}`,
+			kind:       ErrorKindQuota,
+			message:    "You exceeded your current quota, please check your plan and billing details.",
+		},
+		{
+			name:       "anthropic credit balance",
+			statusCode: 400,
+			body:       `{"type":"error","error":{"type":"invalid_request_error","message":"Your credit balance is too low to access the Anthropic API."}}`,
+			kind:       ErrorKindQuota,
+			message:    "Your credit balance is too low to access the Anthropic API.",
+		},
+		{
+			name:       "gemini wrapped resource exhausted",
+			statusCode: 429,
+			body:       `[{"error":{"code":429,"message":"Resource has been exhausted (e.g. check quota).","status":"RESOURCE_EXHAUSTED"}}]`,
+			kind:       ErrorKindRateLimit,
+			message:    "Resource has been exhausted (e.g. check quota).",
+		},
+		{
+			name:       "gemini unavailable",
+			statusCode: 503,
+			body:       `{"error":{"code":503,"message":"The model is overloaded. Please try again later.","status":"UNAVAILABLE"}}`,
+			kind:       ErrorKindOverloaded,
+			message:    "The model is overloaded. Please try again later.",
+		},
+		{
+			name:       "ollama",
+			statusCode: 404,
+			body:       `{"error":"model \"llama9\" not found, try pulling it first"}`,
+			kind:       ErrorKindBadRequest,
+			message:    `model "llama9" not found, try pulling it first`,
+		},
+		{
+			name:       "plain text body",
+			statusCode: 502,
+			body:       "upstream connect error",
+			kind:       ErrorKindUnknown,
+			message:    "upstream connect error",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			providerError := ParseProviderError("test", tc.statusCode, nil, []byte(tc.body))
+			if providerError.Kind != tc.kind {
+				t.Fatalf("expected kind %s, got %s", tc.kind, providerError.Kind)
+			}
+			if providerError.Message != tc.message {
+				t.Fatalf("expected message %q, got %q", tc.message, providerError.Message)
+			}
+			if providerError.StatusCode != tc.statusCode {
+				t.Fatalf("expected status %d, got %d", tc.statusCode, providerError.StatusCode)
+			}
+		})
+	}
+}
+
+func TestParseProviderErrorReadsRetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "12")
+
+	providerError := ParseProviderError("claude", 429, header, []byte(`{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`))
+
+	if providerError.RetryAfter != 12*time.Second {
+		t.Fatalf("expected retry after 12s, got %s", providerError.RetryAfter)
+	}
+	if providerError.HTTPStatus() != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", providerError.HTTPStatus())
+	}
+	if providerError.Error() != "claude: rate limited (429): slow down" {
+		t.Fatalf("unexpected error text %q", providerError.Error())
+	}
+}
+
+func TestMissingApiKeyErrorIsAuth(t *testing.T) {
+	err := error(MissingApiKeyError("claude", "CLAUDE_API_KEY"))
+
+	providerError, ok := AsProviderError(err)
+	if !ok {
+		t.Fatalf("expected a provider error")
+	}
+	if providerError.Kind != ErrorKindAuth {
+		t.Fatalf("expected auth error, got %s", providerError.Kind)
+	}
+	if providerError.Error() != "claude: authentication failed: CLAUDE_API_KEY is not set" {
+		t.Fatalf("unexpected error text %q", providerError.Error())
+	}
+}
@@ -0,0 +1,185 @@
+package compaction
+
+import (
+	"context"
+	"fmt"
+	"owl/data"
+	"owl/logger"
+	"owl/registry"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+)
+
+// Summarizer condenses turns into a summary that continues previous, which is
+// empty for the first summary of a context. It returns the summary and the
+// model that wrote it.
+type Summarizer func(ctx context.Context, historyRepository data.HistoryRepository, previous string, turns []data.History) (string, string, error)
+
+var (
+	summarizerMu sync.RWMutex
+	summarizer   Summarizer
+)
+
+// SetSummarizer sets the function used to summarize old turns. Without one
+// the history is sent as is.
+func SetSummarizer(fn Summarizer) {
+	summarizerMu.Lock()
+	defer summarizerMu.Unlock()
+	summarizer = fn
+}
+
+func currentSummarizer() Summarizer {
+	summarizerMu.RLock()
+	defer summarizerMu.RUnlock()
+	return summarizer
+}
+
+// EstimateTokens approximates the token count of text at four characters per
+// token, which is close enough for English and code to decide when to compact.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// turnOverhead covers the role markers and separators of each message.
+const turnOverhead = 8
+
+// EstimateTurn approximates the tokens one history row adds to a payload.
+func EstimateTurn(h data.History) int {
+	tokens := turnOverhead + EstimateTokens(h.Prompt) + EstimateTokens(h.Response)
+	for _, toolUse := range h.ToolUse {
+		tokens += turnOverhead + EstimateTokens(toolUse.Input) + EstimateTokens(toolUse.Result.Content)
+	}
+	return tokens
+}
+
+// EstimatePayload approximates the size of a request with the given system
+// prompt, history and new prompt.
+func EstimatePayload(systemPrompt string, history []data.History, prompt string) int {
+	tokens := EstimateTokens(systemPrompt) + EstimateTokens(prompt)
+	for _, h := range history {
+		tokens += EstimateTurn(h)
+	}
+	return tokens
+}
+
+// Compact returns the history to send for a request. While the estimated
+// payload fits the model's threshold the history is returned unchanged.
+// Otherwise the turns covered by the latest stored summary are replaced by it
+// and, if that is still too large, the oldest remaining turns are summarized
+// into a new summary row. The summary is returned as a leading turn with
+// IsSummary set. Any failure falls back to the uncompacted history.
+func Compact(ctx context.Context, historyRepository data.HistoryRepository, context *data.Context, spec registry.ModelSpec, prompt string, history []data.History) []data.History {
+	threshold := spec.CompactionThreshold()
+	if threshold <= 0 || context == nil || len(history) == 0 {
+		return history
+	}
+	systemPrompt := context.SystemPrompt
+	if EstimatePayload(systemPrompt, history, prompt) <= threshold {
+		return history
+	}
+
+	summary, err := historyRepository.GetLatestSummary(context.Id)
+	if err != nil {
+		logger.Debug.Printf("could not read history summary for context %d: %v", context.Id, err)
+		return history
+	}
+
+	turns := history
+	previous := ""
+	if summary != nil {
+		turns = turnsAfter(history, summary.ThroughHistoryId)
+		previous = summary.Content
+	}
+
+	base := EstimateTokens(systemPrompt) + EstimateTokens(prompt) + EstimateTokens(previous)
+	if base+EstimatePayload("", turns, "") <= threshold {
+		return withSummary(summary, turns)
+	}
+
+	split := splitPoint(turns, threshold/2-base)
+	summarize := currentSummarizer()
+	if split == 0 || summarize == nil {
+		return withSummary(summary, turns)
+	}
+
+	older := turns[:split]
+	logger.Screen(fmt.Sprintf("\nsummarizing %d earlier messages to fit the context window\n", len(older)), color.RGB(150, 150, 150))
+	content, model, err := summarize(ctx, historyRepository, previous, older)
+	if err != nil || content == "" {
+		logger.Debug.Printf("history summary failed for context %d: %v", context.Id, err)
+		return withSummary(summary, turns)
+	}
+
+	next := &data.Summary{
+		ContextId:        context.Id,
+		ThroughHistoryId: older[len(older)-1].Id,
+		Content:          content,
+		Model:            model,
+	}
+	if _, err := historyRepository.InsertSummary(*next); err != nil {
+		// The summary still shortens this request, it is just written again next time
+		logger.Debug.Printf("could not store history summary for context %d: %v", context.Id, err)
+	}
+	return withSummary(next, turns[split:])
+}
+
+// turnsAfter drops the turns a summary already covers.
+func turnsAfter(history []data.History, throughHistoryId int64) []data.History {
+	for i, h := range history {
+		if h.Id > throughHistoryId {
+			return history[i:]
+		}
+	}
+	return []data.History{}
+}
+
+// splitPoint returns the index of the first turn that is kept. Recent turns
+// are kept while they fit budget, always at least the last one, and the kept
+// part never starts with a tool continuation that has no prompt of its own.
+func splitPoint(turns []data.History, budget int) int {
+	split := len(turns) - 1
+	used := EstimateTurn(turns[split])
+	for split > 0 {
+		next := EstimateTurn(turns[split-1])
+		if used+next > budget {
+			break
+		}
+		used += next
+		split--
+	}
+	for split > 0 && turns[split].Prompt == "" {
+		split--
+	}
+	return split
+}
+
+func withSummary(summary *data.Summary, turns []data.History) []data.History {
+	if summary == nil {
+		return turns
+	}
+	compacted := make([]data.History, 0, len(turns)+1)
+	compacted = append(compacted, data.History{
+		ContextId: summary.ContextId,
+		Response:  summary.Content,
+		Model:     summary.Model,
+		IsSummary: true,
+	})
+	return append(compacted, turns...)
+}
+
+// SplitSummary separates the summary turn Compact may have added from the
+// turns to replay. Payload builders send the summary as part of the system
+// prompt.
+func SplitSummary(history []data.History) (string, []data.History) {
+	if len(history) > 0 && history[0].IsSummary {
+		return history[0].Response, history[1:]
+	}
+	return "", history
+}
+
+// SummarySystemPrompt is the system prompt text that carries a summary.
+func SummarySystemPrompt(summary string) string {
+	return fmt.Sprintf("Summary of the earlier part of this conversation, which is no longer included verbatim:\n\n%s", summary)
+}
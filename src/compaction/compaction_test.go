@@ -0,0 +1,147 @@
+package compaction
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"owl/data"
+	"owl/logger"
+	"owl/registry"
+)
+
+// summaryRepository stores summaries, test_helpers cannot be imported here
+// without a cycle through services.
+type summaryRepository struct {
+	data.HistoryRepository
+	summaries []data.Summary
+}
+
+func (r *summaryRepository) InsertSummary(summary data.Summary) (int64, error) {
+	r.summaries = append(r.summaries, summary)
+	return int64(len(r.summaries)), nil
+}
+
+func (r *summaryRepository) GetLatestSummary(contextId int64) (*data.Summary, error) {
+	if len(r.summaries) == 0 {
+		return nil, nil
+	}
+	return &r.summaries[len(r.summaries)-1], nil
+}
+
+func useSummarizer(t *testing.T, fn Summarizer) {
+	t.Helper()
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	SetSummarizer(fn)
+	t.Cleanup(func() { SetSummarizer(nil) })
+}
+
+// turns builds count history rows of roughly 100 tokens each.
+func turns(count int) []data.History {
+	history := []data.History{}
+	for i := 1; i <= count; i++ {
+		history = append(history, data.History{
+			Id:        int64(i),
+			ContextId: 7,
+			Prompt:    strings.Repeat("q", 200),
+			Response:  strings.Repeat("a", 184),
+		})
+	}
+	return history
+}
+
+func TestCompact_LeavesHistoryThatFits(t *testing.T) {
+	useSummarizer(t, func(ctx context.Context, repository data.HistoryRepository, previous string, older []data.History) (string, string, error) {
+		t.Fatalf("expected no summary for a history that fits")
+		return "", "", nil
+	})
+
+	history := turns(5)
+	compacted := Compact(context.Background(), &summaryRepository{}, &data.Context{Id: 7}, registry.ModelSpec{CompactAt: 1000}, "next", history)
+
+	if len(compacted) != 5 || compacted[0].IsSummary {
+		t.Fatalf("expected the history unchanged, got %d turns", len(compacted))
+	}
+}
+
+func TestCompact_SummarizesOldestTurnsAndStoresSummary(t *testing.T) {
+	var summarized []data.History
+	useSummarizer(t, func(ctx context.Context, repository data.HistoryRepository, previous string, older []data.History) (string, string, error) {
+		summarized = older
+		return "we talked about q and a", "haiku", nil
+	})
+	repository := &summaryRepository{}
+
+	compacted := Compact(context.Background(), repository, &data.Context{Id: 7}, registry.ModelSpec{CompactAt: 1000}, "next", turns(20))
+
+	if len(summarized) == 0 || summarized[0].Id != 1 {
+		t.Fatalf("expected the oldest turns to be summarized, got %d", len(summarized))
+	}
+	if !compacted[0].IsSummary || compacted[0].Response != "we talked about q and a" {
+		t.Fatalf("expected a leading summary turn, got %+v", compacted[0])
+	}
+	kept := compacted[1:]
+	if kept[0].Id != summarized[len(summarized)-1].Id+1 || kept[len(kept)-1].Id != 20 {
+		t.Fatalf("expected the recent turns to follow the summary, got %d..%d", kept[0].Id, kept[len(kept)-1].Id)
+	}
+	if EstimatePayload("", compacted, "next") > 1000 {
+		t.Fatalf("expected the compacted history to fit, estimated %d", EstimatePayload("", compacted, "next"))
+	}
+
+	stored, _ := repository.GetLatestSummary(7)
+	if stored == nil || stored.ThroughHistoryId != summarized[len(summarized)-1].Id || stored.Model != "haiku" {
+		t.Fatalf("expected the summary to be stored, got %+v", stored)
+	}
+}
+
+func TestCompact_ReusesStoredSummary(t *testing.T) {
+	useSummarizer(t, func(ctx context.Context, repository data.HistoryRepository, previous string, older []data.History) (string, string, error) {
+		t.Fatalf("expected the stored summary to be enough")
+		return "", "", nil
+	})
+	repository := &summaryRepository{}
+	repository.InsertSummary(data.Summary{ContextId: 7, ThroughHistoryId: 16, Content: "earlier"})
+
+	compacted := Compact(context.Background(), repository, &data.Context{Id: 7}, registry.ModelSpec{CompactAt: 1000}, "next", turns(20))
+
+	if len(compacted) != 5 || compacted[0].Response != "earlier" || compacted[1].Id != 17 {
+		t.Fatalf("expected the summary followed by turns 17-20, got %+v", compacted)
+	}
+}
+
+func TestCompact_KeepsHistoryWhenSummaryFails(t *testing.T) {
+	useSummarizer(t, func(ctx context.Context, repository data.HistoryRepository, previous string, older []data.History) (string, string, error) {
+		return "", "", errors.New("overloaded")
+	})
+
+	compacted := Compact(context.Background(), &summaryRepository{}, &data.Context{Id: 7}, registry.ModelSpec{CompactAt: 1000}, "next", turns(20))
+
+	if len(compacted) != 20 || compacted[0].IsSummary {
+		t.Fatalf("expected the full history after a failed summary, got %d turns", len(compacted))
+	}
+}
+
+func TestSplitPoint_DoesNotStartOnToolContinuation(t *testing.T) {
+	history := turns(6)
+	history[4].Prompt = ""
+
+	split := splitPoint(history, EstimateTurn(history[4])+EstimateTurn(history[5]))
+
+	if split != 3 {
+		t.Fatalf("expected the kept turns to start at the prompt before the continuation, got %d", split)
+	}
+}
+
+func TestCompactionThreshold(t *testing.T) {
+	if threshold := (registry.ModelSpec{ContextWindow: 200000}).CompactionThreshold(); threshold != 150000 {
+		t.Fatalf("expected three quarters of the window, got %d", threshold)
+	}
+	if threshold := (registry.ModelSpec{ContextWindow: 200000, CompactAt: 50000}).CompactionThreshold(); threshold != 50000 {
+		t.Fatalf("expected compact_at to win, got %d", threshold)
+	}
+}
@@ -0,0 +1,69 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Attachment is a file sent with a prompt. Only the reference is stored with
+// the history, the content is kept by its hash so the turn can be sent again.
+type Attachment struct {
+	Name string `json:"name"`
+	// Source is the path or URL the file came from, or "stdin"
+	Source    string `json:"source"`
+	MediaType string `json:"media_type"`
+	// Hash is the hex sha256 of the content
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Attachment kinds, each provider has its own content block for them.
+const (
+	AttachmentImage = "image"
+	AttachmentPdf   = "pdf"
+	AttachmentText  = "text"
+)
+
+// Kind is image, pdf or text.
+func (attachment Attachment) Kind() string {
+	switch {
+	case strings.HasPrefix(attachment.MediaType, "image/"):
+		return AttachmentImage
+	case attachment.MediaType == "application/pdf":
+		return AttachmentPdf
+	}
+	return AttachmentText
+}
+
+// AttachmentNames joins the names of the attachments, for listings.
+func AttachmentNames(attachments []Attachment) string {
+	names := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		names[i] = attachment.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// encodeAttachments is the stored form of the references,
+// decodeAttachments reads it back. Rows without attachments store NULL.
+func encodeAttachments(attachments []Attachment) any {
+	if len(attachments) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(attachments)
+	if err != nil {
+		return nil
+	}
+	return string(encoded)
+}
+
+func decodeAttachments(stored string) []Attachment {
+	if stored == "" {
+		return nil
+	}
+	var attachments []Attachment
+	if err := json.Unmarshal([]byte(stored), &attachments); err != nil {
+		return nil
+	}
+	return attachments
+}
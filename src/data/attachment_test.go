@@ -0,0 +1,29 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttachmentKind(t *testing.T) {
+	cases := map[string]string{"image/webp": AttachmentImage, "application/pdf": AttachmentPdf, "text/plain; charset=utf-8": AttachmentText}
+	for mediaType, kind := range cases {
+		if got := (Attachment{MediaType: mediaType}).Kind(); got != kind {
+			t.Fatalf("expected %s to be %s, got %s", mediaType, kind, got)
+		}
+	}
+}
+
+func TestEncodeAttachments(t *testing.T) {
+	if stored := encodeAttachments(nil); stored != nil {
+		t.Fatalf("expected NULL without attachments, got %v", stored)
+	}
+	attachments := []Attachment{{Name: "chart.png", Source: "/tmp/chart.png", MediaType: "image/png", Hash: "abc", Size: 12}}
+	stored, ok := encodeAttachments(attachments).(string)
+	if !ok || !reflect.DeepEqual(decodeAttachments(stored), attachments) {
+		t.Fatalf("expected the references back, got %v", stored)
+	}
+	if decoded := decodeAttachments("not json"); decoded != nil {
+		t.Fatalf("expected no references from a broken column, got %+v", decoded)
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ContextOrder is a sort order of a context list.
+type ContextOrder string
+
+const (
+	OrderLastUsed ContextOrder = "last_used"
+	OrderCreated  ContextOrder = "created"
+	OrderName     ContextOrder = "name"
+	OrderTokens   ContextOrder = "tokens"
+	OrderFolder   ContextOrder = "folder"
+)
+
+// ContextOrders lists the orders in the sequence the TUI cycles through them.
+var ContextOrders = []ContextOrder{OrderLastUsed, OrderCreated, OrderName, OrderTokens, OrderFolder}
+
+// ParseContextOrder reads an order name, the empty name is OrderLastUsed.
+func ParseContextOrder(name string) (ContextOrder, error) {
+	if name == "" {
+		return OrderLastUsed, nil
+	}
+	order := ContextOrder(strings.ToLower(strings.TrimSpace(name)))
+	if !slices.Contains(ContextOrders, order) {
+		return "", fmt.Errorf("unknown order %q, use one of %v", name, ContextOrders)
+	}
+	return order, nil
+}
+
+// Next is the order after this one in ContextOrders.
+func (order ContextOrder) Next() ContextOrder {
+	i := slices.Index(ContextOrders, order)
+	return ContextOrders[(i+1)%len(ContextOrders)]
+}
+
+// ContextFilter narrows a context list. Zero values do not filter.
+type ContextFilter struct {
+	Tag    string
+	Folder string
+	// Model and Agent match the preferred model and agent of the context
+	Model string
+	Agent string
+}
+
+// FilterContexts keeps the contexts that match every field of the filter.
+func FilterContexts(contexts []Context, filter ContextFilter) []Context {
+	filtered := []Context{}
+	for _, context := range contexts {
+		if filter.Tag != "" && !context.HasTag(filter.Tag) {
+			continue
+		}
+		if !context.InFolder(filter.Folder) {
+			continue
+		}
+		if filter.Model != "" && !strings.EqualFold(context.PreferredModel, strings.TrimSpace(filter.Model)) {
+			continue
+		}
+		if filter.Agent != "" && !strings.EqualFold(context.PreferredAgent, strings.TrimSpace(filter.Agent)) {
+			continue
+		}
+		filtered = append(filtered, context)
+	}
+	return filtered
+}
+
+// SortContexts orders contexts newest or largest first, by name from A, or
+// grouped by folder. Ties keep their order.
+func SortContexts(contexts []Context, order ContextOrder) {
+	switch order {
+	case OrderCreated:
+		slices.SortStableFunc(contexts, func(a, b Context) int {
+			return b.Created.Compare(a.Created)
+		})
+	case OrderName:
+		slices.SortStableFunc(contexts, func(a, b Context) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+	case OrderTokens:
+		slices.SortStableFunc(contexts, func(a, b Context) int {
+			return b.TotalTokens - a.TotalTokens
+		})
+	case OrderFolder:
+		SortByFolder(contexts)
+	default:
+		slices.SortStableFunc(contexts, func(a, b Context) int {
+			return b.LastActivity().Compare(a.LastActivity())
+		})
+	}
+}
+
+// SortByFolder orders contexts by folder, keeping the order of the contexts
+// within a folder. Contexts without a folder come first.
+func SortByFolder(contexts []Context) {
+	slices.SortStableFunc(contexts, func(a, b Context) int {
+		return strings.Compare(a.Folder, b.Folder)
+	})
+}
+
+// LastActivity is when the context was last used, or created when it has
+// no messages yet.
+func (context Context) LastActivity() time.Time {
+	if context.LastUsed.After(context.Created) {
+		return context.LastUsed
+	}
+	return context.Created
+}
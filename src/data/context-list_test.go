@@ -0,0 +1,71 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func contextIds(contexts []Context) []int64 {
+	ids := []int64{}
+	for _, context := range contexts {
+		ids = append(ids, context.Id)
+	}
+	return ids
+}
+
+func TestSortContexts_Orders(t *testing.T) {
+	day := func(n int) time.Time { return time.Date(2024, 3, n, 0, 0, 0, 0, time.UTC) }
+	contexts := []Context{
+		{Id: 1, Name: "beta", Created: day(1), LastUsed: day(9), TotalTokens: 50, Folder: "work"},
+		{Id: 2, Name: "Alpha", Created: day(3), TotalTokens: 500},
+		{Id: 3, Name: "gamma", Created: day(2), LastUsed: day(4), TotalTokens: 5, Folder: "home"},
+	}
+	for order, want := range map[ContextOrder][]int64{
+		OrderLastUsed: {1, 3, 2},
+		OrderCreated:  {2, 3, 1},
+		OrderName:     {2, 1, 3},
+		OrderTokens:   {2, 1, 3},
+		OrderFolder:   {2, 3, 1},
+	} {
+		sorted := slices.Clone(contexts)
+		SortContexts(sorted, order)
+		if ids := contextIds(sorted); !slices.Equal(ids, want) {
+			t.Fatalf("expected %v for %s, got %v", want, order, ids)
+		}
+	}
+}
+
+func TestParseContextOrder_CyclesThroughOrders(t *testing.T) {
+	if order, err := ParseContextOrder(""); err != nil || order != OrderLastUsed {
+		t.Fatalf("expected last used by default, got %q, err %v", order, err)
+	}
+	if order, err := ParseContextOrder(" Tokens"); err != nil || order != OrderTokens {
+		t.Fatalf("expected tokens, got %q, err %v", order, err)
+	}
+	if _, err := ParseContextOrder("size"); err == nil {
+		t.Fatalf("expected an unknown order to fail")
+	}
+	if OrderFolder.Next() != OrderLastUsed || OrderLastUsed.Next() != OrderCreated {
+		t.Fatalf("expected the orders to cycle")
+	}
+}
+
+func TestFilterContexts_MatchesModelAndAgent(t *testing.T) {
+	contexts := []Context{
+		{Id: 1, PreferredModel: "opus", PreferredAgent: "developer", Tags: []string{"owl"}},
+		{Id: 2, PreferredModel: "sonnet", PreferredAgent: "developer"},
+		{Id: 3, PreferredModel: "opus", PreferredAgent: "planner"},
+	}
+	for filter, want := range map[ContextFilter][]int64{
+		{}:                                  {1, 2, 3},
+		{Model: "Opus"}:                     {1, 3},
+		{Agent: "developer"}:                {1, 2},
+		{Model: "opus", Agent: "developer"}: {1},
+		{Tag: "owl", Agent: "planner"}:      {},
+	} {
+		if ids := contextIds(FilterContexts(contexts, filter)); !slices.Equal(ids, want) {
+			t.Fatalf("expected %v for %+v, got %v", want, filter, ids)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GenerationSettings are the length and sampling settings of a context. Zero
+// values and nil pointers keep the default of the model that answers.
+type GenerationSettings struct {
+	MaxTokens      int `json:"max_tokens,omitempty"`
+	ThinkingBudget int `json:"thinking_budget,omitempty"`
+	// ReasoningEffort is the OpenAI style alternative to a thinking budget,
+	// such as "low" or "high"
+	ReasoningEffort string   `json:"reasoning_effort,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty"`
+}
+
+// GenerationSettingNames are the names Set accepts, in display order.
+var GenerationSettingNames = []string{"max_tokens", "thinking_budget", "reasoning_effort", "temperature", "top_p", "stop"}
+
+// IsZero reports whether the settings keep every model default.
+func (settings GenerationSettings) IsZero() bool {
+	return settings.MaxTokens == 0 && settings.ThinkingBudget == 0 && settings.ReasoningEffort == "" &&
+		settings.Temperature == nil && settings.TopP == nil && len(settings.StopSequences) == 0
+}
+
+// Set changes the named setting from its text form. An empty value or
+// "default" goes back to the model default. Stop sequences are separated by
+// commas.
+func (settings *GenerationSettings) Set(name string, value string) error {
+	value = strings.TrimSpace(value)
+	reset := value == "" || value == "default"
+
+	switch name {
+	case "max_tokens", "thinking_budget":
+		number := 0
+		if !reset {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				return fmt.Errorf("%s must be a positive number", name)
+			}
+			number = parsed
+		}
+		if name == "max_tokens" {
+			settings.MaxTokens = number
+		} else {
+			settings.ThinkingBudget = number
+		}
+	case "reasoning_effort":
+		if reset {
+			value = ""
+		}
+		settings.ReasoningEffort = strings.ToLower(value)
+	case "temperature", "top_p":
+		var number *float64
+		if !reset {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			number = &parsed
+		}
+		if name == "temperature" {
+			settings.Temperature = number
+		} else {
+			settings.TopP = number
+		}
+	case "stop":
+		settings.StopSequences = nil
+		if !reset {
+			for _, stop := range strings.Split(value, ",") {
+				if stop != "" {
+					settings.StopSequences = append(settings.StopSequences, stop)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown setting %q, use one of %s", name, strings.Join(GenerationSettingNames, ", "))
+	}
+	return nil
+}
+
+// String lists the settings that differ from the model defaults, for
+// example "max_tokens=4000 temperature=0.2".
+func (settings GenerationSettings) String() string {
+	parts := []string{}
+	if settings.MaxTokens != 0 {
+		parts = append(parts, fmt.Sprintf("max_tokens=%d", settings.MaxTokens))
+	}
+	if settings.ThinkingBudget != 0 {
+		parts = append(parts, fmt.Sprintf("thinking_budget=%d", settings.ThinkingBudget))
+	}
+	if settings.ReasoningEffort != "" {
+		parts = append(parts, "reasoning_effort="+settings.ReasoningEffort)
+	}
+	if settings.Temperature != nil {
+		parts = append(parts, "temperature="+strconv.FormatFloat(*settings.Temperature, 'g', -1, 64))
+	}
+	if settings.TopP != nil {
+		parts = append(parts, "top_p="+strconv.FormatFloat(*settings.TopP, 'g', -1, 64))
+	}
+	if len(settings.StopSequences) > 0 {
+		parts = append(parts, "stop="+strconv.Quote(strings.Join(settings.StopSequences, ",")))
+	}
+	if len(parts) == 0 {
+		return "model defaults"
+	}
+	return strings.Join(parts, " ")
+}
+
+// encodeGeneration is the stored form of the settings, decodeGeneration
+// reads it back. Contexts on the model defaults store NULL.
+func encodeGeneration(settings GenerationSettings) any {
+	if settings.IsZero() {
+		return nil
+	}
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return nil
+	}
+	return string(encoded)
+}
+
+func decodeGeneration(stored string) GenerationSettings {
+	var settings GenerationSettings
+	if stored == "" {
+		return settings
+	}
+	_ = json.Unmarshal([]byte(stored), &settings)
+	return settings
+}
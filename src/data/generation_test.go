@@ -0,0 +1,38 @@
+package data
+
+import "testing"
+
+func TestGenerationSettingsSet(t *testing.T) {
+	settings := GenerationSettings{}
+	for name, value := range map[string]string{"max_tokens": "4000", "temperature": "0.2", "reasoning_effort": "High", "stop": "END,,STOP"} {
+		if err := settings.Set(name, value); err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+	}
+	if got := settings.String(); got != `max_tokens=4000 reasoning_effort=high temperature=0.2 stop="END,STOP"` {
+		t.Fatalf("unexpected settings %q", got)
+	}
+
+	if err := settings.Set("temperature", "default"); err != nil || settings.Temperature != nil {
+		t.Fatalf("expected the temperature to be reset, got %+v, err %v", settings, err)
+	}
+	if err := settings.Set("max_tokens", "-1"); err == nil {
+		t.Fatalf("expected a negative max_tokens to fail")
+	}
+	if err := settings.Set("top_k", "5"); err == nil {
+		t.Fatalf("expected an unknown setting to fail")
+	}
+	if (GenerationSettings{}).String() != "model defaults" {
+		t.Fatalf("expected the empty settings to read as model defaults")
+	}
+}
+
+func TestEncodeGeneration(t *testing.T) {
+	if stored := encodeGeneration(GenerationSettings{}); stored != nil {
+		t.Fatalf("expected NULL on the model defaults, got %v", stored)
+	}
+	stored, ok := encodeGeneration(GenerationSettings{ThinkingBudget: 4096}).(string)
+	if !ok || decodeGeneration(stored).ThinkingBudget != 4096 {
+		t.Fatalf("expected the settings back, got %v", stored)
+	}
+}
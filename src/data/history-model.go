@@ -15,11 +15,30 @@ type Context struct {
 	PreferredAgent  string    `json:"preferred_agent"`
 	PreferredSkills string    `json:"preferred_skills"`
 	Archived        bool      `json:"archived"`
+	Tags            []string  `json:"tags"`
+	// Folder groups contexts by project, a slash separated path such as
+	// "work/owl"; empty when the context is not in a folder
+	Folder string `json:"folder"`
+	// ActiveLeafId is the last row of the branch that is shown and continued
+	ActiveLeafId int64 `json:"active_leaf_id"`
+	// LastUsed is when the latest message was added, zero without messages
+	LastUsed time.Time `json:"last_used"`
+	// MessageCount and TotalTokens cover every history row of the context,
+	// on all branches
+	MessageCount int `json:"message_count"`
+	TotalTokens  int `json:"total_tokens"`
+	// DeletedAt is when the context was moved to the trash, zero when it is
+	// not in the trash
+	DeletedAt time.Time `json:"deleted_at"`
+	// Generation overrides the max tokens, thinking and sampling defaults of
+	// the model for this context
+	Generation GenerationSettings `json:"generation"`
 }
 
 type History struct {
 	Id               int64     `json:"id"`
 	ContextId        int64     `json:"context_id"`
+	ParentId         int64     `json:"parent_id"`
 	Prompt           string    `json:"prompt"`
 	Response         string    `json:"response"`
 	ResponseContent  string    `json:"response_content"`
@@ -33,8 +52,29 @@ type History struct {
 	Created          string    `json:"created"`
 	ToolResults      string    `json:"tool_results"`
 	Model            string    `json:"model"`
+	Agent            string    `json:"agent"`
 	Archived         bool      `json:"archived"`
+	Interrupted      bool      `json:"interrupted"`
 	ToolUse          []ToolUse `json:"toolUse"`
+	// IsSummary marks the turn compaction puts in front of the recent history,
+	// Response holds the summary. It is never stored as a history row.
+	IsSummary bool `json:"is_summary,omitempty"`
+	// Thinking is the extended thinking that came before the response, kept
+	// apart from it
+	Thinking []Thinking `json:"thinking,omitempty"`
+	// Attachments are the files sent with the prompt
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Summary condenses the history of a context up to and including
+// ThroughHistoryId.
+type Summary struct {
+	Id               int64  `json:"id"`
+	ContextId        int64  `json:"context_id"`
+	ThroughHistoryId int64  `json:"through_history_id"`
+	Content          string `json:"content"`
+	Model            string `json:"model"`
+	Created          string `json:"created"`
 }
 
 type ToolUse struct {
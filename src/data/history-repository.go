@@ -1,18 +1,58 @@
 package data
 
+import (
+	"owl/data/migrations"
+	"time"
+)
+
 type HistoryRepository interface {
 	GetContextById(contextId int64) (Context, error)
+	// FindContext returns the context outside the trash with the id, nil and
+	// no error when there is none. Unlike GetContextById it does not take the
+	// context out of the archive.
+	FindContext(contextId int64) (*Context, error)
 	InsertHistory(history History) (int64, error)
 	InsertContext(context Context) (int64, error)
 	GetHistoryByContextId(contextId int64, maxCount int) ([]History, error)
+	// GetContextHistory returns the rows of every branch, oldest first.
+	GetContextHistory(contextId int64) ([]History, error)
+	// ImportContext stores a context and its rows in one transaction. Rows
+	// name their parent, and the context its ActiveLeafId, by the Id of an
+	// earlier row in histories; rows without ids form a single branch.
+	ImportContext(context Context, histories []History) (int64, error)
+	// GetContextByName returns nil and no error when no context outside the
+	// trash has the name.
 	GetContextByName(name string) (*Context, error)
 	GetAllContexts() ([]Context, error)
 	DeleteContext(contextId int64) (int64, error)
+	GetDeletedContexts() ([]Context, error)
+	RestoreContext(contextId int64) error
+	PurgeContext(contextId int64) (int64, error)
+	PurgeTrash(deletedBefore time.Time) (int64, error)
 	DeleteHistory(historyId int64) (int64, error)
 	UpdateSystemPrompt(contextId int64, systemPrompt string) error
 	UpdatePreferredModel(contextId int64, model string) error
 	UpdatePreferredAgent(contextId int64, agent string) error
 	UpdatePreferredSkills(contextId int64, skills string) error
+	RenameContext(contextId int64, name string) error
+	UpdateTags(contextId int64, tags []string) error
+	UpdateFolder(contextId int64, folder string) error
+	UpdateGenerationSettings(contextId int64, settings GenerationSettings) error
 	ArchiveContext(contextId int64, archived bool) error
 	ArchiveHistory(historyId int64, archived bool) error
+	GetUsage(since time.Time) ([]UsageRow, error)
+	GetUsageTotals(since time.Time) ([]UsageTotal, error)
+	InsertSummary(summary Summary) (int64, error)
+	GetLatestSummary(contextId int64) (*Summary, error)
+	GetHistoryTree(contextId int64) (HistoryTree, error)
+	UpdateActiveLeaf(contextId int64, historyId int64) error
+	SearchHistory(query string, filters SearchFilters) ([]SearchResult, error)
+}
+
+// Migrator is implemented by the repositories that keep their schema with
+// the migrations in data/migrations.
+type Migrator interface {
+	MigrationStatus() ([]migrations.Status, error)
+	MigrateUp() ([]migrations.Migration, error)
+	MigrateDown() (*migrations.Migration, error)
 }
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+)
+
+// HistoryTree is the parent/child structure of the history rows of one
+// context. Parent 0 is the root, so the first rows of every branch are the
+// children of 0.
+type HistoryTree struct {
+	parents  map[int64]int64
+	children map[int64][]int64
+}
+
+// NewHistoryTree builds the tree from rows that have Id and ParentId set.
+// Children are ordered by id, which is the order they were created in.
+func NewHistoryTree(histories []History) HistoryTree {
+	tree := HistoryTree{
+		parents:  make(map[int64]int64, len(histories)),
+		children: map[int64][]int64{},
+	}
+	for _, h := range histories {
+		tree.parents[h.Id] = h.ParentId
+		tree.children[h.ParentId] = append(tree.children[h.ParentId], h.Id)
+	}
+	for parent := range tree.children {
+		sort.Slice(tree.children[parent], func(i, j int) bool {
+			return tree.children[parent][i] < tree.children[parent][j]
+		})
+	}
+	return tree
+}
+
+// Parent returns the parent of a row, 0 for the first row of a branch.
+func (tree HistoryTree) Parent(historyId int64) int64 {
+	return tree.parents[historyId]
+}
+
+// Children returns the rows that continue from historyId.
+func (tree HistoryTree) Children(historyId int64) []int64 {
+	return tree.children[historyId]
+}
+
+// Siblings returns the alternatives of a row, the row itself included.
+func (tree HistoryTree) Siblings(historyId int64) []int64 {
+	if _, ok := tree.parents[historyId]; !ok {
+		return []int64{}
+	}
+	return tree.children[tree.parents[historyId]]
+}
+
+// LatestLeaf follows the newest child from historyId down to a leaf. It is
+// the leaf that becomes active when switching to the branch of historyId.
+func (tree HistoryTree) LatestLeaf(historyId int64) int64 {
+	leaf := historyId
+	for {
+		children := tree.children[leaf]
+		if len(children) == 0 {
+			return leaf
+		}
+		leaf = children[len(children)-1]
+	}
+}
+
+// Path returns the ids from the first row down to leaf.
+func (tree HistoryTree) Path(leaf int64) []int64 {
+	path := []int64{}
+	for id := leaf; id != 0; id = tree.parents[id] {
+		if _, ok := tree.parents[id]; !ok {
+			break
+		}
+		path = append([]int64{id}, path...)
+	}
+	return path
+}
+
+// importHistories stores histories in the context contextId with insert,
+// which gets the new id of the parent of each row. Rows name their parent,
+// and activeLeafId the leaf to continue, by the Id of an earlier row;
+// histories without ids form one branch in their order. It returns the new
+// id of the active leaf, the last row when activeLeafId names none.
+func importHistories(contextId int64, activeLeafId int64, histories []History, insert func(history History, parentId int64) (int64, error)) (int64, error) {
+	newIds := make(map[int64]int64, len(histories))
+	lastId := int64(0)
+	for i, history := range histories {
+		parentId := int64(0)
+		switch {
+		case history.Id == 0:
+			parentId = lastId
+		case history.ParentId != 0:
+			var ok bool
+			if parentId, ok = newIds[history.ParentId]; !ok {
+				return 0, fmt.Errorf("history row %d comes before its parent %d", history.Id, history.ParentId)
+			}
+		}
+
+		history.ContextId = contextId
+		history.ParentId = parentId
+		id, err := insert(history, parentId)
+		if err != nil {
+			return 0, err
+		}
+		if histories[i].Id != 0 {
+			newIds[histories[i].Id] = id
+		}
+		lastId = id
+	}
+
+	if id, ok := newIds[activeLeafId]; ok {
+		return id, nil
+	}
+	return lastId, nil
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+// branchedHistory is the tree
+//
+//	1 ─ 2 ─ 3
+//	  └ 4 ─ 5
+//	      └ 6
+func branchedHistory() []History {
+	return []History{
+		{Id: 1, ParentId: 0},
+		{Id: 2, ParentId: 1},
+		{Id: 3, ParentId: 2},
+		{Id: 4, ParentId: 1},
+		{Id: 5, ParentId: 4},
+		{Id: 6, ParentId: 4},
+	}
+}
+
+func TestHistoryTree_SiblingsAreOrderedByCreation(t *testing.T) {
+	tree := NewHistoryTree(branchedHistory())
+
+	if got := tree.Siblings(4); !slices.Equal(got, []int64{2, 4}) {
+		t.Fatalf("expected siblings [2 4], got %v", got)
+	}
+	if got := tree.Siblings(1); !slices.Equal(got, []int64{1}) {
+		t.Fatalf("expected the first row to be its only sibling, got %v", got)
+	}
+	if got := tree.Siblings(99); len(got) != 0 {
+		t.Fatalf("expected no siblings for an unknown row, got %v", got)
+	}
+}
+
+func TestHistoryTree_LatestLeafFollowsNewestChild(t *testing.T) {
+	tree := NewHistoryTree(branchedHistory())
+
+	if got := tree.LatestLeaf(1); got != 6 {
+		t.Fatalf("expected newest leaf 6, got %d", got)
+	}
+	if got := tree.LatestLeaf(2); got != 3 {
+		t.Fatalf("expected leaf 3 for branch 2, got %d", got)
+	}
+	if got := tree.LatestLeaf(5); got != 5 {
+		t.Fatalf("expected a leaf to be its own latest leaf, got %d", got)
+	}
+}
+
+func TestHistoryTree_PathRunsFromFirstRowToLeaf(t *testing.T) {
+	tree := NewHistoryTree(branchedHistory())
+
+	if got := tree.Path(5); !slices.Equal(got, []int64{1, 4, 5}) {
+		t.Fatalf("expected path [1 4 5], got %v", got)
+	}
+	if got := tree.Path(0); len(got) != 0 {
+		t.Fatalf("expected an empty path for the root, got %v", got)
+	}
+}
@@ -0,0 +1,254 @@
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dialect selects the set of migrations and the SQL of the bookkeeping
+// queries. Each backend has its own ordered migrations under its directory.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+//go:embed sqlite/*.sql postgres/*.sql
+var files embed.FS
+
+// Migration is one schema version, read from NNNN_name.up.sql and
+// NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and whether it has been applied to a database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Load returns the migrations of a dialect ordered by version. Every version
+// needs both an up and a down file.
+func Load(dialect Dialect) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, string(dialect))
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect, err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s/%s", dialect, entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := files.ReadFile(path.Join(string(dialect), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d of %s has two names, %s and %s", version, dialect, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s of %s needs both an up and a down file", migration.Version, migration.Name, dialect)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// placeholder returns the n:th (1-based) bind parameter of the dialect.
+func (dialect Dialect) placeholder(n int) string {
+	if dialect == Postgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	return err
+}
+
+// HasTable reports whether the database keeps track of its migrations yet.
+// Databases created before migrations existed have to be stamped first.
+func HasTable(db *sql.DB, dialect Dialect) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	if dialect == Postgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	}
+	var count int
+	if err := db.QueryRow(query).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func applied(db *sql.DB) (map[int]time.Time, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// StatusOf lists every migration of the dialect and whether it is applied.
+func StatusOf(db *sql.DB, dialect Dialect) ([]Status, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrations))
+	for _, migration := range migrations {
+		appliedAt, ok := versions[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// Up applies the pending migrations in order, each in its own transaction,
+// and returns the ones it applied.
+func Up(db *sql.DB, dialect Dialect) ([]Migration, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := versions[migration.Version]; ok {
+			continue
+		}
+		insert := fmt.Sprintf("INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)", dialect.placeholder(1), dialect.placeholder(2), dialect.placeholder(3))
+		err := inTransaction(db, migration.Up, insert, migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest applied migration. It returns nil when nothing is
+// applied.
+func Down(db *sql.DB, dialect Dialect) (*Migration, error) {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := versions[migration.Version]; !ok {
+			continue
+		}
+		remove := fmt.Sprintf("DELETE FROM schema_migrations WHERE version = %s", dialect.placeholder(1))
+		if err := inTransaction(db, migration.Down, remove, migration.Version); err != nil {
+			return nil, fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		return &migration, nil
+	}
+	return nil, nil
+}
+
+// Stamp records the migrations up to and including version as applied
+// without running them, for databases whose schema already matches.
+func Stamp(db *sql.DB, dialect Dialect, version int) error {
+	migrations, err := Load(dialect)
+	if err != nil {
+		return err
+	}
+	versions, err := applied(db)
+	if err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf("INSERT INTO schema_migrations (version, name, applied_at) VALUES (%s, %s, %s)", dialect.placeholder(1), dialect.placeholder(2), dialect.placeholder(3))
+	for _, migration := range migrations {
+		if _, ok := versions[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		if _, err := db.Exec(insert, migration.Version, migration.Name, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTransaction runs a migration script and its bookkeeping statement
+// together, so a failed migration leaves neither behind.
+func inTransaction(db *sql.DB, script string, bookkeeping string, args ...any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,217 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// expectedColumns are the columns the repositories read and write.
+var expectedColumns = map[string][]string{
+	"context":         {"id", "name", "system_prompt", "preferred_model", "preferred_agent", "preferred_skills", "archived", "active_leaf_id"},
+	"history":         {"id", "context_id", "parent_id", "prompt", "response", "response_content", "token_count", "prompt_tokens", "completion_tokens", "cache_read_tokens", "cache_write_tokens", "created", "tool_results", "model", "agent", "archived", "interrupted"},
+	"tool_use":        {"id", "history_id", "tool_use_external_id", "name", "input", "caller_type", "created"},
+	"tool_result":     {"id", "tool_use_id", "content", "success", "created"},
+	"history_summary": {"id", "context_id", "through_history_id", "content", "model", "created"},
+}
+
+func TestLoad_VersionsAreContiguousAndPaired(t *testing.T) {
+	for _, dialect := range []Dialect{SQLite, Postgres} {
+		migrations, err := Load(dialect)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("%s: expected migrations", dialect)
+		}
+		for i, migration := range migrations {
+			if migration.Version != i+1 {
+				t.Fatalf("%s: expected version %d, got %d_%s", dialect, i+1, migration.Version, migration.Name)
+			}
+			if migration.Up == "" || migration.Down == "" {
+				t.Fatalf("%s: migration %d_%s is missing a script", dialect, migration.Version, migration.Name)
+			}
+		}
+	}
+}
+
+func TestSqlite_RebuildsSchemaFromScratch(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "owl.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rebuildSchema(t, db, SQLite, func(table string) []string {
+		return sqliteColumns(t, db, table)
+	})
+}
+
+// The Postgres schema is rebuilt in a throwaway schema of the database in
+// OWL_TEST_POSTGRES_URL, the test is skipped without it.
+func TestPostgres_RebuildsSchemaFromScratch(t *testing.T) {
+	url := postgresTestURL(t)
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// search_path is per connection
+	db.SetMaxOpenConns(1)
+
+	schema := fmt.Sprintf("owl_migrations_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+	if _, err := db.Exec("SET search_path TO " + schema); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuildSchema(t, db, Postgres, func(table string) []string {
+		return postgresColumns(t, db, table)
+	})
+}
+
+func rebuildSchema(t *testing.T, db *sql.DB, dialect Dialect, columns func(table string) []string) {
+	t.Helper()
+	migrations, err := Load(dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := Up(db, dialect)
+	if err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("expected %d migrations applied, got %d", len(migrations), len(applied))
+	}
+	assertColumns(t, columns)
+
+	again, err := Up(db, dialect)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("expected a second up to do nothing, got %d applied, err %v", len(again), err)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		reverted, err := Down(db, dialect)
+		if err != nil {
+			t.Fatalf("down: %v", err)
+		}
+		if reverted == nil || reverted.Version != migrations[i].Version {
+			t.Fatalf("expected migration %d to be reverted, got %+v", migrations[i].Version, reverted)
+		}
+	}
+	if reverted, err := Down(db, dialect); err != nil || reverted != nil {
+		t.Fatalf("expected nothing left to revert, got %+v, err %v", reverted, err)
+	}
+	for table := range expectedColumns {
+		if len(columns(table)) != 0 {
+			t.Fatalf("expected table %s to be dropped", table)
+		}
+	}
+
+	if _, err := Up(db, dialect); err != nil {
+		t.Fatalf("up after down: %v", err)
+	}
+	assertColumns(t, columns)
+
+	statuses, err := StatusOf(db, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Fatalf("expected %d_%s to be applied, got %+v", status.Version, status.Name, status)
+		}
+	}
+}
+
+func assertColumns(t *testing.T, columns func(table string) []string) {
+	t.Helper()
+	for table, expected := range expectedColumns {
+		actual := columns(table)
+		for _, column := range expected {
+			if !slices.Contains(actual, column) {
+				t.Fatalf("expected column %s.%s, table has %v", table, column, actual)
+			}
+		}
+	}
+}
+
+func sqliteColumns(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	return scanNames(t, rows)
+}
+
+func postgresColumns(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	return scanNames(t, rows)
+}
+
+func scanNames(t *testing.T, rows *sql.Rows) []string {
+	t.Helper()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestStamp_RecordsVersionsWithoutRunningThem(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "owl.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := Stamp(db, SQLite, 1); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := StatusOf(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || statuses[1].Applied {
+		t.Fatalf("expected only the first migration stamped, got %+v", statuses)
+	}
+	if len(sqliteColumns(t, db, "history")) != 0 {
+		t.Fatalf("expected stamping not to create tables")
+	}
+}
+
+// postgresTestURL returns OWL_TEST_POSTGRES_URL and skips the test without it.
+// CI provides a database, so a missing one fails the test there.
+func postgresTestURL(t *testing.T) string {
+	url := os.Getenv("OWL_TEST_POSTGRES_URL")
+	if url == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("OWL_TEST_POSTGRES_URL is not set")
+		}
+		t.Skip("OWL_TEST_POSTGRES_URL is not set")
+	}
+	return url
+}
@@ -0,0 +1,3 @@
+drop table if exists history;
+drop table if exists context;
+drop table if exists users;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS history_summary (
+  id SERIAL PRIMARY KEY,
+  context_id INT NOT NULL,
+  through_history_id INT NOT NULL,
+  content TEXT NOT NULL,
+  model VARCHAR(255),
+  user_id INT,
+  created timestamp
+  with
+    time zone not null default now (),
+    UNIQUE (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_history_summary_context_id ON history_summary (context_id);
@@ -0,0 +1,3 @@
+drop index if exists idx_history_parent_id;
+alter table context drop column if exists active_leaf_id;
+alter table history drop column if exists parent_id;
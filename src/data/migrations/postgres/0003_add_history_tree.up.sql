@@ -0,0 +1,7 @@
+ALTER TABLE history ADD COLUMN IF NOT EXISTS parent_id INT NOT NULL DEFAULT 0;
+ALTER TABLE context ADD COLUMN IF NOT EXISTS active_leaf_id INT NOT NULL DEFAULT 0;
+
+UPDATE history SET parent_id = COALESCE((SELECT MAX(previous.id) FROM history previous WHERE previous.context_id = history.context_id AND previous.id < history.id), 0);
+UPDATE context SET active_leaf_id = COALESCE((SELECT MAX(history.id) FROM history WHERE history.context_id = context.id), 0);
+
+CREATE INDEX IF NOT EXISTS idx_history_parent_id ON history (parent_id);
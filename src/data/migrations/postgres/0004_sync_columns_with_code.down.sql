@@ -0,0 +1,22 @@
+drop table if exists tool_result;
+drop table if exists tool_use;
+
+alter table context
+  drop column if exists archived,
+  drop column if exists preferred_skills,
+  drop column if exists preferred_agent,
+  drop column if exists preferred_model,
+  drop column if exists system_prompt;
+
+alter table history
+  drop column if exists interrupted,
+  drop column if exists archived,
+  drop column if exists agent,
+  drop column if exists model,
+  drop column if exists tool_results,
+  drop column if exists cache_write_tokens,
+  drop column if exists cache_read_tokens,
+  drop column if exists completion_tokens,
+  drop column if exists prompt_tokens;
+
+alter table history rename column response_content to responsecontent;
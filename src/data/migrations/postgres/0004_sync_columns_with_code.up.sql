@@ -0,0 +1,47 @@
+ALTER TABLE history RENAME COLUMN responsecontent TO response_content;
+
+ALTER TABLE history
+  ALTER COLUMN prompt TYPE TEXT,
+  ALTER COLUMN response TYPE TEXT,
+  ALTER COLUMN response_content TYPE TEXT,
+  ALTER COLUMN abbreviation TYPE TEXT,
+  ADD COLUMN prompt_tokens INT NOT NULL DEFAULT 0,
+  ADD COLUMN completion_tokens INT NOT NULL DEFAULT 0,
+  ADD COLUMN cache_read_tokens INT NOT NULL DEFAULT 0,
+  ADD COLUMN cache_write_tokens INT NOT NULL DEFAULT 0,
+  ADD COLUMN tool_results TEXT,
+  ADD COLUMN model VARCHAR(255),
+  ADD COLUMN agent VARCHAR(255),
+  ADD COLUMN archived INT NOT NULL DEFAULT 0,
+  ADD COLUMN interrupted INT NOT NULL DEFAULT 0;
+
+ALTER TABLE context
+  ADD COLUMN system_prompt TEXT NOT NULL DEFAULT '',
+  ADD COLUMN preferred_model VARCHAR(255),
+  ADD COLUMN preferred_agent VARCHAR(255),
+  ADD COLUMN preferred_skills TEXT,
+  ADD COLUMN archived INT NOT NULL DEFAULT 0;
+
+CREATE TABLE tool_use (
+  id SERIAL PRIMARY KEY,
+  history_id INT REFERENCES history (id) ON DELETE CASCADE,
+  tool_use_external_id VARCHAR(255),
+  name VARCHAR(255),
+  input TEXT,
+  caller_type VARCHAR(50) DEFAULT 'assistant',
+  created timestamp
+  with
+    time zone not null default now ()
+);
+
+CREATE INDEX idx_tool_use_history_id ON tool_use (history_id);
+
+CREATE TABLE tool_result (
+  id SERIAL PRIMARY KEY,
+  tool_use_id INT UNIQUE REFERENCES tool_use (id) ON DELETE CASCADE,
+  content TEXT,
+  success INT NOT NULL DEFAULT 1,
+  created timestamp
+  with
+    time zone not null default now ()
+);
@@ -0,0 +1 @@
+ALTER TABLE context ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,2 @@
+ALTER TABLE context DROP COLUMN IF EXISTS folder;
+ALTER TABLE context DROP COLUMN IF EXISTS tags;
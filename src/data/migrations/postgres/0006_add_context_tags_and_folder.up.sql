@@ -0,0 +1,2 @@
+ALTER TABLE context ADD COLUMN IF NOT EXISTS tags TEXT;
+ALTER TABLE context ADD COLUMN IF NOT EXISTS folder TEXT;
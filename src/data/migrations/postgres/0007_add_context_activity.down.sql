@@ -0,0 +1 @@
+ALTER TABLE context DROP COLUMN IF EXISTS last_used;
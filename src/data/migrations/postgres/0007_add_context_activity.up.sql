@@ -0,0 +1,3 @@
+ALTER TABLE context ADD COLUMN IF NOT EXISTS last_used TIMESTAMP WITH TIME ZONE;
+
+UPDATE context SET last_used = (SELECT MAX(created) FROM history WHERE history.context_id = context.id);
@@ -0,0 +1,2 @@
+-- The extended thinking of the answer with its signatures, as JSON.
+ALTER TABLE history ADD COLUMN IF NOT EXISTS thinking TEXT;
@@ -0,0 +1 @@
+ALTER TABLE history DROP COLUMN IF EXISTS attachments;
@@ -0,0 +1,2 @@
+-- The usage and budget queries filter a user's history on created.
+CREATE INDEX IF NOT EXISTS idx_history_user_id_created ON history (user_id, created);
@@ -0,0 +1,15 @@
+-- Users are looked up by name. Concurrent first connects could create a name
+-- twice, so the rows of a duplicate move to the oldest user of the name
+-- before the name becomes unique.
+CREATE TEMPORARY TABLE duplicate_users ON COMMIT DROP AS
+  SELECT users.id AS id, oldest.id AS oldest_id
+  FROM users
+  JOIN (SELECT name, MIN(id) AS id FROM users GROUP BY name) oldest ON oldest.name = users.name
+  WHERE users.id <> oldest.id;
+
+UPDATE context SET user_id = duplicate_users.oldest_id FROM duplicate_users WHERE context.user_id = duplicate_users.id;
+UPDATE history SET user_id = duplicate_users.oldest_id FROM duplicate_users WHERE history.user_id = duplicate_users.id;
+UPDATE history_summary SET user_id = duplicate_users.oldest_id FROM duplicate_users WHERE history_summary.user_id = duplicate_users.id;
+DELETE FROM users WHERE id IN (SELECT id FROM duplicate_users);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_name ON users (name);
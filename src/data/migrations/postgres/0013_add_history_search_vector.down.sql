@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_history_search_vector;
+ALTER TABLE history DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE history DROP COLUMN IF EXISTS tool_text;
@@ -0,0 +1,18 @@
+-- Search matches a row on its prompt, its response and the inputs and
+-- results of its tool calls. The tool text is kept on the row, written with
+-- it by InsertHistory, so the search document is a stored column with an
+-- index instead of being built for every row at query time.
+ALTER TABLE history ADD COLUMN IF NOT EXISTS tool_text TEXT;
+
+UPDATE history SET tool_text = tools.text
+FROM (
+  SELECT tool_use.history_id, string_agg(COALESCE(tool_use.input, '') || ' ' || COALESCE(tool_result.content, ''), ' ' ORDER BY tool_use.id) AS text
+  FROM tool_use LEFT JOIN tool_result ON tool_result.tool_use_id = tool_use.id
+  GROUP BY tool_use.history_id
+) tools
+WHERE tools.history_id = history.id;
+
+ALTER TABLE history ADD COLUMN IF NOT EXISTS search_vector tsvector
+  GENERATED ALWAYS AS (to_tsvector('english', COALESCE(prompt, '') || ' ' || COALESCE(response, '') || ' ' || COALESCE(tool_text, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_history_search_vector ON history USING GIN (search_vector);
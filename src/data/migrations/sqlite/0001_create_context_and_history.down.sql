@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS tool_result;
+DROP TABLE IF EXISTS tool_use;
+DROP TABLE IF EXISTS history;
+DROP TABLE IF EXISTS context;
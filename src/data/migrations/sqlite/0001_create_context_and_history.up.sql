@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS context (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT,
+    system_prompt TEXT,
+    preferred_model TEXT,
+    preferred_agent TEXT,
+    preferred_skills TEXT,
+    archived INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    context_id INTEGER,
+    prompt TEXT,
+    response TEXT,
+    response_content TEXT,
+    abreviation TEXT,
+    token_count INTEGER,
+    prompt_tokens INTEGER DEFAULT 0,
+    completion_tokens INTEGER DEFAULT 0,
+    cache_read_tokens INTEGER DEFAULT 0,
+    cache_write_tokens INTEGER DEFAULT 0,
+    created INT,
+    tool_results TEXT,
+    model TEXT,
+    archived INTEGER DEFAULT 0,
+    interrupted INTEGER DEFAULT 0,
+    agent TEXT
+);
+
+CREATE TABLE IF NOT EXISTS tool_use (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    history_id INTEGER,
+    tool_use_external_id TEXT,
+    name TEXT,
+    input TEXT,
+    caller_type TEXT DEFAULT 'assistant',
+    created INT,
+    FOREIGN KEY(history_id) REFERENCES history(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS tool_result (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tool_use_id INTEGER UNIQUE,
+    content TEXT,
+    success INTEGER DEFAULT 1,
+    created INT,
+    FOREIGN KEY(tool_use_id) REFERENCES tool_use(id) ON DELETE CASCADE
+);
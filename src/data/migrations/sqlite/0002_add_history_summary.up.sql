@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS history_summary (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    context_id INTEGER,
+    through_history_id INTEGER,
+    content TEXT,
+    model TEXT,
+    created INT
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_history_parent_id;
+ALTER TABLE context DROP COLUMN active_leaf_id;
+ALTER TABLE history DROP COLUMN parent_id;
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS tool_result_fts_insert;
+DROP TRIGGER IF EXISTS tool_use_fts_insert;
+DROP TRIGGER IF EXISTS history_fts_delete;
+DROP TRIGGER IF EXISTS history_fts_update;
+DROP TRIGGER IF EXISTS history_fts_insert;
+DROP TABLE IF EXISTS history_fts;
@@ -0,0 +1 @@
+ALTER TABLE context DROP COLUMN deleted_at;
@@ -0,0 +1,3 @@
+-- Deleted contexts stay in the trash until deleted_at is older than the
+-- retention period and owl -gc purges them.
+ALTER TABLE context ADD COLUMN deleted_at TIMESTAMP;
@@ -0,0 +1,2 @@
+ALTER TABLE context DROP COLUMN folder;
+ALTER TABLE context DROP COLUMN tags;
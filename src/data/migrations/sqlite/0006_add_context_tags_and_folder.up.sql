@@ -0,0 +1,3 @@
+-- Tags are stored comma separated, the folder is a slash separated path.
+ALTER TABLE context ADD COLUMN tags TEXT;
+ALTER TABLE context ADD COLUMN folder TEXT;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_history_context_id;
+ALTER TABLE context DROP COLUMN last_used;
+ALTER TABLE context DROP COLUMN created;
@@ -0,0 +1,10 @@
+-- created and last_used of existing contexts come from their oldest and
+-- newest history rows, contexts without history count as created now.
+ALTER TABLE context ADD COLUMN created TIMESTAMP;
+ALTER TABLE context ADD COLUMN last_used TIMESTAMP;
+
+UPDATE context SET
+    created = COALESCE((SELECT MIN(created) FROM history WHERE history.context_id = context.id), CURRENT_TIMESTAMP),
+    last_used = (SELECT MAX(created) FROM history WHERE history.context_id = context.id);
+
+CREATE INDEX IF NOT EXISTS idx_history_context_id ON history (context_id);
@@ -0,0 +1,2 @@
+-- The max tokens, thinking and sampling settings of the context, as JSON.
+ALTER TABLE context ADD COLUMN generation_settings TEXT;
@@ -0,0 +1,2 @@
+-- References to the files sent with the prompt, as JSON.
+ALTER TABLE history ADD COLUMN attachments TEXT;
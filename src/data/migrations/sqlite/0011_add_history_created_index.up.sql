@@ -0,0 +1,3 @@
+-- The usage and budget queries filter history on created. It is stored as
+-- text with the local offset, so the index is on the parsed point in time.
+CREATE INDEX IF NOT EXISTS idx_history_created ON history (julianday(created));
@@ -0,0 +1,37 @@
+-- Back to the FTS4 table of 0004.
+DROP TRIGGER IF EXISTS tool_result_fts_insert;
+DROP TRIGGER IF EXISTS tool_use_fts_insert;
+DROP TRIGGER IF EXISTS history_fts_delete;
+DROP TRIGGER IF EXISTS history_fts_update;
+DROP TRIGGER IF EXISTS history_fts_insert;
+DROP TABLE IF EXISTS history_fts;
+
+CREATE VIRTUAL TABLE history_fts USING fts4(prompt, response, tools, tokenize=unicode61);
+
+INSERT INTO history_fts (docid, prompt, response, tools)
+SELECT history.id, COALESCE(history.prompt, ''), COALESCE(history.response, ''), COALESCE((
+  SELECT group_concat(COALESCE(tool_use.input, '') || ' ' || COALESCE(tool_result.content, ''), ' ')
+  FROM tool_use LEFT JOIN tool_result ON tool_result.tool_use_id = tool_use.id
+  WHERE tool_use.history_id = history.id
+), '')
+FROM history;
+
+CREATE TRIGGER history_fts_insert AFTER INSERT ON history BEGIN
+  INSERT INTO history_fts (docid, prompt, response, tools) VALUES (new.id, COALESCE(new.prompt, ''), COALESCE(new.response, ''), '');
+END;
+
+CREATE TRIGGER history_fts_update AFTER UPDATE OF prompt, response ON history BEGIN
+  UPDATE history_fts SET prompt = COALESCE(new.prompt, ''), response = COALESCE(new.response, '') WHERE docid = new.id;
+END;
+
+CREATE TRIGGER history_fts_delete AFTER DELETE ON history BEGIN
+  DELETE FROM history_fts WHERE docid = old.id;
+END;
+
+CREATE TRIGGER tool_use_fts_insert AFTER INSERT ON tool_use BEGIN
+  UPDATE history_fts SET tools = tools || ' ' || COALESCE(new.input, '') WHERE docid = new.history_id;
+END;
+
+CREATE TRIGGER tool_result_fts_insert AFTER INSERT ON tool_result BEGIN
+  UPDATE history_fts SET tools = tools || ' ' || COALESCE(new.content, '') WHERE docid = (SELECT history_id FROM tool_use WHERE id = new.tool_use_id);
+END;
@@ -0,0 +1,42 @@
+-- FTS5 ranks with bm25() and can order and limit by rank in SQL, so search
+-- no longer scores every match in Go. go-sqlite3 only compiles FTS5 in with
+-- the sqlite_fts5 build tag, owl is built with it.
+DROP TRIGGER IF EXISTS tool_result_fts_insert;
+DROP TRIGGER IF EXISTS tool_use_fts_insert;
+DROP TRIGGER IF EXISTS history_fts_delete;
+DROP TRIGGER IF EXISTS history_fts_update;
+DROP TRIGGER IF EXISTS history_fts_insert;
+DROP TABLE IF EXISTS history_fts;
+
+CREATE VIRTUAL TABLE history_fts USING fts5(prompt, response, tools, tokenize=unicode61);
+
+-- A match in the prompt weighs most, one in the tool inputs and results least
+INSERT INTO history_fts (history_fts, rank) VALUES ('rank', 'bm25(2.0, 1.0, 0.5)');
+
+INSERT INTO history_fts (rowid, prompt, response, tools)
+SELECT history.id, COALESCE(history.prompt, ''), COALESCE(history.response, ''), COALESCE((
+  SELECT group_concat(COALESCE(tool_use.input, '') || ' ' || COALESCE(tool_result.content, ''), ' ')
+  FROM tool_use LEFT JOIN tool_result ON tool_result.tool_use_id = tool_use.id
+  WHERE tool_use.history_id = history.id
+), '')
+FROM history;
+
+CREATE TRIGGER history_fts_insert AFTER INSERT ON history BEGIN
+  INSERT INTO history_fts (rowid, prompt, response, tools) VALUES (new.id, COALESCE(new.prompt, ''), COALESCE(new.response, ''), '');
+END;
+
+CREATE TRIGGER history_fts_update AFTER UPDATE OF prompt, response ON history BEGIN
+  UPDATE history_fts SET prompt = COALESCE(new.prompt, ''), response = COALESCE(new.response, '') WHERE rowid = new.id;
+END;
+
+CREATE TRIGGER history_fts_delete AFTER DELETE ON history BEGIN
+  DELETE FROM history_fts WHERE rowid = old.id;
+END;
+
+CREATE TRIGGER tool_use_fts_insert AFTER INSERT ON tool_use BEGIN
+  UPDATE history_fts SET tools = tools || ' ' || COALESCE(new.input, '') WHERE rowid = new.history_id;
+END;
+
+CREATE TRIGGER tool_result_fts_insert AFTER INSERT ON tool_result BEGIN
+  UPDATE history_fts SET tools = tools || ' ' || COALESCE(new.content, '') WHERE rowid = (SELECT history_id FROM tool_use WHERE id = new.tool_use_id);
+END;
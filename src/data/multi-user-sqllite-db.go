@@ -3,6 +3,7 @@ package data
 import (
 	"fmt"
 	"owl/logger"
+	"time"
 
 	"github.com/fatih/color"
 	_ "github.com/mattn/go-sqlite3"
@@ -12,13 +13,19 @@ type MultiUserContext struct {
 	User User
 }
 
-func (mu_context *MultiUserContext) SetCurrentDb(username string) {
+// SetCurrentDb points the context at the database of the user, opening and
+// migrating it.
+func (mu_context *MultiUserContext) SetCurrentDb(username string) error {
 	logger.Debug.Printf("\nSetting multi user context to username: %s", username)
 	logger.Screen(fmt.Sprintf("\nSetting multi user context to username: %s", username), color.RGB(150, 150, 150))
-	user := User{Name: &username}
+	user, err := OpenUser(username)
+	if err != nil {
+		return err
+	}
 	logger.Screen(fmt.Sprintf("\ncreating user: %v", user), color.RGB(150, 150, 150))
 
 	mu_context.User = user
+	return nil
 }
 
 func (mu_context *MultiUserContext) InsertContext(context Context) (int64, error) {
@@ -29,6 +36,10 @@ func (mu_context *MultiUserContext) GetContextById(contextId int64) (Context, er
 	return mu_context.User.GetContextById(contextId)
 }
 
+func (mu_context *MultiUserContext) FindContext(contextId int64) (*Context, error) {
+	return mu_context.User.FindContext(contextId)
+}
+
 func (mu_context *MultiUserContext) InsertHistory(history History) (int64, error) {
 	return mu_context.User.InsertHistory(history)
 }
@@ -52,6 +63,22 @@ func (mu_context *MultiUserContext) DeleteContext(contextId int64) (int64, error
 	return mu_context.User.DeleteContext(contextId)
 }
 
+func (mu_context *MultiUserContext) GetDeletedContexts() ([]Context, error) {
+	return mu_context.User.GetDeletedContexts()
+}
+
+func (mu_context *MultiUserContext) RestoreContext(contextId int64) error {
+	return mu_context.User.RestoreContext(contextId)
+}
+
+func (mu_context *MultiUserContext) PurgeContext(contextId int64) (int64, error) {
+	return mu_context.User.PurgeContext(contextId)
+}
+
+func (mu_context *MultiUserContext) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	return mu_context.User.PurgeTrash(deletedBefore)
+}
+
 func (mu_context *MultiUserContext) DeleteHistory(historyId int64) (int64, error) {
 	return mu_context.User.DeleteHistory(historyId)
 }
@@ -64,6 +91,22 @@ func (mu_context *MultiUserContext) UpdatePreferredModel(contextId int64, model
 	return mu_context.User.UpdatePreferredModel(contextId, model)
 }
 
+func (mu_context *MultiUserContext) RenameContext(contextId int64, name string) error {
+	return mu_context.User.RenameContext(contextId, name)
+}
+
+func (mu_context *MultiUserContext) UpdateTags(contextId int64, tags []string) error {
+	return mu_context.User.UpdateTags(contextId, tags)
+}
+
+func (mu_context *MultiUserContext) UpdateFolder(contextId int64, folder string) error {
+	return mu_context.User.UpdateFolder(contextId, folder)
+}
+
+func (mu_context *MultiUserContext) UpdateGenerationSettings(contextId int64, settings GenerationSettings) error {
+	return mu_context.User.UpdateGenerationSettings(contextId, settings)
+}
+
 func (mu_context *MultiUserContext) UpdatePreferredAgent(contextId int64, agent string) error {
 	return mu_context.User.UpdatePreferredAgent(contextId, agent)
 }
@@ -79,3 +122,39 @@ func (mu_context *MultiUserContext) ArchiveContext(contextId int64, archived boo
 func (mu_context *MultiUserContext) ArchiveHistory(historyId int64, archived bool) error {
 	return mu_context.User.ArchiveHistory(historyId, archived)
 }
+
+func (mu_context *MultiUserContext) GetUsage(since time.Time) ([]UsageRow, error) {
+	return mu_context.User.GetUsage(since)
+}
+
+func (mu_context *MultiUserContext) GetUsageTotals(since time.Time) ([]UsageTotal, error) {
+	return mu_context.User.GetUsageTotals(since)
+}
+
+func (mu_context *MultiUserContext) InsertSummary(summary Summary) (int64, error) {
+	return mu_context.User.InsertSummary(summary)
+}
+
+func (mu_context *MultiUserContext) GetLatestSummary(contextId int64) (*Summary, error) {
+	return mu_context.User.GetLatestSummary(contextId)
+}
+
+func (mu_context *MultiUserContext) GetHistoryTree(contextId int64) (HistoryTree, error) {
+	return mu_context.User.GetHistoryTree(contextId)
+}
+
+func (mu_context *MultiUserContext) UpdateActiveLeaf(contextId int64, historyId int64) error {
+	return mu_context.User.UpdateActiveLeaf(contextId, historyId)
+}
+
+func (mu_context *MultiUserContext) GetContextHistory(contextId int64) ([]History, error) {
+	return mu_context.User.GetContextHistory(contextId)
+}
+
+func (mu_context *MultiUserContext) ImportContext(context Context, histories []History) (int64, error) {
+	return mu_context.User.ImportContext(context, histories)
+}
+
+func (mu_context *MultiUserContext) SearchHistory(query string, filters SearchFilters) ([]SearchResult, error) {
+	return mu_context.User.SearchHistory(query, filters)
+}
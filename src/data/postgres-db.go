@@ -2,64 +2,304 @@ package data
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"owl/data/migrations"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// PostgresHistoryRepository keeps the history of one user in the shared
+// Postgres database of OWL_DATABASE_URL. Every row is scoped by user_id.
 type PostgresHistoryRepository struct {
 	db   *sql.DB
 	User User
 }
 
-func (postgresHistoryRepository *PostgresHistoryRepository) Init(connectionString string) error {
+// NewPostgresPool returns a pool of Postgres databases keyed by connection
+// string.
+func NewPostgresPool() *DatabasePool {
+	return &DatabasePool{dbs: map[string]*sql.DB{}, open: openPostgres}
+}
+
+func openPostgres(connectionString string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", connectionString)
-	log.Println("setting up database", db)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate the postgres database: %w", err)
+	}
+	return db, nil
+}
+
+// NewPostgresHistoryRepository returns the repository of the user with the
+// given name, creating the user on first use.
+func NewPostgresHistoryRepository(connectionString string, username string) (*PostgresHistoryRepository, error) {
+	repository := &PostgresHistoryRepository{}
+	if err := repository.Init(connectionString); err != nil {
+		return nil, err
+	}
+
+	user, err := repository.ensureUser(username)
+	if err != nil {
+		return nil, err
+	}
+	repository.User = user
+	return repository, nil
+}
+
+// ensureUser returns the user with the name and creates it when there is none
+// in one statement, so concurrent first connects of a user end up with the
+// same row.
+func (r *PostgresHistoryRepository) ensureUser(name string) (User, error) {
+	var user User
+	err := r.db.QueryRow("INSERT INTO users (name) VALUES ($1) ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id, name, email, slack_id", name).
+		Scan(&user.Id, &user.Name, &user.Email, &user.SlackId)
+	return user, err
+}
 
-	err = db.Ping()
+// Init binds the repository to the shared handle of the database, which is
+// migrated the first time it is opened.
+func (postgresHistoryRepository *PostgresHistoryRepository) Init(connectionString string) error {
+	db, err := postgresDatabases.Open(connectionString)
 	if err != nil {
 		return err
 	}
 
 	postgresHistoryRepository.db = db
-
 	return nil
 }
 
+// legacyPostgresSchemaVersion is the migration that databases set up by hand
+// from db/migrations, before the schema_migrations table, are stamped with.
+const legacyPostgresSchemaVersion = 1
+
+// migratePostgres brings the database to the latest schema.
+func migratePostgres(db *sql.DB) error {
+	if err := adoptLegacyPostgres(db); err != nil {
+		return err
+	}
+	_, err := migrations.Up(db, migrations.Postgres)
+	return err
+}
+
+func adoptLegacyPostgres(db *sql.DB) error {
+	tracked, err := migrations.HasTable(db, migrations.Postgres)
+	if err != nil || tracked {
+		return err
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'history'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+	return migrations.Stamp(db, migrations.Postgres, legacyPostgresSchemaVersion)
+}
+
+func (r *PostgresHistoryRepository) MigrationStatus() ([]migrations.Status, error) {
+	if err := adoptLegacyPostgres(r.db); err != nil {
+		return nil, err
+	}
+	return migrations.StatusOf(r.db, migrations.Postgres)
+}
+
+func (r *PostgresHistoryRepository) MigrateUp() ([]migrations.Migration, error) {
+	if err := adoptLegacyPostgres(r.db); err != nil {
+		return nil, err
+	}
+	return migrations.Up(r.db, migrations.Postgres)
+}
+
+func (r *PostgresHistoryRepository) MigrateDown() (*migrations.Migration, error) {
+	if err := adoptLegacyPostgres(r.db); err != nil {
+		return nil, err
+	}
+	return migrations.Down(r.db, migrations.Postgres)
+}
+
+// postgresContextColumns are the columns scanPostgresContext reads.
+const postgresContextColumns = "id, name, user_id, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived, COALESCE(active_leaf_id, 0), deleted_at, COALESCE(tags, ''), COALESCE(folder, ''), COALESCE(generation_settings, ''), created, last_used, (SELECT COUNT(*) FROM history WHERE history.context_id = context.id), (SELECT COALESCE(SUM(COALESCE(prompt_tokens, 0) + COALESCE(completion_tokens, 0) + COALESCE(cache_read_tokens, 0) + COALESCE(cache_write_tokens, 0)), 0) FROM history WHERE history.context_id = context.id)"
+
+func scanPostgresContext(row rowScanner) (Context, error) {
+	var context Context
+	var archived int
+	var deletedAt, created, lastUsed sql.NullTime
+	var tags, generation string
+	err := row.Scan(&context.Id, &context.Name, &context.UserId, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived, &context.ActiveLeafId, &deletedAt, &tags, &context.Folder, &generation, &created, &lastUsed, &context.MessageCount, &context.TotalTokens)
+	context.Archived = archived == 1
+	context.DeletedAt = deletedAt.Time
+	context.Created = created.Time
+	context.LastUsed = lastUsed.Time
+	context.Tags = splitTags(tags)
+	context.Generation = decodeGeneration(generation)
+	return context, err
+}
+
 func (r *PostgresHistoryRepository) GetContextById(contextId int64) (Context, error) {
 	// When getting by ID, we unarchive it
 	_, _ = r.db.Exec("UPDATE context SET archived = 0 WHERE id = $1 AND user_id = $2", contextId, r.User.Id)
 
-	var context Context
-	var archived int
-	err := r.db.QueryRow("SELECT id, name, user_id, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context WHERE id = $1 AND user_id = $2", contextId, r.User.Id).
-		Scan(&context.Id, &context.Name, &context.UserId, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived)
+	context, err := scanPostgresContext(r.db.QueryRow("SELECT "+postgresContextColumns+" FROM context WHERE id = $1 AND user_id = $2", contextId, r.User.Id))
 	if err != nil {
 		return Context{}, err
 	}
-	context.Archived = archived == 1
 	return context, nil
 }
 
+func (r *PostgresHistoryRepository) FindContext(contextId int64) (*Context, error) {
+	context, err := scanPostgresContext(r.db.QueryRow("SELECT "+postgresContextColumns+" FROM context WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL", contextId, r.User.Id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &context, nil
+}
+
 func (r *PostgresHistoryRepository) InsertHistory(history History) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Without an explicit parent the row continues the active branch
+	parentId := history.ParentId
+	if parentId == 0 {
+		err = tx.QueryRow("SELECT COALESCE(active_leaf_id, 0) FROM context WHERE id = $1 AND user_id = $2", history.ContextId, r.User.Id).Scan(&parentId)
+		if err != nil && err != sql.ErrNoRows {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	id, err := r.insertHistory(tx, history, parentId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertHistory stores a row below parentId with its tool uses and makes it
+// the active leaf of its context. The caller rolls tx back on an error.
+func (r *PostgresHistoryRepository) insertHistory(tx *sql.Tx, history History, parentId int64) (int64, error) {
+	interrupted := 0
+	if history.Interrupted {
+		interrupted = 1
+	}
+
 	var id int64
-	err := r.db.QueryRow("INSERT INTO history (context_id, prompt, response, abbreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, user_id, created, response_content, model) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id",
-		history.ContextId, history.Prompt, history.Response, history.Abbreviation, history.TokenCount, history.PromptTokens, history.CompletionTokens, history.CacheReadTokens, history.CacheWriteTokens, history.UserId, time.Now(), history.ResponseContent, history.Model).
+	created := createdAt(history)
+	err := tx.QueryRow("INSERT INTO history (context_id, prompt, response, abbreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, user_id, created, response_content, tool_results, model, interrupted, agent, parent_id, thinking, attachments, tool_text) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) RETURNING id",
+		history.ContextId, history.Prompt, history.Response, history.Abbreviation, history.TokenCount, history.PromptTokens, history.CompletionTokens, history.CacheReadTokens, history.CacheWriteTokens, r.User.Id, created, history.ResponseContent, history.ToolResults, history.Model, interrupted, history.Agent, parentId, encodeThinking(history.Thinking), encodeAttachments(history.Attachments), toolSearchText(history.ToolUse)).
 		Scan(&id)
 	if err != nil {
 		return 0, err
 	}
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = $1, last_used = $2 WHERE id = $3 AND user_id = $4", id, created, history.ContextId, r.User.Id); err != nil {
+		return 0, err
+	}
+
+	for _, toolUse := range history.ToolUse {
+		callerType := strings.TrimSpace(toolUse.CallerType)
+		if callerType == "" {
+			callerType = "assistant"
+		}
+
+		var toolUseId int64
+		err := tx.QueryRow("INSERT INTO tool_use (history_id, tool_use_external_id, name, input, caller_type, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			id, toolUse.Id, toolUse.Name, toolUse.Input, callerType, time.Now()).
+			Scan(&toolUseId)
+		if err != nil {
+			return 0, err
+		}
+
+		success := 0
+		if toolUse.Result.Success {
+			success = 1
+		}
+
+		_, err = tx.Exec("INSERT INTO tool_result (tool_use_id, content, success, created) VALUES ($1, $2, $3, $4)", toolUseId, toolUse.Result.Content, success, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return id, nil
 }
 
+// ImportContext stores a context with its history rows in one transaction,
+// nothing is stored when a row fails. Rows name their parent, and the
+// context its active leaf, by the Id of an earlier row in histories.
+func (r *PostgresHistoryRepository) ImportContext(context Context, histories []History) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	contextId, err := r.insertContext(tx, context)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	activeLeafId, err := importHistories(contextId, context.ActiveLeafId, histories, func(history History, parentId int64) (int64, error) {
+		id, err := r.insertHistory(tx, history, parentId)
+		if err != nil || !history.Archived {
+			return id, err
+		}
+		_, err = tx.Exec("UPDATE history SET archived = 1 WHERE id = $1 AND user_id = $2", id, r.User.Id)
+		return id, err
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	archived := 0
+	if context.Archived {
+		archived = 1
+	}
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = $1, archived = $2 WHERE id = $3 AND user_id = $4", activeLeafId, archived, contextId, r.User.Id); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return contextId, tx.Commit()
+}
+
+// toolSearchText is the text of the tool calls of a row that search matches
+// on, the input and result of each call.
+func toolSearchText(toolUses []ToolUse) string {
+	parts := make([]string, 0, len(toolUses))
+	for _, toolUse := range toolUses {
+		parts = append(parts, toolUse.Input+" "+toolUse.Result.Content)
+	}
+	return strings.Join(parts, " ")
+}
+
 func (r *PostgresHistoryRepository) InsertContext(context Context) (int64, error) {
+	return r.insertContext(r.db, context)
+}
+
+// queryRower is what insertContext needs of a *sql.DB or *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (r *PostgresHistoryRepository) insertContext(db queryRower, context Context) (int64, error) {
 	var id int64
-	err := r.db.QueryRow("INSERT INTO context (name, user_id, system_prompt, preferred_model, preferred_agent, preferred_skills) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
-		context.Name, context.UserId, context.SystemPrompt, context.PreferredModel, context.PreferredAgent, context.PreferredSkills).
+	err := db.QueryRow("INSERT INTO context (name, user_id, system_prompt, preferred_model, preferred_agent, preferred_skills, tags, folder, generation_settings, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		context.Name, r.User.Id, context.SystemPrompt, context.PreferredModel, context.PreferredAgent, context.PreferredSkills, joinTags(context.Tags), NormalizeFolder(context.Folder), encodeGeneration(context.Generation), contextCreatedAt(context)).
 		Scan(&id)
 	if err != nil {
 		return 0, err
@@ -68,49 +308,154 @@ func (r *PostgresHistoryRepository) InsertContext(context Context) (int64, error
 }
 
 func (r *PostgresHistoryRepository) GetHistoryByContextId(contextId int64, maxCount int) ([]History, error) {
-	rows, err := r.db.Query("SELECT id, context_id, prompt, response, abbreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, user_id, created, COALESCE(model, 'sonnet'), archived FROM history WHERE context_id = $1 AND user_id = $2 ORDER BY created DESC LIMIT $3",
+	histories, err := r.queryHistories(postgresActiveBranchQuery+" SELECT "+postgresHistoryColumns+" FROM history h JOIN branch ON branch.id = h.id WHERE h.context_id = $1 AND h.user_id = $2 ORDER BY branch.depth ASC LIMIT $3",
 		contextId, r.User.Id, maxCount)
 	if err != nil {
 		return nil, err
 	}
+
+	// The branch is read from the leaf up, callers expect the oldest row first
+	for i, j := 0, len(histories)-1; i < j; i, j = i+1, j-1 {
+		histories[i], histories[j] = histories[j], histories[i]
+	}
+	return histories, nil
+}
+
+// GetContextHistory returns the history rows of every branch of a context,
+// oldest first.
+func (r *PostgresHistoryRepository) GetContextHistory(contextId int64) ([]History, error) {
+	return r.queryHistories("SELECT "+postgresHistoryColumns+" FROM history h WHERE h.context_id = $1 AND h.user_id = $2 ORDER BY h.id ASC", contextId, r.User.Id)
+}
+
+// postgresHistoryColumns are the columns queryHistories reads.
+const postgresHistoryColumns = "h.id, h.context_id, h.prompt, COALESCE(h.response, ''), COALESCE(h.response_content, ''), COALESCE(h.abbreviation, ''), COALESCE(h.token_count, 0), h.prompt_tokens, h.completion_tokens, h.cache_read_tokens, h.cache_write_tokens, h.user_id, h.created, COALESCE(h.tool_results, ''), COALESCE(h.model, 'sonnet'), h.archived, h.interrupted, COALESCE(h.agent, ''), COALESCE(h.parent_id, 0), COALESCE(h.thinking, ''), COALESCE(h.attachments, '')"
+
+// queryHistories reads the rows of a query on postgresHistoryColumns with
+// their tool uses, in the order of the query.
+func (r *PostgresHistoryRepository) queryHistories(query string, args ...any) ([]History, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var histories []History
 	for rows.Next() {
 		var h History
 		var archived int
-		err := rows.Scan(&h.Id, &h.ContextId, &h.Prompt, &h.Response, &h.Abbreviation, &h.TokenCount, &h.PromptTokens, &h.CompletionTokens, &h.CacheReadTokens, &h.CacheWriteTokens, &h.UserId, &h.Created, &h.Model, &archived)
+		var interrupted int
+		var thinking string
+		var attachments string
+		err := rows.Scan(&h.Id, &h.ContextId, &h.Prompt, &h.Response, &h.ResponseContent, &h.Abbreviation, &h.TokenCount, &h.PromptTokens, &h.CompletionTokens, &h.CacheReadTokens, &h.CacheWriteTokens, &h.UserId, &h.Created, &h.ToolResults, &h.Model, &archived, &interrupted, &h.Agent, &h.ParentId, &thinking, &attachments)
 		if err != nil {
 			log.Println("error parsing history response", err)
 			return nil, err
 		}
 		h.Archived = archived == 1
+		h.Interrupted = interrupted == 1
+		h.Thinking = decodeThinking(thinking)
+		h.Attachments = decodeAttachments(attachments)
+		h.ToolUse = []ToolUse{}
 		histories = append(histories, h)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	historyIDs := make([]int64, 0, len(histories))
+	historyIdx := make(map[int64]int, len(histories))
+	for i := range histories {
+		historyIDs = append(historyIDs, histories[i].Id)
+		historyIdx[histories[i].Id] = i
+	}
+
+	if len(historyIDs) > 0 {
+		toolRows, err := r.db.Query("SELECT tu.history_id, COALESCE(tu.tool_use_external_id, ''), COALESCE(tu.name, ''), COALESCE(tu.input, ''), COALESCE(tu.caller_type, 'assistant'), COALESCE(tr.content, ''), COALESCE(tr.success, 1) FROM tool_use tu LEFT JOIN tool_result tr ON tr.tool_use_id = tu.id WHERE tu.history_id = ANY($1) ORDER BY tu.history_id ASC, tu.id ASC", pq.Array(historyIDs))
+		if err != nil {
+			return nil, err
+		}
+		defer toolRows.Close()
+
+		for toolRows.Next() {
+			var historyId int64
+			var toolUse ToolUse
+			var success int
+
+			err := toolRows.Scan(&historyId, &toolUse.Id, &toolUse.Name, &toolUse.Input, &toolUse.CallerType, &toolUse.Result.Content, &success)
+			if err != nil {
+				return nil, err
+			}
+
+			toolUse.Result.ToolUseId = toolUse.Id
+			toolUse.Result.Success = success == 1
+
+			if idx, ok := historyIdx[historyId]; ok {
+				histories[idx].ToolUse = append(histories[idx].ToolUse, toolUse)
+			}
+		}
+		if err := toolRows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
 	return histories, nil
 }
 
+// postgresActiveBranchQuery selects the ids of the active branch of context
+// $1, from the active leaf up to the first row.
+const postgresActiveBranchQuery = `WITH RECURSIVE branch(id, depth) AS (
+	SELECT active_leaf_id, 0 FROM context WHERE id = $1 AND active_leaf_id > 0
+	UNION ALL
+	SELECT history.parent_id, branch.depth + 1 FROM history JOIN branch ON history.id = branch.id WHERE history.parent_id > 0
+)`
+
+func (r *PostgresHistoryRepository) GetHistoryTree(contextId int64) (HistoryTree, error) {
+	rows, err := r.db.Query("SELECT id, COALESCE(parent_id, 0) FROM history WHERE context_id = $1 AND user_id = $2", contextId, r.User.Id)
+	if err != nil {
+		return HistoryTree{}, err
+	}
+	defer rows.Close()
+
+	histories := []History{}
+	for rows.Next() {
+		var h History
+		if err := rows.Scan(&h.Id, &h.ParentId); err != nil {
+			return HistoryTree{}, err
+		}
+		histories = append(histories, h)
+	}
+	if err := rows.Err(); err != nil {
+		return HistoryTree{}, err
+	}
+	return NewHistoryTree(histories), nil
+}
+
+func (r *PostgresHistoryRepository) UpdateActiveLeaf(contextId int64, historyId int64) error {
+	_, err := r.db.Exec("UPDATE context SET active_leaf_id = $1 WHERE id = $2 AND user_id = $3", historyId, contextId, r.User.Id)
+	return err
+}
+
 func (r *PostgresHistoryRepository) GetContextByName(name string) (*Context, error) {
 	// When getting by name, we unarchive it
-	_, _ = r.db.Exec("UPDATE context SET archived = 0 WHERE name = $1 AND user_id = $2", name, r.User.Id)
+	_, _ = r.db.Exec("UPDATE context SET archived = 0 WHERE name = $1 AND user_id = $2 AND deleted_at IS NULL", name, r.User.Id)
 
-	var context Context
-	var archived int
-	err := r.db.QueryRow("SELECT id, name, user_id, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context WHERE name = $1 AND user_id = $2", name, r.User.Id).
-		Scan(&context.Id, &context.Name, &context.UserId, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived)
+	context, err := scanPostgresContext(r.db.QueryRow("SELECT "+postgresContextColumns+" FROM context WHERE name = $1 AND user_id = $2 AND deleted_at IS NULL", name, r.User.Id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		log.Println("err selecting context", err)
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
 		return nil, err
 	}
-	context.Archived = archived == 1
 	return &context, nil
 }
 
 func (r *PostgresHistoryRepository) GetAllContexts() ([]Context, error) {
-	rows, err := r.db.Query("SELECT id, name, user_id, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context WHERE user_id = $1", r.User.Id)
+	return r.queryContexts("SELECT "+postgresContextColumns+" FROM context WHERE user_id = $1 AND deleted_at IS NULL", r.User.Id)
+}
+
+func (r *PostgresHistoryRepository) queryContexts(query string, args ...any) ([]Context, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -118,53 +463,191 @@ func (r *PostgresHistoryRepository) GetAllContexts() ([]Context, error) {
 
 	var contexts []Context
 	for rows.Next() {
-		var c Context
-		var archived int
-		err := rows.Scan(&c.Id, &c.Name, &c.UserId, &c.SystemPrompt, &c.PreferredModel, &c.PreferredAgent, &c.PreferredSkills, &archived)
+		c, err := scanPostgresContext(rows)
 		if err != nil {
 			return nil, err
 		}
-		c.Archived = archived == 1
 		contexts = append(contexts, c)
 	}
-	return contexts, nil
+	return contexts, rows.Err()
 }
 
+// DeleteContext moves the context to the trash, see PurgeTrash.
 func (r *PostgresHistoryRepository) DeleteContext(contextId int64) (int64, error) {
-	result, err := r.db.Exec("DELETE FROM context WHERE id = $1 AND user_id = $2", contextId, r.User.Id)
+	result, err := r.db.Exec("UPDATE context SET deleted_at = now() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL", contextId, r.User.Id)
 	if err != nil {
 		return 0, err
 	}
 	return result.RowsAffected()
 }
 
+// GetDeletedContexts returns the contexts in the trash, latest deleted first.
+func (r *PostgresHistoryRepository) GetDeletedContexts() ([]Context, error) {
+	contexts, err := r.queryContexts("SELECT "+postgresContextColumns+" FROM context WHERE user_id = $1 AND deleted_at IS NOT NULL", r.User.Id)
+	if err != nil {
+		return nil, err
+	}
+	if contexts == nil {
+		contexts = []Context{}
+	}
+	sortTrash(contexts)
+	return contexts, nil
+}
+
+func (r *PostgresHistoryRepository) RestoreContext(contextId int64) error {
+	_, err := r.db.Exec("UPDATE context SET deleted_at = NULL WHERE id = $1 AND user_id = $2", contextId, r.User.Id)
+	return err
+}
+
+// PurgeContext deletes the context with its history, tool uses and results
+// and summaries.
+func (r *PostgresHistoryRepository) PurgeContext(contextId int64) (int64, error) {
+	return r.purge(func([]Context) []int64 { return []int64{contextId} })
+}
+
+// PurgeTrash deletes the contexts that went into the trash before
+// deletedBefore, with their history, tool uses and results and summaries, in
+// one transaction. Rows of the user left behind by contexts deleted before
+// the trash existed are removed too.
+func (r *PostgresHistoryRepository) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	return r.purge(func(trash []Context) []int64 { return expiredContextIds(trash, deletedBefore) })
+}
+
+func (r *PostgresHistoryRepository) purge(selectIds func(trash []Context) []int64) (int64, error) {
+	trash, err := r.GetDeletedContexts()
+	if err != nil {
+		return 0, err
+	}
+	contextIds := selectIds(trash)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// tool_use and tool_result rows go with their history row (ON DELETE CASCADE)
+	var purged int64
+	for _, contextId := range contextIds {
+		for _, statement := range []string{
+			"DELETE FROM history_summary WHERE context_id = $1 AND user_id = $2",
+			"DELETE FROM history WHERE context_id = $1 AND user_id = $2",
+		} {
+			if _, err := tx.Exec(statement, contextId, r.User.Id); err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+		}
+		result, err := tx.Exec("DELETE FROM context WHERE id = $1 AND user_id = $2", contextId, r.User.Id)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		affected, _ := result.RowsAffected()
+		purged += affected
+	}
+
+	for _, statement := range []string{
+		"DELETE FROM history WHERE user_id = $1 AND context_id NOT IN (SELECT id FROM context)",
+		"DELETE FROM history_summary WHERE user_id = $1 AND context_id NOT IN (SELECT id FROM context)",
+	} {
+		if _, err := tx.Exec(statement, r.User.Id); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return purged, tx.Commit()
+}
+
 func (r *PostgresHistoryRepository) DeleteHistory(historyId int64) (int64, error) {
-	result, err := r.db.Exec("DELETE FROM history WHERE id = $1 AND user_id = $2", historyId, r.User.Id)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// The children of a deleted row continue from its parent, so no branch
+	// loses the rows above it
+	var contextId, parentId int64
+	err = tx.QueryRow("SELECT context_id, COALESCE(parent_id, 0) FROM history WHERE id = $1 AND user_id = $2", historyId, r.User.Id).Scan(&contextId, &parentId)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return 0, nil
+	}
 	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE history SET parent_id = $1 WHERE parent_id = $2", parentId, historyId); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = $1 WHERE id = $2 AND active_leaf_id = $3", parentId, contextId, historyId); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM history WHERE id = $1 AND user_id = $2", historyId, r.User.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
 	return result.RowsAffected()
 }
 
 func (r *PostgresHistoryRepository) UpdateSystemPrompt(contextId int64, systemPrompt string) error {
-	_, err := r.db.Exec("UPDATE contexts SET system_prompt = $1 WHERE id = $2",
-		systemPrompt, contextId)
+	_, err := r.db.Exec("UPDATE context SET system_prompt = $1 WHERE id = $2 AND user_id = $3", systemPrompt, contextId, r.User.Id)
 	return err
 }
 
 func (r *PostgresHistoryRepository) UpdatePreferredModel(contextId int64, model string) error {
-	_, err := r.db.Exec("UPDATE contexts SET preferred_model = $1 WHERE id = $2",
-		model, contextId)
+	_, err := r.db.Exec("UPDATE context SET preferred_model = $1 WHERE id = $2 AND user_id = $3", model, contextId, r.User.Id)
 	return err
 }
 
 func (r *PostgresHistoryRepository) UpdatePreferredAgent(contextId int64, agent string) error {
-	_, err := r.db.Exec("UPDATE contexts SET preferred_agent = $1 WHERE id = $2", agent, contextId)
+	_, err := r.db.Exec("UPDATE context SET preferred_agent = $1 WHERE id = $2 AND user_id = $3", agent, contextId, r.User.Id)
 	return err
 }
 
 func (r *PostgresHistoryRepository) UpdatePreferredSkills(contextId int64, skills string) error {
-	_, err := r.db.Exec("UPDATE contexts SET preferred_skills = $1 WHERE id = $2", skills, contextId)
+	_, err := r.db.Exec("UPDATE context SET preferred_skills = $1 WHERE id = $2 AND user_id = $3", skills, contextId, r.User.Id)
+	return err
+}
+
+// RenameContext fails with ErrContextNameTaken when another context of the
+// user outside the trash has the name.
+func (r *PostgresHistoryRepository) RenameContext(contextId int64, name string) error {
+	name, err := normalizeContextName(name)
+	if err != nil {
+		return err
+	}
+
+	var taken int
+	err = r.db.QueryRow("SELECT COUNT(*) FROM context WHERE name = $1 AND id != $2 AND user_id = $3 AND deleted_at IS NULL", name, contextId, r.User.Id).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrContextNameTaken
+	}
+	_, err = r.db.Exec("UPDATE context SET name = $1 WHERE id = $2 AND user_id = $3", name, contextId, r.User.Id)
+	return err
+}
+
+func (r *PostgresHistoryRepository) UpdateTags(contextId int64, tags []string) error {
+	_, err := r.db.Exec("UPDATE context SET tags = $1 WHERE id = $2 AND user_id = $3", joinTags(tags), contextId, r.User.Id)
+	return err
+}
+
+func (r *PostgresHistoryRepository) UpdateFolder(contextId int64, folder string) error {
+	_, err := r.db.Exec("UPDATE context SET folder = $1 WHERE id = $2 AND user_id = $3", NormalizeFolder(folder), contextId, r.User.Id)
+	return err
+}
+
+func (r *PostgresHistoryRepository) UpdateGenerationSettings(contextId int64, settings GenerationSettings) error {
+	_, err := r.db.Exec("UPDATE context SET generation_settings = $1 WHERE id = $2 AND user_id = $3", encodeGeneration(settings), contextId, r.User.Id)
 	return err
 }
 
@@ -186,6 +669,112 @@ func (r *PostgresHistoryRepository) ArchiveHistory(historyId int64, archived boo
 	return err
 }
 
+func (r *PostgresHistoryRepository) GetUsage(since time.Time) ([]UsageRow, error) {
+	rows, err := r.db.Query("SELECT h.id, h.context_id, COALESCE(c.name, ''), COALESCE(h.model, 'sonnet'), COALESCE(h.agent, ''), h.created, COALESCE(h.prompt_tokens, 0), COALESCE(h.completion_tokens, 0), COALESCE(h.cache_read_tokens, 0), COALESCE(h.cache_write_tokens, 0) FROM history h LEFT JOIN context c ON c.id = h.context_id WHERE h.user_id = $1 AND h.created >= $2 ORDER BY h.id ASC",
+		r.User.Id, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []UsageRow
+	for rows.Next() {
+		var row UsageRow
+		err := rows.Scan(&row.HistoryId, &row.ContextId, &row.ContextName, &row.Model, &row.Agent, &row.Created, &row.PromptTokens, &row.CompletionTokens, &row.CacheReadTokens, &row.CacheWriteTokens)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, row)
+	}
+	return usage, rows.Err()
+}
+
+func (r *PostgresHistoryRepository) GetUsageTotals(since time.Time) ([]UsageTotal, error) {
+	rows, err := r.db.Query("SELECT COALESCE(model, 'sonnet') AS model, COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(cache_read_tokens), 0), COALESCE(SUM(cache_write_tokens), 0) FROM history WHERE user_id = $1 AND created >= $2 GROUP BY 1 ORDER BY 1",
+		r.User.Id, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []UsageTotal
+	for rows.Next() {
+		var total UsageTotal
+		err := rows.Scan(&total.Model, &total.Messages, &total.PromptTokens, &total.CompletionTokens, &total.CacheReadTokens, &total.CacheWriteTokens)
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+func (r *PostgresHistoryRepository) InsertSummary(summary Summary) (int64, error) {
+	var id int64
+	err := r.db.QueryRow("INSERT INTO history_summary (context_id, through_history_id, content, model, user_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		summary.ContextId, summary.ThroughHistoryId, summary.Content, summary.Model, r.User.Id).
+		Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *PostgresHistoryRepository) GetLatestSummary(contextId int64) (*Summary, error) {
+	var summary Summary
+	err := r.db.QueryRow(postgresActiveBranchQuery+" SELECT id, context_id, through_history_id, content, COALESCE(model, ''), created FROM history_summary WHERE context_id = $1 AND user_id = $2 AND through_history_id IN (SELECT id FROM branch) ORDER BY through_history_id DESC, id DESC LIMIT 1", contextId, r.User.Id).
+		Scan(&summary.Id, &summary.ContextId, &summary.ThroughHistoryId, &summary.Content, &summary.Model, &summary.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// postgresSearchQuery ranks the history rows of a user whose search_vector,
+// the prompt, response and tool text of the row, contains all words of $1. The
+// snippets are only built for the rows that make the limit.
+const postgresSearchQuery = `WITH query AS (
+	SELECT plainto_tsquery('english', $1) AS q
+), matches AS (
+	SELECT history.id, history.context_id, COALESCE(context.name, '') AS context_name, history.created,
+		COALESCE(history.prompt, '') || ' ' || COALESCE(history.response, '') || ' ' || COALESCE(history.tool_text, '') AS text,
+		ts_rank(history.search_vector, query.q) AS rank
+	FROM history CROSS JOIN query JOIN context ON context.id = history.context_id
+	WHERE history.search_vector @@ query.q AND history.user_id = $2 AND ($3 = 0 OR history.context_id = $3) AND history.created >= $4 AND context.deleted_at IS NULL
+	ORDER BY rank DESC, history.id DESC
+	LIMIT $5
+)
+SELECT matches.id, matches.context_id, matches.context_name, matches.created,
+	ts_headline('english', matches.text, query.q, 'StartSel=` + SnippetMark + `, StopSel=` + SnippetMark + `, MinWords=8, MaxWords=16'),
+	matches.rank
+FROM matches CROSS JOIN query
+ORDER BY matches.rank DESC, matches.id DESC`
+
+func (r *PostgresHistoryRepository) SearchHistory(query string, filters SearchFilters) ([]SearchResult, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, ErrEmptySearch
+	}
+
+	rows, err := r.db.Query(postgresSearchQuery, query, r.User.Id, filters.ContextId, filters.Since, filters.limit())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.HistoryId, &result.ContextId, &result.ContextName, &result.Created, &result.Snippet, &result.Rank); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
 // User CRUD operations
 
 func (r *PostgresHistoryRepository) CreateUser(user User) (int, error) {
@@ -225,6 +814,20 @@ func (r *PostgresHistoryRepository) DeleteUser(id string) error {
 	return err
 }
 
+// GetUserByName returns the user with the name, nil when there is none.
+func (r *PostgresHistoryRepository) GetUserByName(name string) (*User, error) {
+	var user User
+	err := r.db.QueryRow("SELECT id, name, email, slack_id FROM users WHERE name = $1", name).
+		Scan(&user.Id, &user.Name, &user.Email, &user.SlackId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (r *PostgresHistoryRepository) GetUserByEmail(email string) (*User, error) {
 	var user User
 	err := r.db.QueryRow("SELECT id, name, email, slack_id FROM users WHERE email = $1", email).
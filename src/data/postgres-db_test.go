@@ -0,0 +1,39 @@
+package data
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPostgres_ConcurrentFirstConnectsShareTheUser(t *testing.T) {
+	url := newPostgresTestSchema(t)
+	if _, err := NewPostgresHistoryRepository(url, "setup"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]int, 8)
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repository, err := NewPostgresHistoryRepository(url, "racer")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ids[i] = repository.User.Id
+		}()
+	}
+	wg.Wait()
+
+	for i := range ids {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("expected every connect to get the same user, got %v", ids)
+		}
+	}
+}
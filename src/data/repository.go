@@ -0,0 +1,62 @@
+package data
+
+import (
+	"fmt"
+	"os"
+)
+
+// DatabaseUrl returns OWL_DATABASE_URL, the Postgres database that replaces
+// the SQLite files in ~/.owl when it is set.
+func DatabaseUrl() string {
+	return os.Getenv("OWL_DATABASE_URL")
+}
+
+// NewHistoryRepository returns the repository of the named user. With
+// OWL_DATABASE_URL set every user shares that Postgres database, otherwise
+// each user has its own SQLite database in ~/.owl. The database is opened and
+// migrated here, so a database that cannot be used is reported before the
+// first query.
+func NewHistoryRepository(name string) (HistoryRepository, error) {
+	if url := DatabaseUrl(); url != "" {
+		return NewPostgresHistoryRepository(url, name)
+	}
+	return OpenUser(name)
+}
+
+// OpenUser returns the SQLite repository of the named user after opening and
+// migrating its database.
+func OpenUser(name string) (User, error) {
+	user := User{Name: &name}
+	if _, err := user.getUserDb(); err != nil {
+		return User{}, fmt.Errorf("could not open the database of %s: %w", name, err)
+	}
+	return user, nil
+}
+
+// NewMigrator returns the migrations of the named user's database for the
+// migrate commands. Unlike NewHistoryRepository it leaves a SQLite database
+// at the version it is at.
+func NewMigrator(name string) (Migrator, error) {
+	if url := DatabaseUrl(); url != "" {
+		return NewPostgresHistoryRepository(url, name)
+	}
+	return User{Name: &name}, nil
+}
+
+// RepositoryUserName returns the name of the user a repository belongs to,
+// empty for repositories that are not bound to a user.
+func RepositoryUserName(repository HistoryRepository) string {
+	var user User
+	switch repository := repository.(type) {
+	case User:
+		user = repository
+	case *MultiUserContext:
+		user = repository.User
+	case *PostgresHistoryRepository:
+		user = repository.User
+	}
+	if user.Name == nil {
+		return ""
+	}
+	return *user.Name
+}
@@ -0,0 +1,787 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"owl/logger"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance suite runs the same checks against every HistoryRepository
+// implementation. Postgres runs in a throwaway schema of the database in
+// OWL_TEST_POSTGRES_URL, see postgresTestURL and the README for starting one
+// in Docker.
+var repositoryBackends = map[string]func(t *testing.T) HistoryRepository{
+	"sqlite":   newSqliteTestRepository,
+	"postgres": newPostgresTestRepository,
+}
+
+var conformanceChecks = map[string]func(t *testing.T, repository HistoryRepository){
+	"contexts":            checkContexts,
+	"context preferences": checkContextPreferences,
+	"history":             checkHistory,
+	"tool use":            checkToolUse,
+	"thinking":            checkThinking,
+	"attachments":         checkAttachments,
+	"branches":            checkBranches,
+	"delete history":      checkDeleteHistory,
+	"summaries":           checkSummaries,
+	"usage":               checkUsage,
+	"search":              checkSearch,
+	"trash":               checkTrash,
+	"tags and folders":    checkTagsAndFolders,
+	"context activity":    checkContextActivity,
+	"find context":        checkFindContext,
+	"import context":      checkImportContext,
+	"generation settings": checkGenerationSettings,
+}
+
+func TestRepositoryConformance(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	for backend, newRepository := range repositoryBackends {
+		for name, check := range conformanceChecks {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				check(t, newRepository(t))
+			})
+		}
+	}
+}
+
+func newSqliteTestRepository(t *testing.T) HistoryRepository {
+	dir := t.TempDir()
+	previous := databaseDir
+	databaseDir = func() (string, error) { return dir, nil }
+	t.Cleanup(func() {
+		databaseDir = previous
+		userDatabases.Close()
+	})
+
+	name := "conformance"
+	return User{Name: &name}
+}
+
+func newPostgresTestRepository(t *testing.T) HistoryRepository {
+	repository, err := NewPostgresHistoryRepository(newPostgresTestSchema(t), "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+// newPostgresTestSchema creates a throwaway schema, dropped after the test, and
+// returns the connection string pointed at it.
+func newPostgresTestSchema(t *testing.T) string {
+	url := postgresTestURL(t)
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	schema := fmt.Sprintf("owl_conformance_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		postgresDatabases.Close()
+		cleanup, err := sql.Open("postgres", url)
+		if err != nil {
+			return
+		}
+		defer cleanup.Close()
+		_, _ = cleanup.Exec("DROP SCHEMA " + schema + " CASCADE")
+	})
+	return withSearchPath(url, schema)
+}
+
+// withSearchPath points every connection of url at schema. lib/pq sends
+// unknown settings as run-time parameters.
+func withSearchPath(url string, schema string) string {
+	if !strings.Contains(url, "://") {
+		return url + " search_path=" + schema
+	}
+	if strings.Contains(url, "?") {
+		return url + "&search_path=" + schema
+	}
+	return url + "?search_path=" + schema
+}
+
+func insertTestContext(t *testing.T, repository HistoryRepository, name string) int64 {
+	t.Helper()
+	id, err := repository.InsertContext(Context{Name: name, SystemPrompt: "be brief", PreferredModel: "haiku"})
+	if err != nil {
+		t.Fatalf("insert context: %v", err)
+	}
+	return id
+}
+
+func insertTestHistory(t *testing.T, repository HistoryRepository, history History) int64 {
+	t.Helper()
+	id, err := repository.InsertHistory(history)
+	if err != nil {
+		t.Fatalf("insert history: %v", err)
+	}
+	return id
+}
+
+func historyIds(histories []History) []int64 {
+	ids := []int64{}
+	for _, history := range histories {
+		ids = append(ids, history.Id)
+	}
+	return ids
+}
+
+func checkContexts(t *testing.T, repository HistoryRepository) {
+	id := insertTestContext(t, repository, "first")
+	insertTestContext(t, repository, "second")
+
+	context, err := repository.GetContextById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Name != "first" || context.SystemPrompt != "be brief" || context.PreferredModel != "haiku" {
+		t.Fatalf("unexpected context %+v", context)
+	}
+
+	byName, err := repository.GetContextByName("second")
+	if err != nil || byName == nil || byName.Name != "second" {
+		t.Fatalf("expected context by name, got %+v, err %v", byName, err)
+	}
+	if missing, err := repository.GetContextByName("missing"); missing != nil || err != nil {
+		t.Fatalf("expected no context and no error for an unknown name, got %+v, err %v", missing, err)
+	}
+
+	contexts, err := repository.GetAllContexts()
+	if err != nil || len(contexts) != 2 {
+		t.Fatalf("expected 2 contexts, got %d, err %v", len(contexts), err)
+	}
+
+	if err := repository.ArchiveContext(id, true); err != nil {
+		t.Fatal(err)
+	}
+	contexts, _ = repository.GetAllContexts()
+	for _, c := range contexts {
+		if c.Id == id && !c.Archived {
+			t.Fatalf("expected the context to be archived")
+		}
+	}
+	// Using a context again unarchives it
+	if context, _ := repository.GetContextById(id); context.Archived {
+		t.Fatalf("expected the context to be unarchived when used")
+	}
+
+	deleted, err := repository.DeleteContext(id)
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected one deleted context, got %d, err %v", deleted, err)
+	}
+	if contexts, _ := repository.GetAllContexts(); len(contexts) != 1 {
+		t.Fatalf("expected 1 context left, got %d", len(contexts))
+	}
+}
+
+func checkContextPreferences(t *testing.T, repository HistoryRepository) {
+	id := insertTestContext(t, repository, "preferences")
+
+	if err := repository.UpdateSystemPrompt(id, "be thorough"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UpdatePreferredModel(id, "opus"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UpdatePreferredAgent(id, "coder"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UpdatePreferredSkills(id, "go,sql"); err != nil {
+		t.Fatal(err)
+	}
+
+	context, err := repository.GetContextById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.SystemPrompt != "be thorough" || context.PreferredModel != "opus" || context.PreferredAgent != "coder" || context.PreferredSkills != "go,sql" {
+		t.Fatalf("expected the updated preferences, got %+v", context)
+	}
+}
+
+func checkHistory(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "history")
+	first := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "one", Response: "1"})
+	second := insertTestHistory(t, repository, History{
+		ContextId:        contextId,
+		Prompt:           "two",
+		Response:         "2",
+		ResponseContent:  `[{"type":"text","text":"2"}]`,
+		ToolResults:      "results",
+		Model:            "opus",
+		Agent:            "coder",
+		PromptTokens:     10,
+		CompletionTokens: 20,
+		CacheReadTokens:  3,
+		CacheWriteTokens: 4,
+		Interrupted:      true,
+	})
+	imported := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "three", Response: "3", Created: imported.Format(time.RFC3339Nano)})
+
+	histories, err := repository.GetHistoryByContextId(contextId, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 3 || histories[0].Id != first || histories[1].Id != second {
+		t.Fatalf("expected the history oldest first, got %v", historyIds(histories))
+	}
+
+	h := histories[1]
+	if h.Prompt != "two" || h.Response != "2" || h.ResponseContent != `[{"type":"text","text":"2"}]` || h.ToolResults != "results" {
+		t.Fatalf("expected the stored content, got %+v", h)
+	}
+	if h.Model != "opus" || h.Agent != "coder" || !h.Interrupted || h.ParentId != first || h.ContextId != contextId {
+		t.Fatalf("expected the stored metadata, got %+v", h)
+	}
+	if h.PromptTokens != 10 || h.CompletionTokens != 20 || h.CacheReadTokens != 3 || h.CacheWriteTokens != 4 {
+		t.Fatalf("expected the stored token usage, got %+v", h)
+	}
+	if h.Created == "" {
+		t.Fatalf("expected a created time")
+	}
+	if created := ParseCreated(histories[2].Created); !created.Equal(imported) {
+		t.Fatalf("expected the given created time to be kept, got %q", histories[2].Created)
+	}
+
+	latest, err := repository.GetHistoryByContextId(contextId, 2)
+	if err != nil || len(latest) != 2 || latest[0].Prompt != "two" || latest[1].Prompt != "three" {
+		t.Fatalf("expected the two latest rows, got %v, err %v", historyIds(latest), err)
+	}
+
+	if err := repository.ArchiveHistory(first, true); err != nil {
+		t.Fatal(err)
+	}
+	histories, _ = repository.GetHistoryByContextId(contextId, 10)
+	if !histories[0].Archived || histories[1].Archived {
+		t.Fatalf("expected only the first row archived")
+	}
+}
+
+func checkToolUse(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "tools")
+	insertTestHistory(t, repository, History{
+		ContextId: contextId,
+		Prompt:    "read it",
+		Response:  "done",
+		ToolUse: []ToolUse{
+			{Id: "call_1", Name: "read_file", Input: `{"path":"a"}`, Result: ToolResult{Content: "a", Success: true}},
+			{Id: "call_2", Name: "write_file", Input: `{"path":"b"}`, CallerType: "code_execution", Result: ToolResult{Content: "denied", Success: false}},
+		},
+	})
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "thanks", Response: "welcome"})
+
+	histories, err := repository.GetHistoryByContextId(contextId, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 || len(histories[0].ToolUse) != 2 {
+		t.Fatalf("expected two tool uses on the first row, got %+v", histories)
+	}
+	if len(histories[1].ToolUse) != 0 {
+		t.Fatalf("expected no tool uses on the second row, got %+v", histories[1].ToolUse)
+	}
+
+	read, write := histories[0].ToolUse[0], histories[0].ToolUse[1]
+	if read.Id != "call_1" || read.Name != "read_file" || read.Input != `{"path":"a"}` || read.CallerType != "assistant" {
+		t.Fatalf("unexpected tool use %+v", read)
+	}
+	if read.Result.ToolUseId != "call_1" || read.Result.Content != "a" || !read.Result.Success {
+		t.Fatalf("unexpected tool result %+v", read.Result)
+	}
+	if write.CallerType != "code_execution" || write.Result.Content != "denied" || write.Result.Success {
+		t.Fatalf("unexpected failed tool use %+v", write)
+	}
+}
+
+func checkThinking(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "thinking")
+	thinking := []Thinking{{Text: "the user wants a file", Signature: "sig-1"}, {Redacted: "encrypted"}}
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "read it", Response: "done", Thinking: thinking})
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "thanks", Response: "welcome"})
+
+	histories, err := repository.GetHistoryByContextId(contextId, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 || !reflect.DeepEqual(histories[0].Thinking, thinking) {
+		t.Fatalf("expected the thinking with its signature back, got %+v", histories)
+	}
+	if histories[0].Response != "done" || len(histories[1].Thinking) != 0 {
+		t.Fatalf("expected the thinking apart from the response, got %+v", histories)
+	}
+}
+
+func checkAttachments(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "attachments")
+	attachments := []Attachment{{Name: "chart.png", Source: "/tmp/chart.png", MediaType: "image/png", Hash: "abc", Size: 12}, {Name: "stdin", Source: "stdin", MediaType: "text/plain", Hash: "def", Size: 3}}
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "what is this?", Response: "a chart", Attachments: attachments})
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "thanks", Response: "welcome"})
+
+	histories, err := repository.GetHistoryByContextId(contextId, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histories) != 2 || !reflect.DeepEqual(histories[0].Attachments, attachments) || len(histories[1].Attachments) != 0 {
+		t.Fatalf("expected the references on the first turn only, got %+v", histories)
+	}
+}
+
+func checkGenerationSettings(t *testing.T, repository HistoryRepository) {
+	temperature := 0.2
+	imported := GenerationSettings{MaxTokens: 4000, Temperature: &temperature}
+	id, err := repository.InsertContext(Context{Name: "generation", Generation: imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := insertTestContext(t, repository, "defaults")
+
+	context, err := repository.GetContextById(id)
+	if err != nil || !reflect.DeepEqual(context.Generation, imported) {
+		t.Fatalf("expected the settings of the insert, got %+v, err %v", context.Generation, err)
+	}
+	if context, _ := repository.GetContextById(other); !context.Generation.IsZero() {
+		t.Fatalf("expected the model defaults, got %+v", context.Generation)
+	}
+
+	updated := GenerationSettings{ThinkingBudget: 4096, ReasoningEffort: "high", StopSequences: []string{"END"}}
+	if err := repository.UpdateGenerationSettings(id, updated); err != nil {
+		t.Fatal(err)
+	}
+	context, _ = repository.GetContextById(id)
+	if !reflect.DeepEqual(context.Generation, updated) {
+		t.Fatalf("expected the updated settings, got %+v", context.Generation)
+	}
+
+	if err := repository.UpdateGenerationSettings(id, GenerationSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	if context, _ := repository.GetContextByName("generation"); context == nil || !context.Generation.IsZero() {
+		t.Fatalf("expected the settings to be cleared, got %+v", context)
+	}
+}
+
+func checkBranches(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "branches")
+	first := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "one"})
+	second := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two"})
+	edited := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two, edited", ParentId: first})
+
+	context, _ := repository.GetContextById(contextId)
+	if context.ActiveLeafId != edited {
+		t.Fatalf("expected the new branch to be active, got leaf %d", context.ActiveLeafId)
+	}
+	histories, _ := repository.GetHistoryByContextId(contextId, 10)
+	if !slices.Equal(historyIds(histories), []int64{first, edited}) {
+		t.Fatalf("expected the edited branch, got %v", historyIds(histories))
+	}
+
+	tree, err := repository.GetHistoryTree(contextId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tree.Siblings(edited), []int64{second, edited}) {
+		t.Fatalf("expected two siblings, got %v", tree.Siblings(edited))
+	}
+
+	if err := repository.UpdateActiveLeaf(contextId, second); err != nil {
+		t.Fatal(err)
+	}
+	histories, _ = repository.GetHistoryByContextId(contextId, 10)
+	if !slices.Equal(historyIds(histories), []int64{first, second}) {
+		t.Fatalf("expected the first branch after switching, got %v", historyIds(histories))
+	}
+
+	// A new row continues the active branch
+	third := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "three"})
+	histories, _ = repository.GetHistoryByContextId(contextId, 10)
+	if !slices.Equal(historyIds(histories), []int64{first, second, third}) {
+		t.Fatalf("expected the row appended to the active branch, got %v", historyIds(histories))
+	}
+}
+
+func checkDeleteHistory(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "delete")
+	first := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "one"})
+	second := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two"})
+	third := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "three"})
+
+	deleted, err := repository.DeleteHistory(second)
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected one deleted row, got %d, err %v", deleted, err)
+	}
+	histories, _ := repository.GetHistoryByContextId(contextId, 10)
+	if !slices.Equal(historyIds(histories), []int64{first, third}) {
+		t.Fatalf("expected the children to continue from the parent, got %v", historyIds(histories))
+	}
+
+	if _, err := repository.DeleteHistory(third); err != nil {
+		t.Fatal(err)
+	}
+	context, _ := repository.GetContextById(contextId)
+	if context.ActiveLeafId != first {
+		t.Fatalf("expected the active leaf to move to the parent, got %d", context.ActiveLeafId)
+	}
+
+	if deleted, err := repository.DeleteHistory(999999); err != nil || deleted != 0 {
+		t.Fatalf("expected nothing deleted for an unknown row, got %d, err %v", deleted, err)
+	}
+}
+
+func checkSummaries(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "summaries")
+	first := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "one"})
+	second := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two"})
+
+	if summary, err := repository.GetLatestSummary(contextId); err != nil || summary != nil {
+		t.Fatalf("expected no summary, got %+v, err %v", summary, err)
+	}
+
+	if _, err := repository.InsertSummary(Summary{ContextId: contextId, ThroughHistoryId: first, Content: "short", Model: "haiku"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.InsertSummary(Summary{ContextId: contextId, ThroughHistoryId: second, Content: "longer", Model: "haiku"}); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := repository.GetLatestSummary(contextId)
+	if err != nil || summary == nil || summary.Content != "longer" || summary.Model != "haiku" {
+		t.Fatalf("expected the summary covering the most history, got %+v, err %v", summary, err)
+	}
+
+	// A summary of another branch does not apply
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two, edited", ParentId: first})
+	summary, _ = repository.GetLatestSummary(contextId)
+	if summary == nil || summary.Content != "short" {
+		t.Fatalf("expected the summary of the active branch, got %+v", summary)
+	}
+}
+
+func checkUsage(t *testing.T, repository HistoryRepository) {
+	contextId := insertTestContext(t, repository, "usage")
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "one", Model: "opus", PromptTokens: 100, CompletionTokens: 50, CacheReadTokens: 5, CacheWriteTokens: 7})
+
+	rows, err := repository.GetUsage(time.Now().Add(-time.Hour))
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("expected one usage row, got %d, err %v", len(rows), err)
+	}
+	row := rows[0]
+	if row.ContextId != contextId || row.ContextName != "usage" || row.Model != "opus" {
+		t.Fatalf("unexpected usage row %+v", row)
+	}
+	if row.PromptTokens != 100 || row.CompletionTokens != 50 || row.CacheReadTokens != 5 || row.CacheWriteTokens != 7 {
+		t.Fatalf("unexpected token usage %+v", row)
+	}
+
+	if rows, _ := repository.GetUsage(time.Now().Add(time.Hour)); len(rows) != 0 {
+		t.Fatalf("expected no usage after the cut off, got %d", len(rows))
+	}
+
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "two", Model: "opus", PromptTokens: 10, CompletionTokens: 5})
+	insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "old", Model: "opus", PromptTokens: 1000, Created: time.Now().AddDate(0, 0, -2).Format("2006-01-02 15:04:05.999999999-07:00")})
+
+	totals, err := repository.GetUsageTotals(time.Now().Add(-time.Hour))
+	if err != nil || len(totals) != 1 {
+		t.Fatalf("expected one model total, got %+v, err %v", totals, err)
+	}
+	if total := totals[0]; total.Model != "opus" || total.Messages != 2 || total.PromptTokens != 110 || total.CompletionTokens != 55 || total.CacheReadTokens != 5 || total.CacheWriteTokens != 7 {
+		t.Fatalf("unexpected usage total %+v", total)
+	}
+	if totals, _ := repository.GetUsageTotals(time.Now().AddDate(0, 0, -3)); len(totals) != 1 || totals[0].Messages != 3 {
+		t.Fatalf("expected the old row in a longer range, got %+v", totals)
+	}
+	if totals, _ := repository.GetUsageTotals(time.Now().Add(time.Hour)); len(totals) != 0 {
+		t.Fatalf("expected no totals after the cut off, got %+v", totals)
+	}
+}
+
+func checkSearch(t *testing.T, repository HistoryRepository) {
+	migrations := insertTestContext(t, repository, "migrations")
+	lunch := insertTestContext(t, repository, "lunch")
+	script := insertTestHistory(t, repository, History{ContextId: migrations, Prompt: "how do I write the migration script", Response: "number the files and keep a down script"})
+	insertTestHistory(t, repository, History{
+		ContextId: migrations,
+		Prompt:    "deploy it",
+		Response:  "done",
+		ToolUse:   []ToolUse{{Id: "call_1", Name: "run", Input: `{"command":"deploy.sh"}`, Result: ToolResult{Content: "kubectl rollout finished", Success: true}}},
+	})
+	insertTestHistory(t, repository, History{ContextId: lunch, Prompt: "lunch ideas", Response: "tacos, or a script for ordering pizza"})
+
+	results, err := repository.SearchHistory("migration script", SearchFilters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].HistoryId != script || results[0].ContextId != migrations || results[0].ContextName != "migrations" {
+		t.Fatalf("expected the migration question, got %+v", results)
+	}
+	if !strings.Contains(results[0].Snippet, SnippetMark) {
+		t.Fatalf("expected the match to be marked in the snippet, got %q", results[0].Snippet)
+	}
+
+	if results, _ := repository.SearchHistory("kubectl", SearchFilters{}); len(results) != 1 {
+		t.Fatalf("expected tool results to be searched, got %+v", results)
+	}
+	if results, _ := repository.SearchHistory("script", SearchFilters{}); len(results) != 2 {
+		t.Fatalf("expected matches in both contexts, got %+v", results)
+	}
+	if results, _ := repository.SearchHistory("script", SearchFilters{ContextId: lunch}); len(results) != 1 || results[0].ContextId != lunch {
+		t.Fatalf("expected only the lunch context, got %+v", results)
+	}
+	if results, _ := repository.SearchHistory("script", SearchFilters{Limit: 1}); len(results) != 1 {
+		t.Fatalf("expected the limit to apply, got %d results", len(results))
+	}
+	if results, _ := repository.SearchHistory("script", SearchFilters{Since: time.Now().Add(time.Hour)}); len(results) != 0 {
+		t.Fatalf("expected no results after the cut off, got %d", len(results))
+	}
+	if _, err := repository.SearchHistory("  ", SearchFilters{}); err == nil {
+		t.Fatalf("expected an empty query to fail")
+	}
+}
+
+func checkTrash(t *testing.T, repository HistoryRepository) {
+	kept := insertTestContext(t, repository, "kept")
+	trashed := insertTestContext(t, repository, "trashed")
+	insertTestHistory(t, repository, History{
+		ContextId: trashed,
+		Prompt:    "remember the walrus",
+		Response:  "noted",
+		ToolUse:   []ToolUse{{Id: "call_1", Name: "run", Input: "{}", Result: ToolResult{Content: "ok", Success: true}}},
+	})
+
+	if deleted, err := repository.DeleteContext(trashed); err != nil || deleted != 1 {
+		t.Fatalf("expected one deleted context, got %d, err %v", deleted, err)
+	}
+	if contexts, _ := repository.GetAllContexts(); len(contexts) != 1 || contexts[0].Id != kept {
+		t.Fatalf("expected only the kept context, got %+v", contexts)
+	}
+	if context, err := repository.GetContextByName("trashed"); context != nil || err != nil {
+		t.Fatalf("expected no context and no error by name in the trash, got %+v, err %v", context, err)
+	}
+	if results, _ := repository.SearchHistory("walrus", SearchFilters{}); len(results) != 0 {
+		t.Fatalf("expected no search results from the trash, got %+v", results)
+	}
+
+	trash, err := repository.GetDeletedContexts()
+	if err != nil || len(trash) != 1 || trash[0].Id != trashed || !trash[0].InTrash() {
+		t.Fatalf("expected the context in the trash, got %+v, err %v", trash, err)
+	}
+
+	if err := repository.RestoreContext(trashed); err != nil {
+		t.Fatal(err)
+	}
+	if contexts, _ := repository.GetAllContexts(); len(contexts) != 2 {
+		t.Fatalf("expected the restored context back, got %+v", contexts)
+	}
+	if results, _ := repository.SearchHistory("walrus", SearchFilters{}); len(results) != 1 {
+		t.Fatalf("expected the restored history to be searched, got %+v", results)
+	}
+
+	repository.DeleteContext(trashed)
+	if purged, err := repository.PurgeTrash(time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d, err %v", purged, err)
+	}
+	if purged, err := repository.PurgeTrash(time.Now().Add(time.Hour)); err != nil || purged != 1 {
+		t.Fatalf("expected one purged context, got %d, err %v", purged, err)
+	}
+	if trash, _ := repository.GetDeletedContexts(); len(trash) != 0 {
+		t.Fatalf("expected an empty trash, got %+v", trash)
+	}
+	if histories, _ := repository.GetHistoryByContextId(trashed, 10); len(histories) != 0 {
+		t.Fatalf("expected the history to be purged, got %+v", histories)
+	}
+
+	repository.DeleteContext(kept)
+	if purged, err := repository.PurgeContext(kept); err != nil || purged != 1 {
+		t.Fatalf("expected the context to be purged, got %d, err %v", purged, err)
+	}
+	if trash, _ := repository.GetDeletedContexts(); len(trash) != 0 {
+		t.Fatalf("expected an empty trash, got %+v", trash)
+	}
+}
+
+func checkTagsAndFolders(t *testing.T, repository HistoryRepository) {
+	id, err := repository.InsertContext(Context{Name: "imported", Tags: []string{"Owl", "review"}, Folder: "/work/owl/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := insertTestContext(t, repository, "other")
+
+	context, err := repository.GetContextById(id)
+	if err != nil || !slices.Equal(context.Tags, []string{"owl", "review"}) || context.Folder != "work/owl" {
+		t.Fatalf("expected the tags and folder of the insert, got %+v, err %v", context, err)
+	}
+	if context, _ := repository.GetContextById(other); len(context.Tags) != 0 || context.Folder != "" {
+		t.Fatalf("expected no tags or folder, got %+v", context)
+	}
+
+	if err := repository.UpdateTags(id, []string{"#Release", "release", "owl"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.UpdateFolder(id, "work/ infra"); err != nil {
+		t.Fatal(err)
+	}
+	contexts, _ := repository.GetAllContexts()
+	filtered := FilterContexts(contexts, ContextFilter{Tag: "release", Folder: "work"})
+	if len(filtered) != 1 || filtered[0].Id != id || !slices.Equal(filtered[0].Tags, []string{"owl", "release"}) || filtered[0].Folder != "work/infra" {
+		t.Fatalf("expected the updated context, got %+v", filtered)
+	}
+
+	if err := repository.RenameContext(id, "  renamed "); err != nil {
+		t.Fatal(err)
+	}
+	if context, err := repository.GetContextByName("renamed"); err != nil || context == nil || context.Id != id {
+		t.Fatalf("expected the context under its new name, got %+v, err %v", context, err)
+	}
+	if err := repository.RenameContext(id, "other"); err != ErrContextNameTaken {
+		t.Fatalf("expected the name to be taken, got %v", err)
+	}
+	if err := repository.RenameContext(id, " "); err != ErrEmptyContextName {
+		t.Fatalf("expected an empty name to fail, got %v", err)
+	}
+	// A context in the trash does not keep its name
+	repository.DeleteContext(other)
+	if err := repository.RenameContext(id, "other"); err != nil {
+		t.Fatalf("expected the name of a deleted context to be free, got %v", err)
+	}
+}
+
+func checkContextActivity(t *testing.T, repository HistoryRepository) {
+	imported := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	old, err := repository.InsertContext(Context{Name: "old", Created: imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := insertTestContext(t, repository, "fresh")
+
+	context, err := repository.GetContextById(fresh)
+	if err != nil || context.Created.IsZero() || !context.LastUsed.IsZero() || context.MessageCount != 0 || context.TotalTokens != 0 {
+		t.Fatalf("expected a new context without activity, got %+v, err %v", context, err)
+	}
+
+	insertTestHistory(t, repository, History{ContextId: old, Prompt: "a", Response: "b", Created: "2024-03-02T08:00:00Z", PromptTokens: 100, CompletionTokens: 20})
+	insertTestHistory(t, repository, History{ContextId: fresh, Prompt: "c", Response: "d", PromptTokens: 10, CompletionTokens: 5, CacheReadTokens: 3, CacheWriteTokens: 2})
+	insertTestHistory(t, repository, History{ContextId: fresh, Prompt: "e", Response: "f", ParentId: 0, PromptTokens: 1})
+
+	contexts, err := repository.GetAllContexts()
+	if err != nil || len(contexts) != 2 {
+		t.Fatalf("expected 2 contexts, got %+v, err %v", contexts, err)
+	}
+	byId := map[int64]Context{}
+	for _, c := range contexts {
+		byId[c.Id] = c
+	}
+	if c := byId[old]; !c.Created.Equal(imported) || !c.LastUsed.Equal(time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)) || c.MessageCount != 1 || c.TotalTokens != 120 {
+		t.Fatalf("unexpected activity of the imported context %+v", c)
+	}
+	if c := byId[fresh]; c.LastUsed.Before(c.Created) || c.MessageCount != 2 || c.TotalTokens != 21 {
+		t.Fatalf("unexpected activity of the fresh context %+v", c)
+	}
+
+	SortContexts(contexts, OrderLastUsed)
+	if contexts[0].Id != fresh {
+		t.Fatalf("expected the last used context first, got %+v", contexts)
+	}
+	SortContexts(contexts, OrderTokens)
+	if contexts[0].Id != old {
+		t.Fatalf("expected the context with the most tokens first, got %+v", contexts)
+	}
+}
+
+// postgresTestURL returns OWL_TEST_POSTGRES_URL and skips the test without it.
+// CI provides a database, so a missing one fails the test there.
+func postgresTestURL(t *testing.T) string {
+	url := os.Getenv("OWL_TEST_POSTGRES_URL")
+	if url == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("OWL_TEST_POSTGRES_URL is not set")
+		}
+		t.Skip("OWL_TEST_POSTGRES_URL is not set")
+	}
+	return url
+}
+
+func checkImportContext(t *testing.T, repository HistoryRepository) {
+	// Ids of another repository, the edit of "two" is on its own branch
+	contextId, err := repository.ImportContext(Context{Name: "imported", Archived: true, ActiveLeafId: 11}, []History{
+		{Id: 10, Prompt: "one", Created: "2024-03-01T12:30:00Z"},
+		{Id: 11, ParentId: 10, Prompt: "two", Archived: true, ToolUse: []ToolUse{{Id: "toolu_1", Name: "read_file", Input: "{}", Result: ToolResult{ToolUseId: "toolu_1", Content: "ok", Success: true}}}},
+		{Id: 12, ParentId: 10, Prompt: "two, edited"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	histories, err := repository.GetContextHistory(contextId)
+	if err != nil || len(histories) != 3 {
+		t.Fatalf("expected the rows of both branches, got %d, err %v", len(histories), err)
+	}
+	first, second, edited := histories[0], histories[1], histories[2]
+	if first.ParentId != 0 || second.ParentId != first.Id || edited.ParentId != first.Id {
+		t.Fatalf("expected the tree to be rebuilt with the new ids, got parents %d, %d, %d", first.ParentId, second.ParentId, edited.ParentId)
+	}
+	if !second.Archived || edited.Archived || len(second.ToolUse) != 1 || second.ToolUse[0].Result.Content != "ok" {
+		t.Fatalf("expected the rows to keep their state and tool uses, got %+v", second)
+	}
+
+	context, err := repository.FindContext(contextId)
+	if err != nil || context == nil || !context.Archived || context.ActiveLeafId != second.Id {
+		t.Fatalf("expected the archived context continuing the first branch, got %+v, err %v", context, err)
+	}
+	active, _ := repository.GetHistoryByContextId(contextId, 10)
+	if !slices.Equal(historyIds(active), []int64{first.Id, second.Id}) {
+		t.Fatalf("expected the active branch, got %v", historyIds(active))
+	}
+
+	// A row before its parent fails the import and leaves no context behind
+	_, err = repository.ImportContext(Context{Name: "broken"}, []History{
+		{Id: 2, ParentId: 1, Prompt: "answer to nothing"},
+		{Id: 1, Prompt: "one"},
+	})
+	if err == nil {
+		t.Fatal("expected the import to fail")
+	}
+	contexts, _ := repository.GetAllContexts()
+	if slices.ContainsFunc(contexts, func(context Context) bool { return context.Name == "broken" }) {
+		t.Fatal("expected the failed import to be rolled back")
+	}
+}
+
+func checkFindContext(t *testing.T, repository HistoryRepository) {
+	archived := insertTestContext(t, repository, "archived")
+	if err := repository.ArchiveContext(archived, true); err != nil {
+		t.Fatal(err)
+	}
+	trashed := insertTestContext(t, repository, "trashed")
+	if _, err := repository.DeleteContext(trashed); err != nil {
+		t.Fatal(err)
+	}
+
+	context, err := repository.FindContext(archived)
+	if err != nil || context == nil || context.Name != "archived" || !context.Archived {
+		t.Fatalf("expected the archived context, got %+v, err %v", context, err)
+	}
+	if context, _ := repository.FindContext(archived); context == nil || !context.Archived {
+		t.Fatalf("expected FindContext to leave the context archived, got %+v", context)
+	}
+	for _, id := range []int64{trashed, 999} {
+		if context, err := repository.FindContext(id); context != nil || err != nil {
+			t.Fatalf("expected no context and no error for %d, got %+v, err %v", id, context, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"io"
+	"log"
+	"os"
+	"owl/logger"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoryUserNameNamesTheUserOfEachRepository(t *testing.T) {
+	name := "ada"
+	repositories := map[string]HistoryRepository{
+		"sqlite":     User{Name: &name},
+		"multi user": &MultiUserContext{User: User{Name: &name}},
+		"postgres":   &PostgresHistoryRepository{User: User{Name: &name}},
+	}
+	for kind, repository := range repositories {
+		if got := RepositoryUserName(repository); got != "ada" {
+			t.Fatalf("expected the %s repository to belong to ada, got %q", kind, got)
+		}
+	}
+	if got := RepositoryUserName(nil); got != "" {
+		t.Fatalf("expected no user without a repository, got %q", got)
+	}
+}
+
+func TestNewHistoryRepositoryReportsADatabaseThatCannotBeOpened(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	t.Setenv("OWL_DATABASE_URL", "")
+	// A file where the directory of the databases should be
+	dir := filepath.Join(t.TempDir(), "not-a-directory")
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	previous := databaseDir
+	databaseDir = func() (string, error) { return dir, nil }
+	t.Cleanup(func() { databaseDir = previous })
+
+	if _, err := NewHistoryRepository("ada"); err == nil {
+		t.Fatalf("expected an error for a database that cannot be opened")
+	}
+	if err := (&MultiUserContext{}).SetCurrentDb("ada"); err == nil {
+		t.Fatalf("expected an error from SetCurrentDb for a database that cannot be opened")
+	}
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultSearchLimit is the number of results SearchHistory returns when the
+// filters do not set one.
+const DefaultSearchLimit = 20
+
+// SearchFilters narrow a history search. Zero values do not filter.
+type SearchFilters struct {
+	ContextId int64
+	Since     time.Time
+	Limit     int
+}
+
+// SearchResult is a history row that matched a search. Snippet is an excerpt
+// around the match with the matched words wrapped in SnippetMark.
+type SearchResult struct {
+	HistoryId   int64   `json:"history_id"`
+	ContextId   int64   `json:"context_id"`
+	ContextName string  `json:"context_name"`
+	Snippet     string  `json:"snippet"`
+	Created     string  `json:"created"`
+	Rank        float64 `json:"rank"`
+}
+
+// SnippetMark surrounds the matched words in a snippet.
+const SnippetMark = "**"
+
+var ErrEmptySearch = errors.New("the search query is empty")
+
+func (filters SearchFilters) limit() int {
+	if filters.Limit > 0 {
+		return filters.Limit
+	}
+	return DefaultSearchLimit
+}
+
+// ftsQuery turns free text into a full-text query that matches rows with
+// every word. Words are quoted so the user does not have to know the query
+// syntax; a trailing * keeps prefix matching.
+func ftsQuery(query string) (string, error) {
+	terms := []string{}
+	for _, word := range strings.Fields(query) {
+		word = strings.ReplaceAll(word, `"`, "")
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		if word == "" {
+			continue
+		}
+		if prefix {
+			word += "*"
+		}
+		terms = append(terms, `"`+word+`"`)
+	}
+	if len(terms) == 0 {
+		return "", ErrEmptySearch
+	}
+	return strings.Join(terms, " "), nil
+}
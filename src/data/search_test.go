@@ -0,0 +1,39 @@
+package data
+
+import "testing"
+
+func TestFtsQuery_QuotesEveryWord(t *testing.T) {
+	query, err := ftsQuery(`migration "script" OR deploy* -x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != `"migration" "script" "OR" "deploy*" "-x"` {
+		t.Fatalf("unexpected query %s", query)
+	}
+	if _, err := ftsQuery(` "" * `); err != ErrEmptySearch {
+		t.Fatalf("expected an empty query error, got %v", err)
+	}
+}
+
+func TestSqliteSearch_WeighsPromptAboveToolOutput(t *testing.T) {
+	repository := newSqliteTestRepository(t)
+	contextId := insertTestContext(t, repository, "deploys")
+	inTools := insertTestHistory(t, repository, History{
+		ContextId: contextId,
+		Prompt:    "ship it",
+		Response:  "done",
+		ToolUse:   []ToolUse{{Id: "call_1", Name: "run", Input: `{"command":"deploy.sh"}`, Result: ToolResult{Content: "rollout finished", Success: true}}},
+	})
+	inPrompt := insertTestHistory(t, repository, History{ContextId: contextId, Prompt: "how does the rollout work", Response: "in waves"})
+
+	results, err := repository.SearchHistory("rollout", SearchFilters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].HistoryId != inPrompt || results[1].HistoryId != inTools {
+		t.Fatalf("expected the prompt match before the tool match, got %+v", results)
+	}
+	if results[0].Rank <= results[1].Rank {
+		t.Fatalf("expected a higher rank for the prompt match, got %+v", results)
+	}
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"owl/data/migrations"
+	"strings"
+)
+
+// legacySqliteSchemaVersion is the migration that matches the schema built by
+// the ALTER TABLE helpers that ran before migrations existed.
+const legacySqliteSchemaVersion = 3
+
+// legacySqliteUpgrades are those helpers. They may fail because the column or
+// table is already there, which is why their errors are ignored.
+var legacySqliteUpgrades = []string{
+	"ALTER TABLE context ADD COLUMN archived INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN archived INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN prompt_tokens INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN completion_tokens INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN cache_read_tokens INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN cache_write_tokens INTEGER DEFAULT 0",
+	"ALTER TABLE context ADD COLUMN preferred_agent TEXT",
+	"ALTER TABLE context ADD COLUMN preferred_skills TEXT",
+	"ALTER TABLE history ADD COLUMN interrupted INTEGER DEFAULT 0",
+	"ALTER TABLE history ADD COLUMN agent TEXT",
+	`CREATE TABLE IF NOT EXISTS tool_use (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		history_id INTEGER,
+		tool_use_external_id TEXT,
+		name TEXT,
+		input TEXT,
+		caller_type TEXT DEFAULT 'assistant',
+		created INT,
+		FOREIGN KEY(history_id) REFERENCES history(id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS tool_result (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tool_use_id INTEGER UNIQUE,
+		content TEXT,
+		success INTEGER DEFAULT 1,
+		created INT,
+		FOREIGN KEY(tool_use_id) REFERENCES tool_use(id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS history_summary (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		context_id INTEGER,
+		through_history_id INTEGER,
+		content TEXT,
+		model TEXT,
+		created INT
+	)`,
+}
+
+// migrateSqlite brings a user database to the latest schema.
+func migrateSqlite(db *sql.DB) error {
+	if err := adoptLegacySqlite(db); err != nil {
+		return err
+	}
+	_, err := migrations.Up(db, migrations.SQLite)
+	return withFts5Hint(err)
+}
+
+// withFts5Hint explains the error of a build without FTS5, which history
+// search needs.
+func withFts5Hint(err error) error {
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		return fmt.Errorf("%w (owl has to be built with -tags sqlite_fts5)", err)
+	}
+	return err
+}
+
+// adoptLegacySqlite upgrades a database created before migrations with the
+// old helpers and stamps it with the matching version, so the migrations
+// after it apply normally. New and already migrated databases are left alone.
+func adoptLegacySqlite(db *sql.DB) error {
+	tracked, err := migrations.HasTable(db, migrations.SQLite)
+	if err != nil || tracked {
+		return err
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'history'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+
+	for _, upgrade := range legacySqliteUpgrades {
+		_, _ = db.Exec(upgrade)
+	}
+	// Branches came last, existing contexts become a single branch
+	if _, err := db.Exec("ALTER TABLE history ADD COLUMN parent_id INTEGER DEFAULT 0"); err == nil {
+		_, _ = db.Exec("UPDATE history SET parent_id = COALESCE((SELECT MAX(previous.id) FROM history previous WHERE previous.context_id = history.context_id AND previous.id < history.id), 0)")
+	}
+	if _, err := db.Exec("ALTER TABLE context ADD COLUMN active_leaf_id INTEGER DEFAULT 0"); err == nil {
+		_, _ = db.Exec("UPDATE context SET active_leaf_id = COALESCE((SELECT MAX(history.id) FROM history WHERE history.context_id = context.id), 0)")
+	}
+	_, _ = db.Exec("CREATE INDEX IF NOT EXISTS idx_history_parent_id ON history (parent_id)")
+
+	if err := migrations.Stamp(db, migrations.SQLite, legacySqliteSchemaVersion); err != nil {
+		return fmt.Errorf("could not stamp legacy database: %w", err)
+	}
+	return nil
+}
+
+// MigrationStatus lists the migrations of the user database and whether
+// they are applied.
+func (user User) MigrationStatus() ([]migrations.Status, error) {
+	db, err := user.openUserDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := adoptLegacySqlite(db); err != nil {
+		return nil, err
+	}
+	return migrations.StatusOf(db, migrations.SQLite)
+}
+
+// MigrateUp applies the pending migrations of the user database.
+func (user User) MigrateUp() ([]migrations.Migration, error) {
+	db, err := user.openUserDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := adoptLegacySqlite(db); err != nil {
+		return nil, err
+	}
+	applied, err := migrations.Up(db, migrations.SQLite)
+	return applied, withFts5Hint(err)
+}
+
+// MigrateDown reverts the latest migration of the user database. The next
+// regular use of the database applies it again, so this is meant for going
+// back before running an older build.
+func (user User) MigrateDown() (*migrations.Migration, error) {
+	db, err := user.openUserDb()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := adoptLegacySqlite(db); err != nil {
+		return nil, err
+	}
+	return migrations.Down(db, migrations.SQLite)
+}
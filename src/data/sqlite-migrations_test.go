@@ -0,0 +1,84 @@
+package data
+
+import (
+	"database/sql"
+	"owl/data/migrations"
+	"path/filepath"
+	"testing"
+)
+
+// A database as the first versions of owl created it, before any of the
+// columns that were later added with ALTER TABLE.
+const firstSqliteSchema = `
+	CREATE TABLE context (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, system_prompt TEXT, preferred_model TEXT);
+	CREATE TABLE history (id INTEGER PRIMARY KEY AUTOINCREMENT, context_id INTEGER, prompt TEXT, response TEXT, response_content TEXT, abreviation TEXT, token_count INTEGER, created INT, tool_results TEXT, model TEXT);
+	INSERT INTO context (name) VALUES ('old');
+	INSERT INTO history (context_id, prompt, response) VALUES (1, 'first', 'one'), (1, 'second', 'two');
+`
+
+func TestMigrateSqlite_AdoptsDatabaseCreatedBeforeMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "legacy.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(firstSqliteSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSqlite(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	statuses, err := migrations.StatusOf(db, migrations.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Fatalf("expected %d_%s to be applied, got %+v", status.Version, status.Name, status)
+		}
+	}
+
+	var parentId, activeLeafId int64
+	var agent sql.NullString
+	if err := db.QueryRow("SELECT parent_id, agent FROM history WHERE id = 2").Scan(&parentId, &agent); err != nil {
+		t.Fatalf("expected the added columns on old rows: %v", err)
+	}
+	if parentId != 1 {
+		t.Fatalf("expected old rows to form one branch, parent of 2 is %d", parentId)
+	}
+	if err := db.QueryRow("SELECT active_leaf_id FROM context WHERE id = 1").Scan(&activeLeafId); err != nil || activeLeafId != 2 {
+		t.Fatalf("expected the newest row to be the active leaf, got %d, err %v", activeLeafId, err)
+	}
+
+	var created sql.NullTime
+	if err := db.QueryRow("SELECT created FROM context WHERE id = 1").Scan(&created); err != nil || !created.Valid {
+		t.Fatalf("expected old contexts to get a created time, got %v, err %v", created, err)
+	}
+
+	// A second open finds the database tracked and changes nothing
+	if err := migrateSqlite(db); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+}
+
+func TestMigrateSqlite_CreatesNewDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "new.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := migrateSqlite(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('context', 'history', 'tool_use', 'tool_result', 'history_summary')").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("expected all tables to be created, got %d", count)
+	}
+}
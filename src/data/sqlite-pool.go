@@ -0,0 +1,93 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// sqliteBusyTimeout is how long, in milliseconds, a query waits for another
+// connection's write lock before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5000
+
+// sqliteDsn turns on WAL, so readers do not block the writer, and starts
+// transactions with the write lock, so two writers cannot deadlock while
+// upgrading a read lock.
+func sqliteDsn(path string) string {
+	return fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", path, sqliteBusyTimeout)
+}
+
+// DatabasePool keeps one long-lived handle per database. A handle is
+// migrated when it is first opened and shared by every repository call after
+// that; database/sql pools the connections behind it.
+type DatabasePool struct {
+	mu   sync.Mutex
+	dbs  map[string]*sql.DB
+	open func(source string) (*sql.DB, error)
+}
+
+// NewSqlitePool returns a pool of SQLite databases keyed by file path.
+func NewSqlitePool() *DatabasePool {
+	return &DatabasePool{dbs: map[string]*sql.DB{}, open: openSqlite}
+}
+
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDsn(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSqlite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Open returns the handle of the database at source, opening and migrating
+// it on first use.
+func (pool *DatabasePool) Open(source string) (*sql.DB, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if db, ok := pool.dbs[source]; ok {
+		return db, nil
+	}
+
+	db, err := pool.open(source)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.dbs[source] = db
+	return db, nil
+}
+
+// Close closes every handle. The pool can be used again afterwards, the
+// next Open starts a new handle.
+func (pool *DatabasePool) Close() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var errs []error
+	// Postgres sources hold credentials, so they are left out of the errors
+	for source, db := range pool.dbs {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing a database: %w", err))
+		}
+		delete(pool.dbs, source)
+	}
+	return errors.Join(errs...)
+}
+
+// userDatabases holds the handles of the user databases in ~/.owl and
+// postgresDatabases the ones of OWL_DATABASE_URL.
+var (
+	userDatabases     = NewSqlitePool()
+	postgresDatabases = NewPostgresPool()
+)
+
+// CloseUserDatabases closes every pooled database, call it on shutdown.
+func CloseUserDatabases() error {
+	return errors.Join(userDatabases.Close(), postgresDatabases.Close())
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSqlitePool_SharesOneMigratedHandlePerFile(t *testing.T) {
+	pool := NewSqlitePool()
+	defer pool.Close()
+	path := filepath.Join(t.TempDir(), "owl.db")
+
+	first, err := pool.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatalf("expected the same handle for the same file")
+	}
+
+	other, err := pool.Open(filepath.Join(t.TempDir(), "other.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Fatalf("expected a separate handle per file")
+	}
+
+	var journalMode string
+	if err := first.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Fatalf("expected WAL, got %q, err %v", journalMode, err)
+	}
+	var busyTimeout int
+	if err := first.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil || busyTimeout != sqliteBusyTimeout {
+		t.Fatalf("expected busy timeout %d, got %d, err %v", sqliteBusyTimeout, busyTimeout, err)
+	}
+	var tables int
+	if err := first.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'history'").Scan(&tables); err != nil || tables != 1 {
+		t.Fatalf("expected the handle to be migrated, err %v", err)
+	}
+}
+
+func TestSqlitePool_CloseClosesHandlesAndAllowsReopening(t *testing.T) {
+	pool := NewSqlitePool()
+	path := filepath.Join(t.TempDir(), "owl.db")
+
+	first, err := pool.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Ping(); err == nil {
+		t.Fatalf("expected the old handle to be closed")
+	}
+
+	reopened, err := pool.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if reopened == first {
+		t.Fatalf("expected a new handle after close")
+	}
+}
+
+func TestSqlitePool_ConcurrentWritesWaitForTheLock(t *testing.T) {
+	pool := NewSqlitePool()
+	defer pool.Close()
+	db, err := pool.Open(filepath.Join(t.TempDir(), "owl.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.Begin()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := tx.Exec("INSERT INTO context (name) VALUES ('concurrent')"); err != nil {
+				_ = tx.Rollback()
+				errs <- err
+				return
+			}
+			errs <- tx.Commit()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("expected writers to wait for each other, got %v", err)
+		}
+	}
+}
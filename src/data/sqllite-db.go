@@ -11,215 +11,143 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func (user User) getUserDb() *sql.DB {
-
-	homeDir, err := getHomeDir()
+// getUserDb returns the shared handle of the user's database, opened and
+// migrated on first use.
+func (user User) getUserDb() (*sql.DB, error) {
+	path, err := user.dbPath()
 	if err != nil {
-		panic(fmt.Sprintf("did not find home dir for db creation. %s", err))
-	}
-
-	path := fmt.Sprintf("%s/.owl/%s.db", homeDir, *user.Name)
-
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		panic(err)
-	}
-
-	// Check if the database is new by querying the sqlite_master table
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&count)
-	if err != nil {
-		panic(err)
-	}
-
-	// If the database is new (no tables exist), set it up
-	if count == 0 {
-		user.setupDb(db)
-	} else {
-		user.ensureArchivedColumnsExist(db)
-		user.ensureTokenColumnsExist(db)
-		user.ensureContextPreferenceColumnsExist(db)
-		user.ensureToolTablesExist(db)
+		return nil, err
 	}
-
-	return db
+	return userDatabases.Open(path)
 }
 
-func (user User) setupDb(db *sql.DB) {
-	createHistoryTables(db)
-	createToolTables(db)
-	createContextTable(db)
-	user.ensureArchivedColumnsExist(db)
-	user.ensureTokenColumnsExist(db)
-	user.ensureContextPreferenceColumnsExist(db)
-	user.ensureToolTablesExist(db)
-}
-
-func createContextTable(db *sql.DB) {
-	createTableQuery := `
-		 CREATE TABLE IF NOT EXISTS context (
-	             id INTEGER PRIMARY KEY AUTOINCREMENT,
-	             name TEXT,
-			 system_prompt TEXT,
-			 preferred_model TEXT,
-			 preferred_agent TEXT,
-			 preferred_skills TEXT,
-			 archived INTEGER DEFAULT 0
-	         )
-     `
-
-	_, err := db.Exec(createTableQuery)
+// openUserDb opens a separate, unmigrated handle on the user's database for
+// the migration commands. The caller closes it.
+func (user User) openUserDb() (*sql.DB, error) {
+	path, err := user.dbPath()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return sql.Open("sqlite3", sqliteDsn(path))
 }
 
-func createHistoryTables(db *sql.DB) {
-	createTableQuery := `
-         CREATE TABLE IF NOT EXISTS history (
-             id INTEGER PRIMARY KEY AUTOINCREMENT,
-             context_id INTEGER,
-             prompt TEXT,
-             response TEXT,
-			 response_content TEXT,
-             abreviation TEXT,
-             token_count INTEGER,
-		 prompt_tokens INTEGER DEFAULT 0,
-		 completion_tokens INTEGER DEFAULT 0,
-		 cache_read_tokens INTEGER DEFAULT 0,
-		 cache_write_tokens INTEGER DEFAULT 0,
-		 created INT,
-		 tool_results TEXT,
-		 model TEXT,
-		 archived INTEGER DEFAULT 0
-         )
-     `
-	_, err := db.Exec(createTableQuery)
+// databaseDir returns the directory of the user databases, tests point it at
+// a temporary directory.
+var databaseDir = func() (string, error) {
+	homeDir, err := getHomeDir()
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return homeDir + "/.owl", nil
 }
 
-func createToolTables(db *sql.DB) {
-	createToolUseTableQuery := `
-		CREATE TABLE IF NOT EXISTS tool_use (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			history_id INTEGER,
-			tool_use_external_id TEXT,
-			name TEXT,
-			input TEXT,
-			caller_type TEXT DEFAULT 'assistant',
-			created INT,
-			FOREIGN KEY(history_id) REFERENCES history(id) ON DELETE CASCADE
-		)
-	`
-
-	_, err := db.Exec(createToolUseTableQuery)
+func (user User) dbPath() (string, error) {
+	dir, err := databaseDir()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("did not find home dir for db creation. %w", err)
 	}
 
-	createToolResultTableQuery := `
-		CREATE TABLE IF NOT EXISTS tool_result (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			tool_use_id INTEGER UNIQUE,
-			content TEXT,
-			success INTEGER DEFAULT 1,
-			created INT,
-			FOREIGN KEY(tool_use_id) REFERENCES tool_use(id) ON DELETE CASCADE
-		)
-	`
-
-	_, err = db.Exec(createToolResultTableQuery)
-	if err != nil {
-		panic(err)
-	}
+	return fmt.Sprintf("%s/%s.db", dir, *user.Name), nil
 }
 
-func (user User) ensureArchivedColumnsExist(db *sql.DB) {
-	// Add archived column to context if it doesn't exist
-	_, _ = db.Exec("ALTER TABLE context ADD COLUMN archived INTEGER DEFAULT 0")
-
-	// Add archived column to history if it doesn't exist
-	_, _ = db.Exec("ALTER TABLE history ADD COLUMN archived INTEGER DEFAULT 0")
-}
-
-func (user User) ensureTokenColumnsExist(db *sql.DB) {
-	_, _ = db.Exec("ALTER TABLE history ADD COLUMN prompt_tokens INTEGER DEFAULT 0")
-	_, _ = db.Exec("ALTER TABLE history ADD COLUMN completion_tokens INTEGER DEFAULT 0")
-	_, _ = db.Exec("ALTER TABLE history ADD COLUMN cache_read_tokens INTEGER DEFAULT 0")
-	_, _ = db.Exec("ALTER TABLE history ADD COLUMN cache_write_tokens INTEGER DEFAULT 0")
-}
-
-func (user User) ensureContextPreferenceColumnsExist(db *sql.DB) {
-	_, _ = db.Exec("ALTER TABLE context ADD COLUMN preferred_agent TEXT")
-	_, _ = db.Exec("ALTER TABLE context ADD COLUMN preferred_skills TEXT")
-}
-
-func (user User) ensureToolTablesExist(db *sql.DB) {
-	createToolTables(db)
-}
+// activeBranchQuery selects the ids of the active branch of a context, from
+// the active leaf up to the first row, with the distance to the leaf as depth.
+const activeBranchQuery = `WITH RECURSIVE branch(id, depth) AS (
+	SELECT active_leaf_id, 0 FROM context WHERE id = ? AND active_leaf_id > 0
+	UNION ALL
+	SELECT history.parent_id, branch.depth + 1 FROM history JOIN branch ON history.id = branch.id WHERE history.parent_id > 0
+)`
 
 func (user User) ArchiveContext(contextId int64, archived bool) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 	val := 0
 	if archived {
 		val = 1
 	}
-	_, err := db.Exec("UPDATE context SET archived = ? WHERE id = ?", val, contextId)
+	_, err = db.Exec("UPDATE context SET archived = ? WHERE id = ?", val, contextId)
 	return err
 }
 
 func (user User) ArchiveHistory(historyId int64, archived bool) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 	val := 0
 	if archived {
 		val = 1
 	}
-	_, err := db.Exec("UPDATE history SET archived = ? WHERE id = ?", val, historyId)
+	_, err = db.Exec("UPDATE history SET archived = ? WHERE id = ?", val, historyId)
 	return err
 }
 
 func (user User) InsertContext(context Context) (int64, error) {
-	db := user.getUserDb()
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
 
 	logger.Debug.Printf("inserting context %v, %v, %v", context.Name, user.Name, user.Id)
 
-	insertQuery := "INSERT INTO context (name, system_prompt, preferred_model, preferred_agent, preferred_skills) VALUES (?, ?, ?, ?, ?)"
-	result, err := db.Exec(insertQuery, context.Name, context.SystemPrompt, context.PreferredModel, context.PreferredAgent, context.PreferredSkills)
-	logger.Debug.Println("result of context insert", result)
-
-	defer db.Close()
+	contextId, err := insertContext(db, context)
 	if err != nil {
 		log.Println("insert of context failed", err)
 		return 0, err
 	}
 
-	contextId, err := result.LastInsertId()
+	return contextId, nil
+}
+
+// execer is what insertContext needs of a *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertContext(db execer, context Context) (int64, error) {
+	insertQuery := "INSERT INTO context (name, system_prompt, preferred_model, preferred_agent, preferred_skills, tags, folder, generation_settings, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	result, err := db.Exec(insertQuery, context.Name, context.SystemPrompt, context.PreferredModel, context.PreferredAgent, context.PreferredSkills, joinTags(context.Tags), NormalizeFolder(context.Folder), encodeGeneration(context.Generation), contextCreatedAt(context))
 	if err != nil {
-		log.Println("insert of context failed", err)
 		return 0, err
 	}
+	return result.LastInsertId()
+}
 
-	return contextId, nil
+// contextColumns are the columns scanContext reads, ending with the message
+// count and token total of the context.
+const contextColumns = "id, name, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived, COALESCE(active_leaf_id, 0), deleted_at, COALESCE(tags, ''), COALESCE(folder, ''), COALESCE(generation_settings, ''), created, last_used, (SELECT COUNT(*) FROM history WHERE history.context_id = context.id), (SELECT COALESCE(SUM(COALESCE(prompt_tokens, 0) + COALESCE(completion_tokens, 0) + COALESCE(cache_read_tokens, 0) + COALESCE(cache_write_tokens, 0)), 0) FROM history WHERE history.context_id = context.id)"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanContext(row rowScanner) (Context, error) {
+	var context Context
+	var archived int
+	var deletedAt, created, lastUsed sql.NullTime
+	var tags, generation string
+	err := row.Scan(&context.Id, &context.Name, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived, &context.ActiveLeafId, &deletedAt, &tags, &context.Folder, &generation, &created, &lastUsed, &context.MessageCount, &context.TotalTokens)
+	context.Archived = archived == 1
+	context.DeletedAt = deletedAt.Time
+	context.Created = created.Time
+	context.LastUsed = lastUsed.Time
+	context.Tags = splitTags(tags)
+	context.Generation = decodeGeneration(generation)
+	return context, err
 }
 
 func (user User) GetContextById(contextId int64) (Context, error) {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return Context{}, err
+	}
 
 	// When getting by ID, we unarchive it as it is being "used"
 	_, _ = db.Exec("UPDATE context SET archived = 0 WHERE id = ?", contextId)
 
-	selectQuery := "SELECT id, name, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context WHERE id = ?"
-	row := db.QueryRow(selectQuery, contextId)
-
-	var context Context
-	var archived int
-	err := row.Scan(&context.Id, &context.Name, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived)
-	context.Archived = archived == 1
+	context, err := scanContext(db.QueryRow("SELECT "+contextColumns+" FROM context WHERE id = ?", contextId))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// return context, fmt.Errorf("context with ID %d not found", contextId)
@@ -230,25 +158,78 @@ func (user User) GetContextById(contextId int64) (Context, error) {
 	return context, nil
 }
 
+func (user User) FindContext(contextId int64) (*Context, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	context, err := scanContext(db.QueryRow("SELECT "+contextColumns+" FROM context WHERE id = ? AND deleted_at IS NULL", contextId))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &context, nil
+}
+
 func (user User) InsertHistory(history History) (int64, error) {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
 
-	insertQuery := "INSERT INTO history (context_id, prompt, response, abreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, response_content, created, tool_results, model) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	result, err := tx.Exec(insertQuery, history.ContextId, history.Prompt, history.Response, history.Abbreviation, history.TokenCount, history.PromptTokens, history.CompletionTokens, history.CacheReadTokens, history.CacheWriteTokens, history.ResponseContent, time.Now(), history.ToolResults, history.Model)
+	// Without an explicit parent the row continues the active branch
+	parentId := history.ParentId
+	if parentId == 0 {
+		err = tx.QueryRow("SELECT COALESCE(active_leaf_id, 0) FROM context WHERE id = ?", history.ContextId).Scan(&parentId)
+		if err != nil && err != sql.ErrNoRows {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	historyId, err := insertHistory(tx, history, parentId)
 	if err != nil {
 		_ = tx.Rollback()
 		return 0, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return historyId, nil
+}
+
+// insertHistory stores a row below parentId with its tool uses and makes it
+// the active leaf of its context. The caller rolls tx back on an error.
+func insertHistory(tx *sql.Tx, history History, parentId int64) (int64, error) {
+	interrupted := 0
+	if history.Interrupted {
+		interrupted = 1
+	}
+
+	created := createdAt(history)
+	insertQuery := "INSERT INTO history (context_id, prompt, response, abreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, response_content, created, tool_results, model, interrupted, agent, parent_id, thinking, attachments) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.Exec(insertQuery, history.ContextId, history.Prompt, history.Response, history.Abbreviation, history.TokenCount, history.PromptTokens, history.CompletionTokens, history.CacheReadTokens, history.CacheWriteTokens, history.ResponseContent, created, history.ToolResults, history.Model, interrupted, history.Agent, parentId, encodeThinking(history.Thinking), encodeAttachments(history.Attachments))
+	if err != nil {
+		return 0, err
+	}
+
 	historyId, err := result.LastInsertId()
 	if err != nil {
-		_ = tx.Rollback()
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = ?, last_used = ? WHERE id = ?", historyId, created, history.ContextId); err != nil {
 		return 0, err
 	}
 
@@ -261,13 +242,11 @@ func (user User) InsertHistory(history History) (int64, error) {
 		toolUseInsertQuery := "INSERT INTO tool_use (history_id, tool_use_external_id, name, input, caller_type, created) VALUES (?, ?, ?, ?, ?, ?)"
 		toolUseResult, err := tx.Exec(toolUseInsertQuery, historyId, toolUse.Id, toolUse.Name, toolUse.Input, callerType, time.Now())
 		if err != nil {
-			_ = tx.Rollback()
 			return 0, err
 		}
 
 		toolUseId, err := toolUseResult.LastInsertId()
 		if err != nil {
-			_ = tx.Rollback()
 			return 0, err
 		}
 
@@ -279,43 +258,127 @@ func (user User) InsertHistory(history History) (int64, error) {
 		toolResultInsertQuery := "INSERT INTO tool_result (tool_use_id, content, success, created) VALUES (?, ?, ?, ?)"
 		_, err = tx.Exec(toolResultInsertQuery, toolUseId, toolUse.Result.Content, success, time.Now())
 		if err != nil {
-			_ = tx.Rollback()
 			return 0, err
 		}
 	}
 
+	return historyId, nil
+}
+
+// ImportContext stores a context with its history rows in one transaction,
+// nothing is stored when a row fails. Rows name their parent, and the
+// context its active leaf, by the Id of an earlier row in histories.
+func (user User) ImportContext(context Context, histories []History) (int64, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	contextId, err := insertContext(tx, context)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	activeLeafId, err := importHistories(contextId, context.ActiveLeafId, histories, func(history History, parentId int64) (int64, error) {
+		historyId, err := insertHistory(tx, history, parentId)
+		if err != nil || !history.Archived {
+			return historyId, err
+		}
+		_, err = tx.Exec("UPDATE history SET archived = 1 WHERE id = ?", historyId)
+		return historyId, err
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	archived := 0
+	if context.Archived {
+		archived = 1
+	}
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = ?, archived = ? WHERE id = ?", activeLeafId, archived, contextId); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		_ = tx.Rollback()
 		return 0, err
 	}
 
-	return historyId, nil
+	return contextId, nil
 }
 
 func (user User) GetHistoryByContextId(contextId int64, maxCount int) ([]History, error) {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
 
 	logger.Debug.Printf("Fetching history for contextId: %v, maxCount: %v", contextId, maxCount)
-	selectQuery := "SELECT id, context_id, prompt, response, response_content, abreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, created, tool_results, COALESCE(model, 'sonnet'), archived FROM history WHERE context_id = ? ORDER BY ID DESC LIMIT ?"
-	rows, err := db.Query(selectQuery, contextId, maxCount)
+	histories, err := queryHistories(db, activeBranchQuery+" SELECT "+historyColumns+" FROM history JOIN branch ON branch.id = history.id WHERE history.context_id = ? ORDER BY branch.depth ASC LIMIT ?", contextId, contextId, maxCount)
 	if err != nil {
 		logger.Debug.Printf("Error in sql %s", err)
 		return nil, err
 	}
 
+	for i, j := 0, len(histories)-1; i < j; i, j = i+1, j-1 {
+		histories[i], histories[j] = histories[j], histories[i]
+	}
+
+	return histories, nil
+}
+
+// GetContextHistory returns the history rows of every branch of a context,
+// oldest first.
+func (user User) GetContextHistory(contextId int64) ([]History, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	return queryHistories(db, "SELECT "+historyColumns+" FROM history WHERE history.context_id = ? ORDER BY history.id ASC", contextId)
+}
+
+// historyColumns are the columns queryHistories reads.
+const historyColumns = "history.id, history.context_id, prompt, response, response_content, abreviation, token_count, prompt_tokens, completion_tokens, cache_read_tokens, cache_write_tokens, created, tool_results, COALESCE(model, 'sonnet'), archived, COALESCE(interrupted, 0), COALESCE(agent, ''), COALESCE(parent_id, 0), COALESCE(thinking, ''), COALESCE(attachments, '')"
+
+// queryHistories reads the rows of a query on historyColumns with their tool
+// uses, in the order of the query.
+func queryHistories(db *sql.DB, query string, args ...any) ([]History, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	var histories []History
 	for rows.Next() {
 		var history History
 		var archived int
-		err := rows.Scan(&history.Id, &history.ContextId, &history.Prompt, &history.Response, &history.ResponseContent, &history.Abbreviation, &history.TokenCount, &history.PromptTokens, &history.CompletionTokens, &history.CacheReadTokens, &history.CacheWriteTokens, &history.Created, &history.ToolResults, &history.Model, &archived)
+		var interrupted int
+		var thinking string
+		var attachments string
+		err := rows.Scan(&history.Id, &history.ContextId, &history.Prompt, &history.Response, &history.ResponseContent, &history.Abbreviation, &history.TokenCount, &history.PromptTokens, &history.CompletionTokens, &history.CacheReadTokens, &history.CacheWriteTokens, &history.Created, &history.ToolResults, &history.Model, &archived, &interrupted, &history.Agent, &history.ParentId, &thinking, &attachments)
 		if err != nil {
 			return nil, err
 		}
+		history.Thinking = decodeThinking(thinking)
+		history.Attachments = decodeAttachments(attachments)
 		history.Archived = archived == 1
+		history.Interrupted = interrupted == 1
 		history.ToolUse = []ToolUse{}
 		histories = append(histories, history)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	historyIDs := make([]int64, 0, len(histories))
 	historyIdx := make(map[int64]int, len(histories))
@@ -362,45 +425,143 @@ func (user User) GetHistoryByContextId(contextId int64, maxCount int) ([]History
 		}
 	}
 
-	for i, j := 0, len(histories)-1; i < j; i, j = i+1, j-1 {
-		histories[i], histories[j] = histories[j], histories[i]
+	return histories, nil
+}
+
+// sqliteCreatedSince is the filter on history.created of the usage queries.
+// created is stored as text with the local offset, julianday compares it as
+// a point in time and matches the idx_history_created expression index.
+const sqliteCreatedSince = " WHERE julianday(h.created) >= julianday(?)"
+
+// GetUsage returns the token usage of every history row created at or after
+// since, oldest first.
+func (user User) GetUsage(since time.Time) ([]UsageRow, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	selectQuery := "SELECT h.id, h.context_id, COALESCE(c.name, ''), COALESCE(h.model, 'sonnet'), COALESCE(h.agent, ''), h.created, COALESCE(h.prompt_tokens, 0), COALESCE(h.completion_tokens, 0), COALESCE(h.cache_read_tokens, 0), COALESCE(h.cache_write_tokens, 0) FROM history h LEFT JOIN context c ON c.id = h.context_id"
+	args := []interface{}{}
+	if !since.IsZero() {
+		selectQuery += sqliteCreatedSince
+		args = append(args, since)
+	}
+	rows, err := db.Query(selectQuery+" ORDER BY h.id ASC", args...)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	if err := rows.Err(); err != nil {
+	var usage []UsageRow
+	for rows.Next() {
+		var row UsageRow
+		var created string
+		err := rows.Scan(&row.HistoryId, &row.ContextId, &row.ContextName, &row.Model, &row.Agent, &created, &row.PromptTokens, &row.CompletionTokens, &row.CacheReadTokens, &row.CacheWriteTokens)
+		if err != nil {
+			return nil, err
+		}
+		row.Created = ParseCreated(created)
+		usage = append(usage, row)
+	}
+
+	return usage, rows.Err()
+}
+
+// GetUsageTotals sums the token usage per model of the history rows created
+// at or after since.
+func (user User) GetUsageTotals(since time.Time) ([]UsageTotal, error) {
+	db, err := user.getUserDb()
+	if err != nil {
 		return nil, err
 	}
 
-	return histories, nil
+	selectQuery := "SELECT COALESCE(h.model, 'sonnet') AS model, COUNT(*), COALESCE(SUM(h.prompt_tokens), 0), COALESCE(SUM(h.completion_tokens), 0), COALESCE(SUM(h.cache_read_tokens), 0), COALESCE(SUM(h.cache_write_tokens), 0) FROM history h"
+	args := []interface{}{}
+	if !since.IsZero() {
+		selectQuery += sqliteCreatedSince
+		args = append(args, since)
+	}
+	rows, err := db.Query(selectQuery+" GROUP BY model ORDER BY model", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []UsageTotal
+	for rows.Next() {
+		var total UsageTotal
+		err := rows.Scan(&total.Model, &total.Messages, &total.PromptTokens, &total.CompletionTokens, &total.CacheReadTokens, &total.CacheWriteTokens)
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+
+	return totals, rows.Err()
 }
 
-func (user User) GetContextByName(name string) (*Context, error) {
-	db := user.getUserDb()
-	defer db.Close()
+func (user User) InsertSummary(summary Summary) (int64, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
 
-	// When getting by name, we unarchive it as it is being "used"
-	_, _ = db.Exec("UPDATE context SET archived = 0 WHERE name = ?", name)
+	insertQuery := "INSERT INTO history_summary (context_id, through_history_id, content, model, created) VALUES (?, ?, ?, ?, ?)"
+	result, err := db.Exec(insertQuery, summary.ContextId, summary.ThroughHistoryId, summary.Content, summary.Model, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
 
-	selectQuery := "SELECT id, name, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context WHERE name = ?"
-	row := db.QueryRow(selectQuery, name)
+// GetLatestSummary returns the summary covering the most history of the
+// active branch of a context, nil when there is none.
+func (user User) GetLatestSummary(contextId int64) (*Summary, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
 
-	var context Context
-	var archived int
-	err := row.Scan(&context.Id, &context.Name, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived)
-	context.Archived = archived == 1
+	var summary Summary
+	selectQuery := activeBranchQuery + " SELECT id, context_id, through_history_id, content, COALESCE(model, ''), created FROM history_summary WHERE context_id = ? AND through_history_id IN (SELECT id FROM branch) ORDER BY through_history_id DESC, id DESC LIMIT 1"
+	err = db.QueryRow(selectQuery, contextId, contextId).Scan(&summary.Id, &summary.ContextId, &summary.ThroughHistoryId, &summary.Content, &summary.Model, &summary.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+func (user User) GetContextByName(name string) (*Context, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	// When getting by name, we unarchive it as it is being "used"
+	_, _ = db.Exec("UPDATE context SET archived = 0 WHERE name = ? AND deleted_at IS NULL", name)
 
+	context, err := scanContext(db.QueryRow("SELECT "+contextColumns+" FROM context WHERE name = ? AND deleted_at IS NULL", name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &context, err
+	return &context, nil
 }
 
 func (user User) GetAllContexts() ([]Context, error) {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := db.Query("SELECT id, name, system_prompt, COALESCE(preferred_model, 'sonnet'), COALESCE(preferred_agent, ''), COALESCE(preferred_skills, ''), archived FROM context")
+	rows, err := db.Query("SELECT " + contextColumns + " FROM context WHERE deleted_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
@@ -408,13 +569,10 @@ func (user User) GetAllContexts() ([]Context, error) {
 
 	var contexts []Context
 	for rows.Next() {
-		var context Context
-		var archived int
-		err := rows.Scan(&context.Id, &context.Name, &context.SystemPrompt, &context.PreferredModel, &context.PreferredAgent, &context.PreferredSkills, &archived)
+		context, err := scanContext(rows)
 		if err != nil {
 			return nil, err
 		}
-		context.Archived = archived == 1
 		contexts = append(contexts, context)
 	}
 
@@ -426,62 +584,347 @@ func (user User) GetAllContexts() ([]Context, error) {
 	return contexts, nil
 }
 
+// DeleteContext moves the context to the trash, see PurgeTrash.
 func (user User) DeleteContext(contextId int64) (int64, error) {
-	db := user.getUserDb()
-	defer db.Close()
-
-	res, err := db.Exec("DELETE FROM context WHERE id = ?", contextId)
-	//TODO: should also delete all history connected to the context
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
 
+	res, err := db.Exec("UPDATE context SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now(), contextId)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
+// GetDeletedContexts returns the contexts in the trash, latest deleted first.
+func (user User) GetDeletedContexts() ([]Context, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT " + contextColumns + " FROM context WHERE deleted_at IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contexts := []Context{}
+	for rows.Next() {
+		context, err := scanContext(rows)
+		if err != nil {
+			return nil, err
+		}
+		contexts = append(contexts, context)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortTrash(contexts)
+	return contexts, nil
+}
+
+func (user User) RestoreContext(contextId int64) error {
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE context SET deleted_at = NULL WHERE id = ?", contextId)
+	return err
+}
+
+// PurgeContext deletes the context with its history, tool uses and results
+// and summaries.
+func (user User) PurgeContext(contextId int64) (int64, error) {
+	return user.purge(func([]Context) []int64 { return []int64{contextId} })
+}
+
+// PurgeTrash deletes the contexts that went into the trash before
+// deletedBefore, with their history, tool uses and results and summaries, in
+// one transaction. Rows left behind by contexts deleted before the trash
+// existed are removed too.
+func (user User) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	return user.purge(func(trash []Context) []int64 { return expiredContextIds(trash, deletedBefore) })
+}
+
+func (user User) purge(selectIds func(trash []Context) []int64) (int64, error) {
+	trash, err := user.GetDeletedContexts()
+	if err != nil {
+		return 0, err
+	}
+	contextIds := selectIds(trash)
+
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, contextId := range contextIds {
+		for _, statement := range []string{
+			"DELETE FROM tool_result WHERE tool_use_id IN (SELECT tool_use.id FROM tool_use JOIN history ON history.id = tool_use.history_id WHERE history.context_id = ?)",
+			"DELETE FROM tool_use WHERE history_id IN (SELECT id FROM history WHERE context_id = ?)",
+			"DELETE FROM history_summary WHERE context_id = ?",
+			"DELETE FROM history WHERE context_id = ?",
+		} {
+			if _, err := tx.Exec(statement, contextId); err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+		}
+		result, err := tx.Exec("DELETE FROM context WHERE id = ?", contextId)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		affected, _ := result.RowsAffected()
+		purged += affected
+	}
+
+	for _, statement := range []string{
+		"DELETE FROM history WHERE context_id NOT IN (SELECT id FROM context)",
+		"DELETE FROM history_summary WHERE context_id NOT IN (SELECT id FROM context)",
+		"DELETE FROM tool_use WHERE history_id NOT IN (SELECT id FROM history)",
+		"DELETE FROM tool_result WHERE tool_use_id NOT IN (SELECT id FROM tool_use)",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return purged, tx.Commit()
+}
+
 func (user User) DeleteHistory(historyId int64) (int64, error) {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return 0, err
+	}
 
-	res, err := db.Exec("DELETE FROM history WHERE id = ?", historyId)
+	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
+
+	// The children of a deleted row continue from its parent, so no branch
+	// loses the rows above it
+	var contextId, parentId int64
+	err = tx.QueryRow("SELECT context_id, COALESCE(parent_id, 0) FROM history WHERE id = ?", historyId).Scan(&contextId, &parentId)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return 0, nil
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE history SET parent_id = ? WHERE parent_id = ?", parentId, historyId); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE context SET active_leaf_id = ? WHERE id = ? AND active_leaf_id = ?", parentId, contextId, historyId); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	res, err := tx.Exec("DELETE FROM history WHERE id = ?", historyId)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
 	return res.RowsAffected()
 }
 
+// GetHistoryTree returns the parent of every history row of a context.
+func (user User) GetHistoryTree(contextId int64) (HistoryTree, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return HistoryTree{}, err
+	}
+
+	rows, err := db.Query("SELECT id, COALESCE(parent_id, 0) FROM history WHERE context_id = ?", contextId)
+	if err != nil {
+		return HistoryTree{}, err
+	}
+	defer rows.Close()
+
+	histories := []History{}
+	for rows.Next() {
+		var history History
+		if err := rows.Scan(&history.Id, &history.ParentId); err != nil {
+			return HistoryTree{}, err
+		}
+		histories = append(histories, history)
+	}
+	if err := rows.Err(); err != nil {
+		return HistoryTree{}, err
+	}
+	return NewHistoryTree(histories), nil
+}
+
+// UpdateActiveLeaf selects the branch that ends in historyId. 0 starts a new
+// branch from the beginning of the context.
+func (user User) UpdateActiveLeaf(contextId int64, historyId int64) error {
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE context SET active_leaf_id = ? WHERE id = ?", historyId, contextId)
+	return err
+}
+
 func (user User) UpdateSystemPrompt(contextId int64, systemPrompt string) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("setting system %s %d :::", systemPrompt, contextId)
 
-	_, err := db.Exec("UPDATE context SET system_prompt = ? WHERE id = ?",
+	_, err = db.Exec("UPDATE context SET system_prompt = ? WHERE id = ?",
 		systemPrompt, contextId)
 	return err
 }
 
 func (user User) UpdatePreferredModel(contextId int64, model string) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 
-	_, err := db.Exec("UPDATE context SET preferred_model = ? WHERE id = ?",
+	_, err = db.Exec("UPDATE context SET preferred_model = ? WHERE id = ?",
 		model, contextId)
 	return err
 }
 
 func (user User) UpdatePreferredAgent(contextId int64, agent string) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE context SET preferred_agent = ? WHERE id = ?", agent, contextId)
+	return err
+}
+
+// RenameContext fails with ErrContextNameTaken when another context outside
+// the trash has the name.
+func (user User) RenameContext(contextId int64, name string) error {
+	name, err := normalizeContextName(name)
+	if err != nil {
+		return err
+	}
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+
+	var taken int
+	err = db.QueryRow("SELECT COUNT(*) FROM context WHERE name = ? AND id != ? AND deleted_at IS NULL", name, contextId).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrContextNameTaken
+	}
+	_, err = db.Exec("UPDATE context SET name = ? WHERE id = ?", name, contextId)
+	return err
+}
+
+func (user User) UpdateTags(contextId int64, tags []string) error {
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE context SET tags = ? WHERE id = ?", joinTags(tags), contextId)
+	return err
+}
+
+func (user User) UpdateFolder(contextId int64, folder string) error {
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE context SET folder = ? WHERE id = ?", NormalizeFolder(folder), contextId)
+	return err
+}
+
+func (user User) UpdateGenerationSettings(contextId int64, settings GenerationSettings) error {
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 
-	_, err := db.Exec("UPDATE context SET preferred_agent = ? WHERE id = ?", agent, contextId)
+	_, err = db.Exec("UPDATE context SET generation_settings = ? WHERE id = ?", encodeGeneration(settings), contextId)
 	return err
 }
 
 func (user User) UpdatePreferredSkills(contextId int64, skills string) error {
-	db := user.getUserDb()
-	defer db.Close()
+	db, err := user.getUserDb()
+	if err != nil {
+		return err
+	}
 
-	_, err := db.Exec("UPDATE context SET preferred_skills = ? WHERE id = ?", skills, contextId)
+	_, err = db.Exec("UPDATE context SET preferred_skills = ? WHERE id = ?", skills, contextId)
 	return err
 }
+
+// SearchHistory ranks the history rows of every context whose prompt,
+// response or tool inputs and results contain all words of query, best
+// match first.
+func (user User) SearchHistory(query string, filters SearchFilters) ([]SearchResult, error) {
+	db, err := user.getUserDb()
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := ftsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// rank is bm25 with the column weights set in the migration, lower is better
+	selectQuery := "SELECT history.id, history.context_id, COALESCE(context.name, ''), history.created, snippet(history_fts, -1, '" + SnippetMark + "', '" + SnippetMark + "', '…', 16), history_fts.rank FROM history_fts JOIN history ON history.id = history_fts.rowid JOIN context ON context.id = history.context_id WHERE history_fts MATCH ? AND context.deleted_at IS NULL"
+	args := []any{match}
+	if filters.ContextId > 0 {
+		selectQuery += " AND history.context_id = ?"
+		args = append(args, filters.ContextId)
+	}
+	if !filters.Since.IsZero() {
+		selectQuery += " AND julianday(history.created) >= julianday(?)"
+		args = append(args, filters.Since)
+	}
+	selectQuery += " ORDER BY history_fts.rank, history.id DESC LIMIT ?"
+	args = append(args, filters.limit())
+
+	rows, err := db.Query(selectQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		var rank float64
+		if err := rows.Scan(&result.HistoryId, &result.ContextId, &result.ContextName, &result.Created, &result.Snippet, &rank); err != nil {
+			return nil, err
+		}
+		// Higher ranks are better matches, as with Postgres
+		result.Rank = -rank
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
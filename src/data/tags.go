@@ -0,0 +1,83 @@
+package data
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrEmptyContextName = errors.New("the context name is empty")
+	ErrContextNameTaken = errors.New("another context has that name")
+)
+
+// ParseTags splits tags separated by commas or spaces, as typed in the TUI
+// or on the command line.
+func ParseTags(text string) []string {
+	return NormalizeTags(strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}))
+}
+
+// NormalizeTags lowercases the tags, drops a leading # and empty or repeated
+// tags, and sorts them.
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		for _, part := range strings.Split(tag, ",") {
+			part = strings.ToLower(strings.TrimLeft(strings.TrimSpace(part), "#"))
+			part = strings.Join(strings.Fields(part), "-")
+			if part != "" && !slices.Contains(normalized, part) {
+				normalized = append(normalized, part)
+			}
+		}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
+
+// NormalizeFolder trims the slashes and spaces around the segments of a
+// folder path, "/ work / owl/" becomes "work/owl".
+func NormalizeFolder(folder string) string {
+	segments := []string{}
+	for _, segment := range strings.Split(folder, "/") {
+		if segment = strings.TrimSpace(segment); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func normalizeContextName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrEmptyContextName
+	}
+	return name, nil
+}
+
+// joinTags is the stored form of tags, splitTags reads it back.
+func joinTags(tags []string) string {
+	return strings.Join(NormalizeTags(tags), ",")
+}
+
+func splitTags(stored string) []string {
+	if stored == "" {
+		return []string{}
+	}
+	return NormalizeTags(strings.Split(stored, ","))
+}
+
+// HasTag reports whether the context is tagged with tag.
+func (context Context) HasTag(tag string) bool {
+	tags := NormalizeTags([]string{tag})
+	return len(tags) == 1 && slices.Contains(context.Tags, tags[0])
+}
+
+// InFolder reports whether the context is in folder or one of its
+// subfolders. Every context is in the empty folder.
+func (context Context) InFolder(folder string) bool {
+	folder = NormalizeFolder(folder)
+	return folder == "" || context.Folder == folder || strings.HasPrefix(context.Folder, folder+"/")
+}
@@ -0,0 +1,28 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseTags_NormalizesAndSorts(t *testing.T) {
+	tags := ParseTags("#Owl, review  owl,,Release")
+	if !slices.Equal(tags, []string{"owl", "release", "review"}) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	if tags := ParseTags("  "); len(tags) != 0 {
+		t.Fatalf("expected no tags, got %v", tags)
+	}
+}
+
+func TestInFolder_MatchesSubfolders(t *testing.T) {
+	context := Context{Folder: NormalizeFolder(" work / owl/ ")}
+	if context.Folder != "work/owl" {
+		t.Fatalf("unexpected folder %q", context.Folder)
+	}
+	for folder, expected := range map[string]bool{"": true, "work": true, "work/owl": true, "/work/owl/": true, "wo": false, "work/owl/tui": false} {
+		if context.InFolder(folder) != expected {
+			t.Fatalf("expected InFolder(%q) to be %v", folder, expected)
+		}
+	}
+}
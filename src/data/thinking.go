@@ -0,0 +1,51 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Thinking is a block of extended thinking that came before an answer. The
+// signature lets Claude verify the block when it is sent back. A redacted
+// block has no text, Redacted holds its encrypted data instead.
+type Thinking struct {
+	Text      string `json:"text,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Redacted  string `json:"redacted,omitempty"`
+}
+
+// ThinkingText joins the readable thinking of the blocks, skipping the
+// redacted ones.
+func ThinkingText(thinking []Thinking) string {
+	parts := []string{}
+	for _, block := range thinking {
+		if text := strings.TrimSpace(block.Text); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// encodeThinking is the stored form of the blocks, decodeThinking reads it
+// back. Rows without thinking store NULL.
+func encodeThinking(thinking []Thinking) any {
+	if len(thinking) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(thinking)
+	if err != nil {
+		return nil
+	}
+	return string(encoded)
+}
+
+func decodeThinking(stored string) []Thinking {
+	if stored == "" {
+		return nil
+	}
+	var thinking []Thinking
+	if err := json.Unmarshal([]byte(stored), &thinking); err != nil {
+		return nil
+	}
+	return thinking
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestThinkingText(t *testing.T) {
+	thinking := []Thinking{{Text: " first "}, {Redacted: "encrypted"}, {Text: "second"}}
+	if text := ThinkingText(thinking); text != "first\n\nsecond" {
+		t.Fatalf("expected the readable blocks, got %q", text)
+	}
+	if text := ThinkingText(nil); text != "" {
+		t.Fatalf("expected no text, got %q", text)
+	}
+}
+
+func TestEncodeThinking(t *testing.T) {
+	if stored := encodeThinking(nil); stored != nil {
+		t.Fatalf("expected NULL without thinking, got %v", stored)
+	}
+	thinking := []Thinking{{Text: "hmm", Signature: "sig"}}
+	stored, ok := encodeThinking(thinking).(string)
+	if !ok || !reflect.DeepEqual(decodeThinking(stored), thinking) {
+		t.Fatalf("expected the blocks back, got %v", stored)
+	}
+	if decoded := decodeThinking("not json"); decoded != nil {
+		t.Fatalf("expected no blocks from a broken column, got %+v", decoded)
+	}
+}
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultTrashRetention is how long a deleted context stays in the trash
+// before PurgeTrash removes it.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashRetention returns OWL_TRASH_RETENTION_DAYS as a duration, or
+// DefaultTrashRetention when it is not a number of days.
+func TrashRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("OWL_TRASH_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		return DefaultTrashRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// InTrash reports whether the context has been deleted.
+func (context Context) InTrash() bool {
+	return !context.DeletedAt.IsZero()
+}
+
+// sortTrash orders deleted contexts latest deleted first.
+func sortTrash(contexts []Context) {
+	sort.SliceStable(contexts, func(i, j int) bool {
+		return contexts[i].DeletedAt.After(contexts[j].DeletedAt)
+	})
+}
+
+func expiredContextIds(trash []Context, deletedBefore time.Time) []int64 {
+	ids := []int64{}
+	for _, context := range trash {
+		if context.InTrash() && context.DeletedAt.Before(deletedBefore) {
+			ids = append(ids, context.Id)
+		}
+	}
+	return ids
+}
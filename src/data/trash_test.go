@@ -0,0 +1,31 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrashRetention_ReadsDays(t *testing.T) {
+	t.Setenv("OWL_TRASH_RETENTION_DAYS", "7")
+	if retention := TrashRetention(); retention != 7*24*time.Hour {
+		t.Fatalf("expected 7 days, got %v", retention)
+	}
+	t.Setenv("OWL_TRASH_RETENTION_DAYS", "soon")
+	if retention := TrashRetention(); retention != DefaultTrashRetention {
+		t.Fatalf("expected the default retention, got %v", retention)
+	}
+}
+
+func TestExpiredContextIds_KeepsRecentlyDeleted(t *testing.T) {
+	now := time.Now()
+	trash := []Context{
+		{Id: 1, DeletedAt: now.Add(-40 * 24 * time.Hour)},
+		{Id: 2, DeletedAt: now.Add(-time.Hour)},
+		{Id: 3},
+	}
+	ids := expiredContextIds(trash, now.Add(-DefaultTrashRetention))
+	if !slices.Equal(ids, []int64{1}) {
+		t.Fatalf("expected only the old context to expire, got %v", ids)
+	}
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"strings"
+	"time"
+)
+
+// UsageRow is the token usage of one history row, used for cost reports.
+type UsageRow struct {
+	HistoryId        int64
+	ContextId        int64
+	ContextName      string
+	Model            string
+	Agent            string
+	Created          time.Time
+	PromptTokens     int
+	CompletionTokens int
+	CacheReadTokens  int
+	CacheWriteTokens int
+}
+
+// UsageTotal is the summed token usage of one model's history rows, used
+// where only the spend matters, such as the budget check.
+type UsageTotal struct {
+	Model            string
+	Messages         int
+	PromptTokens     int
+	CompletionTokens int
+	CacheReadTokens  int
+	CacheWriteTokens int
+}
+
+// createdFormats are the layouts created is stored in: the sqlite driver's
+// rendering of time.Now() and the postgres timestamp.
+var createdFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	time.RFC3339Nano,
+}
+
+// ParseCreated reads a History.Created value, the zero time when it is not
+// one of the known formats.
+func ParseCreated(created string) time.Time {
+	created = strings.TrimSpace(created)
+	for _, layout := range createdFormats {
+		if parsed, err := time.Parse(layout, created); err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// createdAt is the time a history row is stored with: its Created value when
+// it has one, as imported rows do, and now otherwise.
+func createdAt(history History) time.Time {
+	if created := ParseCreated(history.Created); !created.IsZero() {
+		return created
+	}
+	return time.Now()
+}
+
+// contextCreatedAt is the time a context is stored with, Created when it is
+// set, as for imported contexts, and now otherwise.
+func contextCreatedAt(context Context) time.Time {
+	if !context.Created.IsZero() {
+		return context.Created
+	}
+	return time.Now()
+}
@@ -1,6 +1,7 @@
 package embeddings
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -22,6 +23,9 @@ import (
 // chunk embedded+stored.
 // SearchQuery: if set, query will be embedded and used to FindMatches.
 // Prompt: used when generating a single embedding (no chunking).
+// Quiet: when true, search does not print the matches.
+// Repository: the repository of the user the embeddings belong to, used
+// instead of opening DBName. Each user has an embeddings store of their own.
 // NOTE: only one of (ChunkPath, SearchQuery, Prompt) should be used at a time.
 
 type Config struct {
@@ -32,6 +36,8 @@ type Config struct {
 	ChunkPath        string
 	SearchQuery      string
 	Prompt           string
+	Quiet            bool
+	Repository       data.HistoryRepository
 }
 
 func defaultedDBName() string {
@@ -50,6 +56,17 @@ func defaultedEmbeddingsDBName() string {
 	return db
 }
 
+// embeddingsDBNameFor is the embeddings store of a user. The default user
+// keeps the default store, every other user gets one named after them, so
+// users of owl -serve never search each other's history.
+func embeddingsDBNameFor(user string) string {
+	name := defaultedEmbeddingsDBName()
+	if user == "" || user == defaultedDBName() {
+		return name
+	}
+	return name + "_" + user
+}
+
 func storeForBackend(backend, embeddingsDB string) data.EmbeddingsStore {
 	switch backend {
 	// case "sqlite":
@@ -66,8 +83,18 @@ func Run(cfg Config) ([]data.EmbeddingMatch, error) {
 	if cfg.DBName == "" {
 		cfg.DBName = defaultedDBName()
 	}
+
+	user := cfg.Repository
+	if user == nil {
+		repository, err := data.NewHistoryRepository(cfg.DBName)
+		if err != nil {
+			return nil, err
+		}
+		user = repository
+	}
+	userName := data.RepositoryUserName(user)
 	if cfg.EmbeddingsDBName == "" {
-		cfg.EmbeddingsDBName = defaultedEmbeddingsDBName()
+		cfg.EmbeddingsDBName = embeddingsDBNameFor(userName)
 	}
 
 	store := storeForBackend("duckdb", cfg.EmbeddingsDBName)
@@ -78,7 +105,6 @@ func Run(cfg Config) ([]data.EmbeddingMatch, error) {
 		rh.Init()
 	}
 
-	user := data.User{Name: &cfg.DBName}
 	model := embeddings_model.OpenAiEmbeddingsModel{ResponseHandler: rh}
 
 	switch {
@@ -93,27 +119,43 @@ func Run(cfg Config) ([]data.EmbeddingMatch, error) {
 		rh.Reference = cfg.ChunkPath
 		for i, chunkStr := range chunks {
 			logger.Screen(fmt.Sprintf("Processing chunk %d/%d (size: %d chars)", i+1, len(chunks), len(chunkStr)), color.RGB(150, 150, 250))
-			services.AwaitedQuery(chunkStr, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings")
+			if err := services.AwaitedQuery(context.Background(), chunkStr, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings"); err != nil {
+				return nil, err
+			}
 		}
 		return nil, nil
 
 	case cfg.SearchQuery != "":
-		services.AwaitedQuery(cfg.SearchQuery, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings")
+		if err := services.AwaitedQuery(context.Background(), cfg.SearchQuery, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings"); err != nil {
+			return nil, err
+		}
 		embedding := <-rh.ResponseChannel
 
-		matches, err := store.FindMatches(embedding)
+		found, err := store.FindMatches(embedding)
 		if err != nil {
 			return nil, err
 		}
+		matches := []data.EmbeddingMatch{}
+		for _, match := range found {
+			if belongsTo(match, userName) {
+				matches = append(matches, match)
+			}
+		}
 
+		if cfg.Quiet {
+			return matches, nil
+		}
+		names := ContextNames(user)
 		for i, match := range matches {
 			logger.Screen(fmt.Sprintf("\n\nindex of match: %d, distance: %f", i, match.Distance), color.RGB(250, 250, 150))
-			logger.Screen(fmt.Sprintf("\nDistance: %f\nReference: %s\nText: %s\n", match.Distance, match.Reference, match.Text), color.RGB(150, 150, 150))
+			logger.Screen(fmt.Sprintf("\nDistance: %f\nReference: %s\nText: %s\n", match.Distance, describeReference(names, match.Reference), match.Text), color.RGB(150, 150, 150))
 		}
 		return matches, nil
 
 	case cfg.Prompt != "":
-		services.AwaitedQuery(cfg.Prompt, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings")
+		if err := services.AwaitedQuery(context.Background(), cfg.Prompt, &model, user, 0, nil, &commontypes.PayloadModifiers{}, "embeddings"); err != nil {
+			return nil, err
+		}
 		return nil, nil
 	default:
 		return nil, fmt.Errorf("no embeddings action specified")
@@ -0,0 +1,166 @@
+package embeddings
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"owl/data"
+	"owl/logger"
+	"owl/services"
+)
+
+// historyReferencePrefix marks the references of embedded history rows, as
+// opposed to the file paths of chunked documents.
+const historyReferencePrefix = "history:"
+
+// maxHistoryTextLength keeps the embedded text of a row well below the input
+// limit of the embeddings model.
+const maxHistoryTextLength = 24000
+
+// HistoryEnabled reports whether OWL_EMBED_HISTORY asks for every saved
+// history row to be embedded.
+func HistoryEnabled() bool {
+	switch strings.ToLower(os.Getenv("OWL_EMBED_HISTORY")) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// Saved history is embedded wherever it is saved, see services.SaveHistory,
+// into the store of the user whose repository saved it.
+func init() {
+	services.OnHistorySaved(func(historyRepository data.HistoryRepository, history data.History) {
+		if !HistoryEnabled() {
+			return
+		}
+		if err := EmbedHistory(historyRepository, history); err != nil {
+			logger.Debug.Printf("failed to embed history %d: %v", history.Id, err)
+		}
+	})
+}
+
+// HistoryReference is the reference stored with the embedding of a history
+// row. Context ids are only unique within the database of one user, so the
+// user is part of the reference.
+func HistoryReference(user string, contextId int64, historyId int64) string {
+	return fmt.Sprintf("%s%s/%d/%d", historyReferencePrefix, user, contextId, historyId)
+}
+
+// ParseHistoryReference returns the user, context and history id of a
+// reference made by HistoryReference. References stored before the user was
+// part of them have an empty user. ok is false for any other reference.
+func ParseHistoryReference(reference string) (user string, contextId int64, historyId int64, ok bool) {
+	rest, found := strings.CutPrefix(reference, historyReferencePrefix)
+	if !found {
+		return "", 0, 0, false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 {
+		return "", 0, 0, false
+	}
+	contextId, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	historyId, err = strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return strings.Join(parts[:len(parts)-2], "/"), contextId, historyId, true
+}
+
+// belongsTo reports whether a match may be shown to user: documents and the
+// history rows of that user. Rows embedded before references named their
+// user are only in the store of the default user.
+func belongsTo(match data.EmbeddingMatch, user string) bool {
+	owner, _, _, ok := ParseHistoryReference(match.Reference)
+	if !ok {
+		return true
+	}
+	if owner == "" {
+		return embeddingsDBNameFor(user) == defaultedEmbeddingsDBName()
+	}
+	return owner == user
+}
+
+// HistoryText is the text that is embedded for a history row.
+func HistoryText(history data.History) string {
+	var b strings.Builder
+	if prompt := strings.TrimSpace(history.Prompt); prompt != "" {
+		b.WriteString("Q: " + prompt + "\n\n")
+	}
+	if response := strings.TrimSpace(history.Response); response != "" {
+		b.WriteString("A: " + response)
+	}
+	text := strings.TrimSpace(b.String())
+	if len(text) > maxHistoryTextLength {
+		text = strings.ToValidUTF8(text[:maxHistoryTextLength], "")
+	}
+	return text
+}
+
+// EmbedHistory stores the embedding of a history row saved by
+// historyRepository in the store of its user, referencing the user, context
+// and id. Rows without text are skipped.
+func EmbedHistory(historyRepository data.HistoryRepository, history data.History) error {
+	text := HistoryText(history)
+	if text == "" {
+		return nil
+	}
+	_, err := Run(Config{
+		Repository: historyRepository,
+		Store:      true,
+		Prompt:     text,
+		Reference:  HistoryReference(data.RepositoryUserName(historyRepository), history.ContextId, history.Id),
+	})
+	return err
+}
+
+// SearchHistory returns the embedded history rows of the repository's user
+// closest to the query.
+func SearchHistory(historyRepository data.HistoryRepository, query string) ([]data.EmbeddingMatch, error) {
+	matches, err := Run(Config{Repository: historyRepository, SearchQuery: query, Quiet: true})
+	if err != nil {
+		return nil, err
+	}
+
+	historyMatches := []data.EmbeddingMatch{}
+	for _, match := range matches {
+		if _, _, _, ok := ParseHistoryReference(match.Reference); ok {
+			historyMatches = append(historyMatches, match)
+		}
+	}
+	return historyMatches, nil
+}
+
+// ContextNames maps the id of every context to its name. It reads the list
+// of contexts, so looking up names leaves archived contexts archived, which
+// GetContextById would not.
+func ContextNames(repository data.HistoryRepository) map[int64]string {
+	names := map[int64]string{}
+	contexts, err := repository.GetAllContexts()
+	if err != nil {
+		return names
+	}
+	for _, context := range contexts {
+		names[context.Id] = context.Name
+	}
+	return names
+}
+
+// describeReference names the context and message of a history reference and
+// leaves other references as they are.
+func describeReference(names map[int64]string, reference string) string {
+	_, contextId, historyId, ok := ParseHistoryReference(reference)
+	if !ok {
+		return reference
+	}
+	name := names[contextId]
+	if name == "" {
+		return fmt.Sprintf("context %d, message #%d", contextId, historyId)
+	}
+	return fmt.Sprintf("context %s, message #%d", name, historyId)
+}
@@ -0,0 +1,93 @@
+package embeddings
+
+import (
+	"owl/data"
+	"strings"
+	"testing"
+)
+
+func TestHistoryReferenceRoundTrips(t *testing.T) {
+	user, contextId, historyId, ok := ParseHistoryReference(HistoryReference("ada", 12, 345))
+	if !ok || user != "ada" || contextId != 12 || historyId != 345 {
+		t.Fatalf("expected ada/12/345, got %s/%d/%d (ok=%v)", user, contextId, historyId, ok)
+	}
+
+	user, contextId, historyId, ok = ParseHistoryReference("history:12/345")
+	if !ok || user != "" || contextId != 12 || historyId != 345 {
+		t.Fatalf("expected a reference without a user to be read, got %s/%d/%d (ok=%v)", user, contextId, historyId, ok)
+	}
+
+	if _, _, _, ok := ParseHistoryReference("/notes/retry.md"); ok {
+		t.Fatalf("a file path is not a history reference")
+	}
+}
+
+func TestEachUserHasAnEmbeddingsStore(t *testing.T) {
+	t.Setenv("OWL_LOCAL_DATABASE", "")
+	t.Setenv("OWL_LOCAL_EMBEDDINGS_DATABASE", "")
+
+	if name := embeddingsDBNameFor("owl"); name != "owl_embeddings" {
+		t.Fatalf("expected the default user to keep the default store, got %q", name)
+	}
+	if name := embeddingsDBNameFor("ada"); name != "owl_embeddings_ada" {
+		t.Fatalf("expected a store of the user, got %q", name)
+	}
+}
+
+func TestSearchKeepsOnlyTheHistoryOfTheUser(t *testing.T) {
+	t.Setenv("OWL_LOCAL_DATABASE", "")
+	t.Setenv("OWL_LOCAL_EMBEDDINGS_DATABASE", "")
+
+	own := data.EmbeddingMatch{Reference: HistoryReference("ada", 1, 2)}
+	other := data.EmbeddingMatch{Reference: HistoryReference("bob", 1, 2)}
+	legacy := data.EmbeddingMatch{Reference: "history:1/2"}
+	document := data.EmbeddingMatch{Reference: "/notes/retry.md"}
+
+	if !belongsTo(own, "ada") || belongsTo(other, "ada") || !belongsTo(document, "ada") {
+		t.Fatalf("expected ada to see her rows and documents only")
+	}
+	if belongsTo(legacy, "ada") || !belongsTo(legacy, "owl") {
+		t.Fatalf("expected rows without a user to be left to the default user")
+	}
+}
+
+func TestHistoryTextKeepsPromptAndResponseWithinTheLimit(t *testing.T) {
+	text := HistoryText(data.History{Prompt: " how? ", Response: strings.Repeat("å", maxHistoryTextLength)})
+	if !strings.HasPrefix(text, "Q: how?\n\nA: å") {
+		t.Fatalf("unexpected text start: %q", text[:20])
+	}
+	if len(text) > maxHistoryTextLength {
+		t.Fatalf("expected at most %d bytes, got %d", maxHistoryTextLength, len(text))
+	}
+	if !strings.HasSuffix(text, "å") {
+		t.Fatalf("expected the text to be cut on a rune boundary")
+	}
+
+	if HistoryText(data.History{Prompt: "  ", Response: ""}) != "" {
+		t.Fatalf("expected no text for an empty row")
+	}
+}
+
+type contextListRepository struct {
+	data.HistoryRepository
+	contexts []data.Context
+}
+
+func (r contextListRepository) GetAllContexts() ([]data.Context, error) {
+	return r.contexts, nil
+}
+
+func TestDescribeReferenceNamesTheContextFromTheList(t *testing.T) {
+	// GetContextById is not implemented, it would un-archive the context
+	names := ContextNames(contextListRepository{contexts: []data.Context{{Id: 4, Name: "archived work", Archived: true}}})
+
+	if got := describeReference(names, HistoryReference("owl", 4, 9)); got != "context archived work, message #9" {
+		t.Fatalf("unexpected description %q", got)
+	}
+	if got := describeReference(names, HistoryReference("owl", 5, 1)); got != "context 5, message #1" {
+		t.Fatalf("unexpected description %q", got)
+	}
+	if got := describeReference(names, "/notes/retry.md"); got != "/notes/retry.md" {
+		t.Fatalf("expected other references to be kept, got %q", got)
+	}
+}
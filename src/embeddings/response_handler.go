@@ -24,7 +24,7 @@ func (rh *ResponseHandler) Init() {
 
 func (rh *ResponseHandler) RecievedText(text string, useColor *string) {}
 
-func (rh *ResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
+func (rh *ResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	logger.Debug.Printf("\nFIND ME:embedding: %s\n", response)
 
 	if rh.Store {
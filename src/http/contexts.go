@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"owl/data"
+	"owl/logger"
+	picker "owl/picker"
+	"strconv"
+)
+
+type RenameContextRequest struct {
+	Name string `json:"name"`
+}
+
+type SetTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type SetFolderRequest struct {
+	Folder string `json:"folder"`
+}
+
+// handleSetGeneration replaces the generation settings of a context. It
+// answers 400 when they do not fit the preferred model of the context.
+func (server_data *server_data) handleSetGeneration(w http.ResponseWriter, r *http.Request) {
+	var req data.GenerationSettings
+	repository, contextId, ok := server_data.openContextUpdate(w, r, &req)
+	if !ok {
+		return
+	}
+
+	context, err := repository.FindContext(contextId)
+	if err != nil {
+		server_data.writeUpdatedContext(w, repository, contextId, err)
+		return
+	}
+	if context == nil {
+		http.Error(w, "context not found", http.StatusNotFound)
+		return
+	}
+	if err := picker.CheckGeneration(context.PreferredModel, req, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server_data.writeUpdatedContext(w, repository, contextId, repository.UpdateGenerationSettings(contextId, req))
+}
+
+// handleRenameContext answers 409 when another context has the name.
+func (server_data *server_data) handleRenameContext(w http.ResponseWriter, r *http.Request) {
+	var req RenameContextRequest
+	repository, contextId, ok := server_data.openContextUpdate(w, r, &req)
+	if !ok {
+		return
+	}
+
+	err := repository.RenameContext(contextId, req.Name)
+	if errors.Is(err, data.ErrEmptyContextName) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, data.ErrContextNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	server_data.writeUpdatedContext(w, repository, contextId, err)
+}
+
+// handleSetTags replaces the tags of a context.
+func (server_data *server_data) handleSetTags(w http.ResponseWriter, r *http.Request) {
+	var req SetTagsRequest
+	repository, contextId, ok := server_data.openContextUpdate(w, r, &req)
+	if !ok {
+		return
+	}
+	server_data.writeUpdatedContext(w, repository, contextId, repository.UpdateTags(contextId, req.Tags))
+}
+
+// handleSetFolder moves a context to a folder, an empty folder takes it out.
+func (server_data *server_data) handleSetFolder(w http.ResponseWriter, r *http.Request) {
+	var req SetFolderRequest
+	repository, contextId, ok := server_data.openContextUpdate(w, r, &req)
+	if !ok {
+		return
+	}
+	server_data.writeUpdatedContext(w, repository, contextId, repository.UpdateFolder(contextId, req.Folder))
+}
+
+// openContextUpdate authenticates a POST to /api/context/{id}/..., reads its
+// JSON body into req and opens the repository of the user.
+func (server_data *server_data) openContextUpdate(w http.ResponseWriter, r *http.Request, req any) (data.HistoryRepository, int64, bool) {
+	enableCors(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return nil, 0, false
+	} else if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+
+	username, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	contextId, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "the context id must be a number", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return nil, 0, false
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing JSON: %v", err), http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return nil, 0, false
+	}
+	return repository, contextId, true
+}
+
+// writeUpdatedContext answers with the context as it is stored after the
+// update, or with the error of the update. The context is read back without
+// taking it out of the archive, a missing or trashed one answers 404.
+func (server_data *server_data) writeUpdatedContext(w http.ResponseWriter, repository data.HistoryRepository, contextId int64, err error) {
+	if err != nil {
+		logger.Debug.Printf("error while updating context %d: %v", contextId, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	context, err := repository.FindContext(contextId)
+	if err != nil {
+		logger.Debug.Printf("error when fetching context %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if context == nil {
+		http.Error(w, "context not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(context)
+}
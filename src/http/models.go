@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"owl/logger"
+	picker "owl/picker"
+	"owl/registry"
+)
+
+type ModelsResponse struct {
+	Models    []registry.ModelSpec `json:"models"`
+	Fallbacks map[string][]string  `json:"fallbacks"`
+}
+
+// handleModels lists the model registry and the fallback chains, the names
+// accepted as "model" by the prompt and setmodel endpoints.
+func (server_data *server_data) handleModels(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := authenticate(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chains, err := picker.LoadFallbackChains()
+	if err != nil {
+		logger.Debug.Printf("could not read fallback chains: %v", err)
+		chains = map[string][]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ModelsResponse{
+		Models:    picker.LoadRegistry(),
+		Fallbacks: chains,
+	})
+}
+
+// checkModel rejects model names that are neither in the registry nor a
+// fallback chain. An empty name selects the context's preferred model.
+func checkModel(model *string) error {
+	if model == nil || *model == "" || picker.KnownModel(*model) {
+		return nil
+	}
+	return fmt.Errorf("unknown model %q, see /api/models", *model)
+}
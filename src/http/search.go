@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"owl/data"
+	"owl/logger"
+	"strconv"
+	"time"
+)
+
+type SearchResponse struct {
+	Results []data.SearchResult `json:"results"`
+}
+
+// handleSearch runs a full-text search over the history of the user.
+// q is the query; context_id, since (RFC 3339) and limit narrow it down.
+func (server_data *server_data) handleSearch(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	filters, err := searchFilters(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
+
+	results, err := repository.SearchHistory(query.Get("q"), filters)
+	if errors.Is(err, data.ErrEmptySearch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Debug.Printf("search failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SearchResponse{Results: results})
+}
+
+func searchFilters(query url.Values) (data.SearchFilters, error) {
+	filters := data.SearchFilters{}
+	if value := query.Get("context_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filters, errors.New("context_id must be a number")
+		}
+		filters.ContextId = id
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filters, errors.New("since must be an RFC 3339 time")
+		}
+		filters.Since = since
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return filters, errors.New("limit must be a positive number")
+		}
+		filters.Limit = limit
+	}
+	return filters, nil
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	commontypes "owl/common_types"
 	data "owl/data"
 	"owl/logger"
@@ -16,48 +20,119 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+type modelFactory func(requestedModel string, context *data.Context, responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, streamMode bool, thinkingMode bool, streamThinkingMode bool, outputThinkingMode bool) (commontypes.Model, string)
+
+// server_data only holds configuration. Repositories, response handlers and
+// models are built per request so concurrent users never share state.
 type server_data struct {
-	model               commontypes.Model
-	responseHandler     *HttpResponseHandler
-	streaming           bool
-	db_connectionString string
+	streaming     bool
+	newRepository func(username string) (data.HistoryRepository, error)
+	getModel      modelFactory
+}
+
+func newServerData(streaming bool) *server_data {
+	return &server_data{
+		streaming:     streaming,
+		newRepository: newUserRepository,
+		getModel:      picker.GetModelForQuery,
+	}
 }
 
-func Run(secure bool, port int, responseHandler *HttpResponseHandler, model commontypes.Model, streaming bool) {
+// newUserRepository returns the user's own SQLite database, or the shared
+// Postgres database when OWL_DATABASE_URL is set.
+func newUserRepository(username string) (data.HistoryRepository, error) {
+	if data.DatabaseUrl() != "" {
+		return data.NewHistoryRepository(username)
+	}
+	repository := &data.MultiUserContext{}
+	if err := repository.SetCurrentDb(username); err != nil {
+		return nil, err
+	}
+	return repository, nil
+}
 
-	server_data := server_data{
-		model:           model,
-		responseHandler: responseHandler,
-		streaming:       streaming,
+// openRepository answers with 500 when the user's database cannot be opened.
+func (server_data *server_data) openRepository(w http.ResponseWriter, username string) (data.HistoryRepository, bool) {
+	repository, err := server_data.newRepository(username)
+	if err != nil {
+		logger.Screen(fmt.Sprintf("\ncould not open the database of %s: %v", username, err), color.RGB(250, 150, 150))
+		http.Error(w, "could not open the database", http.StatusInternalServerError)
+		return nil, false
 	}
+	return repository, true
+}
+
+func (server_data *server_data) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server_data.handleRoot)
+	mux.HandleFunc("/api/prompt", server_data.handlePrompt)
+	mux.HandleFunc("/api/prompt/stream", server_data.handlePromptStream)
+	mux.HandleFunc("/api/login", server_data.handleLogin)
+	mux.HandleFunc("/api/context", server_data.handleContexts)
+	mux.HandleFunc("/api/context/{id}", server_data.handleContext)
+	mux.HandleFunc("/api/context/{id}/systemprompt", server_data.handleSetSystemPrompt)
+	mux.HandleFunc("/api/context/{id}/setmodel", server_data.handleSetModel)
+	mux.HandleFunc("/api/context/{id}/rename", server_data.handleRenameContext)
+	mux.HandleFunc("/api/context/{id}/tags", server_data.handleSetTags)
+	mux.HandleFunc("/api/context/{id}/folder", server_data.handleSetFolder)
+	mux.HandleFunc("/api/context/{id}/generation", server_data.handleSetGeneration)
+	mux.HandleFunc("/api/models", server_data.handleModels)
+	mux.HandleFunc("/api/search", server_data.handleSearch)
+	mux.HandleFunc("/status", server_data.handleStatus)
+	return mux
+}
+
+// shutdownTimeout is how long running requests get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func Run(secure bool, port int, streaming bool) {
+
+	server_data := newServerData(streaming)
 
 	log.Println("server running on port", port)
 
-	http.HandleFunc("/", server_data.handleRoot)
-	http.HandleFunc("/api/prompt", server_data.handlePrompt)
-	http.HandleFunc("/api/login", server_data.handleLogin)
-	http.HandleFunc("/api/context", server_data.handleContexts)
-	http.HandleFunc("/api/context/{id}", server_data.handleContext)
-	http.HandleFunc("/api/context/{id}/systemprompt", server_data.handleSetSystemPrompt)
-	http.HandleFunc("/api/context/{id}/setmodel", server_data.handleSetModel)
-	http.HandleFunc("/status", server_data.handleStatus)
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: server_data.routes(),
+	}
+
+	// ctrl+c or SIGTERM lets running requests finish before the databases close
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("server shutdown:", err)
+		}
+	}()
 
 	var err error
 	if secure {
-		err = http.ListenAndServeTLS(fmt.Sprintf(":%d", port), "cert.pem", "key.pem", nil)
+		err = httpServer.ListenAndServeTLS("cert.pem", "key.pem")
 	} else {
-		err = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+		err = httpServer.ListenAndServe()
 	}
 
-	if err != nil {
+	if errors.Is(err, http.ErrServerClosed) {
+		<-shutdownDone
+	} else if err != nil {
 		println(fmt.Sprintf("\nerr: %v", err))
 	}
+
+	if err := data.CloseUserDatabases(); err != nil {
+		log.Println("closing databases:", err)
+	}
 }
 
 type promptRequest struct {
@@ -66,6 +141,9 @@ type promptRequest struct {
 	ContextName  string  `json:"contextName"`
 	Web          bool    `json:"web"`
 	HistoryCount int     `json:"historyCount"`
+	// Schema is a JSON Schema the answer must match, the validated JSON is
+	// sent instead of the answer
+	Schema json.RawMessage `json:"schema"`
 }
 
 type PromptModifiers struct {
@@ -258,6 +336,9 @@ type ContextsResponse struct {
 	Contexts []data.Context `json:"contexts"`
 }
 
+// handleContexts lists the contexts of the user grouped by folder, or in the
+// order of the sort query parameter. The tag, folder, model and agent
+// parameters narrow the list, a folder includes its subfolders.
 func (server_data *server_data) handleContexts(w http.ResponseWriter, r *http.Request) {
 	enableCors(w)
 	logger.Screen("hit the handle contexts endpoint handler", color.RGB(150, 150, 150))
@@ -273,8 +354,10 @@ func (server_data *server_data) handleContexts(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	repository, _ := server_data.responseHandler.Repository.(*data.MultiUserContext)
-	repository.SetCurrentDb(username)
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
 
 	contexts, err := repository.GetAllContexts()
 	if err != nil {
@@ -282,6 +365,21 @@ func (server_data *server_data) handleContexts(w http.ResponseWriter, r *http.Re
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	query := r.URL.Query()
+	order := data.OrderFolder
+	if query.Get("sort") != "" {
+		if order, err = data.ParseContextOrder(query.Get("sort")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	contexts = data.FilterContexts(contexts, data.ContextFilter{
+		Tag:    query.Get("tag"),
+		Folder: query.Get("folder"),
+		Model:  query.Get("model"),
+		Agent:  query.Get("agent"),
+	})
+	data.SortContexts(contexts, order)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(ContextsResponse{
@@ -296,6 +394,8 @@ type ContextResponse struct {
 	History        []data.History `json:"history"`
 	SystemPrompt   string         `json:"systemPrompt"`
 	PreferredModel string         `json:"preferredModel"`
+	Tags           []string       `json:"tags"`
+	Folder         string         `json:"folder"`
 }
 
 type SetSystemPromptRequest struct {
@@ -322,8 +422,10 @@ func (server_data *server_data) handleSetModel(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	repository, _ := server_data.responseHandler.Repository.(*data.MultiUserContext)
-	repository.SetCurrentDb(username)
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
 
 	intId, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
@@ -338,6 +440,17 @@ func (server_data *server_data) handleSetModel(w http.ResponseWriter, r *http.Re
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := checkModel(&req.Model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The generation settings of the context have to fit the new model
+	if context, err := repository.FindContext(intId); err == nil && context != nil && req.Model != "" {
+		if err := picker.CheckModelSwitch(req.Model, context.Generation, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	err = repository.UpdatePreferredModel(intId, req.Model)
 	if err != nil {
@@ -370,8 +483,10 @@ func (server_data *server_data) handleSetSystemPrompt(w http.ResponseWriter, r *
 		return
 	}
 
-	repository, _ := server_data.responseHandler.Repository.(*data.MultiUserContext)
-	repository.SetCurrentDb(username)
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
 
 	intId, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
@@ -413,8 +528,10 @@ func (server_data *server_data) handleContext(w http.ResponseWriter, r *http.Req
 			return
 		}
 
-		repository, _ := server_data.responseHandler.Repository.(*data.MultiUserContext)
-		repository.SetCurrentDb(username)
+		repository, ok := server_data.openRepository(w, username)
+		if !ok {
+			return
+		}
 
 		intId, err := strconv.ParseInt(id, 10, 64)
 		if err != nil {
@@ -445,6 +562,8 @@ func (server_data *server_data) handleContext(w http.ResponseWriter, r *http.Req
 			Created:        context.Created,
 			History:        history,
 			PreferredModel: context.PreferredModel,
+			Tags:           context.Tags,
+			Folder:         context.Folder,
 		})
 		return
 
@@ -492,15 +611,86 @@ func (server_data *server_data) handlePrompt(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Bad input", http.StatusBadRequest)
 		return
 	}
-
-	repository, _ := server_data.responseHandler.Repository.(*data.MultiUserContext)
+	if err := checkModel(req.Model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schema, err := promptSchema(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	logger.Debug.Printf("Handling prompt request: %v", req)
 
-	repository.SetCurrentDb(username)
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
+	context := findOrCreateContext(repository, &req, username)
+
+	// The status is sent with the first chunk so a failed query can still
+	// answer with an error status.
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
 
-	logger.Screen(fmt.Sprintf("\nCurrent user in repository %v\n", repository.User), color.RGB(150, 150, 150))
+	responseHandler := &HttpResponseHandler{responseWriter: w, Repository: repository, structured: schema != nil}
 
+	modelToUse := ""
+	if req.Model != nil {
+		modelToUse = *req.Model
+	}
+	selectedModel, modelName := server_data.getModel(
+		modelToUse,
+		context,
+		responseHandler,
+		repository,
+		server_data.streaming,
+		true,
+		false,
+		false,
+	)
+
+	modifiers := promptModifiers(req)
+
+	if schema != nil {
+		modifiers.Schema = schema
+		result, err := services.StructuredQuery(r.Context(), req.Prompt, selectedModel, repository, req.HistoryCount, context, modifiers, modelName)
+		if err != nil {
+			responseHandler.writeError(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return
+	}
+
+	if server_data.streaming {
+		err = services.StreamedQuery(r.Context(), req.Prompt, selectedModel, repository, req.HistoryCount, context, modifiers, modelName)
+	} else {
+		err = services.AwaitedQuery(r.Context(), req.Prompt, selectedModel, repository, req.HistoryCount, context, modifiers, modelName)
+	}
+	if err != nil {
+		responseHandler.writeError(err)
+	}
+}
+
+// queryErrorStatus maps a failed query to the status the server answers with.
+func queryErrorStatus(err error) int {
+	if providerError, ok := commontypes.AsProviderError(err); ok {
+		return providerError.HTTPStatus()
+	}
+	var budgetError *services.BudgetExceededError
+	if errors.As(err, &budgetError) {
+		return http.StatusPaymentRequired
+	}
+	if errors.Is(err, services.ErrSchemaMismatch) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+func findOrCreateContext(repository data.HistoryRepository, req *promptRequest, username string) *data.Context {
 	if req.ContextName == "" {
 		req.ContextName = models.Name_new_context(req.Prompt, repository)
 	}
@@ -516,73 +706,80 @@ func (server_data *server_data) handlePrompt(w http.ResponseWriter, r *http.Requ
 		context = &new_context
 		context.Id = id
 	}
+	return context
+}
 
-	w.Header().Set("Connection", "Keep-Alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.WriteHeader(http.StatusOK)
-
-	server_data.responseHandler.SetResponseWriter(w)
-
-	modelToUse := ""
-	if req.Model != nil {
-		modelToUse = *req.Model
+// promptSchema reads the schema of a structured prompt, nil without one.
+func promptSchema(req promptRequest) (map[string]interface{}, error) {
+	if len(req.Schema) == 0 || string(req.Schema) == "null" {
+		return nil, nil
 	}
-	selectedModel, modelName := picker.GetModelForQuery(
-		modelToUse,
-		context,
-		server_data.responseHandler,
-		repository,
-		server_data.streaming,
-		true,
-		false,
-		false,
-	)
+	return services.ParseSchema(req.Schema)
+}
 
+func promptModifiers(req promptRequest) *commontypes.PayloadModifiers {
 	modifiers := &commontypes.PayloadModifiers{}
 	if req.Web {
 		logger.Screen("Adding web to modifiers", color.RGB(150, 150, 150))
 		modifiers.Web = true
 	}
-
-	if server_data.streaming {
-		services.StreamedQuery(req.Prompt, selectedModel, server_data.responseHandler.Repository, req.HistoryCount, context, modifiers, modelName)
-	} else {
-		services.AwaitedQuery(req.Prompt, selectedModel, server_data.responseHandler.Repository, req.HistoryCount, context, modifiers, modelName)
-	}
+	return modifiers
 }
 
 type HttpResponseHandler struct {
 	responseWriter http.ResponseWriter
 	Repository     data.HistoryRepository
-}
-
-func (httpResponseHandler *HttpResponseHandler) SetResponseWriter(writer http.ResponseWriter) {
-	httpResponseHandler.responseWriter = writer
+	wroteBody      bool
+	// structured keeps the answer out of the body, the validated JSON of a
+	// prompt with a schema is written instead
+	structured bool
 }
 
 func (httpResponseHandler *HttpResponseHandler) RecievedText(text string, useColor *string) {
+	if httpResponseHandler.structured {
+		return
+	}
+	httpResponseHandler.wroteBody = true
 	fmt.Fprint(httpResponseHandler.responseWriter, text)
 	httpResponseHandler.responseWriter.(http.Flusher).Flush()
 }
 
-func (httpResponseHandler *HttpResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
-	repository, ok := httpResponseHandler.Repository.(*data.MultiUserContext)
-
+func (httpResponseHandler *HttpResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	logger.Screen(fmt.Sprintf("final text: %s", response), color.RGB(150, 150, 150))
 
-	if !ok {
-		log.Panic("This needs to be called with a repository that supplies user")
+	saveHistory(httpResponseHandler.Repository, contextId, prompt, response, toolUse, modelName, usage, thinking, attachments)
+	if httpResponseHandler.structured {
+		return
 	}
+	httpResponseHandler.wroteBody = true
+	fmt.Fprint(httpResponseHandler.responseWriter, response)
+}
 
+// writeError answers with the status of a failed query. Once part of the
+// answer has been sent the status is already out, so the error is only logged.
+func (httpResponseHandler *HttpResponseHandler) writeError(err error) {
+	logger.Screen(fmt.Sprintf("\nprompt failed: %v\n", err), color.RGB(250, 150, 150))
+	if errors.Is(err, context.Canceled) || httpResponseHandler.wroteBody {
+		return
+	}
+	http.Error(httpResponseHandler.responseWriter, services.DescribeError(err), queryErrorStatus(err))
+}
+
+func saveHistory(repository data.HistoryRepository, contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	history := data.History{
 		ContextId:    contextId,
 		Prompt:       prompt,
 		Response:     response,
 		Abbreviation: "",
 		TokenCount:   0,
-		UserId:       int64(repository.User.Id),
 		Model:        modelName,
 		ToolUse:      toolUse,
+		Thinking:     thinking,
+		Attachments:  attachments,
+	}
+
+	if multiUserRepository, ok := repository.(*data.MultiUserContext); ok {
+		history.UserId = int64(multiUserRepository.User.Id)
 	}
 
 	if usage != nil {
@@ -592,11 +789,10 @@ func (httpResponseHandler *HttpResponseHandler) FinalText(contextId int64, promp
 		history.CacheWriteTokens = usage.CacheWriteTokens
 	}
 
-	_, err := httpResponseHandler.Repository.InsertHistory(history)
+	_, err := services.SaveHistory(repository, history)
 	if err != nil {
 		println(fmt.Sprintf("Error while trying to save history: %s", err))
 	}
-	fmt.Fprint(httpResponseHandler.responseWriter, response)
 }
 
 func (server_data *server_data) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -606,5 +802,5 @@ func (server_data *server_data) handleStatus(w http.ResponseWriter, r *http.Requ
 }
 
 func (server_data *server_data) handleRoot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "%v", server_data.model)
+	fmt.Fprintf(w, "owl server, streaming: %v", server_data.streaming)
 }
@@ -0,0 +1,677 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/logger"
+	"owl/services"
+	testhelpers "owl/test_helpers"
+	"owl/tools"
+)
+
+func ensureTestLogger() {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+}
+
+type fakeLLMRequest struct {
+	Prompt string `json:"prompt"`
+	Stream bool   `json:"stream"`
+}
+
+type fakeLLMResponse struct {
+	Text string `json:"text"`
+}
+
+// newFakeLLMBackend answers every prompt with an echo after a short delay so
+// concurrent requests overlap while they are in flight.
+func newFakeLLMBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req fakeLLMRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		if req.Stream {
+			fmt.Fprintf(w, "thinking:pondering\n")
+			fmt.Fprintf(w, "tool:lookup\n")
+			fmt.Fprintf(w, "text:echo: %s\n", req.Prompt)
+			fmt.Fprintf(w, "done\n")
+			return
+		}
+		json.NewEncoder(w).Encode(fakeLLMResponse{Text: "echo: " + req.Prompt})
+	}))
+}
+
+type fakeModel struct {
+	backendURL      string
+	responseHandler commontypes.ResponseHandler
+	context         *data.Context
+	prompt          string
+	answer          string
+	toolUses        []data.ToolUse
+}
+
+func (m *fakeModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	m.context = context
+	m.prompt = prompt
+	body, _ := json.Marshal(fakeLLMRequest{Prompt: prompt, Stream: streaming})
+	req, _ := http.NewRequestWithContext(ctx, "POST", m.backendURL, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (m *fakeModel) HandleStreamedLine(line []byte) {
+	text := strings.TrimSuffix(string(line), "\n")
+	if thought, ok := strings.CutPrefix(text, "thinking:"); ok {
+		commontypes.SendThinking(m.responseHandler, thought)
+	} else if name, ok := strings.CutPrefix(text, "tool:"); ok {
+		call := data.ToolUse{Id: "tool-1", Name: name, Input: `{"value":"owl"}`, CallerType: "assistant"}
+		runner := tools.ToolRunner{ResponseHandler: &m.responseHandler, Context: m.context}
+		result, err := runner.ExecuteTool(*m.context, call, map[string]string{"value": "owl"})
+		call.Result = data.ToolResult{ToolUseId: call.Id, Content: result, Success: err == nil}
+		m.toolUses = append(m.toolUses, call)
+	} else if answer, ok := strings.CutPrefix(text, "text:"); ok {
+		m.answer += answer
+		m.responseHandler.RecievedText(answer, nil)
+	} else if text == "done" {
+		usage := &commontypes.TokenUsage{PromptTokens: 3, CompletionTokens: 5}
+		m.responseHandler.FinalText(m.context.Id, m.prompt, m.answer, m.toolUses, "fake", usage, nil, nil)
+	}
+}
+
+func (m *fakeModel) HandleBodyBytes(body []byte) {
+	var resp fakeLLMResponse
+	json.Unmarshal(body, &resp)
+	m.responseHandler.FinalText(m.context.Id, m.prompt, resp.Text, nil, "fake", nil, nil, nil)
+}
+
+func (m *fakeModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
+	m.responseHandler = responseHandler
+}
+
+func TestHandlePromptConcurrentUsers(t *testing.T) {
+	ensureTestLogger()
+	backend := newFakeLLMBackend(t)
+	defer backend.Close()
+
+	const userCount = 8
+	repositories := map[string]*testhelpers.MockHistoryRepository{}
+	for i := 0; i < userCount; i++ {
+		repositories[fmt.Sprintf("user-%d", i)] = testhelpers.NewMockHistoryRepository()
+	}
+
+	var handlersMu sync.Mutex
+	handlers := map[commontypes.ResponseHandler]bool{}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repositories[username], nil
+	}
+	server_data.getModel = func(requestedModel string, context *data.Context, responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, streamMode bool, thinkingMode bool, streamThinkingMode bool, outputThinkingMode bool) (commontypes.Model, string) {
+		handlersMu.Lock()
+		handlers[responseHandler] = true
+		handlersMu.Unlock()
+		return &fakeModel{backendURL: backend.URL, responseHandler: responseHandler}, "fake"
+	}
+
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, userCount)
+	for i := 0; i < userCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("user-%d", i)
+			prompt := fmt.Sprintf("prompt from %s", username)
+
+			token, err := CreateToken(username)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			body, _ := json.Marshal(map[string]string{"prompt": prompt, "contextName": "shared-name"})
+			req, _ := http.NewRequest("POST", srv.URL+"/api/prompt", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			answer, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != http.StatusOK {
+				errs <- fmt.Errorf("%s: unexpected status %d", username, resp.StatusCode)
+				return
+			}
+			if strings.TrimSpace(string(answer)) != "echo: "+prompt {
+				errs <- fmt.Errorf("%s: got answer %q", username, answer)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(handlers) != userCount {
+		t.Fatalf("expected %d distinct response handlers, got %d", userCount, len(handlers))
+	}
+
+	for username, repository := range repositories {
+		history, _ := repository.GetHistoryByContextId(0, 10)
+		if len(history) != 1 {
+			t.Fatalf("%s: expected 1 history row, got %d", username, len(history))
+		}
+		expected := fmt.Sprintf("prompt from %s", username)
+		if history[0].Prompt != expected || history[0].Response != "echo: "+expected {
+			t.Fatalf("%s: history leaked between users: %+v", username, history[0])
+		}
+	}
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+func parseSseEvents(body string) []sseEvent {
+	events := []sseEvent{}
+	for _, block := range strings.Split(body, "\n\n") {
+		event := sseEvent{}
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.name = name
+			} else if payload, ok := strings.CutPrefix(line, "data: "); ok {
+				event.data = payload
+			}
+		}
+		if event.name != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestHandlePromptStreamSendsTypedEvents(t *testing.T) {
+	ensureTestLogger()
+	testhelpers.NewDummyTool("lookup").Register()
+	backend := newFakeLLMBackend(t)
+	defer backend.Close()
+
+	repository := testhelpers.NewMockHistoryRepository()
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	server_data.getModel = func(requestedModel string, context *data.Context, responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, streamMode bool, thinkingMode bool, streamThinkingMode bool, outputThinkingMode bool) (commontypes.Model, string) {
+		if !streamMode {
+			t.Errorf("expected the stream endpoint to request a streaming model")
+		}
+		return &fakeModel{backendURL: backend.URL, responseHandler: responseHandler}, "fake"
+	}
+
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("streamer")
+	body, _ := json.Marshal(map[string]string{"prompt": "hello", "contextName": "sse"})
+	req, _ := http.NewRequest("POST", srv.URL+"/api/prompt/stream", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	raw, _ := io.ReadAll(resp.Body)
+	events := parseSseEvents(string(raw))
+
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.name)
+	}
+	// The tool events come while the turn runs, not again with FinalText
+	expected := []string{"thinking", "tool_call", "tool_result", "text", "usage", "done"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, got %v", expected, names)
+	}
+
+	var result sseToolResultEvent
+	json.Unmarshal([]byte(events[2].data), &result)
+	if result.ToolUseId != "tool-1" || result.Content != "DUMMY_OK:owl" || !result.Success {
+		t.Fatalf("unexpected tool result event %q", events[2].data)
+	}
+
+	var text sseTextEvent
+	json.Unmarshal([]byte(events[3].data), &text)
+	if text.Text != "echo: hello" {
+		t.Fatalf("unexpected text event %q", events[3].data)
+	}
+
+	var usage sseUsageEvent
+	json.Unmarshal([]byte(events[4].data), &usage)
+	if usage.Model != "fake" || usage.PromptTokens != 3 || usage.CompletionTokens != 5 {
+		t.Fatalf("unexpected usage event %q", events[4].data)
+	}
+
+	history, _ := repository.GetHistoryByContextId(0, 10)
+	if len(history) != 1 || history[0].Response != "echo: hello" {
+		t.Fatalf("expected streamed answer to be persisted, got %+v", history)
+	}
+}
+
+func TestPromptEndpointsReportProviderErrors(t *testing.T) {
+	ensureTestLogger()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(529)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	}))
+	defer backend.Close()
+
+	services.SetRetryPolicy(services.RetryPolicy{MaxAttempts: 1})
+	defer services.SetRetryPolicy(services.DefaultRetryPolicy)
+
+	repository := testhelpers.NewMockHistoryRepository()
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	server_data.getModel = func(requestedModel string, context *data.Context, responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, streamMode bool, thinkingMode bool, streamThinkingMode bool, outputThinkingMode bool) (commontypes.Model, string) {
+		return &fakeModel{backendURL: backend.URL, responseHandler: responseHandler}, "fake"
+	}
+
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("unlucky")
+	post := func(path string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"prompt": "hello", "contextName": "errors"})
+		req, _ := http.NewRequest("POST", srv.URL+path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	resp := post("/api/prompt")
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", resp.StatusCode, answer)
+	}
+	if !strings.Contains(string(answer), "provider overloaded") {
+		t.Fatalf("expected a readable error, got %q", answer)
+	}
+
+	resp = post("/api/prompt/stream")
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	events := parseSseEvents(string(raw))
+	if len(events) != 1 || events[0].name != "error" {
+		t.Fatalf("expected a single error event, got %+v", events)
+	}
+	var errorEvent sseErrorEvent
+	json.Unmarshal([]byte(events[0].data), &errorEvent)
+	if errorEvent.Kind != "overloaded" || errorEvent.Status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected error event %q", events[0].data)
+	}
+
+	history, _ := repository.GetHistoryByContextId(0, 10)
+	if len(history) != 0 {
+		t.Fatalf("expected no history for failed prompts, got %+v", history)
+	}
+}
+
+func TestPromptWithSchemaAnswersTheValidatedJSON(t *testing.T) {
+	ensureTestLogger()
+	answers := []string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer := answers[0]
+		answers = answers[1:]
+		json.NewEncoder(w).Encode(fakeLLMResponse{Text: answer})
+	}))
+	defer backend.Close()
+
+	repository := testhelpers.NewMockHistoryRepository()
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	server_data.getModel = func(requestedModel string, context *data.Context, responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, streamMode bool, thinkingMode bool, streamThinkingMode bool, outputThinkingMode bool) (commontypes.Model, string) {
+		return &fakeModel{backendURL: backend.URL, responseHandler: responseHandler}, "fake"
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("scripter")
+	post := func(path string) *http.Response {
+		body := `{"prompt":"name it","contextName":"structured","schema":{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}}`
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	answers = []string{"a name", `{"name": "owl"}`}
+	resp := post("/api/prompt")
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" || string(answer) != `{"name":"owl"}` {
+		t.Fatalf("expected the repaired JSON, got %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), answer)
+	}
+
+	answers = []string{"{}", "{}"}
+	resp = post("/api/prompt")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for an answer that stays invalid, got %d", resp.StatusCode)
+	}
+
+	resp = post("/api/prompt/stream")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a schema on the stream endpoint, got %d", resp.StatusCode)
+	}
+}
+
+func TestModelsEndpointListsRegistryAndRejectsUnknownModels(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return testhelpers.NewMockHistoryRepository(), nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("picky")
+	req, _ := http.NewRequest("GET", srv.URL+"/api/models", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var models ModelsResponse
+	json.NewDecoder(resp.Body).Decode(&models)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(models.Models) == 0 {
+		t.Fatalf("expected the model registry, got %d %+v", resp.StatusCode, models)
+	}
+
+	body, _ := json.Marshal(map[string]string{"prompt": "hello", "contextName": "picky", "model": "carrier-pigeon"})
+	req, _ = http.NewRequest("POST", srv.URL+"/api/prompt", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(answer), "unknown model") {
+		t.Fatalf("expected 400 for an unknown model, got %d: %s", resp.StatusCode, answer)
+	}
+}
+
+func TestSearchEndpointReturnsMatchesOfTheUser(t *testing.T) {
+	ensureTestLogger()
+
+	repository := testhelpers.NewMockHistoryRepository()
+	repository.Contexts[1] = data.Context{Id: 1, Name: "migrations"}
+	repository.Histories[1] = []data.History{{Id: 7, ContextId: 1, Prompt: "write the migration script"}, {Id: 8, ContextId: 1, Prompt: "thanks"}}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("searcher")
+	search := func(query string) (*http.Response, SearchResponse) {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/search?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body SearchResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp, body
+	}
+
+	resp, body := search("q=migration&context_id=1")
+	if resp.StatusCode != http.StatusOK || len(body.Results) != 1 || body.Results[0].HistoryId != 7 || body.Results[0].ContextName != "migrations" {
+		t.Fatalf("expected the migration message, got %d %+v", resp.StatusCode, body)
+	}
+
+	if resp, _ := search("q=migration&limit=none"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad limit, got %d", resp.StatusCode)
+	}
+}
+
+func TestContextEndpointsRenameTagAndFilter(t *testing.T) {
+	ensureTestLogger()
+
+	repository := testhelpers.NewMockHistoryRepository()
+	repository.Contexts[1] = data.Context{Id: 1, Name: "release"}
+	repository.Contexts[2] = data.Context{Id: 2, Name: "lunch"}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("organizer")
+	post := func(path string, body any) (*http.Response, data.Context) {
+		encoded, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", srv.URL+path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var context data.Context
+		json.NewDecoder(resp.Body).Decode(&context)
+		return resp, context
+	}
+
+	if resp, context := post("/api/context/1/rename", RenameContextRequest{Name: "release 2.0"}); resp.StatusCode != http.StatusOK || context.Name != "release 2.0" {
+		t.Fatalf("expected the renamed context, got %d %+v", resp.StatusCode, context)
+	}
+	if resp, _ := post("/api/context/1/rename", RenameContextRequest{Name: "lunch"}); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a taken name, got %d", resp.StatusCode)
+	}
+	if resp, context := post("/api/context/1/tags", SetTagsRequest{Tags: []string{"#Owl", "release"}}); resp.StatusCode != http.StatusOK || strings.Join(context.Tags, ",") != "owl,release" {
+		t.Fatalf("expected the tags, got %d %+v", resp.StatusCode, context)
+	}
+	if resp, context := post("/api/context/1/folder", SetFolderRequest{Folder: "/work/owl/"}); resp.StatusCode != http.StatusOK || context.Folder != "work/owl" {
+		t.Fatalf("expected the folder, got %d %+v", resp.StatusCode, context)
+	}
+
+	for _, query := range []string{"tag=owl", "folder=work", "tag=owl&folder=work/owl"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/context?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var body ContextsResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if len(body.Contexts) != 1 || body.Contexts[0].Id != 1 {
+			t.Fatalf("expected only the tagged context for %s, got %+v", query, body.Contexts)
+		}
+	}
+}
+
+func TestContextUpdatesAnswer404ForMissingAndTrashedContexts(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+
+	repository := testhelpers.NewMockHistoryRepository()
+	repository.Contexts[1] = data.Context{Id: 1, Name: "archived", Archived: true}
+	repository.Contexts[2] = data.Context{Id: 2, Name: "trashed", DeletedAt: time.Now()}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("archivist")
+	post := func(path string, body any) (*http.Response, data.Context) {
+		encoded, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", srv.URL+path, bytes.NewBuffer(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var context data.Context
+		json.NewDecoder(resp.Body).Decode(&context)
+		return resp, context
+	}
+
+	if resp, context := post("/api/context/1/tags", SetTagsRequest{Tags: []string{"old"}}); resp.StatusCode != http.StatusOK || !context.Archived {
+		t.Fatalf("expected the tagged context to stay archived, got %d %+v", resp.StatusCode, context)
+	}
+	for _, id := range []int{2, 999} {
+		if resp, _ := post(fmt.Sprintf("/api/context/%d/folder", id), SetFolderRequest{Folder: "work"}); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for context %d, got %d", id, resp.StatusCode)
+		}
+		if resp, _ := post(fmt.Sprintf("/api/context/%d/generation", id), data.GenerationSettings{MaxTokens: 4000}); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404 for the settings of context %d, got %d", id, resp.StatusCode)
+		}
+	}
+}
+
+func TestGenerationEndpointChecksTheModelOfTheContext(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+
+	repository := testhelpers.NewMockHistoryRepository()
+	repository.Contexts[1] = data.Context{Id: 1, Name: "sampling", PreferredModel: "gpt"}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("organizer")
+	post := func(path string, body string) *http.Response {
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	resp := post("/api/context/1/generation", `{"max_tokens":4000,"temperature":1.5}`)
+	var context data.Context
+	json.NewDecoder(resp.Body).Decode(&context)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || context.Generation.MaxTokens != 4000 || context.Generation.Temperature == nil || *context.Generation.Temperature != 1.5 {
+		t.Fatalf("expected the stored settings, got %d %+v", resp.StatusCode, context.Generation)
+	}
+
+	if resp := post("/api/context/1/generation", `{"thinking_budget":2048}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a thinking budget on gpt, got %d", resp.StatusCode)
+	}
+	if resp := post("/api/context/1/setmodel", `{"model":"sonnet"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a model the temperature does not fit, got %d", resp.StatusCode)
+	}
+	if repository.Contexts[1].PreferredModel != "gpt" {
+		t.Fatalf("expected the model to stay, got %q", repository.Contexts[1].PreferredModel)
+	}
+}
+
+func TestContextsEndpointSortsAndFiltersByModel(t *testing.T) {
+	ensureTestLogger()
+
+	repository := testhelpers.NewMockHistoryRepository()
+	repository.Contexts[1] = data.Context{Id: 1, Name: "small", PreferredModel: "opus", TotalTokens: 10}
+	repository.Contexts[2] = data.Context{Id: 2, Name: "large", PreferredModel: "opus", TotalTokens: 900}
+	repository.Contexts[3] = data.Context{Id: 3, Name: "other", PreferredModel: "sonnet", TotalTokens: 5000}
+
+	server_data := newServerData(false)
+	server_data.newRepository = func(username string) (data.HistoryRepository, error) {
+		return repository, nil
+	}
+	srv := httptest.NewServer(server_data.routes())
+	defer srv.Close()
+
+	token, _ := CreateToken("sorter")
+	list := func(query string) (int, []data.Context) {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/context?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body ContextsResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Contexts
+	}
+
+	status, contexts := list("sort=tokens&model=opus")
+	if status != http.StatusOK || len(contexts) != 2 || contexts[0].Id != 2 || contexts[1].Id != 1 {
+		t.Fatalf("expected the opus contexts by tokens, got %d %+v", status, contexts)
+	}
+	if status, _ := list("sort=size"); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown order, got %d", status)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	commontypes "owl/common_types"
+	data "owl/data"
+	"owl/logger"
+	"owl/services"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// Event names sent on /api/prompt/stream
+const (
+	sseEventText       = "text"
+	sseEventThinking   = "thinking"
+	sseEventToolCall   = "tool_call"
+	sseEventToolResult = "tool_result"
+	sseEventUsage      = "usage"
+	sseEventDone       = "done"
+	sseEventError      = "error"
+)
+
+type sseTextEvent struct {
+	Text  string  `json:"text"`
+	Color *string `json:"color,omitempty"`
+}
+
+type sseToolCallEvent struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Input      string `json:"input"`
+	CallerType string `json:"caller_type"`
+}
+
+type sseToolResultEvent struct {
+	ToolUseId string `json:"tool_use_id"`
+	Content   string `json:"content"`
+	Success   bool   `json:"success"`
+}
+
+type sseUsageEvent struct {
+	Model string `json:"model"`
+	commontypes.TokenUsage
+}
+
+type sseDoneEvent struct {
+	ContextId   int64  `json:"context_id"`
+	ContextName string `json:"context_name"`
+}
+
+type sseErrorEvent struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind,omitempty"`
+	Status  int    `json:"status,omitempty"`
+}
+
+func newSseErrorEvent(err error) sseErrorEvent {
+	event := sseErrorEvent{Message: services.DescribeError(err), Status: queryErrorStatus(err)}
+	if providerError, ok := commontypes.AsProviderError(err); ok {
+		event.Kind = string(providerError.Kind)
+	}
+	return event
+}
+
+// SseResponseHandler writes model output as named Server-Sent Events and
+// persists the final answer like HttpResponseHandler.
+// Owl's tool calls are sent as they happen, the tool uses FinalText gets
+// that were not (server tools, calls with arguments that did not parse) are
+// sent with the turn.
+type SseResponseHandler struct {
+	mu             sync.Mutex
+	responseWriter http.ResponseWriter
+	Repository     data.HistoryRepository
+	// sentToolUses are the ids of the tool calls already sent
+	sentToolUses map[string]bool
+}
+
+func (sseResponseHandler *SseResponseHandler) writeEvent(event string, payload any) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		logger.Debug.Printf("could not marshal %s event: %v", event, err)
+		return
+	}
+
+	sseResponseHandler.mu.Lock()
+	defer sseResponseHandler.mu.Unlock()
+
+	fmt.Fprintf(sseResponseHandler.responseWriter, "event: %s\ndata: %s\n\n", event, bytes)
+	if flusher, ok := sseResponseHandler.responseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sseResponseHandler *SseResponseHandler) RecievedText(text string, useColor *string) {
+	sseResponseHandler.writeEvent(sseEventText, sseTextEvent{Text: text, Color: useColor})
+}
+
+func (sseResponseHandler *SseResponseHandler) RecievedThinking(text string) {
+	sseResponseHandler.writeEvent(sseEventThinking, sseTextEvent{Text: text})
+}
+
+func (sseResponseHandler *SseResponseHandler) ToolCalled(toolUse data.ToolUse) {
+	sseResponseHandler.mu.Lock()
+	if sseResponseHandler.sentToolUses == nil {
+		sseResponseHandler.sentToolUses = map[string]bool{}
+	}
+	sseResponseHandler.sentToolUses[toolUse.Id] = true
+	sseResponseHandler.mu.Unlock()
+
+	sseResponseHandler.writeEvent(sseEventToolCall, sseToolCallEvent{
+		Id:         toolUse.Id,
+		Name:       toolUse.Name,
+		Input:      toolUse.Input,
+		CallerType: toolUse.CallerType,
+	})
+}
+
+func (sseResponseHandler *SseResponseHandler) ToolAnswered(toolUse data.ToolUse) {
+	sseResponseHandler.writeEvent(sseEventToolResult, sseToolResultEvent{
+		ToolUseId: toolUse.Id,
+		Content:   toolUse.Result.Content,
+		Success:   toolUse.Result.Success,
+	})
+}
+
+func (sseResponseHandler *SseResponseHandler) toolUseSent(id string) bool {
+	sseResponseHandler.mu.Lock()
+	defer sseResponseHandler.mu.Unlock()
+	return sseResponseHandler.sentToolUses[id]
+}
+
+func (sseResponseHandler *SseResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
+	for _, tool := range toolUse {
+		if sseResponseHandler.toolUseSent(tool.Id) {
+			continue
+		}
+		sseResponseHandler.ToolCalled(tool)
+		if tool.Result.ToolUseId != "" || tool.Result.Content != "" {
+			sseResponseHandler.ToolAnswered(tool)
+		}
+	}
+
+	if usage != nil {
+		sseResponseHandler.writeEvent(sseEventUsage, sseUsageEvent{Model: modelName, TokenUsage: *usage})
+	}
+
+	saveHistory(sseResponseHandler.Repository, contextId, prompt, response, toolUse, modelName, usage, thinking, attachments)
+}
+
+func (server_data *server_data) handlePromptStream(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req, err := parsePromptRequest(r)
+	if err != nil {
+		http.Error(w, "Bad input", http.StatusBadRequest)
+		return
+	}
+	if err := checkModel(req.Model); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if schema, err := promptSchema(req); err != nil || schema != nil {
+		http.Error(w, "schema is only taken by /api/prompt, structured answers are not streamed", http.StatusBadRequest)
+		return
+	}
+
+	logger.Debug.Printf("Handling stream prompt request: %v", req)
+
+	repository, ok := server_data.openRepository(w, username)
+	if !ok {
+		return
+	}
+	context := findOrCreateContext(repository, &req, username)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	responseHandler := &SseResponseHandler{responseWriter: w, Repository: repository}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Screen(fmt.Sprintf("\nstream prompt failed: %v\n", recovered), color.RGB(250, 150, 150))
+			responseHandler.writeEvent(sseEventError, sseErrorEvent{Message: fmt.Sprintf("%v", recovered)})
+		}
+	}()
+
+	modelToUse := ""
+	if req.Model != nil {
+		modelToUse = *req.Model
+	}
+	selectedModel, modelName := server_data.getModel(
+		modelToUse,
+		context,
+		responseHandler,
+		repository,
+		true,
+		true,
+		true,
+		false,
+	)
+
+	err = services.StreamedQuery(r.Context(), req.Prompt, selectedModel, repository, req.HistoryCount, context, promptModifiers(req), modelName)
+	if err != nil {
+		logger.Screen(fmt.Sprintf("\nstream prompt failed: %v\n", err), color.RGB(250, 150, 150))
+		responseHandler.writeEvent(sseEventError, newSseErrorEvent(err))
+		return
+	}
+
+	responseHandler.writeEvent(sseEventDone, sseDoneEvent{ContextId: context.Id, ContextName: context.Name})
+}
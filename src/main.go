@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"owl/agents"
 	commontypes "owl/common_types"
@@ -22,6 +26,7 @@ import (
 	picker "owl/picker"
 	"owl/services"
 	"owl/tools"
+	"owl/transfer"
 	"owl/tui"
 
 	"github.com/charmbracelet/glamour"
@@ -39,6 +44,14 @@ var (
 	stream           bool
 	store            bool
 	view             bool
+	usage_report     bool
+	migrate_command  string
+	find_query       string
+	export_context   string
+	export_format    string
+	import_path      string
+	import_active    bool
+	collect_garbage  bool
 	llm_model        string
 	thinking         bool
 	stream_thinkning bool
@@ -58,8 +71,34 @@ var (
 	authStatus       bool
 	authLogin        bool
 	authLogout       bool
+	schema_path      string
+	attach_paths     attachFlag
+	// generationFlags hold the generation settings given on the command
+	// line, by setting name
+	generationFlags map[string]*string
 )
 
+var generationFlagUsage = map[string]string{
+	"max_tokens":       "set the max tokens of the answers in the context, default goes back to the model's",
+	"thinking_budget":  "set the thinking budget of Claude in the context, at least 1024 and below -max_tokens",
+	"reasoning_effort": "set the reasoning effort of OpenAI and Gemini models in the context: minimal, low, medium or high",
+	"temperature":      "set the temperature of the context, 0 to 1 for Claude and 0 to 2 for the others",
+	"top_p":            "set the top_p of the context, 0 to 1",
+	"stop":             "set the comma separated stop sequences of the context",
+}
+
+// attachFlag collects the values of the repeatable -attach flag.
+type attachFlag []string
+
+func (paths *attachFlag) String() string {
+	return strings.Join(*paths, ",")
+}
+
+func (paths *attachFlag) Set(value string) error {
+	*paths = append(*paths, value)
+	return nil
+}
+
 const owlBaseSystemPrompt = "You are Owl, a coding assistant that prioritizes safe, minimal, and verifiable changes while following repository conventions."
 
 var (
@@ -67,8 +106,15 @@ var (
 	runEmbeddingsFunc    = embeddings.Run
 	awaitedQueryFunc     = services.AwaitedQuery
 	streamedQueryFunc    = services.StreamedQuery
+	structuredQueryFunc  = services.StructuredQuery
 	launchTUIFunc        = launchTUI
 	viewHistoryFunc      = view_history
+	viewUsageFunc        = view_usage
+	runMigrateFunc       = run_migrate
+	findHistoryFunc      = find_history
+	exportContextFunc    = export_history
+	importFileFunc       = import_history
+	gcFunc               = purge_trash
 	nameNewContextFunc   = models.Name_new_context
 	getContextFunc       = getContext
 	getModelForQueryFunc = picker.GetModelForQuery
@@ -94,15 +140,29 @@ func registerFlags(fs *flag.FlagSet) {
 
 	fs.BoolVar(&thinking, "thinking", true, "use thinking in request")
 	fs.BoolVar(&stream_thinkning, "stream_thinking", true, "stream thinking")
-	fs.BoolVar(&output_thinkning, "output_thinking", false, "output thinking")
+	fs.BoolVar(&output_thinkning, "output_thinking", false, "output thinking, also with -view")
 	fs.StringVar(&system_prompt, "system", "", "set a system promt for the context")
+	generationFlags = map[string]*string{}
+	for _, name := range data.GenerationSettingNames {
+		generationFlags[name] = fs.String(name, "", generationFlagUsage[name])
+	}
 
 	fs.BoolVar(&view, "view", false, "view")
+	fs.BoolVar(&usage_report, "usage", false, "report token spend by context, model, day and agent")
+	fs.StringVar(&migrate_command, "migrate", "", "schema migrations of the local database: status, up or down")
+	fs.StringVar(&find_query, "find", "", "full-text search of the conversation history, narrowed to -context_name when it is given")
+	fs.StringVar(&export_context, "export", "", "print the named context with its history, in -format")
+	fs.StringVar(&export_format, "format", transfer.FormatMarkdown, "format of -export: md, json or jsonl")
+	fs.StringVar(&import_path, "import", "", "import a json or jsonl file written by -export, or the conversations.json of a ChatGPT or Claude.ai export")
+	fs.BoolVar(&import_active, "import_active", false, "do not archive the conversations imported from ChatGPT or Claude.ai")
+	fs.BoolVar(&collect_garbage, "gc", false, "purge the contexts that have been in the trash longer than OWL_TRASH_RETENTION_DAYS (default 30)")
 	fs.BoolVar(&tui_mode, "tui", false, "Launch TUI mode")
 
 	fs.BoolVar(&image, "image", false, "image (used clipboard as image)")
 	fs.BoolVar(&web, "web", false, "web search enabled")
 	fs.StringVar(&pdf, "pdf", "", "path to pdf")
+	fs.Var(&attach_paths, "attach", "attach a png, jpg, gif, webp, pdf or text file, - for stdin or an http(s) URL, repeatable")
+	fs.StringVar(&schema_path, "schema", "", "path to a JSON Schema the answer must match, only the validated JSON is printed")
 
 	fs.BoolVar(&store, "embeddings", false, "Enable embeddings generation (no streaming)")
 	fs.StringVar(&search, "search", "", "search for phrase in embedding")
@@ -122,6 +182,8 @@ func registerFlags(fs *flag.FlagSet) {
 func main() {
 	godotenv.Load()
 	flag.Parse()
+	defer data.CloseUserDatabases()
+	defer services.WaitForHistoryHooks()
 	if !wasFlagProvided("model") && openai_auth.HasCodexOAuthCredential() {
 		llm_model = "codex"
 	}
@@ -160,13 +222,48 @@ func main() {
 		return
 	}
 
-	if system_prompt != "" && context_name != "" && prompt == "" && !serve && !view && search == "" && chunk == "" && !tui_mode {
-		db := os.Getenv("OWL_LOCAL_DATABASE")
-		if db == "" {
-			db = "owl"
+	if usage_report {
+		viewUsageFunc()
+		return
+	}
+
+	if migrate_command != "" {
+		if err := runMigrateFunc(migrate_command); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if find_query != "" {
+		if err := findHistoryFunc(find_query); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		user := data.User{Name: &db}
+	if export_context != "" {
+		if err := exportContextFunc(export_context, export_format); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if import_path != "" {
+		if err := importFileFunc(import_path); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if collect_garbage {
+		if err := gcFunc(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if system_prompt != "" && context_name != "" && prompt == "" && !serve && !view && search == "" && chunk == "" && !tui_mode {
+		user := openRepository()
 		context := getContextFunc(user, &resolvedSystemPrompt)
 
 		err := user.UpdateSystemPrompt(context.Id, resolvedSystemPrompt)
@@ -176,7 +273,20 @@ func main() {
 		return
 	}
 
+	if generationFlagsProvided() && prompt == "" && !serve && !view && search == "" && chunk == "" {
+		user := openRepository()
+		context := getContextFunc(user, &resolvedSystemPrompt)
+		if err := applyGenerationFlags(user, context, llm_model); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: %s\n", context.Name, context.Generation)
+		return
+	}
+
 	if prompt == "" && !serve && !view && search == "" && chunk == "" {
+		if slices.Contains(attach_paths, "-") {
+			log.Fatal("-attach - reads the attachment from stdin, give the prompt with -prompt")
+		}
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("Prompt:")
 		prompt, _ = reader.ReadString('\n')
@@ -185,11 +295,7 @@ func main() {
 
 	if create_context && prompt != "" {
 
-		db := os.Getenv("OWL_LOCAL_DATABASE")
-		if db == "" {
-			db = "owl"
-		}
-		user := data.User{Name: &db}
+		user := openRepository()
 		cliResponseHandler := CliResponseHandler{Repository: user}
 		toolResponseHandler := tools.ToolResponseHandler{ResponseHandler: cliResponseHandler}
 		toolResponseHandler.Init()
@@ -198,7 +304,7 @@ func main() {
 		new_context := data.Context{Name: context_name}
 		id, err := user.InsertContext(new_context)
 		if err != nil {
-			log.Println(fmt.Sprintf("Could not create a new context with name %s for user %s, %s", context_name, *user.Name, err))
+			log.Println(fmt.Sprintf("Could not create a new context with name %s, %s", context_name, err))
 		}
 
 		context := &new_context
@@ -208,7 +314,11 @@ func main() {
 		model, modelName := getModelForQueryFunc("haiku", context, &toolResponseHandler, user, stream, thinking, stream_thinkning, output_thinkning)
 
 		// send with proper instructions and catch the answer
-		awaitedQueryFunc(prompt, model, user, history_count, context, &commontypes.PayloadModifiers{}, modelName)
+		queryCtx, stop := interruptibleContext()
+		defer stop()
+		if err := awaitedQueryFunc(queryCtx, prompt, model, user, history_count, context, &commontypes.PayloadModifiers{}, modelName); err != nil {
+			exitWithQueryError(err)
+		}
 
 		response := <-toolResponseHandler.ResponseChannel
 		_ = response
@@ -217,13 +327,7 @@ func main() {
 	}
 
 	if serve {
-		httpResponseHandler := &server.HttpResponseHandler{}
-		user := &data.MultiUserContext{}
-		httpResponseHandler.Repository = user
-
-		model := &claude_model.ClaudeModel{UseStreaming: stream, HistoryRepository: user, ResponseHandler: httpResponseHandler, UseThinking: thinking, StreamThought: stream_thinkning, OutputThought: output_thinkning, ModelVersion: "haiku"}
-
-		runServerFunc(secure, port, httpResponseHandler, model, stream)
+		runServerFunc(secure, port, stream)
 		return
 	}
 
@@ -233,7 +337,7 @@ func main() {
 			ChunkPath: chunk,
 			Prompt:    prompt,
 		}); err != nil {
-			panic(err)
+			exitWithQueryError(err)
 		}
 		return
 	}
@@ -244,7 +348,7 @@ func main() {
 			SearchQuery: search,
 		})
 		if err != nil {
-			panic(err)
+			exitWithQueryError(err)
 		}
 
 		rag_string := ""
@@ -256,16 +360,16 @@ func main() {
 
 		search_prompt := fmt.Sprintf("Q: %s\nMatches from RAG: %s", search, rag_string)
 
-		db := os.Getenv("OWL_LOCAL_DATABASE")
-		if db == "" {
-			db = "owl"
-		}
-		user := data.User{Name: &db}
-		cliResponseHandler := CliResponseHandler{Repository: user}
+		user := openRepository()
+		cliResponseHandler := CliResponseHandler{Repository: user, Agent: selectedAgent.Name}
 		context := getContextFunc(user, &resolvedSystemPrompt)
 		context.SystemPrompt = resolvedSystemPrompt
 		model, modelName := getModelForQueryFunc(llm_model, context, cliResponseHandler, user, stream, thinking, stream_thinkning, output_thinkning)
-		awaitedQueryFunc(search_prompt, model, user, history_count, context, &commontypes.PayloadModifiers{Image: image, Pdf: pdf, Web: web, ToolGroupFilters: tools.ToolGroupsToStrings(agentGroups)}, modelName)
+		queryCtx, stop := interruptibleContext()
+		defer stop()
+		if err := awaitedQueryFunc(queryCtx, search_prompt, model, user, history_count, context, &commontypes.PayloadModifiers{Image: image, Pdf: pdf, Web: web, ToolGroupFilters: tools.ToolGroupsToStrings(agentGroups)}, modelName); err != nil {
+			exitWithQueryError(err)
+		}
 		return
 	}
 
@@ -274,27 +378,71 @@ func main() {
 		return
 	}
 
-	db := os.Getenv("OWL_LOCAL_DATABASE")
-	if db == "" {
-		db = "owl"
+	var schema map[string]interface{}
+	if schema_path != "" {
+		schema, err = services.LoadSchema(schema_path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Status output goes to stderr, stdout only carries the JSON
+		color.Output = color.Error
 	}
 
-	user := data.User{Name: &db}
-	cliResponseHandler := CliResponseHandler{Repository: user}
+	attachments := []data.Attachment{}
+	for _, path := range attach_paths {
+		attachment, err := services.LoadAttachment(path, os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	user := openRepository()
+	cliResponseHandler := CliResponseHandler{Repository: user, Agent: selectedAgent.Name, Quiet: schema != nil}
 	context := getContextFunc(user, &resolvedSystemPrompt)
 	context.SystemPrompt = resolvedSystemPrompt
 
 	model, modelName := getModelForQueryFunc(llm_model, context, cliResponseHandler, user, stream, thinking, stream_thinkning, output_thinkning)
+	if err := applyGenerationFlags(user, context, modelName); err != nil {
+		log.Fatal(err)
+	}
 
-	modifiers := &commontypes.PayloadModifiers{Image: image, Pdf: pdf, Web: web}
+	modifiers := &commontypes.PayloadModifiers{Image: image, Pdf: pdf, Web: web, Schema: schema, Attachments: attachments}
 
 	modifiers.ToolGroupFilters = tools.ToolGroupsToStrings(agentGroups)
 
+	queryCtx, stop := interruptibleContext()
+	defer stop()
+
+	if schema != nil {
+		result, err := structuredQueryFunc(queryCtx, prompt, model, user, history_count, context, modifiers, modelName)
+		if err != nil {
+			exitWithQueryError(err)
+		}
+		fmt.Println(string(result))
+		return
+	}
+
 	if stream {
-		streamedQueryFunc(prompt, model, user, history_count, context, modifiers, modelName)
+		err = streamedQueryFunc(queryCtx, prompt, model, user, history_count, context, modifiers, modelName)
 	} else {
-		awaitedQueryFunc(prompt, model, user, history_count, context, modifiers, modelName)
+		err = awaitedQueryFunc(queryCtx, prompt, model, user, history_count, context, modifiers, modelName)
 	}
+	if err != nil {
+		exitWithQueryError(err)
+	}
+}
+
+// exitWithQueryError prints a failed query with a hint on what to do about it.
+func exitWithQueryError(err error) {
+	color.RGB(250, 100, 100).Fprintf(os.Stderr, "\n%s\n", services.DescribeError(err))
+	os.Exit(1)
+}
+
+// interruptibleContext is cancelled on ctrl+c so a running query stops and
+// its partial answer is stored as an interrupted history row.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
 }
 
 func handleAuthStatus() {
@@ -350,6 +498,40 @@ func handleAuthLogout() {
 	fmt.Println("OpenAI auth cleared.")
 }
 
+func generationFlagsProvided() bool {
+	for _, name := range data.GenerationSettingNames {
+		if wasFlagProvided(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGenerationFlags stores the generation settings given on the command
+// line on the context, after checking them against the model that answers.
+func applyGenerationFlags(repository data.HistoryRepository, context *data.Context, modelName string) error {
+	if !generationFlagsProvided() {
+		return nil
+	}
+	settings := context.Generation
+	for _, name := range data.GenerationSettingNames {
+		if !wasFlagProvided(name) {
+			continue
+		}
+		if err := settings.Set(name, *generationFlags[name]); err != nil {
+			return err
+		}
+	}
+	if err := picker.CheckGeneration(modelName, settings, thinking); err != nil {
+		return err
+	}
+	if err := repository.UpdateGenerationSettings(context.Id, settings); err != nil {
+		return err
+	}
+	context.Generation = settings
+	return nil
+}
+
 func wasFlagProvided(name string) bool {
 	found := false
 	flag.CommandLine.Visit(func(f *flag.Flag) {
@@ -365,17 +547,15 @@ func view_history() {
 		panic("No context name to output")
 	}
 
-	db := os.Getenv("OWL_LOCAL_DATABASE")
-	if db == "" {
-		db = "owl"
-	}
-
-	user := data.User{Name: &db}
+	user := openRepository()
 
 	context, err := user.GetContextByName(context_name)
 	if err != nil {
 		panic(err)
 	}
+	if context == nil {
+		panic(fmt.Sprintf("No context named %s", context_name))
+	}
 
 	count := services.DefaultHistoryCount
 	if history_count > 0 {
@@ -394,7 +574,15 @@ func view_history() {
 	fmt.Println(out)
 
 	for _, h := range history {
-		out, err := glamour.Render(fmt.Sprintf("--- \n## Q\n\n %s \n\n## A\n\n %s", h.Prompt, h.Response), "dark")
+		thinking := ""
+		if output_thinkning {
+			thinking = formatThinking(h.Thinking)
+		}
+		attached := ""
+		if len(h.Attachments) > 0 {
+			attached = fmt.Sprintf("*Attached: %s*\n\n", data.AttachmentNames(h.Attachments))
+		}
+		out, err := glamour.Render(fmt.Sprintf("--- \n## Q\n\n %s \n\n%s%s## A\n\n %s", h.Prompt, attached, thinking, h.Response), "dark")
 		if err != nil {
 			println(fmt.Sprintf("%v", err))
 		}
@@ -402,13 +590,202 @@ func view_history() {
 	}
 }
 
-func launchTUI() {
-	db := os.Getenv("OWL_LOCAL_DATABASE")
-	if db == "" {
-		db = "owl"
+// formatThinking quotes the thinking of a turn under its own heading, empty
+// when the turn has none.
+func formatThinking(thinking []data.Thinking) string {
+	text := data.ThinkingText(thinking)
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("## Thinking\n\n> %s\n\n", strings.ReplaceAll(text, "\n", "\n> "))
+}
+
+func view_usage() {
+	user := openRepository()
+
+	rows, err := user.GetUsage(time.Time{})
+	if err != nil {
+		log.Fatalf("could not read usage: %v", err)
+	}
+
+	report := services.BuildUsageReport(rows, picker.LoadRegistry())
+	fmt.Print(report.Format())
+
+	budget := services.CurrentBudget()
+	now := time.Now()
+	if budget.Daily > 0 {
+		spent, _ := services.Spend(user, services.StartOfDay(now))
+		fmt.Printf("\nDaily budget: %s of %s\n", services.FormatCost(spent), services.FormatCost(budget.Daily))
+	}
+	if budget.Monthly > 0 {
+		spent, _ := services.Spend(user, services.StartOfMonth(now))
+		fmt.Printf("Monthly budget: %s of %s\n", services.FormatCost(spent), services.FormatCost(budget.Monthly))
+	}
+}
+
+func run_migrate(command string) error {
+	migrator, err := data.NewMigrator(localDatabaseName())
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "status":
+		statuses, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%04d %-32s %s\n", status.Version, status.Name, state)
+		}
+	case "up":
+		applied, err := migrator.MigrateUp()
+		for _, migration := range applied {
+			fmt.Printf("applied %04d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		reverted, err := migrator.MigrateDown()
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Println("no migrations to revert")
+			return nil
+		}
+		fmt.Printf("reverted %04d %s\n", reverted.Version, reverted.Name)
+	default:
+		return fmt.Errorf("unknown -migrate command %q, use status, up or down", command)
+	}
+	return nil
+}
+
+// openRepository returns the repository of OWL_LOCAL_DATABASE, a SQLite file
+// in ~/.owl or a user in the Postgres database of OWL_DATABASE_URL.
+func openRepository() data.HistoryRepository {
+	repository, err := data.NewHistoryRepository(localDatabaseName())
+	if err != nil {
+		log.Fatalf("could not open the database: %v", err)
+	}
+	return repository
+}
+
+// localDatabaseName returns OWL_LOCAL_DATABASE, the user the CLI and TUI act
+// as, owl by default.
+func localDatabaseName() string {
+	if db := os.Getenv("OWL_LOCAL_DATABASE"); db != "" {
+		return db
+	}
+	return "owl"
+}
+
+// find_history prints the history rows matching query, best match first,
+// with the context they belong to.
+func find_history(query string) error {
+	repository := openRepository()
+
+	filters := data.SearchFilters{}
+	if wasFlagProvided("context_name") {
+		context, err := repository.GetContextByName(context_name)
+		if err != nil || context == nil {
+			return fmt.Errorf("no context named %s", context_name)
+		}
+		filters.ContextId = context.Id
+	}
+
+	results, err := repository.SearchHistory(query, filters)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		fmt.Println("no matches")
+		return nil
 	}
 
-	user := data.User{Name: &db}
+	for _, result := range results {
+		header := color.New(color.Bold).Sprint(result.ContextName)
+		if created := data.ParseCreated(result.Created); !created.IsZero() {
+			header += color.RGB(150, 150, 150).Sprintf("  %s", created.Local().Format("2006-01-02 15:04"))
+		}
+		fmt.Printf("%s  #%d\n  %s\n\n", header, result.HistoryId, highlightSnippet(result.Snippet))
+	}
+	return nil
+}
+
+// export_history writes the named context to stdout in format.
+func export_history(name string, format string) error {
+	export, err := transfer.Load(openRepository(), name)
+	if err != nil {
+		return err
+	}
+	return transfer.Write(os.Stdout, export, format)
+}
+
+// import_history stores the context of an -export file, or every
+// conversation of a ChatGPT or Claude.ai export, as new contexts.
+func import_history(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	exports, err := transfer.ReadAny(file, !import_active)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+
+	repository := openRepository()
+	for _, export := range exports {
+		context, err := transfer.Save(repository, export)
+		if err != nil {
+			return err
+		}
+		state := ""
+		if context.Archived {
+			state = " (archived)"
+		}
+		fmt.Printf("imported %d messages into context %s%s\n", len(export.Turns), context.Name, state)
+	}
+	if len(exports) != 1 {
+		fmt.Printf("imported %d conversations\n", len(exports))
+	}
+	return nil
+}
+
+// purge_trash deletes the contexts that have been in the trash for longer
+// than the retention, with their history.
+func purge_trash() error {
+	retention := data.TrashRetention()
+	purged, err := openRepository().PurgeTrash(time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d contexts deleted more than %d days ago\n", purged, int(retention.Hours()/24))
+	return nil
+}
+
+// highlightSnippet colors the words a search matched and keeps the snippet
+// on one line.
+func highlightSnippet(snippet string) string {
+	parts := strings.Split(strings.Join(strings.Fields(snippet), " "), data.SnippetMark)
+	for i := 1; i < len(parts); i += 2 {
+		parts[i] = color.RGB(250, 200, 100).Sprint(parts[i])
+	}
+	return strings.Join(parts, "")
+}
+
+func launchTUI() {
+	user := openRepository()
 
 	cliResponseHandler := CliResponseHandler{Repository: user}
 	model := &claude_model.ClaudeModel{ResponseHandler: cliResponseHandler, HistoryRepository: user, UseThinking: true, StreamThought: false, OutputThought: false}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"net/http"
 	"os"
@@ -13,12 +15,16 @@ import (
 	"owl/embeddings"
 	server "owl/http"
 	"owl/services"
+	testhelpers "owl/test_helpers"
+	"owl/transfer"
+
+	"github.com/fatih/color"
 )
 
 type stubModel struct{}
 
-func (stubModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
-	return nil
+func (stubModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	return nil, nil
 }
 
 func (stubModel) HandleStreamedLine(line []byte) {}
@@ -47,8 +53,16 @@ func setupTest(t *testing.T, args []string) func() {
 	origRunEmbeddings := runEmbeddingsFunc
 	origAwaited := awaitedQueryFunc
 	origStreamed := streamedQueryFunc
+	origStructured := structuredQueryFunc
+	origColorOutput := color.Output
 	origLaunch := launchTUIFunc
 	origView := viewHistoryFunc
+	origUsage := viewUsageFunc
+	origMigrate := runMigrateFunc
+	origFind := findHistoryFunc
+	origExport := exportContextFunc
+	origImport := importFileFunc
+	origGc := gcFunc
 	origNameContext := nameNewContextFunc
 	origGetContext := getContextFunc
 	origGetModel := getModelForQueryFunc
@@ -60,6 +74,8 @@ func setupTest(t *testing.T, args []string) func() {
 	skillsFlag = ""
 	tool_groups = ""
 	system_prompt = ""
+	schema_path = ""
+	attach_paths = nil
 	os.Args = append([]string{}, args...)
 	flag.CommandLine = flag.NewFlagSet(args[0], flag.ExitOnError)
 	registerFlags(flag.CommandLine)
@@ -67,6 +83,14 @@ func setupTest(t *testing.T, args []string) func() {
 	serve = false
 	store = false
 	view = false
+	usage_report = false
+	migrate_command = ""
+	find_query = ""
+	export_context = ""
+	export_format = transfer.FormatMarkdown
+	import_path = ""
+	import_active = false
+	collect_garbage = false
 	tui_mode = false
 	create_context = false
 	search = ""
@@ -76,10 +100,17 @@ func setupTest(t *testing.T, args []string) func() {
 	history_count = services.DefaultHistoryCount
 	launchTUIFunc = launchTUI
 	viewHistoryFunc = view_history
+	viewUsageFunc = view_usage
+	runMigrateFunc = run_migrate
+	findHistoryFunc = find_history
+	exportContextFunc = export_history
+	importFileFunc = import_history
+	gcFunc = purge_trash
 	runServerFunc = server.Run
 	runEmbeddingsFunc = embeddings.Run
 	awaitedQueryFunc = services.AwaitedQuery
 	streamedQueryFunc = services.StreamedQuery
+	structuredQueryFunc = services.StructuredQuery
 	nameNewContextFunc = origNameContext
 	getContextFunc = origGetContext
 	getModelForQueryFunc = origGetModel
@@ -92,8 +123,16 @@ func setupTest(t *testing.T, args []string) func() {
 		runEmbeddingsFunc = origRunEmbeddings
 		awaitedQueryFunc = origAwaited
 		streamedQueryFunc = origStreamed
+		structuredQueryFunc = origStructured
+		color.Output = origColorOutput
 		launchTUIFunc = origLaunch
 		viewHistoryFunc = origView
+		viewUsageFunc = origUsage
+		runMigrateFunc = origMigrate
+		findHistoryFunc = origFind
+		exportContextFunc = origExport
+		importFileFunc = origImport
+		gcFunc = origGc
 		nameNewContextFunc = origNameContext
 		getContextFunc = origGetContext
 		getModelForQueryFunc = origGetModel
@@ -117,7 +156,7 @@ func TestMainRunsTUIWhenFlagSet(t *testing.T) {
 func TestMainServeRunsServer(t *testing.T) {
 	defer setupTest(t, []string{"cmd", "-serve"})()
 	called := false
-	runServerFunc = func(sec bool, p int, handler *server.HttpResponseHandler, model commontypes.Model, streaming bool) {
+	runServerFunc = func(sec bool, p int, streaming bool) {
 		called = true
 		if sec {
 			t.Fatalf("secure should default false")
@@ -161,9 +200,10 @@ func TestMainSearchUsesAwaitedQuery(t *testing.T) {
 	}
 	captured := ""
 	capturedHistory := 0
-	awaitedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		captured = prompt
 		capturedHistory = historyCount
+		return nil
 	}
 	main()
 	if !strings.Contains(captured, "Matches from RAG") {
@@ -183,7 +223,7 @@ func TestMainDefaultUsesAwaitedQuery(t *testing.T) {
 		return stubModel{}, "stub"
 	}
 	called := false
-	awaitedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		called = true
 		if prompt != "hello" {
 			t.Fatalf("unexpected prompt %s", prompt)
@@ -191,9 +231,11 @@ func TestMainDefaultUsesAwaitedQuery(t *testing.T) {
 		if historyCount != services.DefaultHistoryCount {
 			t.Fatalf("expected default history count, got %d", historyCount)
 		}
+		return nil
 	}
-	streamedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	streamedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		t.Fatalf("streamed query should not run")
+		return nil
 	}
 	main()
 	if !called {
@@ -201,6 +243,65 @@ func TestMainDefaultUsesAwaitedQuery(t *testing.T) {
 	}
 }
 
+func TestMainSchemaFlagUsesStructuredQuery(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(schemaPath, []byte(`{"type": "object", "required": ["name"]}`), 0o644); err != nil {
+		t.Fatalf("failed to write schema: %v", err)
+	}
+	defer setupTest(t, []string{"cmd", "-prompt", "name it", "-schema", schemaPath, "-stream"})()
+	getContextFunc = func(repo data.HistoryRepository, systemPrompt *string) *data.Context {
+		return &data.Context{Id: 42, Name: "ctx"}
+	}
+	var handler commontypes.ResponseHandler
+	getModelForQueryFunc = func(model string, context *data.Context, responseHandler commontypes.ResponseHandler, repository data.HistoryRepository, stream bool, thinking bool, streamThinking bool, outputThinking bool) (commontypes.Model, string) {
+		handler = responseHandler
+		return stubModel{}, "stub"
+	}
+	var schema map[string]interface{}
+	structuredQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) (json.RawMessage, error) {
+		schema = modifiers.Schema
+		return json.RawMessage(`{"name":"owl"}`), nil
+	}
+	streamedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("streamed query should not run with -schema")
+		return nil
+	}
+	main()
+	if schema == nil || schema["type"] != "object" {
+		t.Fatalf("expected the schema of the file, got %+v", schema)
+	}
+	if cli, ok := handler.(CliResponseHandler); !ok || !cli.Quiet {
+		t.Fatalf("expected a quiet response handler, got %+v", handler)
+	}
+}
+
+func TestMainAttachFlagSendsTheAttachments(t *testing.T) {
+	notesPath := filepath.Join(t.TempDir(), "notes.md")
+	if err := os.WriteFile(notesPath, []byte("# notes"), 0o644); err != nil {
+		t.Fatalf("failed to write attachment: %v", err)
+	}
+	chartPath := filepath.Join(t.TempDir(), "chart.png")
+	if err := os.WriteFile(chartPath, []byte("\x89PNG\r\n\x1a\nfake"), 0o644); err != nil {
+		t.Fatalf("failed to write attachment: %v", err)
+	}
+	defer setupTest(t, []string{"cmd", "-prompt", "compare", "-attach", notesPath, "-attach", chartPath})()
+	getContextFunc = func(repo data.HistoryRepository, systemPrompt *string) *data.Context {
+		return &data.Context{Id: 43, Name: "ctx"}
+	}
+	getModelForQueryFunc = func(model string, context *data.Context, responseHandler commontypes.ResponseHandler, repository data.HistoryRepository, stream bool, thinking bool, streamThinking bool, outputThinking bool) (commontypes.Model, string) {
+		return stubModel{}, "stub"
+	}
+	var attachments []data.Attachment
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		attachments = modifiers.Attachments
+		return nil
+	}
+	main()
+	if len(attachments) != 2 || attachments[0].Name != "notes.md" || attachments[0].Kind() != data.AttachmentText || attachments[1].MediaType != "image/png" {
+		t.Fatalf("expected both attachments in order, got %+v", attachments)
+	}
+}
+
 func TestMainStreamFlagUsesStreamedQuery(t *testing.T) {
 	defer setupTest(t, []string{"cmd", "-prompt", "hi", "-stream"})()
 	getContextFunc = func(repo data.HistoryRepository, systemPrompt *string) *data.Context {
@@ -210,8 +311,9 @@ func TestMainStreamFlagUsesStreamedQuery(t *testing.T) {
 		return stubModel{}, "stub"
 	}
 	called := false
-	streamedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	streamedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		called = true
+		return nil
 	}
 	main()
 	if !called {
@@ -242,7 +344,8 @@ func TestMainDefaultsToCodexWhenOAuthPresentAndModelNotProvided(t *testing.T) {
 		return stubModel{}, "stub"
 	}
 
-	awaitedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		return nil
 	}
 
 	main()
@@ -264,6 +367,132 @@ func TestMainViewFlag(t *testing.T) {
 	}
 }
 
+func TestFormatThinkingQuotesTheThinking(t *testing.T) {
+	if formatted := formatThinking(nil); formatted != "" {
+		t.Fatalf("expected nothing without thinking, got %q", formatted)
+	}
+	formatted := formatThinking([]data.Thinking{{Text: "first\nsecond", Signature: "sig"}})
+	if formatted != "## Thinking\n\n> first\n> second\n\n" {
+		t.Fatalf("unexpected thinking section %q", formatted)
+	}
+}
+
+func TestMainUsageFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-usage"})()
+	called := false
+	viewUsageFunc = func() {
+		called = true
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -usage")
+		return nil
+	}
+	main()
+	if !called {
+		t.Fatalf("expected the usage report to run")
+	}
+}
+
+func TestMainMigrateFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-migrate", "status"})()
+	command := ""
+	runMigrateFunc = func(c string) error {
+		command = c
+		return nil
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -migrate")
+		return nil
+	}
+	main()
+	if command != "status" {
+		t.Fatalf("expected the status command to run, got %q", command)
+	}
+}
+
+func TestRunMigrateRejectsUnknownCommand(t *testing.T) {
+	if err := run_migrate("sideways"); err == nil {
+		t.Fatalf("expected an error for an unknown command")
+	}
+}
+
+func TestMainFindFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-find", "migration script"})()
+	query := ""
+	findHistoryFunc = func(q string) error {
+		query = q
+		return nil
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -find")
+		return nil
+	}
+	main()
+	if query != "migration script" {
+		t.Fatalf("expected the search to run, got %q", query)
+	}
+}
+
+func TestMainExportFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-export", "review", "-format", "jsonl"})()
+	name, format := "", ""
+	exportContextFunc = func(n string, f string) error {
+		name, format = n, f
+		return nil
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -export")
+		return nil
+	}
+	main()
+	if name != "review" || format != "jsonl" {
+		t.Fatalf("expected review as jsonl, got %q as %q", name, format)
+	}
+}
+
+func TestMainImportFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-import", "review.jsonl"})()
+	path := ""
+	importFileFunc = func(p string) error {
+		path = p
+		return nil
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -import")
+		return nil
+	}
+	main()
+	if path != "review.jsonl" {
+		t.Fatalf("expected the file to be imported, got %q", path)
+	}
+}
+
+func TestMainGcFlag(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-gc"})()
+	called := false
+	gcFunc = func() error {
+		called = true
+		return nil
+	}
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		t.Fatalf("expected no query for -gc")
+		return nil
+	}
+	main()
+	if !called {
+		t.Fatalf("expected the trash to be purged")
+	}
+}
+
+func TestHighlightSnippetKeepsTheTextOnOneLine(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+	if got := highlightSnippet("the **migration**\n  script"); got != "the migration script" {
+		t.Fatalf("unexpected snippet %q", got)
+	}
+}
+
 func TestSkillsAppliedToContextAndAwaited(t *testing.T) {
 	defer setupTest(t, []string{"cmd", "-prompt", "hello", "--skills=poem"})()
 	writeSkillFile(t, "poem.md", "Use rhymes")
@@ -277,11 +506,36 @@ func TestSkillsAppliedToContextAndAwaited(t *testing.T) {
 		return stubModel{}, "stub"
 	}
 	capturedContextPrompt := ""
-	awaitedQueryFunc = func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	awaitedQueryFunc = func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		capturedContextPrompt = context.SystemPrompt
+		return nil
 	}
 	main()
 	if !strings.Contains(capturedContextPrompt, "Use rhymes") {
 		t.Fatalf("expected context system prompt to include skills, got %s", capturedContextPrompt)
 	}
 }
+
+func TestApplyGenerationFlagsStoresTheGivenSettings(t *testing.T) {
+	defer setupTest(t, []string{"cmd", "-temperature", "0.3", "-stop", "END,STOP"})()
+	flag.Parse()
+	repository := testhelpers.NewMockHistoryRepository()
+	context := data.Context{Id: 3, Name: "gen", Generation: data.GenerationSettings{MaxTokens: 4000}}
+	repository.Contexts[context.Id] = context
+
+	if err := applyGenerationFlags(repository, &context, "sonnet"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored := repository.Contexts[context.Id].Generation
+	if stored.MaxTokens != 4000 || stored.Temperature == nil || *stored.Temperature != 0.3 || len(stored.StopSequences) != 2 {
+		t.Fatalf("expected the flags over the stored settings, got %+v", stored)
+	}
+
+	flag.CommandLine.Set("temperature", "1.5")
+	if err := applyGenerationFlags(repository, &context, "sonnet"); err == nil {
+		t.Fatalf("expected a temperature above 1 to be refused for Claude")
+	}
+	if err := applyGenerationFlags(repository, &context, "gpt"); err != nil {
+		t.Fatalf("expected the temperature to fit gpt, got %v", err)
+	}
+}
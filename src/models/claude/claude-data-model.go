@@ -9,8 +9,17 @@ type MessageBody struct {
 	System    []SystemContent `json:"system,omitempty"`
 	Stream    bool            `json:"stream"`
 	Thinking  *ThinkingBlock  `json:"thinking,omitempty"`
-	Temp      float32         `json:"temperature"`
+	Temp      *float64        `json:"temperature,omitempty"`
+	TopP      *float64        `json:"top_p,omitempty"`
+	Stop      []string        `json:"stop_sequences,omitempty"`
 	Tools     []ToolModel     `json:"tools"`
+	// ToolChoice forces a tool call, used for structured answers
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+}
+
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
 }
 
 // CacheControl enables prompt caching for content blocks
@@ -48,6 +57,14 @@ type Tool struct {
 	Id          string      `json:"id,omitempty"`
 }
 
+// SchemaTool is a tool with a JSON Schema given as is, the structured
+// answer tool takes the schema of the query.
+type SchemaTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
 // InputSchema represents the schema for tool inputs
 type InputSchema struct {
 	Type       string              `json:"type"`
@@ -97,6 +114,7 @@ type ResponseMessage struct {
 	Input     map[string]interface{} `json:"input,omitempty"`
 	Thinking  string                 `json:"thinking,omitempty"`
 	Signature string                 `json:"signature,omitempty"`
+	Data      string                 `json:"data,omitempty"`
 }
 
 type Role string
@@ -160,6 +178,19 @@ type TextContent struct {
 	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
+// ThinkingContent sends a thinking block back unchanged, with the signature
+// Claude checks it against.
+type ThinkingContent struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking"`
+	Signature string `json:"signature"`
+}
+
+type RedactedThinkingContent struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
 type TextMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
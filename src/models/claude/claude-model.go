@@ -2,14 +2,16 @@ package claude_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	commontypes "owl/common_types"
+	"owl/compaction"
 	data "owl/data"
 	"owl/logger"
 	"owl/mode"
+	"owl/registry"
 	"owl/services"
 	"owl/tools"
 	"sort"
@@ -25,18 +27,25 @@ type ClaudeModel struct {
 	AccumulatedAnswer string
 	Context           *data.Context
 	ModelVersion      string
+	Spec              registry.ModelSpec
 	OutputThought     bool
 	StreamThought     bool
 	UseThinking       bool
 	UseStreaming      bool
+	RequestCtx        context.Context
 
 	//Track streamed content
 	CurrentEvent           string
 	CurrentToolUse         *StreamedToolUse
 	StreamedToolUses       []StreamedToolUse
 	StreamedToolResultById map[string]data.ToolResult
+	CurrentThinking        *data.Thinking
+	StreamedThinking       []data.Thinking
 	Modifiers              *commontypes.PayloadModifiers
 	PendingUsage           *commontypes.TokenUsage
+	// StreamedOutput is set once the request passed anything to the
+	// ResponseHandler, see HasStreamedOutput
+	StreamedOutput bool
 }
 
 type StreamedToolUse struct {
@@ -51,34 +60,31 @@ func (model *ClaudeModel) SetResponseHandler(responseHandler commontypes.Respons
 
 }
 
-func (model *ClaudeModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *ClaudeModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 
 	logger.Debug.Printf("\nMODEL USE: creating claude payload: %s", model.ModelVersion)
 
-	var model_version string
-	switch model.ModelVersion {
-	case "opus":
-		model_version = "claude-opus-4-6"
-	case "sonnet":
-		model_version = "claude-sonnet-4-5-20250929"
-	case "haiku":
-		model_version = "claude-haiku-4-5-20251001"
-	default:
-		model_version = "claude-sonnet-4-5-20250929"
-	}
+	spec := registry.Resolve(model.Spec, model.ModelVersion, "claude")
 
-	payload := createClaudePayload(prompt, streaming, history, model_version, model.UseThinking, context, modifiers)
+	payload, err := createClaudePayload(prompt, streaming, history, spec, model.UseThinking, context, modifiers)
+	if err != nil {
+		return nil, err
+	}
 	model.Prompt = prompt
 	model.AccumulatedAnswer = ""
 	model.Context = context
+	model.RequestCtx = ctx
 	model.StreamedToolUses = nil
 	model.StreamedToolResultById = map[string]data.ToolResult{}
+	model.CurrentThinking = nil
+	model.StreamedThinking = nil
+	model.StreamedOutput = false
 
-	request := createClaudeRequest(payload)
+	request, err := createClaudeRequest(ctx, spec, payload)
 	model.Modifiers = modifiers
 	model.PendingUsage = nil
 
-	return request
+	return request, err
 }
 
 func (model *ClaudeModel) HandleStreamedLine(line []byte) {
@@ -105,6 +111,11 @@ func (model *ClaudeModel) HandleStreamedLine(line []byte) {
 				model.StreamedToolUses = append(model.StreamedToolUses, *model.CurrentToolUse)
 				model.CurrentToolUse = nil
 			}
+			if model.CurrentThinking != nil {
+				model.StreamedThinking = append(model.StreamedThinking, *model.CurrentThinking)
+				model.CurrentThinking = nil
+			}
+			model.StreamedOutput = true
 			model.ResponseHandler.RecievedText("\n", nil)
 		case "message_delta":
 			model.handleMessageDelta(payload)
@@ -150,17 +161,24 @@ func (model *ClaudeModel) HandleStreamedLine(line []byte) {
 
 			logger.Debug.Printf("Message stop with fakedResponse.Content: %v", fakeResponse.Content)
 			toolUses, localToolUses := model.collectToolUses(fakeResponse)
+			if answer, ok := structuredAnswer(fakeResponse); ok {
+				model.AccumulatedAnswer = answer
+			}
 
 			usage := model.PendingUsage
-			model.ResponseHandler.FinalText(model.Context.Id, model.Prompt, model.AccumulatedAnswer, toolUses, model.ModelVersion, usage)
+			thinking := model.StreamedThinking
+			model.StreamedThinking = nil
+			model.ResponseHandler.FinalText(model.Context.Id, model.Prompt, model.AccumulatedAnswer, toolUses, model.ModelVersion, usage, thinking, model.turnAttachments())
 			model.PendingUsage = nil
+			model.finishTurn()
 
 			if len(localToolUses) > 0 {
 				// Continue conversation with tool results
-				services.AwaitedQuery("", model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
+				err := services.AwaitedQuery(model.RequestCtx, "", model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
 					ToolUses:         localToolUses,
 					ToolGroupFilters: model.Modifiers.ToolGroupFilters,
 				}, model.ModelVersion)
+				services.ReportError(err)
 			}
 
 			model.StreamedToolUses = nil
@@ -179,6 +197,7 @@ func (model *ClaudeModel) handleContentBlockStart(payload string) {
 			Name      string      `json:"name,omitempty"`
 			ToolUseId string      `json:"tool_use_id,omitempty"`
 			Content   interface{} `json:"content,omitempty"`
+			Data      string      `json:"data,omitempty"`
 		} `json:"content_block"`
 	}
 
@@ -201,6 +220,13 @@ func (model *ClaudeModel) handleContentBlockStart(payload string) {
 		logger.Debug.Printf("starting streaming tool use block")
 	}
 
+	if response.ContentBlock.Type == "thinking" {
+		model.CurrentThinking = &data.Thinking{}
+	}
+	if response.ContentBlock.Type == "redacted_thinking" {
+		model.StreamedThinking = append(model.StreamedThinking, data.Thinking{Redacted: response.ContentBlock.Data})
+	}
+
 	if response.ContentBlock.Type == "web_search_tool_result" {
 		normalized, ok := normalizeWebSearchToolResultContent(response.ContentBlock.Content)
 		if !ok {
@@ -233,6 +259,7 @@ func (model *ClaudeModel) handleContentBlockDelta(payload string) {
 			Type        string `json:"type"`
 			Text        string `json:"text,omitempty"`
 			Thinking    string `json:"thinking,omitempty"`
+			Signature   string `json:"signature,omitempty"`
 			PartialJson string `json:"partial_json,omitempty"`
 		} `json:"delta"`
 	}
@@ -249,12 +276,21 @@ func (model *ClaudeModel) handleContentBlockDelta(payload string) {
 		}
 	} else if response.Delta.Type == "text_delta" {
 		model.AccumulatedAnswer = model.AccumulatedAnswer + response.Delta.Text
+		model.StreamedOutput = true
 		model.ResponseHandler.RecievedText(response.Delta.Text, nil)
 	} else if response.Delta.Type == "thinking_delta" {
-		model.AccumulatedAnswer = model.AccumulatedAnswer + response.Delta.Thinking
+		// Thinking is kept out of the answer, it is stored and sent back
+		// as its own block
+		if model.CurrentThinking != nil {
+			model.CurrentThinking.Text += response.Delta.Thinking
+		}
 		if model.StreamThought {
-			color := "grey"
-			model.ResponseHandler.RecievedText(response.Delta.Thinking, &color)
+			model.StreamedOutput = true
+			commontypes.SendThinking(model.ResponseHandler, response.Delta.Thinking)
+		}
+	} else if response.Delta.Type == "signature_delta" {
+		if model.CurrentThinking != nil {
+			model.CurrentThinking.Signature += response.Delta.Signature
 		}
 	} else {
 		logger.Debug.Printf("unhandled content block delta arrived of type: %v", response.Delta.Type)
@@ -308,25 +344,96 @@ func (model *ClaudeModel) HandleBodyBytes(bytes []byte) {
 	// logger.Debug.Printf("%v", apiResponse)
 
 	responseText := ""
+	thinking := []data.Thinking{}
 	for _, content := range apiResponse.Content {
-		if content.Type == "text" {
+		switch content.Type {
+		case "text":
 			responseText += fmt.Sprintf("\n%s", content.Text)
+		case "thinking":
+			thinking = append(thinking, data.Thinking{Text: content.Thinking, Signature: content.Signature})
+		case "redacted_thinking":
+			thinking = append(thinking, data.Thinking{Redacted: content.Data})
+		}
+	}
+
+	if model.OutputThought {
+		if text := data.ThinkingText(thinking); text != "" {
+			commontypes.SendThinking(model.ResponseHandler, text+"\n\n")
 		}
 	}
 
 	toolUses, localToolUses := model.collectToolUses(apiResponse)
+	if answer, ok := structuredAnswer(apiResponse); ok {
+		responseText = answer
+	}
 
 	usage := claudeUsageToTokenUsage(apiResponse.Usage)
-	model.ResponseHandler.FinalText(model.Context.Id, model.Prompt, responseText, toolUses, model.ModelVersion, usage)
+	model.ResponseHandler.FinalText(model.Context.Id, model.Prompt, responseText, toolUses, model.ModelVersion, usage, thinking, model.turnAttachments())
 	model.PendingUsage = nil
+	model.finishTurn()
 
 	if len(localToolUses) > 0 {
 		// Continue conversation with tool results
-		services.AwaitedQuery("", model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
+		err := services.AwaitedQuery(model.RequestCtx, "", model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
 			ToolUses:         localToolUses,
 			ToolGroupFilters: model.Modifiers.ToolGroupFilters,
 		}, model.ModelVersion)
+		services.ReportError(err)
+	}
+}
+
+// PartialResponse reports the prompt and answer of the turn in flight.
+func (model *ClaudeModel) PartialResponse() (string, string) {
+	return model.Prompt, model.AccumulatedAnswer
+}
+
+// HasStreamedOutput reports whether the request in flight passed text or
+// thinking to the ResponseHandler. It stays set after FinalText, so a stream
+// that breaks after the turn was handed over is not sent again.
+func (model *ClaudeModel) HasStreamedOutput() bool {
+	return model.StreamedOutput
+}
+
+// PartialThinking reports the thinking of the turn in flight, the block that
+// was still streaming included.
+func (model *ClaudeModel) PartialThinking() []data.Thinking {
+	thinking := append([]data.Thinking{}, model.StreamedThinking...)
+	if model.CurrentThinking != nil && model.CurrentThinking.Text != "" {
+		thinking = append(thinking, *model.CurrentThinking)
+	}
+	return thinking
+}
+
+// turnAttachments are the files sent with the prompt of the turn, tool
+// continuations have none.
+func (model *ClaudeModel) turnAttachments() []data.Attachment {
+	if model.Modifiers == nil {
+		return nil
+	}
+	return model.Modifiers.Attachments
+}
+
+// finishTurn clears the turn state once it has been handed to FinalText.
+func (model *ClaudeModel) finishTurn() {
+	model.Prompt = ""
+	model.AccumulatedAnswer = ""
+}
+
+// structuredAnswer returns the input of the structured answer tool as the
+// answer, the tool only carries the answer and is never run.
+func structuredAnswer(apiResponse MessageResponse) (string, bool) {
+	for _, content := range apiResponse.Content {
+		if content.Type != "tool_use" || content.Name != commontypes.StructuredOutputTool {
+			continue
+		}
+		bytes, err := json.Marshal(content.Input)
+		if err != nil {
+			logger.Debug.Printf("could not marshal the structured answer: %v", err)
+			return "", false
+		}
+		return string(bytes), true
 	}
+	return "", false
 }
 
 func (model *ClaudeModel) collectToolUses(apiResponse MessageResponse) ([]data.ToolUse, []data.ToolUse) {
@@ -344,7 +451,7 @@ func (model *ClaudeModel) handleToolCalls(apiResponse MessageResponse) []data.To
 	toolUses := []data.ToolUse{}
 
 	for _, content := range apiResponse.Content {
-		if content.Type != "tool_use" {
+		if content.Type != "tool_use" || content.Name == commontypes.StructuredOutputTool {
 			continue
 		}
 
@@ -450,7 +557,7 @@ func (model *ClaudeModel) handleAssistantSideToolCallsParsing(apiResponse Messag
 }
 
 func (model *ClaudeModel) useTool(content ResponseMessage) (commontypes.ToolResponse, error) {
-	runner := tools.ToolRunner{ResponseHandler: &model.ResponseHandler, HistoryRepository: &model.HistoryRepository, Context: model.Context}
+	runner := tools.ToolRunner{ResponseHandler: &model.ResponseHandler, HistoryRepository: &model.HistoryRepository, Context: model.Context, RequestCtx: model.RequestCtx}
 	args := map[string]string{}
 	for key, value := range content.Input {
 		switch v := value.(type) {
@@ -466,7 +573,9 @@ func (model *ClaudeModel) useTool(content ResponseMessage) (commontypes.ToolResp
 		}
 	}
 
-	result, err := runner.ExecuteTool(*model.Context, content.Name, args)
+	input, _ := json.Marshal(content.Input)
+	call := data.ToolUse{Id: content.Id, Name: content.Name, Input: string(input), CallerType: "assistant"}
+	result, err := runner.ExecuteTool(*model.Context, call, args)
 
 	if result != "" && err == nil {
 		return commontypes.ToolResponse{
@@ -547,9 +656,25 @@ func normalizeWebSearchToolResultContent(raw interface{}) (interface{}, bool) {
 	}
 }
 
-func createClaudePayload(prompt string, streamed bool, history []data.History, model string, useThinking bool, context *data.Context, modifiers *commontypes.PayloadModifiers) MessageBody {
+func createClaudePayload(prompt string, streamed bool, history []data.History, spec registry.ModelSpec, useThinking bool, context *data.Context, modifiers *commontypes.PayloadModifiers) (MessageBody, error) {
 	logger.Debug.Printf("crateClaudePayload called with responseCount: %d and history count: %d", len(modifiers.ToolUses), len(history))
 
+	settings := data.GenerationSettings{}
+	if context != nil {
+		settings = context.Generation
+	}
+	generation := spec.Generation(settings)
+
+	// A forced tool call does not work with thinking
+	if modifiers.Schema != nil {
+		useThinking = false
+	}
+	// A budget Anthropic would refuse leaves thinking out of the request
+	if useThinking && !registry.ThinkingFits(generation) {
+		useThinking = false
+	}
+
+	summary, history := compaction.SplitSummary(history)
 	messages := []Message{}
 	toolCacheTargets := selectToolCacheTargets(history)
 	userWithoutToolCount := 0
@@ -559,10 +684,11 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 	for i, h := range history {
 
 		//user
-		if h.Prompt != "" {
+		if h.Prompt != "" || len(h.Attachments) > 0 {
+			prompt, files := services.PromptWithAttachments(h.Prompt, h.Attachments)
 			textContent := TextContent{
 				Type: "text",
-				Text: h.Prompt,
+				Text: prompt,
 			}
 			if len(h.ToolUse) == 0 {
 				userWithoutToolCount++
@@ -574,7 +700,7 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 
 			messages = append(messages, RequestMessage{
 				Role:    "user",
-				Content: []Content{textContent},
+				Content: append([]Content{textContent}, attachmentContent(files)...),
 			})
 		}
 
@@ -624,6 +750,11 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 		}
 
 		if len(assistantContent) > 0 {
+			// With thinking on, the thinking of a turn goes back unchanged
+			// in front of its answer and tool calls
+			if useThinking {
+				assistantContent = append(thinkingContent(h.Thinking), assistantContent...)
+			}
 			messages = append(messages, RequestMessage{
 				Role:    "assistant",
 				Content: assistantContent,
@@ -667,20 +798,27 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 	}
 
 	if modifiers.Image {
-		imageMessage := createImageMessage(prompt)
+		imageMessage, err := createImageMessage(prompt)
+		if err != nil {
+			return MessageBody{}, err
+		}
 		messages = append(messages, imageMessage)
 	} else if modifiers.Pdf != "" {
-		imageMessage := createPdfMessage(prompt, *modifiers)
+		imageMessage, err := createPdfMessage(prompt, *modifiers)
+		if err != nil {
+			return MessageBody{}, err
+		}
 		messages = append(messages, imageMessage)
 	} else {
-		if prompt != "" {
+		if prompt != "" || len(modifiers.Attachments) > 0 {
+			prompt, files := services.PromptWithAttachments(prompt, modifiers.Attachments)
 			userContent := TextContent{
 				Type: "text",
 				Text: prompt,
 			}
 			messages = append(messages, RequestMessage{
 				Role:    "user",
-				Content: []Content{userContent},
+				Content: append([]Content{userContent}, attachmentContent(files)...),
 			})
 		}
 	}
@@ -688,10 +826,13 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 	logger.Debug.Printf("Messages length: %d", len(messages))
 
 	payload := MessageBody{
-		Model:     model,
+		Model:     spec.Model,
 		Messages:  messages,
-		MaxTokens: 20000,
+		MaxTokens: generation.MaxTokens,
 		Stream:    streamed,
+		Temp:      generation.Temperature,
+		TopP:      generation.TopP,
+		Stop:      generation.StopSequences,
 	}
 
 	toolsList := tools.GetCustomTools(mode.Mode, modifiers.ToolGroupFilters...)
@@ -718,6 +859,15 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 		payload.Tools = append(payload.Tools, ToolModel{Value: getWebSearchTool()})
 	}
 
+	if modifiers.Schema != nil {
+		payload.Tools = append(payload.Tools, ToolModel{Value: SchemaTool{
+			Name:        commontypes.StructuredOutputTool,
+			Description: "Return the answer as JSON matching the input schema.",
+			InputSchema: services.StructuredSchema(modifiers.Schema),
+		}})
+		payload.ToolChoice = &ToolChoice{Type: "tool", Name: commontypes.StructuredOutputTool}
+	}
+
 	// Handle system prompt with caching - ALWAYS cache it
 	if context != nil && context.SystemPrompt != "" {
 		systemContent := SystemContent{
@@ -726,18 +876,43 @@ func createClaudePayload(prompt string, streamed bool, history []data.History, m
 		}
 		payload.System = []SystemContent{systemContent}
 	}
+	if summary != "" {
+		payload.System = append(payload.System, SystemContent{
+			Type: "text",
+			Text: compaction.SummarySystemPrompt(summary),
+		})
+	}
 
 	if useThinking {
 		payload.Thinking = &ThinkingBlock{
 			Type:         "enabled",
-			BudgetTokens: 2000,
+			BudgetTokens: generation.ThinkingBudget,
+		}
+		// Thinking only works at the default temperature and a top_p of at
+		// least 0.95, other values of the context wait for -thinking=false
+		payload.Temp = nil
+		if payload.TopP != nil && *payload.TopP < 0.95 {
+			payload.TopP = nil
 		}
-		payload.Temp = 1
 	}
 
 	// logger.Debug.Println("FULL PAYLOAD:")
 	// logger.Debug.Printf("\n----\n\n%v\n\n------\n", payload)
-	return payload
+	return payload, nil
+}
+
+// thinkingContent returns the blocks of the stored thinking that Claude can
+// verify, thinking without a signature is left out.
+func thinkingContent(thinking []data.Thinking) []Content {
+	content := []Content{}
+	for _, block := range thinking {
+		if block.Redacted != "" {
+			content = append(content, RedactedThinkingContent{Type: "redacted_thinking", Data: block.Redacted})
+		} else if block.Signature != "" {
+			content = append(content, ThinkingContent{Type: "thinking", Thinking: block.Text, Signature: block.Signature})
+		}
+	}
+	return content
 }
 
 func toClaudeToolProperties(props map[string]tools.Property) map[string]Property {
@@ -802,14 +977,14 @@ func claudeUsageToTokenUsage(u Usage) *commontypes.TokenUsage {
 	}
 }
 
-func createImageMessage(prompt string) RequestMessage {
+func createImageMessage(prompt string) (RequestMessage, error) {
 	image, err := services.GetImageFromClipboard()
 	if err != nil {
-		panic(fmt.Sprintf("could not get image from clipboard, %v", err))
+		return RequestMessage{}, fmt.Errorf("could not get image from clipboard: %w", err)
 	}
 	base64, err := services.ImageToBase64(image)
 	if err != nil {
-		panic(fmt.Sprintf("could not get base64 from image, %v", err))
+		return RequestMessage{}, fmt.Errorf("could not get base64 from image: %w", err)
 	}
 
 	imageMessage := RequestMessage{Role: "user", Content: []Content{
@@ -820,13 +995,13 @@ func createImageMessage(prompt string) RequestMessage {
 			Data:      base64,
 		}},
 	}}
-	return imageMessage
+	return imageMessage, nil
 }
 
-func createPdfMessage(prompt string, modifiers commontypes.PayloadModifiers) RequestMessage {
+func createPdfMessage(prompt string, modifiers commontypes.PayloadModifiers) (RequestMessage, error) {
 	base64, err := services.ReadPDFAsBase64(modifiers.Pdf)
 	if err != nil {
-		panic(fmt.Sprintf("could not get base64 from pdf, %v", err))
+		return RequestMessage{}, fmt.Errorf("could not get base64 from pdf: %w", err)
 	}
 	imageMessage := RequestMessage{Role: "user", Content: []Content{
 		TextContent{Type: "text", Text: prompt},
@@ -836,7 +1011,25 @@ func createPdfMessage(prompt string, modifiers commontypes.PayloadModifiers) Req
 			Data:      base64,
 		}},
 	}}
-	return imageMessage
+	return imageMessage, nil
+}
+
+// attachmentContent returns an image block for each image and a document
+// block for each PDF.
+func attachmentContent(files []services.AttachmentFile) []Content {
+	content := []Content{}
+	for _, file := range files {
+		blockType := "image"
+		if file.Kind() == data.AttachmentPdf {
+			blockType = "document"
+		}
+		content = append(content, SourceContent{Type: blockType, Source: Source{
+			Type:      string(Base64),
+			MediaType: MediaType(file.MediaType),
+			Data:      file.Base64,
+		}})
+	}
+	return content
 }
 
 func getWebSearchTool() BasicTool {
@@ -847,24 +1040,24 @@ func getWebSearchTool() BasicTool {
 	}
 }
 
-func createClaudeRequest(payload MessageBody) *http.Request {
-	apiKey, ok := os.LookupEnv("CLAUDE_API_KEY")
+func createClaudeRequest(ctx context.Context, spec registry.ModelSpec, payload MessageBody) (*http.Request, error) {
+	apiKey, ok := spec.APIKey()
 	if !ok {
-		panic(fmt.Errorf("Could not fetch api key"))
+		return nil, commontypes.MissingApiKeyError("claude", spec.ApiKeyEnv)
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 	logger.Debug.Println("FULL JSON PAYLOAD:")
 	logger.Debug.Printf("\n%s", jsonpayload)
 
-	url := "https://api.anthropic.com/v1/messages"
+	url := spec.Endpoint("/messages")
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic("failed to create request")
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("x-api-key", apiKey)
@@ -872,5 +1065,5 @@ func createClaudeRequest(payload MessageBody) *http.Request {
 	req.Header.Set("anthropic-version", "2023-06-01")
 	req.Header.Set("anthropic-beta", "prompt-caching-2024-07-31")
 
-	return req
+	return req, nil
 }
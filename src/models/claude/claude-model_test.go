@@ -1,16 +1,25 @@
 package claude_model
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	commontypes "owl/common_types"
 	"owl/data"
 	"owl/logger"
+	"owl/registry"
 	"owl/services"
 	testhelpers "owl/test_helpers"
 )
@@ -28,8 +37,9 @@ func TestClaudeModelToolCallbacksTriggerFinalText(t *testing.T) {
 	handler := testhelpers.NewMockResponseHandler()
 
 	awaitedCalls := 0
-	services.SetAwaitedQueryHook(func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		awaitedCalls++
+		return nil
 	})
 	defer services.SetAwaitedQueryHook(nil)
 
@@ -88,8 +98,9 @@ func TestClaudeModelStreamingToolCallbacks(t *testing.T) {
 
 	handler := testhelpers.NewMockResponseHandler()
 	awaitedCalls := 0
-	services.SetAwaitedQueryHook(func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		awaitedCalls++
+		return nil
 	})
 	defer services.SetAwaitedQueryHook(nil)
 
@@ -166,6 +177,140 @@ func TestClaudeModelStreamingToolCallbacks(t *testing.T) {
 	}
 }
 
+func TestClaudeModelStreamingKeepsThinkingApart(t *testing.T) {
+	ensureTestLogger()
+	ctx := data.Context{Id: 3, Name: "thinking_ctx"}
+	handler := testhelpers.NewMockResponseHandler()
+	model := &ClaudeModel{
+		ResponseHandler: handler,
+		Context:         &ctx,
+		ModelVersion:    "sonnet",
+		Modifiers:       &commontypes.PayloadModifiers{},
+		StreamThought:   true,
+	}
+	model.Prompt = "think"
+
+	streamClaudeEvent(t, model, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         0,
+		"content_block": map[string]interface{}{"type": "thinking", "thinking": ""},
+	})
+	streamClaudeEvent(t, model, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": 0,
+		"delta": map[string]interface{}{"type": "thinking_delta", "thinking": "Let me think"},
+	})
+	streamClaudeEvent(t, model, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": 0,
+		"delta": map[string]interface{}{"type": "signature_delta", "signature": "sig-1"},
+	})
+	streamClaudeEvent(t, model, "content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 0})
+	streamClaudeEvent(t, model, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         1,
+		"content_block": map[string]interface{}{"type": "redacted_thinking", "data": "encrypted"},
+	})
+	streamClaudeEvent(t, model, "content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 1})
+	streamClaudeEvent(t, model, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         2,
+		"content_block": map[string]interface{}{"type": "text"},
+	})
+	streamClaudeEvent(t, model, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": 2,
+		"delta": map[string]interface{}{"type": "text_delta", "text": "The answer"},
+	})
+	streamClaudeEvent(t, model, "content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 2})
+	streamClaudeEvent(t, model, "message_stop", map[string]interface{}{"type": "message_stop"})
+
+	textEvents := handler.CopyTextEvents()
+	if len(textEvents) == 0 || textEvents[0].Text != "Let me think" || textEvents[0].Color == nil {
+		t.Fatalf("expected the thinking to be streamed in color, got %+v", textEvents)
+	}
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 {
+		t.Fatalf("expected final event, got %d", len(finalEvents))
+	}
+	if finalEvents[0].Response != "The answer" {
+		t.Fatalf("expected the answer without thinking, got %q", finalEvents[0].Response)
+	}
+	expected := []data.Thinking{{Text: "Let me think", Signature: "sig-1"}, {Redacted: "encrypted"}}
+	if !reflect.DeepEqual(finalEvents[0].Thinking, expected) {
+		t.Fatalf("expected the thinking with its signature, got %+v", finalEvents[0].Thinking)
+	}
+}
+
+func TestStreamedQueryDoesNotRetryAfterStreamedThinking(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("OWL_TEST_CLAUDE_KEY", "key")
+	services.SetRetryPolicy(services.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	t.Cleanup(func() { services.SetRetryPolicy(services.DefaultRetryPolicy) })
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"thinking\",\"thinking\":\"\"}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"thinking_delta\",\"thinking\":\"Let me think\"}}\n\n")
+		w.(http.Flusher).Flush()
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack failed: %v", err)
+			return
+		}
+		buf.Flush()
+		conn.Close()
+	}))
+	defer backend.Close()
+
+	handler := testhelpers.NewMockResponseHandler()
+	model := &ClaudeModel{
+		ResponseHandler: handler,
+		ModelVersion:    "sonnet",
+		Spec:            registry.ModelSpec{Alias: "sonnet", Provider: registry.ProviderAnthropic, Model: "claude-test", MaxTokens: 1000, BaseURL: backend.URL, ApiKeyEnv: "OWL_TEST_CLAUDE_KEY"},
+		StreamThought:   true,
+		UseStreaming:    true,
+	}
+	repository := testhelpers.NewMockHistoryRepository()
+	err := services.StreamedQuery(context.Background(), "think", model, repository, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "sonnet")
+
+	if err == nil {
+		t.Fatalf("expected the dropped stream to fail")
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected no retry once thinking was streamed, got %d attempts", attempts.Load())
+	}
+	thinking := 0
+	for _, event := range handler.CopyTextEvents() {
+		if event.Text == "Let me think" {
+			thinking++
+		}
+	}
+	if thinking != 1 {
+		t.Fatalf("expected the thinking to reach the handler once, got %d", thinking)
+	}
+}
+
+func TestClaudeModelHandleBodyBytesKeepsThinkingApart(t *testing.T) {
+	ensureTestLogger()
+	ctx := data.Context{Id: 4, Name: "thinking_body_ctx"}
+	handler := testhelpers.NewMockResponseHandler()
+	model := &ClaudeModel{ResponseHandler: handler, Context: &ctx, ModelVersion: "sonnet", Modifiers: &commontypes.PayloadModifiers{}}
+
+	model.HandleBodyBytes([]byte(`{"content":[{"type":"thinking","thinking":"Let me think","signature":"sig-1"},{"type":"text","text":"The answer"}]}`))
+
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 || strings.Contains(finalEvents[0].Response, "Let me think") {
+		t.Fatalf("expected the answer without thinking, got %+v", finalEvents)
+	}
+	if len(finalEvents[0].Thinking) != 1 || finalEvents[0].Thinking[0].Signature != "sig-1" {
+		t.Fatalf("expected the thinking with its signature, got %+v", finalEvents[0].Thinking)
+	}
+}
+
 func TestClaudeModelHandleBodyBytes_RealToolUsePayload(t *testing.T) {
 	ensureTestLogger()
 
@@ -175,8 +320,9 @@ func TestClaudeModelHandleBodyBytes_RealToolUsePayload(t *testing.T) {
 
 	handler := testhelpers.NewMockResponseHandler()
 	awaitedCalls := 0
-	services.SetAwaitedQueryHook(func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		awaitedCalls++
+		return nil
 	})
 	defer services.SetAwaitedQueryHook(nil)
 
@@ -276,7 +422,7 @@ func TestClaudePayloadReplaysToolUseFromHistoryRecord(t *testing.T) {
 		},
 	}
 
-	payload := createClaudePayload("latest", false, history, "claude-sonnet", false, &data.Context{Id: 11}, &commontypes.PayloadModifiers{})
+	payload, _ := createClaudePayload("latest", false, history, registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000}, false, &data.Context{Id: 11}, &commontypes.PayloadModifiers{})
 	messageSlice, ok := payload.Messages.([]Message)
 	if !ok {
 		t.Fatalf("expected payload.Messages to be []Message")
@@ -311,6 +457,119 @@ func TestClaudePayloadReplaysToolUseFromHistoryRecord(t *testing.T) {
 	}
 }
 
+func TestClaudePayloadReplaysThinkingWithSignature(t *testing.T) {
+	history := []data.History{
+		{
+			Prompt:   "inspect the records",
+			Response: "Let me look",
+			Thinking: []data.Thinking{{Text: "a tool will help", Signature: "sig-1"}, {Text: "unsigned"}, {Redacted: "encrypted"}},
+			ToolUse: []data.ToolUse{
+				{Id: "toolu_1", Name: "lookup", CallerType: "assistant", Input: `{}`, Result: data.ToolResult{ToolUseId: "toolu_1", Content: "found", Success: true}},
+			},
+		},
+	}
+	spec := registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000, ThinkingBudget: 1024}
+
+	payload, _ := createClaudePayload("latest", false, history, spec, true, &data.Context{Id: 12}, &commontypes.PayloadModifiers{})
+	assistant := payload.Messages.([]Message)[1].(RequestMessage)
+	if assistant.Role != "assistant" || len(assistant.Content) != 4 {
+		t.Fatalf("expected two thinking blocks, the answer and the tool use, got %+v", assistant)
+	}
+	thinking, ok := assistant.Content[0].(ThinkingContent)
+	if !ok || thinking.Thinking != "a tool will help" || thinking.Signature != "sig-1" {
+		t.Fatalf("expected the signed thinking first, got %+v", assistant.Content[0])
+	}
+	if redacted, ok := assistant.Content[1].(RedactedThinkingContent); !ok || redacted.Data != "encrypted" {
+		t.Fatalf("expected the redacted thinking second, got %+v", assistant.Content[1])
+	}
+
+	payload, _ = createClaudePayload("latest", false, history, spec, false, &data.Context{Id: 12}, &commontypes.PayloadModifiers{})
+	assistant = payload.Messages.([]Message)[1].(RequestMessage)
+	if len(assistant.Content) != 2 {
+		t.Fatalf("expected no thinking without thinking enabled, got %+v", assistant.Content)
+	}
+}
+
+func TestClaudePayloadAppliesContextGenerationSettings(t *testing.T) {
+	temperature, topP := 0.3, 0.9
+	context := &data.Context{Id: 13, Generation: data.GenerationSettings{MaxTokens: 8000, ThinkingBudget: 4096, Temperature: &temperature, TopP: &topP, StopSequences: []string{"END"}}}
+	spec := registry.ModelSpec{Model: "claude-sonnet", Provider: registry.ProviderAnthropic, MaxTokens: 20000, ThinkingBudget: 2000}
+
+	payload, err := createClaudePayload("latest", false, nil, spec, false, context, &commontypes.PayloadModifiers{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if payload.MaxTokens != 8000 || payload.Temp == nil || *payload.Temp != 0.3 || payload.TopP == nil || *payload.TopP != 0.9 || len(payload.Stop) != 1 {
+		t.Fatalf("expected the settings of the context, got %+v", payload)
+	}
+
+	payload, _ = createClaudePayload("latest", false, nil, spec, true, context, &commontypes.PayloadModifiers{})
+	if payload.Thinking == nil || payload.Thinking.BudgetTokens != 4096 {
+		t.Fatalf("expected the thinking budget of the context, got %+v", payload.Thinking)
+	}
+	if payload.Temp != nil || payload.TopP != nil {
+		t.Fatalf("expected no temperature or low top_p with thinking, got %v %v", payload.Temp, payload.TopP)
+	}
+
+	high := 1.5
+	context.Generation = data.GenerationSettings{Temperature: &high}
+	payload, err = createClaudePayload("latest", false, nil, spec, false, context, &commontypes.PayloadModifiers{})
+	if err != nil || payload.Temp != nil {
+		t.Fatalf("expected a temperature above 1 to be left out, got %v %v", payload.Temp, err)
+	}
+
+	context.Generation = data.GenerationSettings{MaxTokens: 1500}
+	payload, err = createClaudePayload("latest", false, nil, spec, true, context, &commontypes.PayloadModifiers{})
+	if err != nil || payload.Thinking != nil {
+		t.Fatalf("expected thinking to be left out when the budget does not fit max_tokens, got %+v %v", payload.Thinking, err)
+	}
+}
+
+func TestClaudePayloadForcesTheStructuredAnswerTool(t *testing.T) {
+	ensureTestLogger()
+	spec := registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000, ThinkingBudget: 2000}
+	schema := map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+
+	payload, err := createClaudePayload("list them", false, nil, spec, true, &data.Context{Id: 14}, &commontypes.PayloadModifiers{Schema: schema})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if payload.ToolChoice == nil || payload.ToolChoice.Type != "tool" || payload.ToolChoice.Name != commontypes.StructuredOutputTool {
+		t.Fatalf("expected the structured answer tool to be forced, got %+v", payload.ToolChoice)
+	}
+	if payload.Thinking != nil {
+		t.Fatalf("expected thinking to be off for a forced tool call, got %+v", payload.Thinking)
+	}
+	tool, ok := payload.Tools[len(payload.Tools)-1].Value.(SchemaTool)
+	if !ok || tool.InputSchema["type"] != "object" {
+		t.Fatalf("expected the schema wrapped in an object as the last tool, got %+v", payload.Tools[len(payload.Tools)-1])
+	}
+}
+
+func TestClaudeModelTakesTheStructuredAnswerFromTheTool(t *testing.T) {
+	ensureTestLogger()
+	awaitedCalls := 0
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		awaitedCalls++
+		return nil
+	})
+	defer services.SetAwaitedQueryHook(nil)
+
+	ctx := data.Context{Id: 15, Name: "structured_ctx"}
+	handler := testhelpers.NewMockResponseHandler()
+	model := &ClaudeModel{ResponseHandler: handler, Context: &ctx, ModelVersion: "sonnet", Modifiers: &commontypes.PayloadModifiers{}}
+
+	model.HandleBodyBytes([]byte(`{"content":[{"type":"tool_use","id":"tool-1","name":"structured_output","input":{"name":"owl"}}]}`))
+
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 || finalEvents[0].Response != `{"name":"owl"}` || len(finalEvents[0].ToolUse) != 0 {
+		t.Fatalf("expected the tool input as the answer and no tool use, got %+v", finalEvents)
+	}
+	if awaitedCalls != 0 {
+		t.Fatalf("expected no continuation, got %d", awaitedCalls)
+	}
+}
+
 func TestClaudePayloadCachingRules(t *testing.T) {
 	history := []data.History{
 		{Prompt: "First question", Response: "answer"},
@@ -319,7 +578,7 @@ func TestClaudePayloadCachingRules(t *testing.T) {
 		buildToolHistory("Fourth question", []string{"tool-b1", "tool-b2"}),
 	}
 	context := &data.Context{Id: 1}
-	payload := createClaudePayload("latest", false, history, "claude-sonnet", false, context, &commontypes.PayloadModifiers{})
+	payload, _ := createClaudePayload("latest", false, history, registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000}, false, context, &commontypes.PayloadModifiers{})
 	messageSlice, ok := payload.Messages.([]Message)
 	if !ok {
 		t.Fatalf("expected payload.Messages to be []Message")
@@ -355,6 +614,56 @@ func TestClaudePayloadCachingRules(t *testing.T) {
 	}
 }
 
+func TestClaudePayloadSendsCompactionSummaryAsSystemBlock(t *testing.T) {
+	history := []data.History{
+		{IsSummary: true, Response: "the user is migrating the billing service"},
+		{Id: 30, Prompt: "and the invoices?", Response: "next sprint"},
+	}
+
+	payload, _ := createClaudePayload("latest", false, history, registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000}, false, &data.Context{Id: 11, SystemPrompt: "be brief"}, &commontypes.PayloadModifiers{})
+
+	if len(payload.System) != 2 || payload.System[0].Text != "be brief" || !strings.Contains(payload.System[1].Text, "the user is migrating the billing service") {
+		t.Fatalf("expected the system prompt followed by the summary, got %+v", payload.System)
+	}
+	messageSlice := payload.Messages.([]Message)
+	if len(messageSlice) != 3 {
+		t.Fatalf("expected the summary not to be replayed as a turn, got %d messages", len(messageSlice))
+	}
+}
+
+func TestClaudePayloadSendsAttachmentsAsContentBlocks(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "chart.png")
+	pdfPath := filepath.Join(dir, "report.pdf")
+	os.WriteFile(imagePath, []byte("\x89PNG\r\n\x1a\nfake"), 0o644)
+	os.WriteFile(pdfPath, []byte("%PDF-1.4 fake"), 0o644)
+	image, _ := services.LoadAttachment(imagePath, nil)
+	pdf, _ := services.LoadAttachment(pdfPath, nil)
+	notes, _ := services.LoadAttachment("-", strings.NewReader("remember the milk"))
+
+	history := []data.History{{Prompt: "what is this?", Response: "a chart", Attachments: []data.Attachment{image}}}
+	payload, err := createClaudePayload("summarize", false, history, registry.ModelSpec{Model: "claude-sonnet", MaxTokens: 20000}, false, &data.Context{Id: 15}, &commontypes.PayloadModifiers{Attachments: []data.Attachment{pdf, notes}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages := payload.Messages.([]Message)
+	replayed := messages[0].(RequestMessage).Content
+	if len(replayed) != 2 || replayed[1].(SourceContent).Type != "image" || replayed[1].(SourceContent).Source.MediaType != "image/png" {
+		t.Fatalf("expected the replayed turn to carry its image, got %+v", replayed)
+	}
+	current := messages[2].(RequestMessage).Content
+	text := current[0].(TextContent).Text
+	if !strings.Contains(text, "remember the milk") || !strings.HasSuffix(text, "summarize") {
+		t.Fatalf("expected the text attachment inlined before the prompt, got %q", text)
+	}
+	if len(current) != 2 || current[1].(SourceContent).Type != "document" || current[1].(SourceContent).Source.MediaType != "application/pdf" {
+		t.Fatalf("expected the pdf as a document block, got %+v", current)
+	}
+}
+
 func buildToolHistory(prompt string, toolIDs []string) data.History {
 	toolUses := make([]data.ToolUse, len(toolIDs))
 	for i, id := range toolIDs {
@@ -2,37 +2,46 @@ package gemeni_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	commontypes "owl/common_types"
 	"owl/data"
 	"owl/logger"
 	"owl/models/open-ai-base"
+	"owl/registry"
 )
 
 type GemeniModel struct {
 	openai_base.OpenAICompatibleModel
+	Spec registry.ModelSpec
 }
 
 func (model *GemeniModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
 	model.ResponseHandler = responseHandler
 }
 
-func (model *GemeniModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *GemeniModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	// Initialize the base model fields
 	model.Prompt = prompt
 	model.AccumulatedAnswer = ""
+	model.StreamedOutput = false
 	model.ContextId = context.Id
 	model.Context = context
 	model.StreamedToolCalls = make(map[int]*openai_base.StreamingToolCall)
 	model.ModelName = "gemeni"
 	model.Modifiers = modifiers
+	model.RequestCtx = ctx
 
 	// Standard chat completions request via Gemini OpenAI-compatible endpoint
-	payload := openai_base.CreatePayload(prompt, streaming, history, modifiers, "gemini-3-flash-preview", 16000, context)
-	return createGemeniRequest(payload)
+	spec := registry.Resolve(model.Spec, "gemeni", "gemeni")
+	generation := spec.Generation(context.Generation)
+	payload, err := openai_base.CreatePayload(prompt, streaming, history, modifiers, spec.Model, generation, context)
+	if err != nil {
+		return nil, err
+	}
+	return createGemeniRequest(ctx, spec, payload)
 }
 
 func (model *GemeniModel) HandleStreamedLine(line []byte) {
@@ -45,28 +54,28 @@ func (model *GemeniModel) HandleBodyBytes(bytes []byte) {
 	model.OpenAICompatibleModel.HandleBodyBytes(bytes, model)
 }
 
-func createGemeniRequest(payload interface{}) *http.Request {
-	apiKey, ok := os.LookupEnv("GEMINI_API_KEY")
+func createGemeniRequest(ctx context.Context, spec registry.ModelSpec, payload interface{}) (*http.Request, error) {
+	apiKey, ok := spec.APIKey()
 	if !ok {
-		panic(fmt.Errorf("Could not fetch GEMINI_API_KEY"))
+		return nil, commontypes.MissingApiKeyError("gemini", spec.ApiKeyEnv)
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	logger.Debug.Printf("Gemini Request Payload:\n%s", string(jsonpayload))
 
-	url := "https://generativelanguage.googleapis.com/v1beta/openai/chat/completions"
+	url := spec.Endpoint("/chat/completions")
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
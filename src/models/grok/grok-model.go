@@ -2,18 +2,20 @@ package grok_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	commontypes "owl/common_types"
 	"owl/data"
 	"owl/logger"
 	"owl/models/open-ai-base"
+	"owl/registry"
 )
 
 type GrokModel struct {
 	openai_base.OpenAICompatibleModel
+	Spec registry.ModelSpec
 }
 
 func (model *GrokModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
@@ -21,26 +23,34 @@ func (model *GrokModel) SetResponseHandler(responseHandler commontypes.ResponseH
 
 }
 
-func (model *GrokModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *GrokModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	// Initialize the base model fields
 	model.Prompt = prompt
 	model.AccumulatedAnswer = ""
+	model.StreamedOutput = false
 	model.ContextId = context.Id
 	model.Context = context
 	model.StreamedToolCalls = make(map[int]*openai_base.StreamingToolCall)
 	model.ModelName = "grok"
 	model.Modifiers = modifiers
+	model.RequestCtx = ctx
+
+	spec := registry.Resolve(model.Spec, "grok", "grok")
 
 	// Check if web search is enabled - use different API endpoint
 	if modifiers.Web {
 		logger.Debug.Println("Web search enabled for Grok, using /v1/responses endpoint")
-		payload := openai_base.CreateWebSearchPayload(prompt, history, "grok-4-1-fast-reasoning", context)
-		return createGrokRequest(payload, true)
+		payload := openai_base.CreateWebSearchPayload(prompt, history, spec.Model, context)
+		return createGrokRequest(ctx, spec, payload, true)
 	}
 
 	// Standard chat completions request
-	payload := openai_base.CreatePayload(prompt, streaming, history, modifiers, "grok-4-1-fast-reasoning", 8000, context)
-	return createGrokRequest(payload, false)
+	generation := spec.Generation(context.Generation)
+	payload, err := openai_base.CreatePayload(prompt, streaming, history, modifiers, spec.Model, generation, context)
+	if err != nil {
+		return nil, err
+	}
+	return createGrokRequest(ctx, spec, payload, false)
 }
 
 func (model *GrokModel) HandleStreamedLine(line []byte) {
@@ -61,33 +71,33 @@ func (model *GrokModel) HandleBodyBytes(bytes []byte) {
 	model.OpenAICompatibleModel.HandleBodyBytes(bytes, model)
 }
 
-func createGrokRequest(payload interface{}, isWebSearch bool) *http.Request {
-	apiKey, ok := os.LookupEnv("XAI_API_KEY")
+func createGrokRequest(ctx context.Context, spec registry.ModelSpec, payload interface{}, isWebSearch bool) (*http.Request, error) {
+	apiKey, ok := spec.APIKey()
 	if !ok {
-		panic(fmt.Errorf("Could not fetch XAI_API_KEY"))
+		return nil, commontypes.MissingApiKeyError("grok", spec.ApiKeyEnv)
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	logger.Debug.Printf("Grok Request Payload:\n%s", string(jsonpayload))
 
 	// Use different endpoint for web search
-	url := "https://api.x.ai/v1/chat/completions"
+	url := spec.Endpoint("/chat/completions")
 	if isWebSearch {
-		url = "https://api.x.ai/v1/responses"
+		url = spec.Endpoint("/responses")
 		logger.Debug.Println("Using Grok web search endpoint: /v1/responses")
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
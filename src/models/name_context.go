@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"github.com/fatih/color"
 	commontypes "owl/common_types"
@@ -21,11 +22,16 @@ func Name_new_context(user_prompt string, repository data.HistoryRepository) str
 	model, _ := picker.GetModelForQuery("haiku", nil, &toolHandler, repository, false, false, false, false)
 
 	prompt := fmt.Sprintf("Create a short context name for this prompt. Return ONLY the name, nothing else. Use at most 3 words, plain text only, no punctuation, no quotes. Prompt: %s", user_prompt)
-	services.AwaitedQuery(prompt, model, repository, 0, &data.Context{
+	err := services.AwaitedQuery(context.Background(), prompt, model, repository, 0, &data.Context{
 		Name:    "Create name for context",
 		Id:      9999,
 		History: []data.History{},
 	}, &commontypes.PayloadModifiers{}, "haiku")
+	if err != nil {
+		// Fall back to the start of the prompt so the conversation can go on
+		services.ReportError(err)
+		return fallbackContextName(user_prompt)
+	}
 
 	response := <-toolHandler.ResponseChannel
 	response = normalizeContextName(response)
@@ -36,6 +42,17 @@ func Name_new_context(user_prompt string, repository data.HistoryRepository) str
 	return response
 }
 
+func fallbackContextName(userPrompt string) string {
+	parts := strings.Fields(userPrompt)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	if len(parts) == 0 {
+		return "new context"
+	}
+	return strings.Join(parts, " ")
+}
+
 func normalizeContextName(raw string) string {
 	parts := strings.Fields(raw)
 	return strings.Join(parts, " ")
@@ -2,6 +2,7 @@ package ollama_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,22 +10,25 @@ import (
 	commontypes "owl/common_types"
 	"owl/data"
 	openai_base "owl/models/open-ai-base"
+	"owl/registry"
 )
 
 type OllamaModel struct {
 	openai_base.OpenAICompatibleModel
 	ModelVersion string
+	Spec         registry.ModelSpec
 	ollamaURL    string
 }
 
-func NewOllamaModel(responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, modelName string) *OllamaModel {
-	// Get model name from env or use default
-	if modelName == "" {
-		modelName = "qwen3" // default model
-	}
+func NewOllamaModel(responseHandler commontypes.ResponseHandler, historyRepository data.HistoryRepository, spec registry.ModelSpec) *OllamaModel {
+	// Without a registry entry use the default model
+	spec = registry.Resolve(spec, spec.Alias, "ollama")
 
-	// Get Ollama URL from env or use default
-	ollamaURL := os.Getenv("OLLAMA_URL")
+	// A base url in the registry wins over OLLAMA_URL
+	ollamaURL := spec.BaseURL
+	if ollamaURL == "" {
+		ollamaURL = os.Getenv("OLLAMA_URL")
+	}
 	if ollamaURL == "" {
 		ollamaURL = "http://localhost:11434" // default Ollama URL
 	}
@@ -34,7 +38,8 @@ func NewOllamaModel(responseHandler commontypes.ResponseHandler, historyReposito
 			ResponseHandler:   responseHandler,
 			HistoryRepository: historyRepository,
 		},
-		ModelVersion: modelName,
+		ModelVersion: spec.Model,
+		Spec:         spec,
 		ollamaURL:    ollamaURL,
 	}
 }
@@ -43,17 +48,23 @@ func (model *OllamaModel) SetResponseHandler(responseHandler commontypes.Respons
 	model.ResponseHandler = responseHandler
 }
 
-func (model *OllamaModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *OllamaModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	model.Prompt = prompt
 	model.AccumulatedAnswer = ""
+	model.StreamedOutput = false
 	model.ContextId = context.Id
 	model.Context = context
 	model.StreamedToolCalls = make(map[int]*openai_base.StreamingToolCall)
 	model.ModelName = model.ModelVersion
 	model.Modifiers = modifiers
+	model.RequestCtx = ctx
 
-	payload := openai_base.CreatePayload(prompt, streaming, history, modifiers, model.ModelVersion, 8000, context)
-	return model.createRequest(payload)
+	generation := model.Spec.Generation(context.Generation)
+	payload, err := openai_base.CreatePayload(prompt, streaming, history, modifiers, model.ModelVersion, generation, context)
+	if err != nil {
+		return nil, err
+	}
+	return model.createRequest(ctx, payload)
 }
 
 func (model *OllamaModel) HandleStreamedLine(line []byte) {
@@ -64,21 +75,21 @@ func (model *OllamaModel) HandleBodyBytes(bytes []byte) {
 	model.OpenAICompatibleModel.HandleBodyBytes(bytes, model)
 }
 
-func (model *OllamaModel) createRequest(payload interface{}) *http.Request {
+func (model *OllamaModel) createRequest(ctx context.Context, payload interface{}) (*http.Request, error) {
 	// Ollama doesn't require an API key for local instances
 	// But we'll check for one in case someone is using a remote Ollama instance
-	apiKey := os.Getenv("OLLAMA_API_KEY")
+	apiKey, _ := model.Spec.APIKey()
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	// Use OpenAI-compatible endpoint
 	url := fmt.Sprintf("%s/v1/chat/completions", model.ollamaURL)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -88,5 +99,5 @@ func (model *OllamaModel) createRequest(payload interface{}) *http.Request {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 	}
 
-	return req
+	return req, nil
 }
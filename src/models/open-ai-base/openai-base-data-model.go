@@ -15,11 +15,27 @@ type RequestMessage struct {
 }
 
 type ChatCompletionRequest struct {
-	Model     string         `json:"model"`
-	Messages  []interface{}  `json:"messages"`
-	Tools     []FunctionTool `json:"tools,omitempty"`
-	Stream    bool           `json:"stream"`
-	MaxTokens int            `json:"max_completion_tokens"`
+	Model           string          `json:"model"`
+	Messages        []interface{}   `json:"messages"`
+	Tools           []FunctionTool  `json:"tools,omitempty"`
+	Stream          bool            `json:"stream"`
+	MaxTokens       int             `json:"max_completion_tokens"`
+	Temperature     *float64        `json:"temperature,omitempty"`
+	TopP            *float64        `json:"top_p,omitempty"`
+	Stop            []string        `json:"stop,omitempty"`
+	ReasoningEffort string          `json:"reasoning_effort,omitempty"`
+	ResponseFormat  *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat asks for an answer matching a JSON Schema.
+type ResponseFormat struct {
+	Type       string     `json:"type"`
+	JSONSchema JSONSchema `json:"json_schema"`
+}
+
+type JSONSchema struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
 }
 
 // Tool calling structures (OpenAI format)
@@ -76,15 +92,22 @@ type Delta struct {
 }
 
 type RequestContent struct {
-	Type     string `json:"type"`
-	Text     string `json:"text,omitempty"`
-	ImageURL *Image `json:"image_url,omitempty"`
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *Image    `json:"image_url,omitempty"`
+	File     *FilePart `json:"file,omitempty"`
 }
 
 type Image struct {
 	URL string `json:"url"`
 }
 
+// FilePart is a file sent inline, file_data is a data URL.
+type FilePart struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
 type ChatCompletionChunkChoice struct {
 	Index        int         `json:"index"`
 	Delta        Delta       `json:"delta"`
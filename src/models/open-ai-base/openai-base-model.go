@@ -1,9 +1,11 @@
 package openai_base
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	commontypes "owl/common_types"
+	"owl/compaction"
 	"owl/data"
 	"owl/logger"
 	"owl/mode"
@@ -32,6 +34,37 @@ type OpenAICompatibleModel struct {
 	ModelName         string
 	Modifiers         *commontypes.PayloadModifiers
 	PendingUsage      *commontypes.TokenUsage
+	RequestCtx        context.Context
+	// StreamedOutput is set once the request passed anything to the
+	// ResponseHandler, see HasStreamedOutput
+	StreamedOutput bool
+}
+
+// PartialResponse reports the prompt and answer of the turn in flight.
+func (model *OpenAICompatibleModel) PartialResponse() (string, string) {
+	return model.Prompt, model.AccumulatedAnswer
+}
+
+// HasStreamedOutput reports whether the request in flight passed text or tool
+// status to the ResponseHandler. It stays set after FinalText, so a stream
+// that breaks after the turn was handed over is not sent again.
+func (model *OpenAICompatibleModel) HasStreamedOutput() bool {
+	return model.StreamedOutput
+}
+
+// turnAttachments are the files sent with the prompt of the turn, tool
+// continuations have none.
+func (model *OpenAICompatibleModel) turnAttachments() []data.Attachment {
+	if model.Modifiers == nil {
+		return nil
+	}
+	return model.Modifiers.Attachments
+}
+
+// finishTurn clears the turn state once it has been handed to FinalText.
+func (model *OpenAICompatibleModel) finishTurn() {
+	model.Prompt = ""
+	model.AccumulatedAnswer = ""
 }
 
 func (model *OpenAICompatibleModel) sendToolStatus(message string) {
@@ -43,6 +76,7 @@ func (model *OpenAICompatibleModel) sendToolStatus(message string) {
 		return
 	}
 	color := "cyan"
+	model.StreamedOutput = true
 	model.ResponseHandler.RecievedText("\n"+trimmed+"\n", &color)
 }
 
@@ -82,6 +116,7 @@ func (model *OpenAICompatibleModel) HandleStreamedLine(line []byte, callback_mod
 			// Handle regular content
 			if choice.Delta.Content != "" {
 				model.AccumulatedAnswer += choice.Delta.Content
+				model.StreamedOutput = true
 				model.ResponseHandler.RecievedText(choice.Delta.Content, nil)
 			}
 		}
@@ -148,15 +183,17 @@ func (model *OpenAICompatibleModel) FinishStreaming(callback_model commontypes.M
 		logger.Debug.Printf("Calling Final Text with answer: %v, \nand tool result: %v", model.AccumulatedAnswer, toolUses)
 
 		usage := model.PendingUsage
-		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, model.AccumulatedAnswer, toolUses, model.ModelName, usage)
+		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, model.AccumulatedAnswer, toolUses, model.ModelName, usage, nil, model.turnAttachments())
 		model.PendingUsage = nil
+		model.finishTurn()
 
 		// Continue with results
 		if len(localToolUses) > 0 {
-			services.AwaitedQuery("", callback_model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
+			err := services.AwaitedQuery(model.RequestCtx, "", callback_model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
 				ToolUses:         localToolUses,
 				ToolGroupFilters: model.Modifiers.ToolGroupFilters,
 			}, model.ModelName)
+			services.ReportError(err)
 		}
 
 		// Reset
@@ -165,8 +202,9 @@ func (model *OpenAICompatibleModel) FinishStreaming(callback_model commontypes.M
 		// Regular finish
 		logger.Debug.Printf("Calling Final Text with answer: %v", model.AccumulatedAnswer)
 		usage := model.PendingUsage
-		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, model.AccumulatedAnswer, nil, model.ModelName, usage)
+		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, model.AccumulatedAnswer, nil, model.ModelName, usage, nil, model.turnAttachments())
 		model.PendingUsage = nil
+		model.finishTurn()
 	}
 }
 
@@ -194,20 +232,23 @@ func (model *OpenAICompatibleModel) HandleBodyBytes(bytes []byte, callback_model
 		toolUses, localToolUses := model.collectToolUsesFromChatCompletion(message)
 
 		usage := usageFromOpenAI(apiResponse.Usage)
-		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, message.Content, toolUses, model.ModelName, usage)
+		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, message.Content, toolUses, model.ModelName, usage, nil, model.turnAttachments())
 		model.PendingUsage = nil
+		model.finishTurn()
 
 		// Continue conversation with tool results
 		if len(localToolUses) > 0 {
-			services.AwaitedQuery("", callback_model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
+			err := services.AwaitedQuery(model.RequestCtx, "", callback_model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
 				ToolUses: localToolUses,
 			}, model.ModelName)
+			services.ReportError(err)
 		}
 	} else {
 		// Regular text response
 		usage := usageFromOpenAI(apiResponse.Usage)
-		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, message.Content, nil, model.ModelName, usage)
+		model.ResponseHandler.FinalText(model.ContextId, model.Prompt, message.Content, nil, model.ModelName, usage, nil, model.turnAttachments())
 		model.PendingUsage = nil
+		model.finishTurn()
 	}
 }
 
@@ -245,8 +286,10 @@ func (model *OpenAICompatibleModel) HandleToolCalls(message Message) []data.Tool
 			ResponseHandler:   &model.ResponseHandler,
 			HistoryRepository: &model.HistoryRepository,
 			Context:           model.Context,
+			RequestCtx:        model.RequestCtx,
 		}
-		result, err := runner.ExecuteTool(*model.Context, toolCall.Function.Name, args)
+		call := data.ToolUse{Id: toolCall.Id, Name: toolCall.Function.Name, Input: toolCall.Function.Arguments, CallerType: "assistant"}
+		result, err := runner.ExecuteTool(*model.Context, call, args)
 
 		if err != nil {
 			logger.Debug.Printf("Error executing tool: %s", err)
@@ -268,14 +311,32 @@ func (model *OpenAICompatibleModel) HandleToolCalls(message Message) []data.Tool
 	return toolUses
 }
 
-// CreatePayload builds the request payload with history and tool definitions
-func CreatePayload(prompt string, streamed bool, history []data.History, modifiers *commontypes.PayloadModifiers, model string, maxTokens int, context *data.Context) ChatCompletionRequest {
+// userContent is the prompt with text attachments inlined, followed by an
+// image_url part for each image and a file part for each PDF.
+func userContent(prompt string, attachments []data.Attachment) []RequestContent {
+	prompt, files := services.PromptWithAttachments(prompt, attachments)
+	content := []RequestContent{{Type: "text", Text: prompt}}
+	for _, file := range files {
+		dataURL := fmt.Sprintf("data:%s;base64,%s", file.MediaType, file.Base64)
+		if file.Kind() == data.AttachmentPdf {
+			content = append(content, RequestContent{Type: "file", File: &FilePart{Filename: file.Name, FileData: dataURL}})
+			continue
+		}
+		content = append(content, RequestContent{Type: "image_url", ImageURL: &Image{URL: dataURL}})
+	}
+	return content
+}
+
+// CreatePayload builds the request payload with history and tool definitions.
+// generation holds the settings the model resolved for the context.
+func CreatePayload(prompt string, streamed bool, history []data.History, modifiers *commontypes.PayloadModifiers, model string, generation data.GenerationSettings, context *data.Context) (ChatCompletionRequest, error) {
 	logger.Debug.Printf("\nMODEL USE: creating grok payload: %s", "PLACEHOLDER FROM GROK")
 
 	if modifiers == nil {
 		modifiers = &commontypes.PayloadModifiers{}
 	}
 
+	summary, history := compaction.SplitSummary(history)
 	messages := []interface{}{}
 	replayedToolUseIDs := map[string]bool{}
 
@@ -285,11 +346,16 @@ func CreatePayload(prompt string, streamed bool, history []data.History, modifie
 			Content: context.SystemPrompt,
 		})
 	}
+	if summary != "" {
+		messages = append(messages, RequestMessage{
+			Role:    "developer",
+			Content: compaction.SummarySystemPrompt(summary),
+		})
+	}
 
 	// Process history (including tool results)
 	for _, h := range history {
-		questionContent := RequestContent{Type: "text", Text: h.Prompt}
-		messages = append(messages, RequestMessage{Role: "user", Content: []RequestContent{questionContent}})
+		messages = append(messages, RequestMessage{Role: "user", Content: userContent(h.Prompt, h.Attachments)})
 
 		localToolUses := filterLocalToolUses(h.ToolUse)
 		if len(localToolUses) > 0 {
@@ -354,11 +420,11 @@ func CreatePayload(prompt string, streamed bool, history []data.History, modifie
 	if modifiers.Image {
 		image, err := services.GetImageFromClipboard()
 		if err != nil {
-			panic(fmt.Sprintf("could not get image from clipboard, %s", err))
+			return ChatCompletionRequest{}, fmt.Errorf("could not get image from clipboard: %w", err)
 		}
 		base64, err := services.ImageToBase64(image)
 		if err != nil {
-			panic(fmt.Sprintf("could not get base64 from image, %s", err))
+			return ChatCompletionRequest{}, fmt.Errorf("could not get base64 from image: %w", err)
 		}
 
 		messages = append(messages, RequestMessage{Role: "user", Content: []RequestContent{
@@ -368,16 +434,27 @@ func CreatePayload(prompt string, streamed bool, history []data.History, modifie
 			}},
 		}})
 	} else {
-		if prompt != "" {
-			messages = append(messages, RequestMessage{Role: "user", Content: []RequestContent{{Type: "text", Text: prompt}}})
+		if prompt != "" || len(modifiers.Attachments) > 0 {
+			messages = append(messages, RequestMessage{Role: "user", Content: userContent(prompt, modifiers.Attachments)})
 		}
 	}
 
 	payload := ChatCompletionRequest{
-		Model:     model,
-		Stream:    streamed,
-		Messages:  messages,
-		MaxTokens: maxTokens,
+		Model:           model,
+		Stream:          streamed,
+		Messages:        messages,
+		MaxTokens:       generation.MaxTokens,
+		Temperature:     generation.Temperature,
+		TopP:            generation.TopP,
+		Stop:            generation.StopSequences,
+		ReasoningEffort: generation.ReasoningEffort,
+	}
+
+	if modifiers.Schema != nil {
+		payload.ResponseFormat = &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: JSONSchema{Name: commontypes.StructuredOutputTool, Schema: services.StructuredSchema(modifiers.Schema)},
+		}
 	}
 
 	// Add tools
@@ -387,7 +464,7 @@ func CreatePayload(prompt string, streamed bool, history []data.History, modifie
 		logger.Debug.Printf("Added %d tools to payload", len(payload.Tools))
 	}
 
-	return payload
+	return payload, nil
 }
 
 // ConvertToolsToOpenAIFormat converts tool definitions to OpenAI function calling format
@@ -594,7 +671,10 @@ func (model *OpenAICompatibleModel) HandleWebSearchResponse(bytes []byte, callba
 		toolUses,
 		model.ModelName,
 		nil,
+		nil,
+		model.turnAttachments(),
 	)
+	model.finishTurn()
 }
 
 func filterLocalToolUses(toolUses []data.ToolUse) []data.ToolUse {
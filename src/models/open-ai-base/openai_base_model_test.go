@@ -1,10 +1,13 @@
 package openai_base
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -28,8 +31,9 @@ func TestOpenAIModelToolCallbacksTriggerFinalText(t *testing.T) {
 	handler := testhelpers.NewMockResponseHandler()
 
 	awaitedCalls := 0
-	services.SetAwaitedQueryHook(func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		awaitedCalls++
+		return nil
 	})
 	defer services.SetAwaitedQueryHook(nil)
 
@@ -89,8 +93,9 @@ func TestOpenAIModelStreamingToolCallbacks(t *testing.T) {
 
 	handler := testhelpers.NewMockResponseHandler()
 	awaitedCalls := 0
-	services.SetAwaitedQueryHook(func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
 		awaitedCalls++
+		return nil
 	})
 	defer services.SetAwaitedQueryHook(nil)
 
@@ -170,7 +175,7 @@ func TestCreatePayloadReplaysHistoryToolUses(t *testing.T) {
 		},
 	}
 
-	payload := CreatePayload("latest", false, history, &commontypes.PayloadModifiers{}, "gpt-test", 2000, &data.Context{})
+	payload, _ := CreatePayload("latest", false, history, &commontypes.PayloadModifiers{}, "gpt-test", data.GenerationSettings{MaxTokens: 2000}, &data.Context{})
 
 	hasAssistantToolCall := false
 	hasToolResult := false
@@ -194,6 +199,24 @@ func TestCreatePayloadReplaysHistoryToolUses(t *testing.T) {
 	}
 }
 
+func TestCreatePayloadSendsCompactionSummaryAsDeveloperMessage(t *testing.T) {
+	ensureTestLogger()
+	history := []data.History{
+		{IsSummary: true, Response: "the user is migrating the billing service"},
+		{Id: 30, Prompt: "and the invoices?", Response: "next sprint"},
+	}
+
+	payload, _ := CreatePayload("latest", false, history, &commontypes.PayloadModifiers{}, "gpt-test", data.GenerationSettings{MaxTokens: 2000}, &data.Context{SystemPrompt: "be brief"})
+
+	if len(payload.Messages) != 5 {
+		t.Fatalf("expected system, summary, one turn and the prompt, got %d messages", len(payload.Messages))
+	}
+	summary, ok := payload.Messages[1].(RequestMessage)
+	if !ok || summary.Role != "developer" || !strings.Contains(summary.Content.(string), "the user is migrating the billing service") {
+		t.Fatalf("expected the summary as second developer message, got %+v", payload.Messages[1])
+	}
+}
+
 func ensureTestLogger() {
 	if logger.Debug == nil {
 		logger.Debug = log.New(io.Discard, "", 0)
@@ -215,8 +238,8 @@ func newTestOpenAIModel(handler commontypes.ResponseHandler, repo data.HistoryRe
 	return m
 }
 
-func (t *testOpenAIModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
-	return nil
+func (t *testOpenAIModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	return nil, nil
 }
 
 func (t *testOpenAIModel) HandleStreamedLine(line []byte) {
@@ -239,3 +262,63 @@ func streamOpenAIChunk(t *testing.T, model *testOpenAIModel, chunk ChatCompletio
 	}
 	model.HandleStreamedLine([]byte("data: " + string(bytes) + "\n"))
 }
+
+func TestCreatePayloadSendsGenerationSettings(t *testing.T) {
+	ensureTestLogger()
+	temperature := 0.4
+	generation := data.GenerationSettings{MaxTokens: 3000, Temperature: &temperature, StopSequences: []string{"END"}, ReasoningEffort: "low"}
+
+	payload, _ := CreatePayload("hi", false, nil, &commontypes.PayloadModifiers{}, "gpt-test", generation, &data.Context{})
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+	for _, want := range []string{`"max_completion_tokens":3000`, `"temperature":0.4`, `"stop":["END"]`, `"reasoning_effort":"low"`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Fatalf("expected %s in the payload, got %s", want, encoded)
+		}
+	}
+	if strings.Contains(string(encoded), "top_p") {
+		t.Fatalf("expected no top_p without a setting, got %s", encoded)
+	}
+}
+
+func TestCreatePayloadAsksForTheSchemaAsResponseFormat(t *testing.T) {
+	ensureTestLogger()
+	schema := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}}}
+
+	payload, _ := CreatePayload("hi", false, nil, &commontypes.PayloadModifiers{Schema: schema}, "gpt-test", data.GenerationSettings{}, &data.Context{})
+	if payload.ResponseFormat == nil || payload.ResponseFormat.Type != "json_schema" || payload.ResponseFormat.JSONSchema.Schema["type"] != "object" {
+		t.Fatalf("expected a json_schema response format, got %+v", payload.ResponseFormat)
+	}
+
+	payload, _ = CreatePayload("hi", false, nil, &commontypes.PayloadModifiers{}, "gpt-test", data.GenerationSettings{}, &data.Context{})
+	if payload.ResponseFormat != nil {
+		t.Fatalf("expected no response format without a schema, got %+v", payload.ResponseFormat)
+	}
+}
+
+func TestCreatePayloadSendsAttachmentsAsContentParts(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "chart.png")
+	pdfPath := filepath.Join(dir, "report.pdf")
+	os.WriteFile(imagePath, []byte("\x89PNG\r\n\x1a\nfake"), 0o644)
+	os.WriteFile(pdfPath, []byte("%PDF-1.4 fake"), 0o644)
+	image, _ := services.LoadAttachment(imagePath, nil)
+	pdf, _ := services.LoadAttachment(pdfPath, nil)
+
+	history := []data.History{{Prompt: "what is this?", Response: "a chart", Attachments: []data.Attachment{image}}}
+	payload, _ := CreatePayload("summarize", false, history, &commontypes.PayloadModifiers{Attachments: []data.Attachment{pdf}}, "gpt-test", data.GenerationSettings{}, &data.Context{})
+
+	replayed := payload.Messages[0].(RequestMessage).Content.([]RequestContent)
+	if len(replayed) != 2 || replayed[1].Type != "image_url" || !strings.HasPrefix(replayed[1].ImageURL.URL, "data:image/png;base64,") {
+		t.Fatalf("expected the replayed turn to carry its image, got %+v", replayed)
+	}
+	current := payload.Messages[2].(RequestMessage).Content.([]RequestContent)
+	if len(current) != 2 || current[0].Text != "summarize" || current[1].Type != "file" || current[1].File.Filename != "report.pdf" || !strings.HasPrefix(current[1].File.FileData, "data:application/pdf;base64,") {
+		t.Fatalf("expected the pdf as a file part, got %+v", current)
+	}
+}
@@ -2,6 +2,7 @@ package open_ai_embedings
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,10 +20,10 @@ func (model *OpenAiEmbeddingsModel) SetResponseHandler(responseHandler commontyp
 	model.ResponseHandler = responseHandler
 }
 
-func (model *OpenAiEmbeddingsModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *OpenAiEmbeddingsModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	payload := createPayload(prompt, streaming, history)
 	model.prompt = prompt
-	return createRequest(payload, history, modifiers.Image)
+	return createRequest(ctx, payload, history, modifiers.Image)
 }
 
 func createPayload(prompt string, streamed bool, history []data.History) Payload {
@@ -36,28 +37,28 @@ func createPayload(prompt string, streamed bool, history []data.History) Payload
 	return payload
 }
 
-func createRequest(payload Payload, history []data.History, image bool) *http.Request {
+func createRequest(ctx context.Context, payload Payload, history []data.History, image bool) (*http.Request, error) {
 	//use gcloud to fetch the token
 	apiKey, ok := os.LookupEnv("OPENAI_API_KEY")
 	if !ok {
-		panic(fmt.Errorf("Could not fetch api key"))
+		return nil, commontypes.MissingApiKeyError("openai", "OPENAI_API_KEY")
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	url := "https://api.openai.com/v1/embeddings"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
 
 func (model *OpenAiEmbeddingsModel) HandleStreamedLine(line []byte) {
@@ -80,5 +81,5 @@ func (model *OpenAiEmbeddingsModel) HandleBodyBytes(bytes []byte) {
 		println(err)
 	}
 
-	model.ResponseHandler.FinalText(0, model.prompt, string(embeddingsArray), nil, "EmbeddingsModel", nil)
+	model.ResponseHandler.FinalText(0, model.prompt, string(embeddingsArray), nil, "EmbeddingsModel", nil, nil, nil)
 }
@@ -2,63 +2,55 @@ package openai_gpt_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	commontypes "owl/common_types"
 	"owl/data"
 	"owl/logger"
 	"owl/models/open-ai-base"
+	"owl/registry"
 )
 
 type OpenAIGPTModel struct {
 	openai_base.OpenAICompatibleModel
 	ModelVersion string
+	Spec         registry.ModelSpec
 }
 
 func (model *OpenAIGPTModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
 	model.ResponseHandler = responseHandler
 }
 
-func (model *OpenAIGPTModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *OpenAIGPTModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	// Initialize the base model fields
 	model.Prompt = prompt
 	model.AccumulatedAnswer = ""
+	model.StreamedOutput = false
 	model.ContextId = context.Id
 	model.Context = context
 	model.StreamedToolCalls = make(map[int]*openai_base.StreamingToolCall)
 	model.Modifiers = modifiers
+	model.RequestCtx = ctx
 
-	var model_version string
-	switch model.ModelVersion {
-	case "codex":
-		model_version = "gpt-5.3-codex"
-	case "gpt":
-		model_version = "gpt-5.3-chat-latest"
-	case "gpt-5.4":
-		model_version = "gpt-5.4"
-	case "gpt-5.5":
-		model_version = "gpt-5.5"
-	case "gpt-mini":
-		model_version = "gpt-5.4-mini-2026-03-17"
-	case "gpt-nano":
-		model_version = "gpt-5.4-nano-2026-03-17"
-	default:
-		model_version = "gpt-5.4"
-	}
-	model.ModelName = model_version
+	spec := registry.Resolve(model.Spec, model.ModelVersion, "gpt-5.4")
+	model.ModelName = spec.Model
 
 	// Check if web search is enabled - use different API endpoint
 	if modifiers.Web {
 		logger.Debug.Println("Web search enabled, using /v1/responses endpoint")
-		payload := openai_base.CreateWebSearchPayload(prompt, history, model_version, context)
-		return createOpenAIGPTRequest(payload, true)
+		payload := openai_base.CreateWebSearchPayload(prompt, history, spec.Model, context)
+		return createOpenAIGPTRequest(ctx, spec, payload, true)
 	}
 
 	// Standard chat completions request
-	payload := openai_base.CreatePayload(prompt, streaming, history, modifiers, model_version, 16000, context)
-	return createOpenAIGPTRequest(payload, false)
+	generation := spec.Generation(context.Generation)
+	payload, err := openai_base.CreatePayload(prompt, streaming, history, modifiers, spec.Model, generation, context)
+	if err != nil {
+		return nil, err
+	}
+	return createOpenAIGPTRequest(ctx, spec, payload, false)
 }
 
 func (model *OpenAIGPTModel) HandleStreamedLine(line []byte) {
@@ -79,33 +71,33 @@ func (model *OpenAIGPTModel) HandleBodyBytes(bytes []byte) {
 	model.OpenAICompatibleModel.HandleBodyBytes(bytes, model)
 }
 
-func createOpenAIGPTRequest(payload interface{}, isWebSearch bool) *http.Request {
-	apiKey, ok := os.LookupEnv("OPENAI_API_KEY")
+func createOpenAIGPTRequest(ctx context.Context, spec registry.ModelSpec, payload interface{}, isWebSearch bool) (*http.Request, error) {
+	apiKey, ok := spec.APIKey()
 	if !ok {
-		panic(fmt.Errorf("OPENAI_API_KEY is required for chat-completions models"))
+		return nil, commontypes.MissingApiKeyError("openai", spec.ApiKeyEnv)
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	logger.Debug.Printf("OpenAI chat-completions request payload:\n%s", string(jsonpayload))
 
 	// Use different endpoint for web search
-	url := "https://api.openai.com/v1/chat/completions"
+	url := spec.Endpoint("/chat/completions")
 	if isWebSearch {
-		url = "https://api.openai.com/v1/responses"
+		url = spec.Endpoint("/responses")
 		logger.Debug.Println("Using OpenAI web search endpoint: /v1/responses")
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
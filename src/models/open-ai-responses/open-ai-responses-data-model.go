@@ -2,18 +2,76 @@ package open_ai_responses
 
 import (
 	"encoding/json"
-	"fmt"
+	"owl/logger"
 )
 
 type RequestPayload struct {
-	Model  string `json:"model"`
-	Input  string `json:"input"`
-	Tools  []Tool `json:"tools"`
-	Stream *bool  `json:"stream,omitempty"`
+	Model           string            `json:"model"`
+	Instructions    string            `json:"instructions,omitempty"`
+	Input           []interface{}     `json:"input"`
+	Tools           []Tool            `json:"tools"`
+	Stream          *bool             `json:"stream,omitempty"`
+	MaxOutputTokens int               `json:"max_output_tokens,omitempty"`
+	Temperature     *float64          `json:"temperature,omitempty"`
+	TopP            *float64          `json:"top_p,omitempty"`
+	Reasoning       *RequestReasoning `json:"reasoning,omitempty"`
+	Text            *TextFormat       `json:"text,omitempty"`
 }
 
+type RequestReasoning struct {
+	Effort string `json:"effort"`
+}
+
+// Tool is a built-in tool such as web_search, or with Type "function" one of
+// Owl's tools.
 type Tool struct {
-	Type string `json:"type"`
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// InputMessage is a user, assistant or developer message of the input.
+type InputMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// InputPartsMessage is a user message with images or files, its content is a
+// list of parts.
+type InputPartsMessage struct {
+	Role    string      `json:"role"`
+	Content []InputPart `json:"content"`
+}
+
+// InputPart is an input_text, input_image or input_file part. Images and files
+// are sent as data URLs.
+type InputPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+}
+
+// FunctionCall is a call of a function tool, read from the output and sent
+// back in the input of the turns that follow it.
+type FunctionCall struct {
+	ID        string `json:"id,omitempty"`
+	Type      string `json:"type"`
+	Status    string `json:"status,omitempty"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+func (f FunctionCall) GetType() string { return f.Type }
+
+// FunctionCallOutput is the result of a function call, sent in the input.
+type FunctionCallOutput struct {
+	Type   string `json:"type"`
+	CallID string `json:"call_id"`
+	Output string `json:"output"`
 }
 
 type WebSearchCall struct {
@@ -108,12 +166,20 @@ type ContentItem struct {
 func (r *Response) UnmarshalJSON(data []byte) error {
 	// First, unmarshal into a temporary structure
 	var temp struct {
+		ID     string            `json:"id"`
+		Status string            `json:"status"`
+		Model  string            `json:"model"`
 		Output []json.RawMessage `json:"output"`
+		Usage  Usage             `json:"usage"`
 	}
 
 	if err := json.Unmarshal(data, &temp); err != nil {
 		return err
 	}
+	r.ID = temp.ID
+	r.Status = temp.Status
+	r.Model = temp.Model
+	r.Usage = temp.Usage
 
 	// Process each output item
 	r.Output = make([]OutputItem, 0, len(temp.Output))
@@ -158,8 +224,16 @@ func (r *Response) UnmarshalJSON(data []byte) error {
 			}
 			r.Output = append(r.Output, wf)
 
+		case "function_call":
+			var fc FunctionCall
+			if err := json.Unmarshal(raw, &fc); err != nil {
+				return err
+			}
+			r.Output = append(r.Output, fc)
+
 		default:
-			return fmt.Errorf("unknown output type: %s", typeCheck.Type)
+			// Reasoning and other items carry nothing Owl shows or stores
+			logger.Debug.Printf("skipping output item of type %s", typeCheck.Type)
 		}
 	}
 
@@ -175,8 +249,12 @@ type TextFormat struct {
 	Format FormatType `json:"format"`
 }
 
+// FormatType is "text" or, for a structured answer, "json_schema" with the
+// name and schema.
 type FormatType struct {
-	Type string `json:"type"`
+	Type   string                 `json:"type"`
+	Name   string                 `json:"name,omitempty"`
+	Schema map[string]interface{} `json:"schema,omitempty"`
 }
 
 type Usage struct {
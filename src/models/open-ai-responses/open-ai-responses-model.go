@@ -2,6 +2,7 @@ package open_ai_responses
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,11 +10,18 @@ import (
 	"net/http"
 	"os"
 	commontypes "owl/common_types"
+	"owl/compaction"
 	"owl/data"
 	"owl/logger"
+	"owl/mode"
+	openai_base "owl/models/open-ai-base"
+	"owl/registry"
+	"owl/services"
+	"owl/tools"
 	"strings"
 	"time"
 
+	"github.com/fatih/color"
 	"github.com/skratchdot/open-golang/open"
 )
 
@@ -21,73 +29,208 @@ var MODELNAME = "open_ai_responses"
 
 type OpenAiResponseModel struct {
 	ResponseHandler   commontypes.ResponseHandler
+	HistoryRepository data.HistoryRepository
+	Context           *data.Context
 	prompt            string
 	accumulatedAnswer string
 	contextId         int64
 	modelName         string
 	ModelVersion      string
+	Spec              registry.ModelSpec
+	// BuiltInToolsOnly leaves Owl's tools out of the request, set when the
+	// model answers a tool itself
+	BuiltInToolsOnly bool
+
+	requestCtx    context.Context
+	modifiers     *commontypes.PayloadModifiers
+	functionCalls []FunctionCall
+	// streamedOutput is set once the request passed anything to the
+	// ResponseHandler, see HasStreamedOutput
+	streamedOutput bool
 }
 
-func (model *OpenAiResponseModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
-	payload := createResponsePayload(prompt, streaming, history, modifiers, model.ModelVersion)
+func init() {
+	tools.ImageModel = func(responseHandler commontypes.ResponseHandler) commontypes.Model {
+		return &OpenAiResponseModel{ResponseHandler: responseHandler, BuiltInToolsOnly: true}
+	}
+}
+
+func (model *OpenAiResponseModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	spec := registry.Resolve(model.Spec, model.ModelVersion, "responses")
+	settings := data.GenerationSettings{}
+	if context != nil && !model.BuiltInToolsOnly {
+		// A tool's request is not bound by the settings of the chat model
+		settings = context.Generation
+	}
+	generation := spec.Generation(settings)
+	payload := createResponsePayload(prompt, streaming, history, modifiers, spec.Model, generation, context, !model.BuiltInToolsOnly)
 	model.prompt = prompt
 	model.accumulatedAnswer = ""
 	model.contextId = context.Id
+	model.Context = context
 	model.modelName = payload.Model
-	return createRequest(payload)
+	model.requestCtx = ctx
+	model.modifiers = modifiers
+	model.functionCalls = nil
+	model.streamedOutput = false
+	return createRequest(ctx, spec, payload)
+}
+
+// PartialResponse reports the prompt and answer of the turn in flight.
+func (model *OpenAiResponseModel) PartialResponse() (string, string) {
+	return model.prompt, model.accumulatedAnswer
 }
 
-func createRequest(payload RequestPayload) *http.Request {
-	apiKey, ok := os.LookupEnv("OPENAI_API_KEY")
+// HasStreamedOutput reports whether the request in flight passed text or tool
+// status to the ResponseHandler. It stays set after FinalText, so a stream
+// that breaks after the turn was handed over is not sent again.
+func (model *OpenAiResponseModel) HasStreamedOutput() bool {
+	return model.streamedOutput
+}
+
+// finalText hands the turn to the response handler. When the model called
+// Owl's tools their results are sent back in a follow-up query, the same way
+// the Claude and OpenAI chat models continue.
+func (model *OpenAiResponseModel) finalText(response string, toolUses []data.ToolUse, usage *commontypes.TokenUsage) {
+	var attachments []data.Attachment
+	if model.modifiers != nil {
+		attachments = model.modifiers.Attachments
+	}
+	model.ResponseHandler.FinalText(model.contextId, model.prompt, response, toolUses, model.modelName, usage, nil, attachments)
+	model.prompt = ""
+	model.accumulatedAnswer = ""
+	model.functionCalls = nil
+
+	localToolUses := filterLocalToolUses(toolUses)
+	if len(localToolUses) == 0 {
+		return
+	}
+	toolGroupFilters := []string{}
+	if model.modifiers != nil {
+		toolGroupFilters = model.modifiers.ToolGroupFilters
+	}
+	err := services.AwaitedQuery(model.requestCtx, "", model, model.HistoryRepository, 1000, model.Context, &commontypes.PayloadModifiers{
+		ToolUses:         localToolUses,
+		ToolGroupFilters: toolGroupFilters,
+	}, model.modelName)
+	services.ReportError(err)
+}
+
+func (model *OpenAiResponseModel) sendToolStatus(message string) {
+	color := "cyan"
+	model.streamedOutput = true
+	model.ResponseHandler.RecievedText("\n"+strings.TrimSpace(message)+"\n", &color)
+}
+
+// runFunctionCalls runs the tools the model called and returns them with
+// their results.
+func (model *OpenAiResponseModel) runFunctionCalls(calls []FunctionCall) []data.ToolUse {
+	toolUses := []data.ToolUse{}
+	for _, call := range calls {
+		logger.Debug.Printf("Executing tool: %s with args: %s", call.Name, call.Arguments)
+		model.sendToolStatus(fmt.Sprintf("→ running %s", call.Name))
+
+		toolUse := data.ToolUse{
+			Id:         call.CallID,
+			Name:       call.Name,
+			Input:      call.Arguments,
+			CallerType: "assistant",
+		}
+
+		var args map[string]string
+		if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+			logger.Debug.Printf("Error parsing tool arguments: %s", err)
+			toolUse.Result = data.ToolResult{ToolUseId: call.CallID, Content: fmt.Sprintf("Error parsing arguments: %s", err), Success: false}
+			toolUses = append(toolUses, toolUse)
+			continue
+		}
+
+		runner := tools.ToolRunner{
+			ResponseHandler:   &model.ResponseHandler,
+			HistoryRepository: &model.HistoryRepository,
+			Context:           model.Context,
+			RequestCtx:        model.requestCtx,
+		}
+		result, err := runner.ExecuteTool(*model.Context, toolUse, args)
+		if err != nil {
+			logger.Debug.Printf("Error executing tool: %s", err)
+			result = fmt.Sprintf("Error: %s", err)
+		}
+		model.sendToolStatus(fmt.Sprintf("%s result:\n%s", call.Name, result))
+
+		toolUse.Result = data.ToolResult{ToolUseId: call.CallID, Content: result, Success: err == nil}
+		toolUses = append(toolUses, toolUse)
+	}
+	return toolUses
+}
+
+func createRequest(ctx context.Context, spec registry.ModelSpec, payload RequestPayload) (*http.Request, error) {
+	apiKey, ok := spec.APIKey()
 	if !ok {
-		panic(fmt.Errorf("Could not fetch api key"))
+		return nil, commontypes.MissingApiKeyError("openai", spec.ApiKeyEnv)
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	logger.Debug.Println("Will send payload")
 	logger.Debug.Println(jsonpayload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	url := "https://api.openai.com/v1/responses"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	url := spec.Endpoint("/responses")
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
 
-func createResponsePayload(prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers, requestedModel string) RequestPayload {
-	modelVersion := "gpt-5.3-chat-latest"
-	if requestedModel == "gpt-5.5" {
-		modelVersion = "gpt-5.5"
-	} else if requestedModel == "gpt-5.4" {
-		modelVersion = "gpt-5.4"
+// createResponsePayload sends the generation settings the responses API
+// takes, it has no stop sequences.
+func createResponsePayload(prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers, modelVersion string, generation data.GenerationSettings, context *data.Context, withCustomTools bool) RequestPayload {
+	if modifiers == nil {
+		modifiers = &commontypes.PayloadModifiers{}
 	}
 
-	tools := []Tool{}
-	if modifiers != nil {
-		if modifiers.Image {
-			tools = append(tools, Tool{Type: "image_generation"})
-		}
-		if modifiers.Web {
-			tools = append(tools, Tool{Type: "web_search"})
-			tools = append(tools, Tool{Type: "web_fetch"})
-		}
+	payloadTools := []Tool{}
+	if modifiers.Image {
+		payloadTools = append(payloadTools, Tool{Type: "image_generation"})
 	}
-	if len(tools) == 0 {
-		tools = append(tools, Tool{Type: "image_generation"})
+	if modifiers.Web {
+		payloadTools = append(payloadTools, Tool{Type: "web_search"})
+		payloadTools = append(payloadTools, Tool{Type: "web_fetch"})
+	}
+	if len(payloadTools) == 0 {
+		payloadTools = append(payloadTools, Tool{Type: "image_generation"})
+	}
+	if withCustomTools {
+		payloadTools = append(payloadTools, functionTools(tools.GetCustomTools(mode.Mode, modifiers.ToolGroupFilters...))...)
 	}
 
 	request := RequestPayload{
-		Model: modelVersion,
-		Input: prompt,
-		Tools: tools,
+		Model:           modelVersion,
+		Input:           createInput(prompt, history, modifiers),
+		Tools:           payloadTools,
+		MaxOutputTokens: generation.MaxTokens,
+		Temperature:     generation.Temperature,
+		TopP:            generation.TopP,
+	}
+	if generation.ReasoningEffort != "" {
+		request.Reasoning = &RequestReasoning{Effort: generation.ReasoningEffort}
+	}
+	if modifiers.Schema != nil {
+		request.Text = &TextFormat{Format: FormatType{
+			Type:   "json_schema",
+			Name:   commontypes.StructuredOutputTool,
+			Schema: services.StructuredSchema(modifiers.Schema),
+		}}
+	}
+	if context != nil {
+		request.Instructions = context.SystemPrompt
 	}
 	if streaming {
 		stream := true
@@ -99,6 +242,128 @@ func createResponsePayload(prompt string, streaming bool, history []data.History
 	return request
 }
 
+// createInput replays the history as input items. The turns that ran Owl's
+// tools get their function calls and outputs back, and tool results of a
+// continuation are added when the history does not hold them yet.
+func createInput(prompt string, history []data.History, modifiers *commontypes.PayloadModifiers) []interface{} {
+	summary, history := compaction.SplitSummary(history)
+	input := []interface{}{}
+	replayedToolUseIDs := map[string]bool{}
+
+	if summary != "" {
+		input = append(input, InputMessage{Role: "developer", Content: compaction.SummarySystemPrompt(summary)})
+	}
+
+	for _, h := range history {
+		if h.Prompt != "" || len(h.Attachments) > 0 {
+			input = append(input, userMessage(h.Prompt, h.Attachments))
+		}
+		if h.Response != "" {
+			input = append(input, InputMessage{Role: "assistant", Content: h.Response})
+		}
+		localToolUses := filterLocalToolUses(h.ToolUse)
+		input = append(input, functionCallItems(localToolUses)...)
+		for _, toolUse := range localToolUses {
+			replayedToolUseIDs[toolUse.Id] = true
+		}
+	}
+
+	pendingToolUses := []data.ToolUse{}
+	for _, toolUse := range filterLocalToolUses(modifiers.ToolUses) {
+		if !replayedToolUseIDs[toolUse.Id] {
+			pendingToolUses = append(pendingToolUses, toolUse)
+		}
+	}
+	if len(pendingToolUses) > 0 {
+		logger.Debug.Printf("Adding %d tool responses to payload", len(pendingToolUses))
+		input = append(input, functionCallItems(pendingToolUses)...)
+	}
+
+	if prompt != "" || len(modifiers.Attachments) > 0 {
+		input = append(input, userMessage(prompt, modifiers.Attachments))
+	}
+	return input
+}
+
+// userMessage is the prompt with text attachments inlined. Images and PDFs
+// turn it into a message of parts.
+func userMessage(prompt string, attachments []data.Attachment) interface{} {
+	prompt, files := services.PromptWithAttachments(prompt, attachments)
+	if len(files) == 0 {
+		return InputMessage{Role: "user", Content: prompt}
+	}
+	parts := []InputPart{{Type: "input_text", Text: prompt}}
+	for _, file := range files {
+		dataURL := fmt.Sprintf("data:%s;base64,%s", file.MediaType, file.Base64)
+		if file.Kind() == data.AttachmentPdf {
+			parts = append(parts, InputPart{Type: "input_file", Filename: file.Name, FileData: dataURL})
+			continue
+		}
+		parts = append(parts, InputPart{Type: "input_image", ImageURL: dataURL})
+	}
+	return InputPartsMessage{Role: "user", Content: parts}
+}
+
+// functionCallItems returns the calls of the tool uses followed by their
+// outputs.
+func functionCallItems(toolUses []data.ToolUse) []interface{} {
+	items := []interface{}{}
+	for _, toolUse := range toolUses {
+		arguments := strings.TrimSpace(toolUse.Input)
+		if arguments == "" || !json.Valid([]byte(arguments)) {
+			arguments = "{}"
+		}
+		items = append(items, FunctionCall{Type: "function_call", CallID: toolUse.Id, Name: toolUse.Name, Arguments: arguments})
+	}
+	for _, toolUse := range toolUses {
+		items = append(items, FunctionCallOutput{Type: "function_call_output", CallID: toolUse.Id, Output: toolUse.Result.Content})
+	}
+	return items
+}
+
+// functionTools describes Owl's tools as function tools.
+func functionTools(customTools []tools.Tool) []Tool {
+	functions := make([]Tool, 0, len(customTools))
+	for _, tool := range customTools {
+		parameters := map[string]interface{}{
+			"type":       tool.InputSchema.Type,
+			"properties": openai_base.ConvertProperties(tool.InputSchema.Properties),
+		}
+		if len(tool.InputSchema.Required) > 0 {
+			parameters["required"] = tool.InputSchema.Required
+		}
+		functions = append(functions, Tool{
+			Type:        "function",
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  parameters,
+		})
+	}
+	return functions
+}
+
+func filterLocalToolUses(toolUses []data.ToolUse) []data.ToolUse {
+	localToolUses := []data.ToolUse{}
+	for _, toolUse := range toolUses {
+		if toolUse.CallerType == "" || toolUse.CallerType == "assistant" {
+			localToolUses = append(localToolUses, toolUse)
+		}
+	}
+	return localToolUses
+}
+
+func usageFromResponses(u Usage) *commontypes.TokenUsage {
+	if u.InputTokens == 0 && u.OutputTokens == 0 {
+		return nil
+	}
+	// Cached tokens are part of the input tokens
+	return &commontypes.TokenUsage{
+		PromptTokens:     u.InputTokens - u.InputTokensDetails.CachedTokens,
+		CompletionTokens: u.OutputTokens,
+		CacheReadTokens:  u.InputTokensDetails.CachedTokens,
+	}
+}
+
 func (model *OpenAiResponseModel) HandleStreamedLine(line []byte) {
 	responseLine := string(line)
 
@@ -120,22 +385,40 @@ func (model *OpenAiResponseModel) HandleStreamedLine(line []byte) {
 			text := extractEventText(event)
 			if text != "" {
 				model.accumulatedAnswer += text
+				model.streamedOutput = true
 				model.ResponseHandler.RecievedText(text, nil)
 			}
 
+		case "response.output_item.done":
+			var itemEvent struct {
+				Item FunctionCall `json:"item"`
+			}
+			if err := json.Unmarshal([]byte(data), &itemEvent); err == nil && itemEvent.Item.Type == "function_call" {
+				model.sendToolStatus(fmt.Sprintf("→ calling tool %s", itemEvent.Item.Name))
+				model.functionCalls = append(model.functionCalls, itemEvent.Item)
+			}
+
 		case "response.output_text.done", "response.completed":
 			if text := extractEventText(event); text != "" && !strings.Contains(model.accumulatedAnswer, text) {
 				model.accumulatedAnswer += text
 			}
 			if eventType == "response.completed" {
-				model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, nil, model.modelName, nil)
+				var completed struct {
+					Response struct {
+						Usage Usage `json:"usage"`
+					} `json:"response"`
+				}
+				_ = json.Unmarshal([]byte(data), &completed)
+				toolUses := model.runFunctionCalls(model.functionCalls)
+				model.finalText(model.accumulatedAnswer, toolUses, usageFromResponses(completed.Response.Usage))
 			}
 
 		case "response.error":
 			if msg, ok := event["message"].(string); ok && strings.TrimSpace(msg) != "" {
+				model.streamedOutput = true
 				model.ResponseHandler.RecievedText("\nError: "+msg+"\n", nil)
 			}
-			model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, nil, model.modelName, nil)
+			model.finalText(model.accumulatedAnswer, nil, nil)
 
 		default:
 			// Ignore unknown event types to remain resilient.
@@ -177,6 +460,7 @@ func (model *OpenAiResponseModel) HandleBodyBytes(byte_list []byte) {
 	text := ""
 	toolUses := []data.ToolUse{}
 	toolUseByID := map[string]int{}
+	functionCalls := []FunctionCall{}
 
 	for _, output := range apiResponse.Output {
 		logger.Debug.Printf("%s", output)
@@ -184,19 +468,22 @@ func (model *OpenAiResponseModel) HandleBodyBytes(byte_list []byte) {
 		case ImageGenerationCall:
 			unbased, err := base64.StdEncoding.DecodeString(v.Result)
 			if err != nil {
-				panic("Cannot decode b64")
+				logger.Screen(fmt.Sprintf("could not decode generated image: %v", err), color.RGB(250, 100, 100))
+				continue
 			}
 
 			r := bytes.NewReader(unbased)
 			im, err := png.Decode(r)
 			if err != nil {
-				panic("Bad png")
+				logger.Screen(fmt.Sprintf("generated image is not a valid png: %v", err), color.RGB(250, 100, 100))
+				continue
 			}
 
 			filename := fmt.Sprintf("/Users/olofmoriya/.owl/img/%d-%s.png", model.contextId, time.Now().Format("2006-01-02:15:04:05"))
 			f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0777)
 			if err != nil {
-				panic("Cannot open file")
+				logger.Screen(fmt.Sprintf("could not save generated image: %v", err), color.RGB(250, 100, 100))
+				continue
 			}
 
 			png.Encode(f, im)
@@ -255,6 +542,9 @@ func (model *OpenAiResponseModel) HandleBodyBytes(byte_list []byte) {
 			}
 			toolUseByID[v.ID] = len(toolUses)
 			toolUses = append(toolUses, toolUse)
+
+		case FunctionCall:
+			functionCalls = append(functionCalls, v)
 		}
 	}
 
@@ -272,8 +562,10 @@ func (model *OpenAiResponseModel) HandleBodyBytes(byte_list []byte) {
 		}
 	}
 
+	toolUses = append(toolUses, model.runFunctionCalls(functionCalls)...)
+
 	logger.Debug.Printf("Final text from responses: %s", text)
-	model.ResponseHandler.FinalText(model.contextId, model.prompt, text, toolUses, model.modelName, nil)
+	model.finalText(text, toolUses, usageFromResponses(apiResponse.Usage))
 }
 
 func (model *OpenAiResponseModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
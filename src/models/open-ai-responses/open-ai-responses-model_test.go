@@ -0,0 +1,287 @@
+package open_ai_responses
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/logger"
+	"owl/services"
+	testhelpers "owl/test_helpers"
+)
+
+func TestCreateResponsePayloadReplaysHistoryAndToolUses(t *testing.T) {
+	ensureTestLogger()
+	history := []data.History{
+		{Prompt: "hello", Response: "hi"},
+		{
+			Prompt:   "what is in the file?",
+			Response: "let me look",
+			ToolUse: []data.ToolUse{
+				{Id: "call-1", Name: "read_file", Input: `{"path":"a.txt"}`, CallerType: "assistant", Result: data.ToolResult{Content: "apples", Success: true}},
+				{Id: "ws-1", Name: "web_search", Input: "{}", CallerType: "assistant_server"},
+			},
+		},
+	}
+
+	payload := createResponsePayload("and then?", false, history, &commontypes.PayloadModifiers{}, "gpt-test", data.GenerationSettings{}, &data.Context{SystemPrompt: "be brief"}, false)
+
+	if payload.Instructions != "be brief" {
+		t.Fatalf("expected the system prompt as instructions, got %q", payload.Instructions)
+	}
+	if len(payload.Input) != 7 {
+		t.Fatalf("expected two turns, one tool call with its output and the prompt, got %d items: %+v", len(payload.Input), payload.Input)
+	}
+	if message, ok := payload.Input[1].(InputMessage); !ok || message.Role != "assistant" || message.Content != "hi" {
+		t.Fatalf("expected the first answer to be replayed, got %+v", payload.Input[1])
+	}
+	call, ok := payload.Input[4].(FunctionCall)
+	if !ok || call.Type != "function_call" || call.CallID != "call-1" || call.Name != "read_file" || call.Arguments != `{"path":"a.txt"}` {
+		t.Fatalf("expected the function call to be replayed, got %+v", payload.Input[4])
+	}
+	output, ok := payload.Input[5].(FunctionCallOutput)
+	if !ok || output.CallID != "call-1" || output.Output != "apples" {
+		t.Fatalf("expected the function call output to be replayed, got %+v", payload.Input[5])
+	}
+	if message, ok := payload.Input[6].(InputMessage); !ok || message.Role != "user" || message.Content != "and then?" {
+		t.Fatalf("expected the prompt last, got %+v", payload.Input[6])
+	}
+}
+
+func TestCreateResponsePayloadAddsToolResultsOfContinuation(t *testing.T) {
+	ensureTestLogger()
+	toolUse := data.ToolUse{Id: "call-2", Name: "read_file", Input: "not json", CallerType: "assistant", Result: data.ToolResult{Content: "pears"}}
+	history := []data.History{{Prompt: "read it", ToolUse: []data.ToolUse{{Id: "call-1", Name: "read_file", CallerType: "assistant"}}}}
+
+	payload := createResponsePayload("", false, history, &commontypes.PayloadModifiers{ToolUses: []data.ToolUse{history[0].ToolUse[0], toolUse}}, "gpt-test", data.GenerationSettings{}, &data.Context{}, false)
+
+	if len(payload.Input) != 5 {
+		t.Fatalf("expected the prompt, the replayed call and the new call with their outputs, got %d items: %+v", len(payload.Input), payload.Input)
+	}
+	call, ok := payload.Input[3].(FunctionCall)
+	if !ok || call.CallID != "call-2" || call.Arguments != "{}" {
+		t.Fatalf("expected the new call with empty arguments, got %+v", payload.Input[3])
+	}
+	for _, item := range payload.Input {
+		if message, ok := item.(InputMessage); ok && message.Content == "" {
+			t.Fatalf("expected no empty messages, got %+v", payload.Input)
+		}
+	}
+}
+
+func TestCreateResponsePayloadExposesCustomTools(t *testing.T) {
+	ensureTestLogger()
+	dummyTool := testhelpers.NewDummyTool("dummy_tool_responses_payload")
+	dummyTool.Register()
+
+	payload := createResponsePayload("hi", true, nil, nil, "gpt-test", data.GenerationSettings{}, &data.Context{}, true)
+	if !hasFunctionTool(payload, dummyTool.GetName()) {
+		t.Fatalf("expected the registered tool as a function tool, got %+v", payload.Tools)
+	}
+	if payload.Stream == nil || !*payload.Stream {
+		t.Fatalf("expected a streamed payload")
+	}
+
+	payload = createResponsePayload("hi", false, nil, nil, "gpt-test", data.GenerationSettings{}, &data.Context{}, false)
+	if hasFunctionTool(payload, dummyTool.GetName()) {
+		t.Fatalf("expected no function tools, got %+v", payload.Tools)
+	}
+}
+
+func TestCreateResponsePayloadSendsGenerationSettings(t *testing.T) {
+	ensureTestLogger()
+	topP := 0.8
+	payload := createResponsePayload("hi", false, nil, nil, "gpt-test", data.GenerationSettings{MaxTokens: 5000, TopP: &topP, ReasoningEffort: "high"}, &data.Context{}, false)
+
+	if payload.MaxOutputTokens != 5000 || payload.TopP == nil || *payload.TopP != 0.8 || payload.Temperature != nil {
+		t.Fatalf("expected the max tokens and top_p, got %+v", payload)
+	}
+	if payload.Reasoning == nil || payload.Reasoning.Effort != "high" {
+		t.Fatalf("expected the reasoning effort, got %+v", payload.Reasoning)
+	}
+}
+
+func TestCreateResponsePayloadAsksForTheSchemaAsTextFormat(t *testing.T) {
+	ensureTestLogger()
+	schema := map[string]interface{}{"type": "string"}
+	payload := createResponsePayload("hi", false, nil, &commontypes.PayloadModifiers{Schema: schema}, "gpt-test", data.GenerationSettings{}, &data.Context{}, false)
+
+	if payload.Text == nil || payload.Text.Format.Type != "json_schema" || payload.Text.Format.Schema["type"] != "object" {
+		t.Fatalf("expected the wrapped schema as the text format, got %+v", payload.Text)
+	}
+}
+
+func TestResponsesModelRunsFunctionCallsAndContinues(t *testing.T) {
+	ensureTestLogger()
+	dummyTool := testhelpers.NewDummyTool("dummy_tool_responses_body")
+	dummyTool.Register()
+	dummyTool.ResetCalls()
+
+	var continuation *commontypes.PayloadModifiers
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		continuation = modifiers
+		return nil
+	})
+	defer services.SetAwaitedQueryHook(nil)
+
+	handler := testhelpers.NewMockResponseHandler()
+	model := newTestResponsesModel(handler)
+
+	body := `{"id":"resp-1","status":"completed","output":[
+		{"type":"reasoning","id":"rs-1","summary":[]},
+		{"type":"function_call","id":"fc-1","call_id":"call-1","name":"dummy_tool_responses_body","arguments":"{\"value\":\"ping\"}"}
+	],"usage":{"input_tokens":20,"input_tokens_details":{"cached_tokens":5},"output_tokens":7}}`
+	model.HandleBodyBytes([]byte(body))
+
+	if len(dummyTool.Calls) != 1 || dummyTool.Calls[0].Input["value"] != "ping" {
+		t.Fatalf("expected the tool to run once with its arguments, got %+v", dummyTool.Calls)
+	}
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 {
+		t.Fatalf("expected one final event, got %d", len(finalEvents))
+	}
+	if len(finalEvents[0].ToolUse) != 1 || finalEvents[0].ToolUse[0].Id != "call-1" || !strings.Contains(finalEvents[0].ToolUse[0].Result.Content, dummyTool.Response) {
+		t.Fatalf("expected the tool use with its result, got %+v", finalEvents[0].ToolUse)
+	}
+	usage := finalEvents[0].Usage
+	if usage == nil || usage.PromptTokens != 15 || usage.CacheReadTokens != 5 || usage.CompletionTokens != 7 {
+		t.Fatalf("expected the token usage, got %+v", usage)
+	}
+	if continuation == nil || len(continuation.ToolUses) != 1 || continuation.ToolUses[0].Id != "call-1" {
+		t.Fatalf("expected a continuation with the tool results, got %+v", continuation)
+	}
+}
+
+func TestResponsesModelStreamedFunctionCalls(t *testing.T) {
+	ensureTestLogger()
+	dummyTool := testhelpers.NewDummyTool("dummy_tool_responses_stream")
+	dummyTool.Register()
+	dummyTool.ResetCalls()
+
+	awaitedCalls := 0
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		awaitedCalls++
+		return nil
+	})
+	defer services.SetAwaitedQueryHook(nil)
+
+	handler := testhelpers.NewMockResponseHandler()
+	model := newTestResponsesModel(handler)
+
+	streamEvent(t, model, map[string]interface{}{"type": "response.output_text.delta", "delta": "Checking "})
+	streamEvent(t, model, map[string]interface{}{"type": "response.output_item.done", "item": map[string]interface{}{
+		"type": "function_call", "id": "fc-1", "call_id": "call-1", "name": dummyTool.GetName(), "arguments": `{"value":"ping"}`,
+	}})
+	streamEvent(t, model, map[string]interface{}{"type": "response.completed", "response": map[string]interface{}{
+		"usage": map[string]interface{}{"input_tokens": 30, "output_tokens": 60},
+	}})
+
+	if len(dummyTool.Calls) != 1 {
+		t.Fatalf("expected the tool to run once, got %d", len(dummyTool.Calls))
+	}
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 || !strings.Contains(finalEvents[0].Response, "Checking") || len(finalEvents[0].ToolUse) != 1 {
+		t.Fatalf("expected one final event with the answer and the tool use, got %+v", finalEvents)
+	}
+	if finalEvents[0].Usage == nil || finalEvents[0].Usage.PromptTokens != 30 || finalEvents[0].Usage.CompletionTokens != 60 {
+		t.Fatalf("expected the streamed token usage, got %+v", finalEvents[0].Usage)
+	}
+	if awaitedCalls != 1 {
+		t.Fatalf("expected one continuation, got %d", awaitedCalls)
+	}
+}
+
+func TestResponsesModelWithoutFunctionCallsDoesNotContinue(t *testing.T) {
+	ensureTestLogger()
+	awaitedCalls := 0
+	services.SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		awaitedCalls++
+		return nil
+	})
+	defer services.SetAwaitedQueryHook(nil)
+
+	handler := testhelpers.NewMockResponseHandler()
+	model := newTestResponsesModel(handler)
+	model.HandleBodyBytes([]byte(`{"output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`))
+
+	finalEvents := handler.CopyFinalEvents()
+	if len(finalEvents) != 1 || finalEvents[0].Response != "done" {
+		t.Fatalf("expected the answer, got %+v", finalEvents)
+	}
+	if awaitedCalls != 0 {
+		t.Fatalf("expected no continuation, got %d", awaitedCalls)
+	}
+}
+
+func TestCreateResponsePayloadSendsAttachmentsAsInputParts(t *testing.T) {
+	ensureTestLogger()
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "chart.png")
+	pdfPath := filepath.Join(dir, "report.pdf")
+	os.WriteFile(imagePath, []byte("\x89PNG\r\n\x1a\nfake"), 0o644)
+	os.WriteFile(pdfPath, []byte("%PDF-1.4 fake"), 0o644)
+	image, _ := services.LoadAttachment(imagePath, nil)
+	pdf, _ := services.LoadAttachment(pdfPath, nil)
+	notes, _ := services.LoadAttachment("-", strings.NewReader("remember the milk"))
+
+	history := []data.History{{Prompt: "what is this?", Response: "a chart", Attachments: []data.Attachment{image}}}
+	payload := createResponsePayload("summarize", false, history, &commontypes.PayloadModifiers{Attachments: []data.Attachment{pdf, notes}}, "gpt-test", data.GenerationSettings{}, &data.Context{}, false)
+
+	replayed, ok := payload.Input[0].(InputPartsMessage)
+	if !ok || len(replayed.Content) != 2 || replayed.Content[1].Type != "input_image" || !strings.HasPrefix(replayed.Content[1].ImageURL, "data:image/png;base64,") {
+		t.Fatalf("expected the replayed turn to carry its image, got %+v", payload.Input[0])
+	}
+	current, ok := payload.Input[2].(InputPartsMessage)
+	if !ok || len(current.Content) != 2 || current.Content[1].Type != "input_file" || current.Content[1].Filename != "report.pdf" {
+		t.Fatalf("expected the pdf as an input_file part, got %+v", payload.Input[2])
+	}
+	if text := current.Content[0].Text; current.Content[0].Type != "input_text" || !strings.Contains(text, "remember the milk") || !strings.HasSuffix(text, "summarize") {
+		t.Fatalf("expected the text attachment inlined before the prompt, got %+v", current.Content[0])
+	}
+}
+
+func ensureTestLogger() {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+}
+
+func newTestResponsesModel(handler commontypes.ResponseHandler) *OpenAiResponseModel {
+	ctx := data.Context{Id: 4, Name: "responses_ctx"}
+	repo := testhelpers.NewMockHistoryRepository()
+	repo.Contexts[ctx.Id] = ctx
+	return &OpenAiResponseModel{
+		ResponseHandler:   handler,
+		HistoryRepository: repo,
+		Context:           &ctx,
+		contextId:         ctx.Id,
+		prompt:            "inspect",
+		modifiers:         &commontypes.PayloadModifiers{},
+	}
+}
+
+func hasFunctionTool(payload RequestPayload, name string) bool {
+	for _, tool := range payload.Tools {
+		if tool.Type == "function" && tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func streamEvent(t *testing.T, model *OpenAiResponseModel, event map[string]interface{}) {
+	t.Helper()
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	model.HandleStreamedLine([]byte("data: " + string(bytes) + "\n"))
+}
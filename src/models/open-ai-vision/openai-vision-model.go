@@ -2,6 +2,7 @@ package openai_vision_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,14 +23,14 @@ func (model *OpenAiModel) SetResponseHandler(responseHandler commontypes.Respons
 	model.ResponseHandler = responseHandler
 }
 
-func (model *OpenAiModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *OpenAiModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	payload := createOpenaiPayload(prompt, streaming, history)
 	model.prompt = prompt
 	model.accumulatedAnswer = ""
 	if context != nil {
 		model.contextId = context.Id
 	}
-	return createRequest(payload)
+	return createRequest(ctx, payload)
 }
 
 func (model *OpenAiModel) HandleStreamedLine(line []byte) {
@@ -51,7 +52,7 @@ func (model *OpenAiModel) HandleStreamedLine(line []byte) {
 
 			if choice.FinishReason != nil {
 				fmt.Println(*choice.FinishReason)
-				model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, "", "", "vision", nil)
+				model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, nil, "vision", nil, nil, nil)
 			}
 		}
 	}
@@ -64,7 +65,7 @@ func (model *OpenAiModel) HandleBodyBytes(bytes []byte) {
 		println(fmt.Sprintf("Error unmarshalling response body: %v\n", err))
 	}
 
-	model.ResponseHandler.FinalText(model.contextId, model.prompt, apiResponse.Choices[0].Message.Content, "", "", "vision", nil)
+	model.ResponseHandler.FinalText(model.contextId, model.prompt, apiResponse.Choices[0].Message.Content, nil, "vision", nil, nil, nil)
 }
 
 func createOpenaiPayload(prompt string, streamed bool, history []data.History) Payload {
@@ -87,27 +88,27 @@ func createOpenaiPayload(prompt string, streamed bool, history []data.History) P
 	return payload
 }
 
-func createRequest(payload Payload) *http.Request {
+func createRequest(ctx context.Context, payload Payload) (*http.Request, error) {
 	//use gcloud to fetch the token
 	apiKey, ok := os.LookupEnv("OPENAI_API_KEY")
 	if !ok {
-		panic(fmt.Errorf("Could not fetch api key"))
+		return nil, commontypes.MissingApiKeyError("openai", "OPENAI_API_KEY")
 	}
 	// fmt.Printf("\nkey: -%s-", apiKey)
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	url := "https://api.openai.com/v1/chat/completions"
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic(fmt.Errorf("failed to create request: %v", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	return req
+	return req, nil
 }
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	commontypes "owl/common_types"
+	"owl/compaction"
+	"owl/data"
+	"owl/logger"
+	picker "owl/picker"
+	"owl/services"
+	"owl/tools"
+	"strings"
+)
+
+// The summary model is cheap and fast, OWL_SUMMARY_MODEL picks another alias.
+const defaultSummaryModel = "haiku"
+
+// Turns are shortened before they are sent to the summary model, so a few
+// huge tool results cannot push the summary request over its own limit.
+const (
+	maxSummaryTurnChars  = 4000
+	maxSummaryInputChars = 400000
+)
+
+func init() {
+	compaction.SetSummarizer(Summarize_history)
+}
+
+// Summarize_history asks the summary model to condense turns, continuing the
+// previous summary of the context.
+func Summarize_history(ctx context.Context, repository data.HistoryRepository, previous string, turns []data.History) (string, string, error) {
+	modelName := os.Getenv("OWL_SUMMARY_MODEL")
+	if modelName == "" {
+		modelName = defaultSummaryModel
+	}
+	logger.Debug.Printf("Sending %s request to summarize %d turns", modelName, len(turns))
+
+	toolHandler := tools.ToolResponseHandler{}
+	toolHandler.Init()
+	model, _ := picker.GetModelForQuery(modelName, nil, &toolHandler, repository, false, false, false, false)
+
+	err := services.AwaitedQuery(ctx, summaryPrompt(previous, turns), model, repository, 0, &data.Context{
+		Name:         "Summarize history",
+		SystemPrompt: "You summarize conversations between a user and an assistant so the conversation can continue without the original messages. Keep decisions, facts, names, file paths, code identifiers and open questions. Do not use tools. Answer with the summary only.",
+		History:      []data.History{},
+	}, &commontypes.PayloadModifiers{}, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	response := strings.TrimSpace(<-toolHandler.ResponseChannel)
+	if response == "" {
+		return "", "", fmt.Errorf("%s returned an empty summary", modelName)
+	}
+	return response, modelName, nil
+}
+
+func summaryPrompt(previous string, turns []data.History) string {
+	transcript := []string{}
+	size := 0
+	// Walk backwards so the newest turns survive the input cap
+	for i := len(turns) - 1; i >= 0; i-- {
+		turn := formatSummaryTurn(turns[i])
+		if size+len(turn) > maxSummaryInputChars {
+			break
+		}
+		size += len(turn)
+		transcript = append([]string{turn}, transcript...)
+	}
+
+	var b strings.Builder
+	if previous != "" {
+		b.WriteString("Summary so far:\n\n")
+		b.WriteString(previous)
+		b.WriteString("\n\nExtend the summary with the following messages.\n\n")
+	} else {
+		b.WriteString("Summarize the following messages.\n\n")
+	}
+	b.WriteString(strings.Join(transcript, "\n\n"))
+	return b.String()
+}
+
+func formatSummaryTurn(h data.History) string {
+	parts := []string{}
+	if h.Prompt != "" {
+		parts = append(parts, "User: "+truncateForSummary(h.Prompt))
+	}
+	if h.Response != "" {
+		parts = append(parts, "Assistant: "+truncateForSummary(h.Response))
+	}
+	for _, toolUse := range h.ToolUse {
+		parts = append(parts, fmt.Sprintf("Tool %s(%s): %s", toolUse.Name, truncateForSummary(toolUse.Input), truncateForSummary(toolUse.Result.Content)))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func truncateForSummary(text string) string {
+	if len(text) <= maxSummaryTurnChars {
+		return text
+	}
+	return strings.ToValidUTF8(text[:maxSummaryTurnChars], "") + " [...]"
+}
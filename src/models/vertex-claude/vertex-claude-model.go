@@ -2,6 +2,7 @@ package vertex_claude_model
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,14 +23,14 @@ func (model *ClaudeModel) SetResponseHandler(responseHandler commontypes.Respons
 	model.ResponseHandler = responseHandler
 }
 
-func (model *ClaudeModel) CreateRequest(context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) *http.Request {
+func (model *ClaudeModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
 	payload := createClaudePayload(prompt, streaming, history)
 	model.prompt = prompt
 	model.accumulatedAnswer = ""
 	if context != nil {
 		model.contextId = context.Id
 	}
-	return createClaudeRequest(payload, history)
+	return createClaudeRequest(ctx, payload, history)
 }
 
 func (model *ClaudeModel) HandleStreamedLine(line []byte) {
@@ -46,7 +47,7 @@ func (model *ClaudeModel) HandleStreamedLine(line []byte) {
 			model.accumulatedAnswer = model.accumulatedAnswer + apiResponse.Delta.Text
 			model.ResponseHandler.RecievedText(apiResponse.Delta.Text, nil)
 		} else if apiResponse.Type == message_stop {
-			model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, "", "", "claude", nil)
+			model.ResponseHandler.FinalText(model.contextId, model.prompt, model.accumulatedAnswer, nil, "claude", nil, nil, nil)
 		}
 		//TODO: catch the token count response
 	} else {
@@ -61,7 +62,7 @@ func (model *ClaudeModel) HandleBodyBytes(bytes []byte) {
 		fmt.Printf("Error unmarshalling response body: %v\n", err)
 	}
 
-	model.ResponseHandler.FinalText(model.contextId, model.prompt, apiResponse.Content[0].Text, "", "", "cluade", nil)
+	model.ResponseHandler.FinalText(model.contextId, model.prompt, apiResponse.Content[0].Text, nil, "cluade", nil, nil, nil)
 }
 
 func createClaudePayload(prompt string, streamed bool, history []data.History) VertexMessageBody {
@@ -81,19 +82,19 @@ func createClaudePayload(prompt string, streamed bool, history []data.History) V
 	return payload
 }
 
-func createClaudeRequest(payload VertexMessageBody, history []data.History) *http.Request {
+func createClaudeRequest(ctx context.Context, payload VertexMessageBody, history []data.History) (*http.Request, error) {
 	//use gcloud to fetch the token
 	cmd := exec.Command("gcloud", "auth", "print-access-token")
 	apiKeyBytes, err := cmd.CombinedOutput()
 	//apiKey, ok := os.LookupEnv("VERTEX_CLAUDE_API_KEY")
 	apiKey := strings.TrimSpace(string(apiKeyBytes))
 	if err != nil {
-		panic(fmt.Errorf("Could not fetch api key %v", err))
+		return nil, &commontypes.ProviderError{Kind: commontypes.ErrorKindAuth, Provider: "vertex", Message: fmt.Sprintf("could not fetch access token: %v", err)}
 	}
 
 	jsonpayload, err := json.Marshal(payload)
 	if err != nil {
-		panic("failed to marshal payload")
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	project_id := "sandbox-416509"
@@ -102,14 +103,14 @@ func createClaudeRequest(payload VertexMessageBody, history []data.History) *htt
 
 	url := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:streamRawPredict", location, project_id, location, model)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonpayload))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonpayload))
 	if err != nil {
-		panic("failed to create request")
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("anthropic-version", "vertex-2023-10-16")
 
-	return req
+	return req, nil
 }
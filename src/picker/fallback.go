@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/registry"
+)
+
+// LoadFallbackChains returns the fallback chains of the model registry by
+// name, see registry.Config.
+func LoadFallbackChains() (map[string][]string, error) {
+	config, err := registry.Current()
+	if err != nil {
+		return nil, err
+	}
+	return config.Fallbacks, nil
+}
+
+func newFallbackChainModel(
+	chain []string,
+	responseHandler commontypes.ResponseHandler,
+	historyRepository data.HistoryRepository,
+	streamMode bool,
+	thinkingMode bool,
+	streamThinkingMode bool,
+	outputThinkingMode bool,
+) *FallbackChainModel {
+	fallbackModel := &FallbackChainModel{}
+	for _, name := range chain {
+		model, modelName := modelForName(name, nil, historyRepository, streamMode, thinkingMode, streamThinkingMode, outputThinkingMode)
+		model.SetResponseHandler(answeringModel(responseHandler, modelName))
+		fallbackModel.candidates = append(fallbackModel.candidates, fallbackCandidate{name: modelName, model: model})
+	}
+	return fallbackModel
+}
+
+// fallbackChain resolves name to its chain, nil when it is not a chain.
+func fallbackChain(name string) []string {
+	if name == "" {
+		return nil
+	}
+	chains, err := LoadFallbackChains()
+	if err != nil {
+		// An unreadable config should not stop plain model names from working
+		fmt.Fprintf(os.Stderr, "could not read fallback chains: %v\n", err)
+		return nil
+	}
+	return chains[name]
+}
+
+type fallbackCandidate struct {
+	name  string
+	model commontypes.Model
+}
+
+// FallbackChainModel sends every request to its active model and moves down
+// the chain when the query pipeline asks it to.
+type FallbackChainModel struct {
+	candidates []fallbackCandidate
+	active     int
+}
+
+func (chain *FallbackChainModel) ActiveModel() commontypes.Model {
+	return chain.candidates[chain.active].model
+}
+
+func (chain *FallbackChainModel) ActiveModelName() string {
+	return chain.candidates[chain.active].name
+}
+
+func (chain *FallbackChainModel) Fallback() bool {
+	if chain.active+1 >= len(chain.candidates) {
+		return false
+	}
+	chain.active++
+	return true
+}
+
+func (chain *FallbackChainModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	return chain.ActiveModel().CreateRequest(ctx, context, prompt, streaming, history, modifiers)
+}
+
+func (chain *FallbackChainModel) HandleStreamedLine(line []byte) {
+	chain.ActiveModel().HandleStreamedLine(line)
+}
+
+func (chain *FallbackChainModel) HandleBodyBytes(bytes []byte) {
+	chain.ActiveModel().HandleBodyBytes(bytes)
+}
+
+func (chain *FallbackChainModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {
+	for _, candidate := range chain.candidates {
+		candidate.model.SetResponseHandler(answeringModel(responseHandler, candidate.name))
+	}
+}
+
+// answeringModelHandler records the chain member that answered as the history
+// model, instead of the provider specific version the model reports.
+type answeringModelHandler struct {
+	commontypes.ResponseHandler
+	modelName string
+}
+
+func answeringModel(responseHandler commontypes.ResponseHandler, modelName string) commontypes.ResponseHandler {
+	if responseHandler == nil {
+		return nil
+	}
+	return &answeringModelHandler{ResponseHandler: responseHandler, modelName: modelName}
+}
+
+func (handler *answeringModelHandler) RecievedThinking(text string) {
+	commontypes.SendThinking(handler.ResponseHandler, text)
+}
+
+func (handler *answeringModelHandler) ToolCalled(toolUse data.ToolUse) {
+	commontypes.SendToolCalled(handler.ResponseHandler, toolUse)
+}
+
+func (handler *answeringModelHandler) ToolAnswered(toolUse data.ToolUse) {
+	commontypes.SendToolAnswered(handler.ResponseHandler, toolUse)
+}
+
+func (handler *answeringModelHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
+	handler.ResponseHandler.FinalText(contextId, prompt, response, toolUse, handler.modelName, usage, thinking, attachments)
+}
@@ -1,17 +1,20 @@
 package models
 
 import (
+	"fmt"
+	"os"
 	commontypes "owl/common_types"
 	"owl/data"
 	claude_model "owl/models/claude"
 	gemeni_model "owl/models/gemeni"
 	grok_model "owl/models/grok"
 	ollama_model "owl/models/ollama"
-	openai_4o_model "owl/models/open-ai-4o"
 	openai_base "owl/models/open-ai-base"
 	open_ai_gpt_model "owl/models/open-ai-gpt"
 	open_ai_responses "owl/models/open-ai-responses"
 	"owl/openai_auth"
+	"owl/registry"
+	"sync"
 )
 
 func GetModelForQuery(
@@ -37,64 +40,122 @@ func GetModelForQuery(
 		}
 	}
 
+	if chain := fallbackChain(modelToUse); len(chain) > 0 {
+		return newFallbackChainModel(chain, responseHandler, historyRepository, streamMode, thinkingMode, streamThinkingMode, outputThinkingMode), modelToUse
+	}
+
+	return modelForName(modelToUse, responseHandler, historyRepository, streamMode, thinkingMode, streamThinkingMode, outputThinkingMode)
+}
+
+var registryWarning sync.Once
+
+// LoadRegistry returns the configured models, or the built-in ones when
+// ~/.owl/models.yaml cannot be read. The registry is read once per process,
+// see registry.Current.
+func LoadRegistry() []registry.ModelSpec {
+	config, err := registry.Current()
+	if err != nil {
+		registryWarning.Do(func() {
+			fmt.Fprintf(os.Stderr, "could not read model registry: %v\n", err)
+		})
+	}
+	return config.Models
+}
+
+func modelForName(
+	modelToUse string,
+	responseHandler commontypes.ResponseHandler,
+	historyRepository data.HistoryRepository,
+	streamMode bool,
+	thinkingMode bool,
+	streamThinkingMode bool,
+	outputThinkingMode bool,
+) (commontypes.Model, string) {
+	models := LoadRegistry()
+	spec, ok := registry.Lookup(models, modelToUse)
+	if !ok {
+		modelToUse = "claude"
+		spec, _ = registry.Lookup(models, modelToUse)
+	}
+
 	var model commontypes.Model
 
-	switch modelToUse {
-	case "gemeni":
+	switch spec.Provider {
+	case registry.ProviderGemini:
 		model = &gemeni_model.GemeniModel{
 			OpenAICompatibleModel: openai_base.OpenAICompatibleModel{
 				ResponseHandler:   responseHandler,
 				HistoryRepository: historyRepository,
 			},
+			Spec: spec,
 		}
-	case "grok":
-		model = &grok_model.GrokModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}}
-	case "4o":
-		model = &openai_4o_model.OpenAi4oModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: "gpt-4o"}
-	case "gpt":
-		if openai_auth.HasCodexOAuthCredential() {
-			model = &open_ai_responses.OpenAiResponseModel{ResponseHandler: responseHandler, ModelVersion: modelToUse}
+	case registry.ProviderGrok:
+		model = &grok_model.GrokModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, Spec: spec}
+	case registry.ProviderOpenAIChat:
+		if UsesCodexLogin(modelToUse) {
+			model = &open_ai_responses.OpenAiResponseModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository, ModelVersion: modelToUse, Spec: spec}
 		} else {
-			model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
+			model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse, Spec: spec}
 		}
-	case "codex":
-		if openai_auth.HasCodexOAuthCredential() {
-			model = &open_ai_responses.OpenAiResponseModel{ResponseHandler: responseHandler, ModelVersion: modelToUse}
-		} else {
-			model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
-		}
-	case "gpt-5.4":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
-	case "gpt-5.5":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
-	case "responses":
-		model = &open_ai_responses.OpenAiResponseModel{ResponseHandler: responseHandler, ModelVersion: "gpt"}
-	case "gpt-nano":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
-	case "gpt-mini":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: modelToUse}
-	case "gpt-chat":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: "gpt"}
-		modelToUse = "gpt-chat"
-	case "codex-chat":
-		model = &open_ai_gpt_model.OpenAIGPTModel{OpenAICompatibleModel: openai_base.OpenAICompatibleModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository}, ModelVersion: "codex"}
-		modelToUse = "codex-chat"
-	case "ollama":
-		model = ollama_model.NewOllamaModel(responseHandler, historyRepository, "")
-	case "qwen3":
-		model = ollama_model.NewOllamaModel(responseHandler, historyRepository, "")
-	case "opus":
-		model = &claude_model.ClaudeModel{UseStreaming: streamMode, HistoryRepository: historyRepository, ResponseHandler: responseHandler, UseThinking: thinkingMode, StreamThought: streamThinkingMode, OutputThought: outputThinkingMode, ModelVersion: "opus"}
-	case "sonnet":
-		model = &claude_model.ClaudeModel{UseStreaming: streamMode, HistoryRepository: historyRepository, ResponseHandler: responseHandler, UseThinking: thinkingMode, StreamThought: streamThinkingMode, OutputThought: outputThinkingMode, ModelVersion: "sonnet"}
-	case "haiku":
-		model = &claude_model.ClaudeModel{UseStreaming: streamMode, HistoryRepository: historyRepository, ResponseHandler: responseHandler, UseThinking: thinkingMode, StreamThought: streamThinkingMode, OutputThought: outputThinkingMode, ModelVersion: "haiku"}
-	case "claude":
-		fallthrough
+	case registry.ProviderOpenAIResponses:
+		model = &open_ai_responses.OpenAiResponseModel{ResponseHandler: responseHandler, HistoryRepository: historyRepository, ModelVersion: modelToUse, Spec: spec}
+	case registry.ProviderOllama:
+		model = ollama_model.NewOllamaModel(responseHandler, historyRepository, spec)
 	default:
-		model = &claude_model.ClaudeModel{UseStreaming: streamMode, HistoryRepository: historyRepository, ResponseHandler: responseHandler, UseThinking: thinkingMode, StreamThought: streamThinkingMode, OutputThought: outputThinkingMode}
-		modelToUse = "claude"
+		model = &claude_model.ClaudeModel{UseStreaming: streamMode, HistoryRepository: historyRepository, ResponseHandler: responseHandler, UseThinking: thinkingMode, StreamThought: streamThinkingMode, OutputThought: outputThinkingMode, ModelVersion: modelToUse, Spec: spec}
 	}
 
 	return model, modelToUse
 }
+
+// UsesCodexLogin reports whether a chat completions alias is sent through the
+// responses API because of a codex login.
+func UsesCodexLogin(modelName string) bool {
+	return (modelName == "gpt" || modelName == "codex") && openai_auth.HasCodexOAuthCredential()
+}
+
+// KnownModel reports whether name is a registry alias or a fallback chain.
+func KnownModel(name string) bool {
+	if _, ok := registry.Lookup(LoadRegistry(), name); ok {
+		return true
+	}
+	return len(fallbackChain(name)) > 0
+}
+
+// CheckGeneration checks generation settings against the model they will be
+// sent to. For a fallback chain the first model has to take every setting,
+// the later ones leave out what they do not take. An unknown name is checked
+// against the default model, as GetModelForQuery falls back to it. The
+// thinking budget is only checked when thinking is on.
+func CheckGeneration(modelName string, settings data.GenerationSettings, thinking bool) error {
+	return checkGeneration(modelName, settings, thinking, true)
+}
+
+// CheckModelSwitch checks the settings a context already has against the
+// model it switches to. Settings the model does not take are left out of its
+// requests, so only the values of the ones it takes are checked.
+func CheckModelSwitch(modelName string, settings data.GenerationSettings, thinking bool) error {
+	return checkGeneration(modelName, settings, thinking, false)
+}
+
+func checkGeneration(modelName string, settings data.GenerationSettings, thinking bool, strict bool) error {
+	names := fallbackChain(modelName)
+	if len(names) == 0 {
+		names = []string{modelName}
+	}
+	models := LoadRegistry()
+	for i, name := range names {
+		spec, ok := registry.Lookup(models, name)
+		if !ok {
+			spec, _ = registry.Lookup(models, "claude")
+		}
+		check := spec.CheckFallbackGeneration
+		if strict && i == 0 {
+			check = spec.CheckGeneration
+		}
+		if err := check(settings, thinking); err != nil {
+			return fmt.Errorf("%s: %w", spec.Alias, err)
+		}
+	}
+	return nil
+}
@@ -3,10 +3,14 @@ package models
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	commontypes "owl/common_types"
+	"owl/data"
 	open_ai_gpt_model "owl/models/open-ai-gpt"
 	open_ai_responses "owl/models/open-ai-responses"
+	"owl/registry"
 )
 
 func TestGetModelForQuery_DefaultsToClaudeWithoutCodexAuth(t *testing.T) {
@@ -64,3 +68,147 @@ func TestGetModelForQuery_GptUsesResponsesWithCodexAuth(t *testing.T) {
 		t.Fatalf("expected responses model with oauth")
 	}
 }
+
+func writeFallbackChains(t *testing.T, home string, content string) {
+	t.Helper()
+	path := filepath.Join(home, ".owl", "models.yaml")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	registry.Reload()
+	t.Cleanup(registry.Reload)
+}
+
+func TestLoadFallbackChains_ReadsTheRegistry(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeFallbackChains(t, home, "fallbacks:\n  resilient: [claude, gpt, ollama]\n  local: [ollama]\n")
+
+	chains, err := LoadFallbackChains()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(chains["resilient"], ",") != "claude,gpt,ollama" {
+		t.Fatalf("unexpected resilient chain %v", chains["resilient"])
+	}
+	if strings.Join(chains["local"], ",") != "ollama" {
+		t.Fatalf("unexpected local chain %v", chains["local"])
+	}
+}
+
+func TestLoadFallbackChains_RejectsUnknownModel(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeFallbackChains(t, home, "fallbacks:\n  broken: [claude, carrier-pigeon]\n")
+
+	if _, err := LoadFallbackChains(); err == nil {
+		t.Fatalf("expected an error for an unknown model in a chain")
+	}
+}
+
+type recordingHandler struct {
+	modelName string
+}
+
+func (h *recordingHandler) RecievedText(text string, color *string) {}
+
+func (h *recordingHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
+	h.modelName = modelName
+}
+
+func TestGetModelForQuery_ResolvesFallbackChain(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeFallbackChains(t, home, "fallbacks:\n  resilient: [claude, gpt]\n")
+
+	handler := &recordingHandler{}
+	model, modelName := GetModelForQuery("resilient", nil, handler, nil, false, false, false, false)
+	if modelName != "resilient" {
+		t.Fatalf("expected the chain name to be kept as preferred model, got %q", modelName)
+	}
+
+	chain, ok := model.(*FallbackChainModel)
+	if !ok {
+		t.Fatalf("expected a fallback chain model, got %T", model)
+	}
+	if chain.ActiveModelName() != "claude" {
+		t.Fatalf("expected claude first, got %s", chain.ActiveModelName())
+	}
+	if !chain.Fallback() || chain.ActiveModelName() != "gpt" {
+		t.Fatalf("expected gpt after a fallback, got %s", chain.ActiveModelName())
+	}
+	if chain.Fallback() {
+		t.Fatalf("expected the chain to be exhausted")
+	}
+
+	gpt, ok := chain.ActiveModel().(*open_ai_gpt_model.OpenAIGPTModel)
+	if !ok {
+		t.Fatalf("expected chat-completions GPT model, got %T", chain.ActiveModel())
+	}
+	gpt.ResponseHandler.FinalText(1, "prompt", "answer", nil, "gpt-5.3-codex", nil, nil, nil)
+	if handler.modelName != "gpt" {
+		t.Fatalf("expected history to record the answering chain member, got %q", handler.modelName)
+	}
+}
+
+func TestGetModelForQuery_UsesRegistryEntries(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, ".owl", "models.yaml")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	content := "models:\n  - alias: mistral\n    provider: openai-chat\n    model: mistral-large-latest\n    base_url: https://api.mistral.ai/v1\n    api_key_env: MISTRAL_API_KEY\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	registry.Reload()
+	t.Cleanup(registry.Reload)
+
+	model, modelName := GetModelForQuery("mistral", nil, nil, nil, false, false, false, false)
+	if modelName != "mistral" {
+		t.Fatalf("expected mistral, got %q", modelName)
+	}
+	gpt, ok := model.(*open_ai_gpt_model.OpenAIGPTModel)
+	if !ok {
+		t.Fatalf("expected a chat-completions model, got %T", model)
+	}
+	if gpt.Spec.Model != "mistral-large-latest" || gpt.Spec.ApiKeyEnv != "MISTRAL_API_KEY" {
+		t.Fatalf("expected the registry entry on the model, got %+v", gpt.Spec)
+	}
+
+	if !KnownModel("mistral") || KnownModel("carrier-pigeon") {
+		t.Fatalf("expected KnownModel to follow the registry")
+	}
+}
+
+func TestCheckGeneration_ChecksEveryModelOfAChain(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeFallbackChains(t, home, "fallbacks:\n  resilient: [gpt, sonnet]\n")
+
+	temperature := 1.5
+	settings := data.GenerationSettings{Temperature: &temperature}
+	if err := CheckGeneration("gpt", settings, true); err != nil {
+		t.Fatalf("expected the temperature to fit gpt, got %v", err)
+	}
+	err := CheckGeneration("resilient", settings, true)
+	if err == nil || !strings.Contains(err.Error(), "sonnet") {
+		t.Fatalf("expected sonnet in the chain to refuse the temperature, got %v", err)
+	}
+}
+
+func TestCheckModelSwitch_SkipsSettingsTheModelDoesNotTake(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	settings := data.GenerationSettings{ThinkingBudget: 4000}
+	if err := CheckGeneration("gpt", settings, true); err == nil {
+		t.Fatalf("expected setting a thinking budget on gpt to be refused")
+	}
+	if err := CheckModelSwitch("gpt", settings, true); err != nil {
+		t.Fatalf("expected a context with a thinking budget to switch to gpt, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"fmt"
+	"owl/data"
+	"slices"
+	"strings"
+)
+
+// MinThinkingBudget is the smallest thinking budget Anthropic accepts.
+const MinThinkingBudget = 1024
+
+// generationLimits are the generation settings a provider accepts.
+type generationLimits struct {
+	maxTemperature   float64
+	thinkingBudget   bool
+	reasoningEfforts []string
+	stopSequences    bool
+	// maxStopSequences is zero when the provider does not limit them
+	maxStopSequences int
+}
+
+var providerLimits = map[Provider]generationLimits{
+	ProviderAnthropic:       {maxTemperature: 1, thinkingBudget: true, stopSequences: true},
+	ProviderOpenAIChat:      {maxTemperature: 2, reasoningEfforts: []string{"minimal", "low", "medium", "high"}, stopSequences: true, maxStopSequences: 4},
+	ProviderOpenAIResponses: {maxTemperature: 2, reasoningEfforts: []string{"minimal", "low", "medium", "high"}},
+	ProviderOllama:          {maxTemperature: 2, stopSequences: true},
+	ProviderGemini:          {maxTemperature: 2, reasoningEfforts: []string{"low", "medium", "high"}, stopSequences: true, maxStopSequences: 5},
+	ProviderGrok:            {maxTemperature: 2},
+}
+
+// Generation returns the settings a request of this entry is sent with: the
+// settings of the context over the defaults of the entry. Settings the
+// provider does not take are left out, so a context keeps working when it
+// moves to another model or a chain falls back. They are checked when they
+// are set, see CheckGeneration.
+func (spec ModelSpec) Generation(settings data.GenerationSettings) data.GenerationSettings {
+	settings = spec.withDefaults(settings)
+	if spec.ContextWindow > 0 && settings.MaxTokens > spec.ContextWindow {
+		settings.MaxTokens = spec.MaxTokens
+	}
+
+	limits, ok := providerLimits[spec.Provider]
+	if !ok {
+		return settings
+	}
+	if !limits.thinkingBudget {
+		settings.ThinkingBudget = 0
+	}
+	if settings.ReasoningEffort != "" && !slices.Contains(limits.reasoningEfforts, settings.ReasoningEffort) {
+		settings.ReasoningEffort = ""
+	}
+	if settings.Temperature != nil && (*settings.Temperature < 0 || *settings.Temperature > limits.maxTemperature) {
+		settings.Temperature = nil
+	}
+	if settings.TopP != nil && (*settings.TopP < 0 || *settings.TopP > 1) {
+		settings.TopP = nil
+	}
+	if !limits.stopSequences {
+		settings.StopSequences = nil
+	} else if limits.maxStopSequences > 0 && len(settings.StopSequences) > limits.maxStopSequences {
+		settings.StopSequences = settings.StopSequences[:limits.maxStopSequences]
+	}
+	return settings
+}
+
+// ThinkingFits reports whether the thinking budget of settings can be sent
+// with thinking on, Anthropic refuses a budget below MinThinkingBudget or
+// not below max_tokens.
+func ThinkingFits(settings data.GenerationSettings) bool {
+	if settings.ThinkingBudget < MinThinkingBudget {
+		return false
+	}
+	return settings.MaxTokens == 0 || settings.ThinkingBudget < settings.MaxTokens
+}
+
+// CheckGeneration checks the settings of a context against the limits of the
+// provider, for the commands that set them or pick the model. The thinking
+// budget is only checked when thinking is on.
+func (spec ModelSpec) CheckGeneration(settings data.GenerationSettings, thinking bool) error {
+	return checkGeneration(spec, spec.withDefaults(settings), thinking, true)
+}
+
+// CheckFallbackGeneration is CheckGeneration for the later models of a
+// fallback chain: settings the provider does not take are left out for them,
+// see Generation, only the values of the ones it takes are checked.
+func (spec ModelSpec) CheckFallbackGeneration(settings data.GenerationSettings, thinking bool) error {
+	return checkGeneration(spec, spec.withDefaults(settings), thinking, false)
+}
+
+func (spec ModelSpec) withDefaults(settings data.GenerationSettings) data.GenerationSettings {
+	if settings.MaxTokens == 0 {
+		settings.MaxTokens = spec.MaxTokens
+	}
+	if settings.ThinkingBudget == 0 {
+		settings.ThinkingBudget = spec.ThinkingBudget
+	}
+	if settings.ReasoningEffort == "" {
+		settings.ReasoningEffort = spec.ReasoningEffort
+	}
+	if settings.Temperature == nil {
+		settings.Temperature = spec.Temperature
+	}
+	if settings.TopP == nil {
+		settings.TopP = spec.TopP
+	}
+	return settings
+}
+
+// checkGeneration reports settings outside the limits of the provider. When
+// strict is false the settings the provider does not take are not reported.
+func checkGeneration(spec ModelSpec, settings data.GenerationSettings, thinking bool, strict bool) error {
+	if settings.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must be positive")
+	}
+	if spec.ContextWindow > 0 && settings.MaxTokens > spec.ContextWindow {
+		return fmt.Errorf("max_tokens %d is above the context window of %s (%d)", settings.MaxTokens, spec.Alias, spec.ContextWindow)
+	}
+
+	limits, ok := providerLimits[spec.Provider]
+	if !ok {
+		// Specs built without a provider have no limits to check against
+		return nil
+	}
+
+	if settings.ThinkingBudget != 0 {
+		if !limits.thinkingBudget {
+			if strict {
+				return fmt.Errorf("%s has no thinking budget, use reasoning_effort", spec.Provider)
+			}
+		} else if thinking {
+			if settings.ThinkingBudget < MinThinkingBudget {
+				return fmt.Errorf("thinking_budget must be at least %d", MinThinkingBudget)
+			}
+			if !ThinkingFits(settings) {
+				return fmt.Errorf("thinking_budget %d must be below max_tokens %d", settings.ThinkingBudget, settings.MaxTokens)
+			}
+		}
+	}
+
+	if settings.ReasoningEffort != "" && !slices.Contains(limits.reasoningEfforts, settings.ReasoningEffort) {
+		if len(limits.reasoningEfforts) == 0 {
+			if strict {
+				return fmt.Errorf("%s has no reasoning effort", spec.Provider)
+			}
+		} else {
+			return fmt.Errorf("reasoning_effort must be one of %s for %s", strings.Join(limits.reasoningEfforts, ", "), spec.Provider)
+		}
+	}
+
+	if settings.Temperature != nil && (*settings.Temperature < 0 || *settings.Temperature > limits.maxTemperature) {
+		return fmt.Errorf("temperature must be between 0 and %g for %s", limits.maxTemperature, spec.Provider)
+	}
+	if settings.TopP != nil && (*settings.TopP < 0 || *settings.TopP > 1) {
+		return fmt.Errorf("top_p must be between 0 and 1")
+	}
+
+	if len(settings.StopSequences) > 0 {
+		if !limits.stopSequences {
+			if strict {
+				return fmt.Errorf("%s does not take stop sequences", spec.Provider)
+			}
+		} else if limits.maxStopSequences > 0 && len(settings.StopSequences) > limits.maxStopSequences {
+			return fmt.Errorf("%s takes at most %d stop sequences", spec.Provider, limits.maxStopSequences)
+		}
+	}
+	return nil
+}
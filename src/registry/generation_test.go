@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"owl/data"
+	"testing"
+)
+
+func TestGeneration_ContextSettingsOverrideModelDefaults(t *testing.T) {
+	temperature := 0.7
+	spec := ModelSpec{Alias: "sonnet", Provider: ProviderAnthropic, MaxTokens: 20000, ThinkingBudget: 2000, Temperature: &temperature, ContextWindow: 200000}
+
+	settings := spec.Generation(data.GenerationSettings{MaxTokens: 8000})
+	if settings.MaxTokens != 8000 || settings.ThinkingBudget != 2000 || settings.Temperature == nil || *settings.Temperature != 0.7 {
+		t.Fatalf("expected the context max tokens over the model defaults, got %+v", settings)
+	}
+}
+
+func TestCheckGeneration_RejectsSettingsOutsideProviderLimits(t *testing.T) {
+	claude, _ := Builtin("sonnet")
+	gpt, _ := Builtin("gpt")
+	grok, _ := Builtin("grok")
+	high := 1.5
+	negative := -0.1
+
+	cases := []struct {
+		name     string
+		spec     ModelSpec
+		settings data.GenerationSettings
+	}{
+		{"claude temperature", claude, data.GenerationSettings{Temperature: &high}},
+		{"claude effort", claude, data.GenerationSettings{ReasoningEffort: "high"}},
+		{"small thinking budget", claude, data.GenerationSettings{ThinkingBudget: 500}},
+		{"thinking budget over max tokens", claude, data.GenerationSettings{MaxTokens: 4000, ThinkingBudget: 4000}},
+		{"max tokens over context window", claude, data.GenerationSettings{MaxTokens: 300000}},
+		{"openai thinking budget", gpt, data.GenerationSettings{ThinkingBudget: 2048}},
+		{"openai effort", gpt, data.GenerationSettings{ReasoningEffort: "extreme"}},
+		{"openai stop sequences", gpt, data.GenerationSettings{StopSequences: []string{"a", "b", "c", "d", "e"}}},
+		{"grok stop sequences", grok, data.GenerationSettings{StopSequences: []string{"END"}}},
+		{"top_p", gpt, data.GenerationSettings{TopP: &negative}},
+	}
+	for _, c := range cases {
+		if err := c.spec.CheckGeneration(c.settings, true); err == nil {
+			t.Errorf("%s: expected an error for %+v", c.name, c.settings)
+		}
+	}
+
+	if err := gpt.CheckGeneration(data.GenerationSettings{Temperature: &high, ReasoningEffort: "low", StopSequences: []string{"END"}}, true); err != nil {
+		t.Fatalf("expected the settings to fit openai, got %v", err)
+	}
+}
+
+func TestCheckGeneration_ChecksThinkingBudgetOnlyWithThinking(t *testing.T) {
+	claude, _ := Builtin("sonnet")
+	settings := data.GenerationSettings{MaxTokens: 1500}
+
+	if err := claude.CheckGeneration(settings, false); err != nil {
+		t.Fatalf("expected the default thinking budget to be ignored without thinking, got %v", err)
+	}
+	if err := claude.CheckGeneration(settings, true); err == nil {
+		t.Fatalf("expected the default thinking budget to be refused over max_tokens with thinking")
+	}
+}
+
+func TestGeneration_SkipsSettingsTheProviderDoesNotTake(t *testing.T) {
+	gpt, _ := Builtin("gpt")
+	grok, _ := Builtin("grok")
+	claude, _ := Builtin("sonnet")
+	high := 1.5
+
+	settings := gpt.Generation(data.GenerationSettings{ThinkingBudget: 4000})
+	if settings.ThinkingBudget != 0 {
+		t.Fatalf("expected openai to leave out the thinking budget, got %+v", settings)
+	}
+	settings = grok.Generation(data.GenerationSettings{StopSequences: []string{"END"}})
+	if len(settings.StopSequences) != 0 {
+		t.Fatalf("expected grok to leave out the stop sequences, got %+v", settings)
+	}
+	settings = claude.Generation(data.GenerationSettings{Temperature: &high, ReasoningEffort: "high"})
+	if settings.Temperature != nil || settings.ReasoningEffort != "" {
+		t.Fatalf("expected anthropic to leave out the temperature and effort, got %+v", settings)
+	}
+
+	if err := gpt.CheckFallbackGeneration(data.GenerationSettings{ThinkingBudget: 4000}, true); err != nil {
+		t.Fatalf("expected a fallback model to skip the thinking budget, got %v", err)
+	}
+}
+
+func TestLoad_RejectsModelDefaultsOutsideLimits(t *testing.T) {
+	writeConfig(t, "models.yaml", `
+models:
+  - alias: haiku
+    temperature: 1.5
+`)
+
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected an error for a temperature Anthropic does not accept")
+	}
+}
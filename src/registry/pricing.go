@@ -0,0 +1,42 @@
+package registry
+
+// Pricing is the price of a model in USD per million tokens. A nil Pricing on
+// a ModelSpec means the price is unknown, an empty one that the model is free.
+type Pricing struct {
+	Input      float64 `yaml:"input" toml:"input" json:"input"`
+	Output     float64 `yaml:"output" toml:"output" json:"output"`
+	CacheRead  float64 `yaml:"cache_read" toml:"cache_read" json:"cache_read,omitempty"`
+	CacheWrite float64 `yaml:"cache_write" toml:"cache_write" json:"cache_write,omitempty"`
+}
+
+var (
+	sonnetPricing      = &Pricing{Input: 3, Output: 15, CacheRead: 0.30, CacheWrite: 3.75}
+	opusPricing        = &Pricing{Input: 5, Output: 25, CacheRead: 0.50, CacheWrite: 6.25}
+	haikuPricing       = &Pricing{Input: 1, Output: 5, CacheRead: 0.10, CacheWrite: 1.25}
+	gpt4oPricing       = &Pricing{Input: 2.5, Output: 10, CacheRead: 1.25}
+	grokFastPricing    = &Pricing{Input: 0.2, Output: 0.5, CacheRead: 0.05}
+	geminiFlashPricing = &Pricing{Input: 0.5, Output: 3}
+	localPricing       = &Pricing{}
+)
+
+// Cost returns the price in USD of one message's token counts.
+func (pricing Pricing) Cost(promptTokens, completionTokens, cacheReadTokens, cacheWriteTokens int) float64 {
+	return (float64(promptTokens)*pricing.Input +
+		float64(completionTokens)*pricing.Output +
+		float64(cacheReadTokens)*pricing.CacheRead +
+		float64(cacheWriteTokens)*pricing.CacheWrite) / 1_000_000
+}
+
+// PricingFor finds the price of a history model name. Rows store the alias,
+// older rows the provider's model id, so both are tried.
+func PricingFor(models []ModelSpec, name string) (*Pricing, bool) {
+	if spec, ok := Lookup(models, name); ok {
+		return spec.Pricing, spec.Pricing != nil
+	}
+	for _, spec := range models {
+		if spec.Model == name && spec.Pricing != nil {
+			return spec.Pricing, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,398 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+	"owl/data"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Provider selects the model implementation the picker builds for an entry.
+type Provider string
+
+const (
+	ProviderAnthropic       Provider = "anthropic"
+	ProviderOpenAIChat      Provider = "openai-chat"
+	ProviderOpenAIResponses Provider = "openai-responses"
+	ProviderOllama          Provider = "ollama"
+	ProviderGemini          Provider = "gemini"
+	ProviderGrok            Provider = "grok"
+)
+
+var providers = []Provider{
+	ProviderAnthropic,
+	ProviderOpenAIChat,
+	ProviderOpenAIResponses,
+	ProviderOllama,
+	ProviderGemini,
+	ProviderGrok,
+}
+
+// ModelSpec is one selectable model. Alias is the name used with -model, in
+// the TUI and over HTTP, Model is the id sent to the provider's API.
+type ModelSpec struct {
+	Alias          string   `yaml:"alias" toml:"alias" json:"alias"`
+	Provider       Provider `yaml:"provider" toml:"provider" json:"provider"`
+	Model          string   `yaml:"model" toml:"model" json:"model"`
+	MaxTokens      int      `yaml:"max_tokens" toml:"max_tokens" json:"max_tokens,omitempty"`
+	ThinkingBudget int      `yaml:"thinking_budget" toml:"thinking_budget" json:"thinking_budget,omitempty"`
+	BaseURL        string   `yaml:"base_url" toml:"base_url" json:"base_url,omitempty"`
+	ApiKeyEnv      string   `yaml:"api_key_env" toml:"api_key_env" json:"api_key_env,omitempty"`
+	Pricing        *Pricing `yaml:"pricing" toml:"pricing" json:"pricing,omitempty"`
+	ContextWindow  int      `yaml:"context_window" toml:"context_window" json:"context_window,omitempty"`
+	CompactAt      int      `yaml:"compact_at" toml:"compact_at" json:"compact_at,omitempty"`
+	// Temperature, TopP and ReasoningEffort are the defaults of the entry,
+	// unset ones leave them to the provider
+	Temperature     *float64 `yaml:"temperature" toml:"temperature" json:"temperature,omitempty"`
+	TopP            *float64 `yaml:"top_p" toml:"top_p" json:"top_p,omitempty"`
+	ReasoningEffort string   `yaml:"reasoning_effort" toml:"reasoning_effort" json:"reasoning_effort,omitempty"`
+}
+
+// Endpoint joins the base URL and an API path like "/chat/completions".
+func (spec ModelSpec) Endpoint(path string) string {
+	return strings.TrimRight(spec.BaseURL, "/") + path
+}
+
+// CompactionThreshold is the estimated payload size in tokens above which the
+// oldest turns are summarized. Zero disables compaction.
+func (spec ModelSpec) CompactionThreshold() int {
+	if spec.CompactAt > 0 {
+		return spec.CompactAt
+	}
+	return spec.ContextWindow * 3 / 4
+}
+
+// APIKey reads the key from the entry's environment variable.
+func (spec ModelSpec) APIKey() (string, bool) {
+	if spec.ApiKeyEnv == "" {
+		return "", false
+	}
+	return os.LookupEnv(spec.ApiKeyEnv)
+}
+
+const (
+	anthropicURL = "https://api.anthropic.com/v1"
+	openAIURL    = "https://api.openai.com/v1"
+	geminiURL    = "https://generativelanguage.googleapis.com/v1beta/openai"
+	grokURL      = "https://api.x.ai/v1"
+)
+
+// builtinModels are available without a config file. Entries in
+// ~/.owl/models.yaml with the same alias override them field by field. Models
+// without a published price are left unpriced and can be priced in the file.
+var builtinModels = []ModelSpec{
+	{Alias: "sonnet", Provider: ProviderAnthropic, Model: "claude-sonnet-4-5-20250929", MaxTokens: 20000, ThinkingBudget: 2000, BaseURL: anthropicURL, ApiKeyEnv: "CLAUDE_API_KEY", Pricing: sonnetPricing, ContextWindow: 200000},
+	{Alias: "codex", Provider: ProviderOpenAIChat, Model: "gpt-5.3-codex", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "codex-chat", Provider: ProviderOpenAIChat, Model: "gpt-5.3-codex", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "grok", Provider: ProviderGrok, Model: "grok-4-1-fast-reasoning", MaxTokens: 8000, BaseURL: grokURL, ApiKeyEnv: "XAI_API_KEY", Pricing: grokFastPricing, ContextWindow: 2000000},
+	{Alias: "opus", Provider: ProviderAnthropic, Model: "claude-opus-4-6", MaxTokens: 20000, ThinkingBudget: 2000, BaseURL: anthropicURL, ApiKeyEnv: "CLAUDE_API_KEY", Pricing: opusPricing, ContextWindow: 200000},
+	{Alias: "gpt", Provider: ProviderOpenAIChat, Model: "gpt-5.3-chat-latest", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "gpt-chat", Provider: ProviderOpenAIChat, Model: "gpt-5.3-chat-latest", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "haiku", Provider: ProviderAnthropic, Model: "claude-haiku-4-5-20251001", MaxTokens: 20000, ThinkingBudget: 2000, BaseURL: anthropicURL, ApiKeyEnv: "CLAUDE_API_KEY", Pricing: haikuPricing, ContextWindow: 200000},
+	{Alias: "ollama", Provider: ProviderOllama, Model: "qwen3", MaxTokens: 8000, ApiKeyEnv: "OLLAMA_API_KEY", Pricing: localPricing, ContextWindow: 32768},
+	{Alias: "claude", Provider: ProviderAnthropic, Model: "claude-sonnet-4-5-20250929", MaxTokens: 20000, ThinkingBudget: 2000, BaseURL: anthropicURL, ApiKeyEnv: "CLAUDE_API_KEY", Pricing: sonnetPricing, ContextWindow: 200000},
+	{Alias: "gpt-5.4", Provider: ProviderOpenAIChat, Model: "gpt-5.4", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "gpt-5.5", Provider: ProviderOpenAIChat, Model: "gpt-5.5", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "gpt-mini", Provider: ProviderOpenAIChat, Model: "gpt-5.4-mini-2026-03-17", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "gpt-nano", Provider: ProviderOpenAIChat, Model: "gpt-5.4-nano-2026-03-17", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "4o", Provider: ProviderOpenAIChat, Model: "gpt-4o", MaxTokens: 15000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", Pricing: gpt4oPricing, ContextWindow: 128000},
+	{Alias: "responses", Provider: ProviderOpenAIResponses, Model: "gpt-5.3-chat-latest", MaxTokens: 16000, BaseURL: openAIURL, ApiKeyEnv: "OPENAI_API_KEY", ContextWindow: 400000},
+	{Alias: "gemeni", Provider: ProviderGemini, Model: "gemini-3-flash-preview", MaxTokens: 16000, BaseURL: geminiURL, ApiKeyEnv: "GEMINI_API_KEY", Pricing: geminiFlashPricing, ContextWindow: 1048576},
+	{Alias: "qwen3", Provider: ProviderOllama, Model: "qwen3", MaxTokens: 8000, ApiKeyEnv: "OLLAMA_API_KEY", Pricing: localPricing, ContextWindow: 32768},
+}
+
+// Builtins returns a copy of the built-in models.
+func Builtins() []ModelSpec {
+	return append([]ModelSpec{}, builtinModels...)
+}
+
+// Builtin returns the built-in entry for alias. Models constructed outside
+// the picker use it to find their defaults.
+func Builtin(alias string) (ModelSpec, bool) {
+	return Lookup(builtinModels, alias)
+}
+
+// Resolve returns spec when the picker filled it in, otherwise the built-in
+// entry for alias or, failing that, for fallbackAlias.
+func Resolve(spec ModelSpec, alias string, fallbackAlias string) ModelSpec {
+	if spec.Model != "" {
+		return spec
+	}
+	if builtin, ok := Builtin(alias); ok {
+		return builtin
+	}
+	builtin, _ := Builtin(fallbackAlias)
+	return builtin
+}
+
+type modelsFile struct {
+	Models    []ModelSpec         `yaml:"models" toml:"models"`
+	Fallbacks map[string][]string `yaml:"fallbacks" toml:"fallbacks"`
+}
+
+// Config is the model registry: the models and the named fallback chains of
+// their aliases, which can be used wherever a model name is accepted.
+type Config struct {
+	Models    []ModelSpec
+	Fallbacks map[string][]string
+}
+
+// configPaths are tried in order, the first existing file is used.
+func configPaths() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(home, ".owl")
+	return []string{
+		filepath.Join(dir, "models.yaml"),
+		filepath.Join(dir, "models.yml"),
+		filepath.Join(dir, "models.toml"),
+	}, nil
+}
+
+// Load returns the built-in models merged with ~/.owl/models.yaml (or
+// models.toml). Configured aliases that are not built in are appended in file
+// order.
+func Load() ([]ModelSpec, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return config.Models, nil
+}
+
+var (
+	currentMu  sync.Mutex
+	current    *Config
+	currentErr error
+)
+
+// Current returns the registry of the process, the config file is read on the
+// first call only. When it cannot be read the built-in models are used, without
+// fallback chains, and every call returns the error.
+func Current() (Config, error) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil {
+		config, err := LoadConfig()
+		if err != nil {
+			config = Config{Models: Builtins(), Fallbacks: map[string][]string{}}
+		}
+		current, currentErr = &config, err
+	}
+	return *current, currentErr
+}
+
+// Reload drops the registry Current has read, the next call reads the config
+// file again.
+func Reload() {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current, currentErr = nil, nil
+}
+
+// LoadConfig returns the models like Load and the fallback chains of the
+// config file.
+func LoadConfig() (Config, error) {
+	paths, err := configPaths()
+	if err != nil {
+		return Config{}, err
+	}
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Config{}, err
+		}
+
+		file, err := parse(path, content)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		models, err := merge(builtinModels, file.Models)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := validateFallbacks(models, file.Fallbacks); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", path, err)
+		}
+		return Config{Models: models, Fallbacks: file.Fallbacks}, nil
+	}
+
+	return Config{Models: Builtins(), Fallbacks: map[string][]string{}}, nil
+}
+
+func parse(path string, content []byte) (modelsFile, error) {
+	var file modelsFile
+	if strings.HasSuffix(path, ".toml") {
+		if _, err := toml.Decode(string(content), &file); err != nil {
+			return modelsFile{}, err
+		}
+	} else if err := yaml.Unmarshal(content, &file); err != nil {
+		return modelsFile{}, err
+	}
+	if file.Fallbacks == nil {
+		file.Fallbacks = map[string][]string{}
+	}
+	return file, nil
+}
+
+// validateFallbacks checks that every chain lists known aliases and that no
+// chain is named like a model.
+func validateFallbacks(models []ModelSpec, fallbacks map[string][]string) error {
+	for name, chain := range fallbacks {
+		if _, ok := Lookup(models, name); ok {
+			return fmt.Errorf("fallback %s has the name of a model", name)
+		}
+		if len(chain) == 0 {
+			return fmt.Errorf("fallback %s has no models", name)
+		}
+		for _, alias := range chain {
+			if _, ok := Lookup(models, alias); !ok {
+				return fmt.Errorf("fallback %s: unknown model %q", name, alias)
+			}
+		}
+	}
+	return nil
+}
+
+func merge(builtin []ModelSpec, configured []ModelSpec) ([]ModelSpec, error) {
+	models := append([]ModelSpec{}, builtin...)
+	index := map[string]int{}
+	for i, spec := range models {
+		index[spec.Alias] = i
+	}
+
+	for _, spec := range configured {
+		if spec.Alias == "" {
+			return nil, fmt.Errorf("model %q has no alias", spec.Model)
+		}
+		if i, ok := index[spec.Alias]; ok {
+			models[i] = override(models[i], spec)
+			continue
+		}
+		if err := validate(spec); err != nil {
+			return nil, err
+		}
+		index[spec.Alias] = len(models)
+		models = append(models, withProviderDefaults(spec))
+	}
+
+	for _, spec := range models {
+		if err := validate(spec); err != nil {
+			return nil, err
+		}
+	}
+	return models, nil
+}
+
+func override(base ModelSpec, spec ModelSpec) ModelSpec {
+	if spec.Provider != "" && spec.Provider != base.Provider {
+		// A different provider does not share URL and key with the built-in
+		return withProviderDefaults(spec)
+	}
+	if spec.Model != "" {
+		base.Model = spec.Model
+	}
+	if spec.MaxTokens != 0 {
+		base.MaxTokens = spec.MaxTokens
+	}
+	if spec.ThinkingBudget != 0 {
+		base.ThinkingBudget = spec.ThinkingBudget
+	}
+	if spec.BaseURL != "" {
+		base.BaseURL = spec.BaseURL
+	}
+	if spec.ApiKeyEnv != "" {
+		base.ApiKeyEnv = spec.ApiKeyEnv
+	}
+	if spec.Pricing != nil {
+		base.Pricing = spec.Pricing
+	}
+	if spec.ContextWindow != 0 {
+		base.ContextWindow = spec.ContextWindow
+	}
+	if spec.CompactAt != 0 {
+		base.CompactAt = spec.CompactAt
+	}
+	if spec.Temperature != nil {
+		base.Temperature = spec.Temperature
+	}
+	if spec.TopP != nil {
+		base.TopP = spec.TopP
+	}
+	if spec.ReasoningEffort != "" {
+		base.ReasoningEffort = spec.ReasoningEffort
+	}
+	return base
+}
+
+// withProviderDefaults fills the URL, key variable, token limits and context
+// window of a new entry from the built-in entries of the same provider.
+func withProviderDefaults(spec ModelSpec) ModelSpec {
+	for _, builtin := range builtinModels {
+		if builtin.Provider != spec.Provider {
+			continue
+		}
+		if spec.BaseURL == "" {
+			spec.BaseURL = builtin.BaseURL
+		}
+		if spec.ApiKeyEnv == "" {
+			spec.ApiKeyEnv = builtin.ApiKeyEnv
+		}
+		if spec.MaxTokens == 0 {
+			spec.MaxTokens = builtin.MaxTokens
+		}
+		if spec.ThinkingBudget == 0 {
+			spec.ThinkingBudget = builtin.ThinkingBudget
+		}
+		if spec.ContextWindow == 0 {
+			spec.ContextWindow = builtin.ContextWindow
+		}
+		break
+	}
+	return spec
+}
+
+func validate(spec ModelSpec) error {
+	if spec.Model == "" {
+		return fmt.Errorf("model %s has no model id", spec.Alias)
+	}
+	for _, provider := range providers {
+		if spec.Provider == provider {
+			if err := spec.CheckGeneration(data.GenerationSettings{}, spec.ThinkingBudget != 0); err != nil {
+				return fmt.Errorf("model %s: %w", spec.Alias, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("model %s has unknown provider %q", spec.Alias, spec.Provider)
+}
+
+// Lookup finds alias in the registry.
+func Lookup(models []ModelSpec, alias string) (ModelSpec, bool) {
+	for _, spec := range models {
+		if spec.Alias == alias {
+			return spec, true
+		}
+	}
+	return ModelSpec{}, false
+}
+
+// Aliases lists the aliases in registry order.
+func Aliases(models []ModelSpec) []string {
+	aliases := make([]string, 0, len(models))
+	for _, spec := range models {
+		aliases = append(aliases, spec.Alias)
+	}
+	return aliases
+}
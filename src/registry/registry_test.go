@@ -0,0 +1,212 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name string, content string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, ".owl", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+func TestLoad_WithoutConfigReturnsBuiltins(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	models, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opus, ok := Lookup(models, "opus")
+	if !ok || opus.Model != "claude-opus-4-6" || opus.Provider != ProviderAnthropic {
+		t.Fatalf("unexpected opus entry %+v", opus)
+	}
+}
+
+func TestBuiltins_HaveOutputLimitAndContextWindow(t *testing.T) {
+	for _, spec := range Builtins() {
+		if spec.MaxTokens <= 0 || spec.ContextWindow <= 0 {
+			t.Errorf("expected %s to have max tokens and a context window, got %d and %d", spec.Alias, spec.MaxTokens, spec.ContextWindow)
+		}
+	}
+}
+
+func TestLoad_YamlOverridesAndAddsModels(t *testing.T) {
+	writeConfig(t, "models.yaml", `
+models:
+  - alias: opus
+    model: claude-opus-4-7
+    max_tokens: 32000
+  - alias: local
+    provider: ollama
+    model: llama3.3
+    base_url: http://gpu-box:11434
+  - alias: mistral
+    provider: openai-chat
+    model: mistral-large-latest
+    base_url: https://api.mistral.ai/v1
+    api_key_env: MISTRAL_API_KEY
+`)
+
+	models, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opus, _ := Lookup(models, "opus")
+	if opus.Model != "claude-opus-4-7" || opus.MaxTokens != 32000 || opus.ThinkingBudget != 2000 || opus.ApiKeyEnv != "CLAUDE_API_KEY" {
+		t.Fatalf("expected opus to be overridden field by field, got %+v", opus)
+	}
+
+	local, ok := Lookup(models, "local")
+	if !ok || local.Provider != ProviderOllama || local.MaxTokens != 8000 || local.BaseURL != "http://gpu-box:11434" {
+		t.Fatalf("unexpected local entry %+v", local)
+	}
+
+	mistral, _ := Lookup(models, "mistral")
+	if mistral.Endpoint("/chat/completions") != "https://api.mistral.ai/v1/chat/completions" || mistral.ApiKeyEnv != "MISTRAL_API_KEY" {
+		t.Fatalf("unexpected mistral entry %+v", mistral)
+	}
+
+	aliases := Aliases(models)
+	if aliases[len(aliases)-2] != "local" || aliases[len(aliases)-1] != "mistral" {
+		t.Fatalf("expected new models after the built-in ones, got %v", aliases)
+	}
+}
+
+func TestLoad_ReadsToml(t *testing.T) {
+	writeConfig(t, "models.toml", `
+[[models]]
+alias = "flash"
+provider = "gemini"
+model = "gemini-3-flash"
+`)
+
+	models, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	flash, ok := Lookup(models, "flash")
+	if !ok || flash.ApiKeyEnv != "GEMINI_API_KEY" || flash.BaseURL == "" {
+		t.Fatalf("unexpected flash entry %+v", flash)
+	}
+}
+
+func TestLoadConfig_ReadsFallbacksFromToml(t *testing.T) {
+	writeConfig(t, "models.toml", `
+[[models]]
+alias = "flash"
+provider = "gemini"
+model = "gemini-3-flash"
+
+[fallbacks]
+resilient = ["claude", "flash"]
+`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chain := config.Fallbacks["resilient"]; len(chain) != 2 || chain[0] != "claude" || chain[1] != "flash" {
+		t.Fatalf("unexpected resilient chain %v", chain)
+	}
+}
+
+func TestLoadConfig_RejectsFallbackNamedLikeAModel(t *testing.T) {
+	writeConfig(t, "models.yaml", `
+fallbacks:
+  opus: [sonnet, gpt]
+`)
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatalf("expected an error for a chain named like a model")
+	}
+}
+
+func TestCurrent_ReadsTheConfigOnce(t *testing.T) {
+	writeConfig(t, "models.yaml", "models:\n  - alias: opus\n    model: claude-opus-4-7\n")
+	Reload()
+	t.Cleanup(Reload)
+
+	config, err := Current()
+	opus, _ := Lookup(config.Models, "opus")
+	if err != nil || opus.Model != "claude-opus-4-7" {
+		t.Fatalf("expected the configured opus, got %+v, %v", opus, err)
+	}
+
+	os.Remove(filepath.Join(os.Getenv("HOME"), ".owl", "models.yaml"))
+	config, _ = Current()
+	if opus, _ := Lookup(config.Models, "opus"); opus.Model != "claude-opus-4-7" {
+		t.Fatalf("expected the registry to be read once, got %+v", opus)
+	}
+
+	Reload()
+	config, _ = Current()
+	if opus, _ := Lookup(config.Models, "opus"); opus.Model != "claude-opus-4-6" {
+		t.Fatalf("expected Reload to read the config again, got %+v", opus)
+	}
+}
+
+func TestLoad_RejectsUnknownProvider(t *testing.T) {
+	writeConfig(t, "models.yaml", `
+models:
+  - alias: mystery
+    provider: carrier-pigeon
+    model: coo
+`)
+
+	if _, err := Load(); err == nil {
+		t.Fatalf("expected an error for an unknown provider")
+	}
+}
+
+func TestResolve_FallsBackToBuiltins(t *testing.T) {
+	if spec := Resolve(ModelSpec{}, "haiku", "claude"); spec.Model != "claude-haiku-4-5-20251001" {
+		t.Fatalf("expected the built-in haiku, got %+v", spec)
+	}
+	if spec := Resolve(ModelSpec{}, "", "claude"); spec.Alias != "claude" {
+		t.Fatalf("expected the fallback alias, got %+v", spec)
+	}
+	configured := ModelSpec{Alias: "haiku", Model: "custom"}
+	if spec := Resolve(configured, "haiku", "claude"); spec.Model != "custom" {
+		t.Fatalf("expected the configured spec to win, got %+v", spec)
+	}
+}
+
+func TestPricingFor_MatchesAliasModelIdAndOverrides(t *testing.T) {
+	writeConfig(t, "models.yaml", `
+models:
+  - alias: gpt-5.5
+    pricing:
+      input: 1.25
+      output: 10
+`)
+
+	models, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pricing, ok := PricingFor(models, "gpt-5.5")
+	if !ok || pricing.Cost(1_000_000, 100_000, 0, 0) != 2.25 {
+		t.Fatalf("expected configured gpt-5.5 pricing, got %+v", pricing)
+	}
+	if pricing, ok := PricingFor(models, "claude-opus-4-6"); !ok || pricing.Output != 25 {
+		t.Fatalf("expected older rows with the provider id to be priced, got %+v", pricing)
+	}
+	if _, ok := PricingFor(models, "gpt-5.4"); ok {
+		t.Fatalf("expected gpt-5.4 to be unpriced")
+	}
+	if pricing, ok := PricingFor(models, "ollama"); !ok || pricing.Cost(1000, 1000, 0, 0) != 0 {
+		t.Fatalf("expected local models to be free, got %+v", pricing)
+	}
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"owl/data"
+	"owl/logger"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxAttachmentSize is the largest file -attach takes.
+const MaxAttachmentSize = 20 << 20
+
+// StdinSource is the source of an attachment read from standard input.
+const StdinSource = "stdin"
+
+var attachmentMediaTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+}
+
+var attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+// AttachmentFile is an image or PDF attachment with its content, ready for
+// the content block of a provider.
+type AttachmentFile struct {
+	data.Attachment
+	Base64 string
+}
+
+// LoadAttachment reads a file, "-" for standard input or an http(s) URL and
+// keeps its content under ~/.owl/attachments by hash. Images (png, jpg, gif,
+// webp), PDFs and text files are taken.
+func LoadAttachment(source string, stdin io.Reader) (data.Attachment, error) {
+	attachment := data.Attachment{Source: source, Name: filepath.Base(source)}
+	var content []byte
+	var err error
+
+	switch {
+	case source == "-":
+		attachment.Source = StdinSource
+		attachment.Name = StdinSource
+		content, err = io.ReadAll(io.LimitReader(stdin, MaxAttachmentSize+1))
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		content, attachment.MediaType, err = fetchAttachment(source)
+		attachment.Name = urlName(source)
+	default:
+		if absolute, absErr := filepath.Abs(source); absErr == nil {
+			attachment.Source = absolute
+		}
+		content, err = readAttachmentFile(source)
+	}
+	if err != nil {
+		return attachment, fmt.Errorf("could not read attachment %s: %w", source, err)
+	}
+	if len(content) > MaxAttachmentSize {
+		return attachment, fmt.Errorf("attachment %s is larger than %d MB", source, MaxAttachmentSize>>20)
+	}
+
+	attachment.MediaType, err = attachmentMediaType(attachment.Name, attachment.MediaType, content)
+	if err != nil {
+		return attachment, fmt.Errorf("attachment %s: %w", source, err)
+	}
+
+	sum := sha256.Sum256(content)
+	attachment.Hash = hex.EncodeToString(sum[:])
+	attachment.Size = int64(len(content))
+	if err := storeAttachment(attachment.Hash, content); err != nil {
+		return attachment, fmt.Errorf("could not keep attachment %s: %w", source, err)
+	}
+	return attachment, nil
+}
+
+// ReadAttachment returns the content of an attachment, from the store or
+// else from the file it came from.
+func ReadAttachment(attachment data.Attachment) ([]byte, error) {
+	dir, err := attachmentDir()
+	if err == nil && attachment.Hash != "" {
+		if content, err := os.ReadFile(filepath.Join(dir, attachment.Hash)); err == nil {
+			return content, nil
+		}
+	}
+	if filepath.IsAbs(attachment.Source) {
+		return os.ReadFile(attachment.Source)
+	}
+	return nil, fmt.Errorf("attachment %s is no longer available", attachment.Name)
+}
+
+// PromptWithAttachments inlines the text attachments into the prompt as
+// fenced blocks and returns the images and PDFs with their content for the
+// payload builders. An attachment that can no longer be read is replaced by
+// a note, so an old turn can still be sent.
+func PromptWithAttachments(prompt string, attachments []data.Attachment) (string, []AttachmentFile) {
+	blocks := []string{}
+	files := []AttachmentFile{}
+	for _, attachment := range attachments {
+		content, err := ReadAttachment(attachment)
+		if err != nil {
+			logger.Debug.Printf("could not read attachment: %v", err)
+			blocks = append(blocks, fmt.Sprintf("(attachment %s is no longer available)", attachment.Name))
+			continue
+		}
+		if attachment.Kind() == data.AttachmentText {
+			blocks = append(blocks, AttachmentText(attachment.Name, string(content)))
+			continue
+		}
+		files = append(files, AttachmentFile{Attachment: attachment, Base64: base64.StdEncoding.EncodeToString(content)})
+	}
+	if len(blocks) == 0 {
+		return prompt, files
+	}
+	if prompt != "" {
+		blocks = append(blocks, prompt)
+	}
+	return strings.Join(blocks, "\n\n"), files
+}
+
+// AttachmentText is a text attachment as a fenced block, with the extension
+// of the file as its language.
+func AttachmentText(name string, content string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	language := strings.TrimPrefix(filepath.Ext(name), ".")
+	return fmt.Sprintf("%s:\n%s%s\n%s\n%s", name, fence, language, strings.TrimRight(content, "\n"), fence)
+}
+
+func readAttachmentFile(source string) ([]byte, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", source)
+	}
+	if info.Size() > MaxAttachmentSize {
+		return nil, fmt.Errorf("larger than %d MB", MaxAttachmentSize>>20)
+	}
+	return os.ReadFile(source)
+}
+
+func fetchAttachment(source string) ([]byte, string, error) {
+	resp, err := attachmentClient.Get(source)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s answered %s", source, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, MaxAttachmentSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return content, mediaType, nil
+}
+
+func urlName(source string) string {
+	parsed, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	if name := path.Base(parsed.Path); name != "." && name != "/" {
+		return name
+	}
+	return parsed.Host
+}
+
+// attachmentMediaType goes by the extension, then by the media type the
+// server sent, then by the content. Anything that is not an image or a PDF
+// has to be UTF-8 text.
+func attachmentMediaType(name string, sent string, content []byte) (string, error) {
+	if mediaType, ok := attachmentMediaTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return mediaType, nil
+	}
+	for _, candidate := range []string{sent, http.DetectContentType(content)} {
+		mediaType, _, _ := mime.ParseMediaType(candidate)
+		for _, supported := range attachmentMediaTypes {
+			if mediaType == supported {
+				return mediaType, nil
+			}
+		}
+	}
+	if !utf8.Valid(content) || strings.ContainsRune(string(content), 0) {
+		return "", fmt.Errorf("only png, jpg, gif, webp, pdf and text files can be attached")
+	}
+	return "text/plain", nil
+}
+
+func attachmentDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".owl", "attachments"), nil
+}
+
+func storeAttachment(hash string, content []byte) error {
+	dir, err := attachmentDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, hash)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	return os.WriteFile(target, content, 0o644)
+}
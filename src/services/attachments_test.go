@@ -0,0 +1,82 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"owl/data"
+	"owl/logger"
+)
+
+func TestLoadAttachmentFromFileStdinAndURL(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "chart.PNG")
+	os.WriteFile(imagePath, []byte("\x89PNG\r\n\x1a\nfake"), 0o644)
+
+	image, err := LoadAttachment(imagePath, nil)
+	if err != nil || image.Kind() != data.AttachmentImage || image.MediaType != "image/png" || image.Source != imagePath || image.Hash == "" {
+		t.Fatalf("expected a png reference, got %+v, %v", image, err)
+	}
+
+	text, err := LoadAttachment("-", strings.NewReader("line one\n"))
+	if err != nil || text.Source != StdinSource || text.Kind() != data.AttachmentText || text.Size != 9 {
+		t.Fatalf("expected a text reference for stdin, got %+v, %v", text, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		fmt.Fprint(w, "%PDF-1.4 fake")
+	}))
+	defer server.Close()
+	pdf, err := LoadAttachment(server.URL+"/papers/report", nil)
+	if err != nil || pdf.Kind() != data.AttachmentPdf || pdf.Name != "report" {
+		t.Fatalf("expected a pdf reference for the URL, got %+v, %v", pdf, err)
+	}
+
+	os.Remove(imagePath)
+	content, err := ReadAttachment(image)
+	if err != nil || string(content) != "\x89PNG\r\n\x1a\nfake" {
+		t.Fatalf("expected the stored content once the file is gone, got %q, %v", content, err)
+	}
+
+	binaryPath := filepath.Join(dir, "blob.bin")
+	os.WriteFile(binaryPath, []byte{0, 1, 2, 255}, 0o644)
+	if _, err := LoadAttachment(binaryPath, nil); err == nil {
+		t.Fatalf("expected a binary file to be refused")
+	}
+}
+
+func TestPromptWithAttachmentsInlinesText(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	codePath := filepath.Join(dir, "main.go")
+	os.WriteFile(codePath, []byte("package main\n"), 0o644)
+	imagePath := filepath.Join(dir, "shot.webp")
+	os.WriteFile(imagePath, []byte("RIFF"), 0o644)
+
+	code, _ := LoadAttachment(codePath, nil)
+	image, _ := LoadAttachment(imagePath, nil)
+	gone := data.Attachment{Name: "old.txt", Source: StdinSource, MediaType: "text/plain", Hash: "missing"}
+
+	prompt, files := PromptWithAttachments("review this", []data.Attachment{code, image, gone})
+	if !strings.Contains(prompt, "main.go:\n```go\npackage main\n```") || !strings.HasSuffix(prompt, "review this") {
+		t.Fatalf("expected the code fenced in front of the prompt, got %q", prompt)
+	}
+	if !strings.Contains(prompt, "old.txt is no longer available") {
+		t.Fatalf("expected a note for the missing attachment, got %q", prompt)
+	}
+	if len(files) != 1 || files[0].Name != "shot.webp" || files[0].Base64 != "UklGRg==" {
+		t.Fatalf("expected the image with its content, got %+v", files)
+	}
+}
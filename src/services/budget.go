@@ -0,0 +1,130 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"owl/data"
+	"owl/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Budget limits spend in USD per calendar day and month. A zero limit is not
+// enforced. When Block is false an exceeded budget only prints a warning.
+type Budget struct {
+	Daily   float64
+	Monthly float64
+	Block   bool
+}
+
+var (
+	budgetMu sync.RWMutex
+	budget   = budgetFromEnv()
+)
+
+// SetBudget replaces the budget checked by AwaitedQuery and StreamedQuery.
+func SetBudget(newBudget Budget) {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	budget = newBudget
+}
+
+// CurrentBudget returns the budget in effect.
+func CurrentBudget() Budget {
+	budgetMu.RLock()
+	defer budgetMu.RUnlock()
+	return budget
+}
+
+// budgetFromEnv reads OWL_BUDGET_DAILY and OWL_BUDGET_MONTHLY (USD) and
+// OWL_BUDGET_MODE, "warn" (default) or "block".
+func budgetFromEnv() Budget {
+	budget := Budget{}
+	if value := os.Getenv("OWL_BUDGET_DAILY"); value != "" {
+		if limit, err := strconv.ParseFloat(value, 64); err == nil && limit > 0 {
+			budget.Daily = limit
+		}
+	}
+	if value := os.Getenv("OWL_BUDGET_MONTHLY"); value != "" {
+		if limit, err := strconv.ParseFloat(value, 64); err == nil && limit > 0 {
+			budget.Monthly = limit
+		}
+	}
+	budget.Block = strings.EqualFold(os.Getenv("OWL_BUDGET_MODE"), "block")
+	return budget
+}
+
+// BudgetExceededError is returned instead of sending a query when a blocking
+// budget has been spent.
+type BudgetExceededError struct {
+	Period string
+	Limit  float64
+	Spent  float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s budget of %s exceeded, %s spent", e.Period, FormatCost(e.Limit), FormatCost(e.Spent))
+}
+
+func (e *BudgetExceededError) Hint() string {
+	if e.Period == "daily" {
+		return "raise OWL_BUDGET_DAILY or wait until tomorrow"
+	}
+	return "raise OWL_BUDGET_MONTHLY or wait until next month"
+}
+
+// StartOfDay is the local midnight the daily budget resets at.
+func StartOfDay(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// StartOfMonth is the local midnight the monthly budget resets at.
+func StartOfMonth(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// checkBudget compares today's and this month's spend with the budget. It
+// warns or, in block mode, returns a *BudgetExceededError. Failing to read the
+// usage never stops a query.
+func checkBudget(historyRepository data.HistoryRepository, now time.Time) error {
+	budget := CurrentBudget()
+	if budget.Daily <= 0 && budget.Monthly <= 0 {
+		return nil
+	}
+
+	models := registryModels()
+	var exceeded *BudgetExceededError
+	if budget.Monthly > 0 {
+		spent, err := spendSince(historyRepository, StartOfMonth(now), models)
+		if err != nil {
+			logger.Debug.Printf("could not read usage for budget check: %v", err)
+			return nil
+		}
+		if spent >= budget.Monthly {
+			exceeded = &BudgetExceededError{Period: "monthly", Limit: budget.Monthly, Spent: spent}
+		}
+	}
+	if budget.Daily > 0 && exceeded == nil {
+		spent, err := spendSince(historyRepository, StartOfDay(now), models)
+		if err != nil {
+			logger.Debug.Printf("could not read usage for budget check: %v", err)
+			return nil
+		}
+		if spent >= budget.Daily {
+			exceeded = &BudgetExceededError{Period: "daily", Limit: budget.Daily, Spent: spent}
+		}
+	}
+	if exceeded == nil {
+		return nil
+	}
+
+	if budget.Block {
+		return exceeded
+	}
+	logger.Screen(fmt.Sprintf("\nwarning: %s\n", exceeded.Error()), color.RGB(250, 200, 100))
+	return nil
+}
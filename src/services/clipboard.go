@@ -3,6 +3,7 @@ package services
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
@@ -46,26 +47,20 @@ func GetImageFromClipboard() (image.Image, error) {
 	// Initialize the clipboard package
 	err := clipboard.Init()
 	if err != nil {
-		panic(fmt.Sprintf("Failed to initialize clipboard: %v", err))
-	}
-
-	err = clipboard.Init()
-	if err != nil {
-		panic(fmt.Sprintf("Failed to initialize clipboard: %v", err))
-		// Handle the error appropriately
+		return nil, fmt.Errorf("failed to initialize clipboard: %w", err)
 	}
 
 	// Read image from clipboard
 	imgBytes := clipboard.Read(clipboard.FmtImage)
 
 	if len(imgBytes) == 0 {
-		panic("Empty image data")
+		return nil, errors.New("no image data in clipboard")
 	}
 
 	// If you need the data as an image.Image type for processing
 	img, format, err := image.Decode(bytes.NewReader(imgBytes))
 	if err != nil {
-		panic(fmt.Sprintf("Failed to decode image: %v", err))
+		return nil, fmt.Errorf("failed to decode image: %w", err)
 	}
 	fmt.Printf("Got image from clipboard in format: %s\n", format)
 
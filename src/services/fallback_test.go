@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	commontypes "owl/common_types"
+	"owl/data"
+)
+
+// chainModel is a minimal commontypes.FallbackModel, the picker's chain
+// cannot be imported here without a cycle through the models.
+type chainModel struct {
+	names  []string
+	models []commontypes.Model
+	active int
+}
+
+func (c *chainModel) ActiveModel() commontypes.Model { return c.models[c.active] }
+func (c *chainModel) ActiveModelName() string        { return c.names[c.active] }
+
+func (c *chainModel) Fallback() bool {
+	if c.active+1 >= len(c.models) {
+		return false
+	}
+	c.active++
+	return true
+}
+
+func (c *chainModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	return c.ActiveModel().CreateRequest(ctx, context, prompt, streaming, history, modifiers)
+}
+func (c *chainModel) HandleStreamedLine(line []byte)                                 { c.ActiveModel().HandleStreamedLine(line) }
+func (c *chainModel) HandleBodyBytes(bytes []byte)                                   { c.ActiveModel().HandleBodyBytes(bytes) }
+func (c *chainModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {}
+
+func failingBackend(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestStreamedQuery_FallsBackOnOverloadAndAuth(t *testing.T) {
+	useFastRetries(t)
+
+	overloaded := failingBackend(529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	defer overloaded.Close()
+	unauthorized := failingBackend(http.StatusUnauthorized, `{"error":{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}}`)
+	defer unauthorized.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fallback answer\n")
+	}))
+	defer working.Close()
+
+	answering := &partialStreamModel{backendURL: working.URL}
+	model := &chainModel{
+		names: []string{"claude", "gpt", "ollama"},
+		models: []commontypes.Model{
+			&partialStreamModel{backendURL: overloaded.URL},
+			&partialStreamModel{backendURL: unauthorized.URL},
+			answering,
+		},
+	}
+
+	err := StreamedQuery(context.Background(), "hello", model, &recordingRepository{}, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "resilient")
+
+	if err != nil {
+		t.Fatalf("expected the chain to answer, got %v", err)
+	}
+	if model.ActiveModelName() != "ollama" {
+		t.Fatalf("expected ollama to answer, got %s", model.ActiveModelName())
+	}
+	if answering.answer != "fallback answer" {
+		t.Fatalf("unexpected answer %q", answering.answer)
+	}
+}
+
+func TestAwaitedQuery_DoesNotFallBackOnBadRequest(t *testing.T) {
+	useFastRetries(t)
+
+	badRequest := failingBackend(http.StatusBadRequest, `{"error":{"message":"bad temperature","type":"invalid_request_error","code":null}}`)
+	defer badRequest.Close()
+
+	model := &chainModel{
+		names:  []string{"claude", "gpt"},
+		models: []commontypes.Model{&bodyModel{backendURL: badRequest.URL}, &bodyModel{backendURL: badRequest.URL}},
+	}
+
+	err := AwaitedQuery(context.Background(), "hello", model, &recordingRepository{}, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "resilient")
+
+	providerError, ok := commontypes.AsProviderError(err)
+	if !ok || providerError.Kind != commontypes.ErrorKindBadRequest {
+		t.Fatalf("expected a bad request error, got %v", err)
+	}
+	if providerError.Provider != "claude" {
+		t.Fatalf("expected the error to name the chain member, got %q", providerError.Provider)
+	}
+	if model.ActiveModelName() != "claude" {
+		t.Fatalf("expected no fallback, active model is %s", model.ActiveModelName())
+	}
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"owl/data"
+	"owl/logger"
+	"sync"
+)
+
+var (
+	historyHooksMu sync.RWMutex
+	historyHooks   []func(data.HistoryRepository, data.History)
+	historyHooksWg sync.WaitGroup
+)
+
+// OnHistorySaved registers a function run in the background with every row
+// saved by SaveHistory, its Id set, and the repository that saved it.
+// Embedding saved history hooks in here.
+func OnHistorySaved(hook func(data.HistoryRepository, data.History)) {
+	historyHooksMu.Lock()
+	defer historyHooksMu.Unlock()
+	historyHooks = append(historyHooks, hook)
+}
+
+// SaveHistory stores the history row of a finished turn and hands it to the
+// OnHistorySaved hooks. Every response handler saves its turn through here, so
+// the CLI, the TUI and the HTTP and SSE endpoints treat saved rows alike.
+func SaveHistory(historyRepository data.HistoryRepository, history data.History) (int64, error) {
+	id, err := historyRepository.InsertHistory(history)
+	if err != nil {
+		return 0, err
+	}
+	history.Id = id
+	logger.HistoryPersisted(history.ContextId)
+
+	historyHooksMu.RLock()
+	defer historyHooksMu.RUnlock()
+	for _, hook := range historyHooks {
+		historyHooksWg.Add(1)
+		go func() {
+			defer historyHooksWg.Done()
+			hook(historyRepository, history)
+		}()
+	}
+	return id, nil
+}
+
+// WaitForHistoryHooks blocks until the hooks of every saved row returned. A
+// process that exits after its turn calls it so the hooks are not cut off.
+func WaitForHistoryHooks() {
+	historyHooksWg.Wait()
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"owl/data"
+	"sync"
+	"testing"
+)
+
+func useHistoryHooks(t *testing.T) {
+	t.Helper()
+	historyHooksMu.Lock()
+	saved := historyHooks
+	historyHooks = nil
+	historyHooksMu.Unlock()
+	t.Cleanup(func() {
+		historyHooksMu.Lock()
+		historyHooks = saved
+		historyHooksMu.Unlock()
+	})
+}
+
+func TestSaveHistoryHandsTheSavedRowToTheHooks(t *testing.T) {
+	useHistoryHooks(t)
+
+	var mu sync.Mutex
+	hooked := []data.History{}
+	var hookedRepository data.HistoryRepository
+	OnHistorySaved(func(historyRepository data.HistoryRepository, history data.History) {
+		mu.Lock()
+		defer mu.Unlock()
+		hookedRepository = historyRepository
+		hooked = append(hooked, history)
+	})
+
+	repository := &recordingRepository{}
+	id, err := SaveHistory(repository, data.History{ContextId: 4, Prompt: "hello", Response: "hi"})
+	if err != nil || id != 1 {
+		t.Fatalf("expected the row to be saved as 1, got %d, err %v", id, err)
+	}
+	WaitForHistoryHooks()
+
+	if len(repository.history) != 1 {
+		t.Fatalf("expected one saved row, got %+v", repository.history)
+	}
+	if len(hooked) != 1 || hooked[0].Id != 1 || hooked[0].ContextId != 4 || hooked[0].Response != "hi" {
+		t.Fatalf("expected the hook to get the saved row with its id, got %+v", hooked)
+	}
+	if hookedRepository != repository {
+		t.Fatalf("expected the hook to get the repository that saved the row")
+	}
+}
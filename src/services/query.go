@@ -2,19 +2,23 @@ package services
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"owl/common_types"
+	"owl/compaction"
 	"owl/data"
 	"owl/logger"
+	"owl/registry"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 )
 
-type awaitedQueryFunc func(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string)
+type awaitedQueryFunc func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error
 
 var awaitedQueryHook awaitedQueryFunc = awaitedQueryImplementation
 
@@ -29,11 +33,26 @@ func SetAwaitedQueryHook(fn awaitedQueryFunc) {
 	awaitedQueryHook = fn
 }
 
-func AwaitedQuery(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
-	awaitedQueryHook(prompt, model, historyRepository, historyCount, context, modifiers, modelName)
+// AwaitedQuery sends a non-streamed query. Cancelling ctx aborts the request
+// and any tool continuation that would follow it. Provider failures are
+// returned as *commontypes.ProviderError.
+func AwaitedQuery(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+	return awaitedQueryHook(ensureContext(ctx), prompt, model, historyRepository, historyCount, context, modifiers, modelName)
 }
 
-func awaitedQueryImplementation(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+func ensureContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+func awaitedQueryImplementation(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+
+	if ctx.Err() != nil {
+		logger.Debug.Printf("skipping awaited query, request was cancelled: %v", ctx.Err())
+		return ctx.Err()
+	}
 
 	logger.Screen("sending awaited query", color.RGB(150, 150, 150))
 
@@ -45,7 +64,14 @@ func awaitedQueryImplementation(prompt string, model commontypes.Model, historyR
 	if trimmedPrompt == "" && !hasToolResponses {
 		logger.Screen("no prompt or tool response, skipping awaited query", color.RGB(250, 150, 150))
 		logger.Debug.Printf("skipping awaited query due to empty input. modifiers=%+v", modifiers)
-		return
+		return nil
+	}
+
+	// Tool continuations finish the turn that already passed the check
+	if trimmedPrompt != "" {
+		if err := checkBudget(historyRepository, time.Now()); err != nil {
+			return err
+		}
 	}
 
 	history := []data.History{}
@@ -65,55 +91,82 @@ func awaitedQueryImplementation(prompt string, model commontypes.Model, historyR
 		}
 	}
 
-	req := model.CreateRequest(context, prompt, false, history, modifiers)
-	logger.Debug.Printf("sending req: %v", req)
+	history = compactHistory(ctx, model, modelName, historyRepository, context, prompt, history)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(fmt.Errorf("failed to execute request: %v", err))
+	for {
+		err := sendAwaited(ctx, prompt, model, historyRepository, context, history, modifiers, modelName)
+		if err == nil {
+			break
+		}
+		if !fallBack(model, err) {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		logger.Debug.Printf("\nbody: %v\n\n", resp.Body)
-		bytes, err := io.ReadAll(resp.Body)
+	// Update the context's preferred model after successful query
+	if context != nil && modelName != "" {
+		err := historyRepository.UpdatePreferredModel(context.Id, modelName)
 		if err != nil {
-			log.Fatal(err)
+			logger.Debug.Printf("Failed to update preferred model: %v", err)
 		}
+	}
+	return nil
+}
 
-		logger.Debug.Printf("Issue from llm: %s", string(bytes))
-		logger.Debug.Printf("received non-OK response status: %d", resp.StatusCode)
-		logger.Debug.Printf("\nerr: %v", err)
-		panic(fmt.Errorf("received non-OK response status: %d", resp.StatusCode))
+func sendAwaited(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, context *data.Context, history []data.History, modifiers *commontypes.PayloadModifiers, modelName string) error {
+	req, err := model.CreateRequest(ctx, context, prompt, false, history, modifiers)
+	if err != nil {
+		return err
 	}
+	logger.Debug.Printf("sending req: %v", req)
+
+	resp, err := sendWithRetry(ctx, req, answeringModelName(model, modelName))
+	if err != nil {
+		if ctx.Err() != nil {
+			saveInterruptedHistory(model, historyRepository, context, modifiers, modelName)
+			return ctx.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
 
 	logger.Debug.Printf("statusCode: %d", resp.StatusCode)
 	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil && ctx.Err() != nil {
+		saveInterruptedHistory(model, historyRepository, context, modifiers, modelName)
+		return ctx.Err()
+	}
 	if err != nil {
 		logger.Debug.Println(err)
 		println(fmt.Sprintf("Error reading response body: %v\n", err))
 	}
-	defer resp.Body.Close()
 
 	logger.Debug.Println("Received a response without streaming")
 	logger.Debug.Printf("bodyBytes %s", string(bodyBytes))
 
 	model.HandleBodyBytes(bodyBytes)
+	return nil
+}
 
-	// Update the context's preferred model after successful query
-	if context != nil && modelName != "" {
-		err := historyRepository.UpdatePreferredModel(context.Id, modelName)
-		if err != nil {
-			logger.Debug.Printf("Failed to update preferred model: %v", err)
+// StreamedQuery sends a streamed query. Cancelling ctx stops reading the
+// stream and saves what has been received so far as an interrupted row.
+// Provider failures are returned as *commontypes.ProviderError.
+func StreamedQuery(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+	ctx = ensureContext(ctx)
+	if ctx.Err() != nil {
+		logger.Debug.Printf("skipping streamed query, request was cancelled: %v", ctx.Err())
+		return ctx.Err()
+	}
+
+	if strings.TrimSpace(prompt) != "" {
+		if err := checkBudget(historyRepository, time.Now()); err != nil {
+			return err
 		}
 	}
-}
 
-func StreamedQuery(prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
 	history, err := historyRepository.GetHistoryByContextId(context.Id, historyCount)
 	if err != nil {
-		panic(fmt.Sprintf("Could not fetch history %s", err))
+		return fmt.Errorf("could not fetch history: %w", err)
 	}
 
 	logger.Screen("sending streamed query", color.RGB(150, 150, 150))
@@ -129,45 +182,228 @@ func StreamedQuery(prompt string, model commontypes.Model, historyRepository dat
 		droppedEmpty,
 	)
 
-	req := model.CreateRequest(context, prompt, true, validHistory, modifiers)
+	validHistory = compactHistory(ctx, model, modelName, historyRepository, context, prompt, validHistory)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(fmt.Errorf("Failed to execute request: %v", err))
+	for {
+		err := sendStreamed(ctx, prompt, model, historyRepository, context, validHistory, modifiers, modelName)
+		if err == nil {
+			break
+		}
+		if !fallBack(model, err) {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bytes, _ := io.ReadAll(resp.Body)
-		println("bytes", string(bytes))
+	// Update the context's preferred model after successful query
+	if context != nil && modelName != "" {
+		err := historyRepository.UpdatePreferredModel(context.Id, modelName)
+		if err != nil {
+			logger.Debug.Printf("Failed to update preferred model: %v", err)
+		}
+	}
+	return nil
+}
+
+func sendStreamed(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, context *data.Context, history []data.History, modifiers *commontypes.PayloadModifiers, modelName string) error {
+	policy := currentRetryPolicy()
+	for attempt := 1; ; attempt++ {
+		req, err := model.CreateRequest(ctx, context, prompt, true, history, modifiers)
+		if err != nil {
+			return err
+		}
+
+		resp, err := sendWithRetry(ctx, req, answeringModelName(model, modelName))
+		if err != nil {
+			if ctx.Err() != nil {
+				saveInterruptedHistory(model, historyRepository, context, modifiers, modelName)
+				return ctx.Err()
+			}
+			return err
+		}
+
+		streamErr := readStream(resp, model)
+		resp.Body.Close()
+
+		if ctx.Err() != nil {
+			saveInterruptedHistory(model, historyRepository, context, modifiers, modelName)
+			return ctx.Err()
+		}
+		if streamErr == nil {
+			return nil
+		}
 
-		panic(fmt.Errorf("received non-OK response status: %d", resp.StatusCode))
+		// Once tokens reached the ResponseHandler a retry or fallback would
+		// repeat them, so the error is no longer marked as retryable
+		if hasStreamedTokens(model) {
+			saveInterruptedHistory(model, historyRepository, context, modifiers, modelName)
+			return fmt.Errorf("stream interrupted: %v", streamErr)
+		}
+		delay, retry := policy.nextDelay(streamErr, attempt)
+		if !retry {
+			return streamErr
+		}
+		reportRetry(streamErr, delay, attempt, policy)
+		if !sleepContext(ctx, delay) {
+			return ctx.Err()
+		}
 	}
+}
 
+// readStream hands every line of a streamed response to the model. A broken
+// connection is returned as a transportError, the end of the stream is not.
+func readStream(resp *http.Response, model commontypes.Model) error {
 	reader := bufio.NewReader(resp.Body)
-	finished := false
-	for !finished {
+	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			if err != io.EOF {
-				logger.Debug.Println("failed to read bytes from stream response")
-				logger.Debug.Printf("\n%s", err)
+			if err == io.EOF {
+				return nil
 			}
-			finished = true
-			continue
+			logger.Debug.Println("failed to read bytes from stream response")
+			logger.Debug.Printf("\n%s", err)
+			return &transportError{err: err}
 		}
 
 		model.HandleStreamedLine(line)
 	}
+}
 
-	// Update the context's preferred model after successful query
-	if context != nil && modelName != "" {
-		err := historyRepository.UpdatePreferredModel(context.Id, modelName)
-		if err != nil {
-			logger.Debug.Printf("Failed to update preferred model: %v", err)
-		}
+// hasStreamedTokens reports whether the model already passed text, thinking
+// or tool events on. Models that cannot tell are treated as if they did.
+func hasStreamedTokens(model commontypes.Model) bool {
+	if reporter, ok := activeModel(model).(commontypes.StreamedOutputReporter); ok {
+		return reporter.HasStreamedOutput()
+	}
+	responder, ok := activeModel(model).(commontypes.PartialResponder)
+	if !ok {
+		return true
 	}
+	_, response := responder.PartialResponse()
+	return response != ""
+}
+
+// fallBack moves a fallback chain to its next model when err is a retryable
+// or auth failure. Errors after streamed tokens are never retryable, see
+// sendStreamed.
+func fallBack(model commontypes.Model, err error) bool {
+	chain, ok := model.(commontypes.FallbackModel)
+	if !ok || !canFallBack(err) {
+		return false
+	}
+	failedModel := chain.ActiveModelName()
+	if !chain.Fallback() {
+		return false
+	}
+	logger.Debug.Printf("%s failed, falling back to %s: %v", failedModel, chain.ActiveModelName(), err)
+	logger.Screen(fmt.Sprintf("\n%s, falling back to %s\n", err.Error(), chain.ActiveModelName()), color.RGB(250, 200, 100))
+	return true
+}
+
+func canFallBack(err error) bool {
+	if providerError, ok := commontypes.AsProviderError(err); ok && (providerError.Kind == commontypes.ErrorKindAuth || providerError.Kind == commontypes.ErrorKindQuota) {
+		return true
+	}
+	return isRetryable(err)
+}
+
+// activeModel is the model of a fallback chain that currently handles the query.
+func activeModel(model commontypes.Model) commontypes.Model {
+	if chain, ok := model.(commontypes.FallbackModel); ok {
+		return chain.ActiveModel()
+	}
+	return model
+}
+
+// answeringModelName names provider errors and interrupted rows after the
+// chain member that was asked, not the chain.
+func answeringModelName(model commontypes.Model, modelName string) string {
+	if chain, ok := model.(commontypes.FallbackModel); ok {
+		return chain.ActiveModelName()
+	}
+	return modelName
+}
+
+// compactHistory replaces the oldest turns with a summary when the payload
+// would not fit the context window of the model that is asked first.
+func compactHistory(ctx context.Context, model commontypes.Model, modelName string, historyRepository data.HistoryRepository, context *data.Context, prompt string, history []data.History) []data.History {
+	spec, ok := registry.Lookup(registryModels(), answeringModelName(model, modelName))
+	if !ok {
+		return history
+	}
+	return compaction.Compact(ctx, historyRepository, context, spec, prompt, history)
+}
+
+// DescribeError formats a query error for the CLI and TUI, adding the hint of
+// a provider error.
+func DescribeError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "query cancelled"
+	}
+	if providerError, ok := commontypes.AsProviderError(err); ok && providerError.Hint() != "" {
+		return fmt.Sprintf("%s (%s)", providerError.Error(), providerError.Hint())
+	}
+	var budgetError *BudgetExceededError
+	if errors.As(err, &budgetError) {
+		return fmt.Sprintf("%s (%s)", budgetError.Error(), budgetError.Hint())
+	}
+	return err.Error()
+}
+
+// ReportError shows a query error on screen. Used where the error cannot be
+// returned to the caller, like the query that follows a tool call.
+func ReportError(err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	logger.Debug.Printf("query failed: %v", err)
+	logger.Screen(fmt.Sprintf("\n%s\n", DescribeError(err)), color.RGB(250, 100, 100))
+}
+
+// readProviderError turns a non-OK response into a typed provider error.
+func readProviderError(resp *http.Response, modelName string) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Debug.Printf("failed to read error body: %v", err)
+	}
+	logger.Debug.Printf("received non-OK response status: %d, body: %s", resp.StatusCode, string(body))
+	return commontypes.ParseProviderError(modelName, resp.StatusCode, resp.Header, body)
+}
+
+// saveInterruptedHistory stores the turn that was in flight when the query was
+// cancelled, with the attachments of the prompt and the thinking streamed so
+// far. Models that already handed their answer to FinalText report an empty
+// partial response, so nothing is saved twice.
+func saveInterruptedHistory(model commontypes.Model, historyRepository data.HistoryRepository, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) {
+	responder, ok := activeModel(model).(commontypes.PartialResponder)
+	if !ok || context == nil {
+		return
+	}
+
+	prompt, response := responder.PartialResponse()
+	if strings.TrimSpace(prompt) == "" && strings.TrimSpace(response) == "" {
+		return
+	}
+
+	history := data.History{
+		ContextId:   context.Id,
+		Prompt:      prompt,
+		Response:    response,
+		Model:       answeringModelName(model, modelName),
+		Interrupted: true,
+	}
+	if modifiers != nil {
+		history.Attachments = modifiers.Attachments
+	}
+	if thinker, ok := activeModel(model).(commontypes.PartialThinker); ok {
+		history.Thinking = thinker.PartialThinking()
+	}
+
+	if _, err := SaveHistory(historyRepository, history); err != nil {
+		logger.Debug.Printf("failed to save interrupted history: %v", err)
+		return
+	}
+
+	logger.Screen("\nquery cancelled, partial answer saved\n", color.RGB(250, 150, 150))
 }
 
 func filterStreamHistory(history []data.History) ([]data.History, int, int) {
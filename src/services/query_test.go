@@ -1,9 +1,18 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	commontypes "owl/common_types"
 	"owl/data"
+	"owl/logger"
 )
 
 func TestFilterStreamHistory_KeepPromptOrResponse(t *testing.T) {
@@ -37,3 +46,130 @@ func TestFilterStreamHistory_KeepPromptOrResponse(t *testing.T) {
 		t.Fatalf("unexpected second filtered entry: %+v", filtered[1])
 	}
 }
+
+// recordingRepository keeps inserted rows in memory, test_helpers cannot be
+// imported here without a cycle through tools.
+type recordingRepository struct {
+	data.HistoryRepository
+	history []data.History
+}
+
+func (r *recordingRepository) GetHistoryByContextId(contextId int64, maxCount int) ([]data.History, error) {
+	return r.history, nil
+}
+
+func (r *recordingRepository) UpdatePreferredModel(contextId int64, preferredModel string) error {
+	return nil
+}
+
+func (r *recordingRepository) InsertHistory(history data.History) (int64, error) {
+	r.history = append(r.history, history)
+	return int64(len(r.history)), nil
+}
+
+type partialStreamModel struct {
+	backendURL string
+	cancel     context.CancelFunc
+	prompt     string
+	answer     string
+	body       string
+	thinking   []data.Thinking
+}
+
+func (m *partialStreamModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	m.prompt = prompt
+	req, _ := http.NewRequestWithContext(ctx, "POST", m.backendURL, nil)
+	return req, nil
+}
+
+func (m *partialStreamModel) HandleStreamedLine(line []byte) {
+	m.answer += strings.TrimSuffix(string(line), "\n")
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+func (m *partialStreamModel) HandleBodyBytes(body []byte) {
+	m.body = string(body)
+}
+
+func (m *partialStreamModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {}
+
+func (m *partialStreamModel) PartialResponse() (string, string) {
+	return m.prompt, m.answer
+}
+
+func (m *partialStreamModel) PartialThinking() []data.Thinking {
+	return m.thinking
+}
+
+func TestStreamedQuery_CancelSavesInterruptedHistory(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "partial answer\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repository := &recordingRepository{}
+	model := &partialStreamModel{backendURL: backend.URL, cancel: cancel, thinking: []data.Thinking{{Text: "a dragon, maybe"}}}
+	attachments := []data.Attachment{{Name: "map.png", Source: "map.png", MediaType: "image/png"}}
+
+	StreamedQuery(ctx, "tell me a story", model, repository, 10, &data.Context{Id: 7}, &commontypes.PayloadModifiers{Attachments: attachments}, "stub")
+
+	history := repository.history
+	if len(history) != 1 {
+		t.Fatalf("expected 1 interrupted history row, got %d", len(history))
+	}
+	if !history[0].Interrupted {
+		t.Fatalf("expected history row to be marked interrupted: %+v", history[0])
+	}
+	if history[0].ContextId != 7 || history[0].Prompt != "tell me a story" || history[0].Response != "partial answer" || history[0].Model != "stub" {
+		t.Fatalf("unexpected interrupted history row: %+v", history[0])
+	}
+	if len(history[0].Attachments) != 1 || history[0].Attachments[0].Name != "map.png" {
+		t.Fatalf("expected the attachments of the prompt on the interrupted row, got %+v", history[0].Attachments)
+	}
+	if len(history[0].Thinking) != 1 || history[0].Thinking[0].Text != "a dragon, maybe" {
+		t.Fatalf("expected the streamed thinking on the interrupted row, got %+v", history[0].Thinking)
+	}
+}
+
+func TestAwaitedQuery_ReturnsProviderErrorOnNonOKStatus(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	}))
+	defer backend.Close()
+
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	defer SetRetryPolicy(DefaultRetryPolicy)
+
+	repository := &recordingRepository{}
+	model := &partialStreamModel{backendURL: backend.URL}
+
+	err := AwaitedQuery(context.Background(), "hello", model, repository, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	providerError, ok := commontypes.AsProviderError(err)
+	if !ok {
+		t.Fatalf("expected a provider error, got %v", err)
+	}
+	if providerError.Kind != commontypes.ErrorKindRateLimit || providerError.Provider != "stub" || providerError.Message != "slow down" {
+		t.Fatalf("unexpected provider error %+v", providerError)
+	}
+	if len(repository.history) != 0 {
+		t.Fatalf("expected nothing to be saved for a failed query, got %+v", repository.history)
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"owl/common_types"
+	"owl/logger"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// RetryPolicy controls how rate limits, overloads and transient network
+// failures are retried. Delays grow exponentially from BaseDelay with jitter
+// and never exceed MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+var (
+	retryPolicyMu sync.RWMutex
+	retryPolicy   = retryPolicyFromEnv(DefaultRetryPolicy)
+)
+
+// SetRetryPolicy replaces the policy used by AwaitedQuery and StreamedQuery.
+func SetRetryPolicy(policy RetryPolicy) {
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+	retryPolicy = policy
+}
+
+func currentRetryPolicy() RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+	return retryPolicy
+}
+
+// retryPolicyFromEnv reads OWL_RETRY_MAX_ATTEMPTS and OWL_RETRY_MAX_DELAY
+// (a duration such as "45s") on top of the defaults.
+func retryPolicyFromEnv(policy RetryPolicy) RetryPolicy {
+	if value := os.Getenv("OWL_RETRY_MAX_ATTEMPTS"); value != "" {
+		if attempts, err := strconv.Atoi(value); err == nil && attempts > 0 {
+			policy.MaxAttempts = attempts
+		}
+	}
+	if value := os.Getenv("OWL_RETRY_MAX_DELAY"); value != "" {
+		if maxDelay, err := time.ParseDuration(value); err == nil && maxDelay > 0 {
+			policy.MaxDelay = maxDelay
+		}
+	}
+	return policy
+}
+
+// nextDelay returns how long to wait before the next attempt, or false when
+// err should not be retried. A retry-after longer than MaxDelay is not
+// shortened, the query fails instead.
+func (policy RetryPolicy) nextDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt >= policy.MaxAttempts || !isRetryable(err) {
+		return 0, false
+	}
+
+	if providerError, ok := commontypes.AsProviderError(err); ok && providerError.RetryAfter > 0 {
+		if providerError.RetryAfter > policy.MaxDelay {
+			return 0, false
+		}
+		return providerError.RetryAfter, true
+	}
+
+	backoff := policy.BaseDelay << (attempt - 1)
+	if backoff <= 0 || backoff > policy.MaxDelay {
+		backoff = policy.MaxDelay
+	}
+	// Jitter between half and the full backoff so parallel clients spread out
+	half := backoff / 2
+	return half + rand.N(half+1), true
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if providerError, ok := commontypes.AsProviderError(err); ok {
+		return providerError.Retryable()
+	}
+	var transportError *transportError
+	return errors.As(err, &transportError)
+}
+
+// transportError is a request that never got a response, like a refused or
+// reset connection.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("failed to execute request: %v", e.err)
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// sendWithRetry sends req and retries until the provider answers 200, the
+// error is not retryable or the policy runs out of attempts. Nothing has
+// reached the ResponseHandler at this point, so retrying is always safe.
+func sendWithRetry(ctx context.Context, req *http.Request, modelName string) (*http.Response, error) {
+	policy := currentRetryPolicy()
+	client := &http.Client{}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq, err := requestForAttempt(ctx, req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(attemptReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = &transportError{err: err}
+		} else if resp.StatusCode != http.StatusOK {
+			err = readProviderError(resp, modelName)
+			resp.Body.Close()
+		} else {
+			return resp, nil
+		}
+
+		delay, retry := policy.nextDelay(err, attempt)
+		if !retry {
+			return nil, err
+		}
+		reportRetry(err, delay, attempt, policy)
+		if !sleepContext(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// requestForAttempt returns req for the first attempt and a copy with a fresh
+// body for the following ones.
+func requestForAttempt(ctx context.Context, req *http.Request, attempt int) (*http.Request, error) {
+	if attempt == 1 || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("could not rewind request body: %w", err)
+	}
+	retryReq := req.Clone(ctx)
+	retryReq.Body = body
+	return retryReq, nil
+}
+
+func reportRetry(err error, delay time.Duration, attempt int, policy RetryPolicy) {
+	logger.Debug.Printf("retrying after attempt %d: %v", attempt, err)
+	logger.Screen(fmt.Sprintf("\n%s, retrying in %s (attempt %d/%d)\n", err.Error(), delay.Round(100*time.Millisecond), attempt+1, policy.MaxAttempts), color.RGB(250, 200, 100))
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/logger"
+)
+
+func useFastRetries(t *testing.T) {
+	t.Helper()
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond})
+	t.Cleanup(func() { SetRetryPolicy(DefaultRetryPolicy) })
+}
+
+func TestAwaitedQuery_RetriesOverloadedAndHonoursRetryAfter(t *testing.T) {
+	useFastRetries(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("expected the body to be resent, got %q", body)
+		}
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(529)
+			fmt.Fprint(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+		case 2:
+			w.Header().Set("Retry-After-Ms", "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"slow down","type":"requests","code":"rate_limit_exceeded"}}`)
+		default:
+			fmt.Fprint(w, "answer")
+		}
+	}))
+	defer backend.Close()
+
+	model := &bodyModel{backendURL: backend.URL}
+	err := AwaitedQuery(context.Background(), "hello", model, &recordingRepository{}, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	if err != nil {
+		t.Fatalf("expected the query to succeed after retries, got %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts.Load())
+	}
+	if model.body != "answer" {
+		t.Fatalf("expected the final answer to reach the model, got %q", model.body)
+	}
+}
+
+func TestAwaitedQuery_DoesNotRetryBadRequest(t *testing.T) {
+	useFastRetries(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"message":"bad temperature","type":"invalid_request_error","code":null}}`)
+	}))
+	defer backend.Close()
+
+	err := AwaitedQuery(context.Background(), "hello", &bodyModel{backendURL: backend.URL}, &recordingRepository{}, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	providerError, ok := commontypes.AsProviderError(err)
+	if !ok || providerError.Kind != commontypes.ErrorKindBadRequest {
+		t.Fatalf("expected a bad request error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d", attempts.Load())
+	}
+}
+
+func TestAwaitedQuery_DoesNotRetryInsufficientQuota(t *testing.T) {
+	useFastRetries(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`)
+	}))
+	defer backend.Close()
+
+	err := AwaitedQuery(context.Background(), "hello", &bodyModel{backendURL: backend.URL}, &recordingRepository{}, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	providerError, ok := commontypes.AsProviderError(err)
+	if !ok || providerError.Kind != commontypes.ErrorKindQuota {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d", attempts.Load())
+	}
+}
+
+func TestStreamedQuery_RetriesDroppedStreamBeforeTokens(t *testing.T) {
+	useFastRetries(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			dropConnection(t, w)
+			return
+		}
+		fmt.Fprint(w, "streamed answer\n")
+	}))
+	defer backend.Close()
+
+	model := &partialStreamModel{backendURL: backend.URL}
+	err := StreamedQuery(context.Background(), "hello", model, &recordingRepository{}, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	if err != nil {
+		t.Fatalf("expected the stream to succeed after a retry, got %v", err)
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts.Load())
+	}
+	if model.answer != "streamed answer" {
+		t.Fatalf("unexpected answer %q", model.answer)
+	}
+}
+
+func TestStreamedQuery_DoesNotRetryAfterTokens(t *testing.T) {
+	useFastRetries(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		fmt.Fprint(w, "first tokens\n")
+		w.(http.Flusher).Flush()
+		dropConnection(t, w)
+	}))
+	defer backend.Close()
+
+	repository := &recordingRepository{}
+	model := &partialStreamModel{backendURL: backend.URL}
+	err := StreamedQuery(context.Background(), "hello", model, repository, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "stub")
+
+	if err == nil {
+		t.Fatalf("expected the dropped stream to fail")
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected no retry once tokens were streamed, got %d attempts", attempts.Load())
+	}
+	if len(repository.history) != 1 || !repository.history[0].Interrupted || repository.history[0].Response != "first tokens" {
+		t.Fatalf("expected the partial answer to be kept, got %+v", repository.history)
+	}
+}
+
+func TestRetryPolicyNextDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	overloaded := &commontypes.ProviderError{Kind: commontypes.ErrorKindOverloaded, StatusCode: 529}
+
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		delay, retry := policy.nextDelay(overloaded, attempt)
+		backoff := policy.BaseDelay << (attempt - 1)
+		if !retry || delay < backoff/2 || delay > backoff {
+			t.Fatalf("attempt %d: expected a jittered delay up to %s, got %s (retry %v)", attempt, backoff, delay, retry)
+		}
+	}
+
+	if _, retry := policy.nextDelay(overloaded, policy.MaxAttempts); retry {
+		t.Fatalf("expected no retry after the last attempt")
+	}
+
+	capped := RetryPolicy{MaxAttempts: 20, BaseDelay: time.Second, MaxDelay: 2 * time.Second}
+	if delay, _ := capped.nextDelay(overloaded, 10); delay > capped.MaxDelay {
+		t.Fatalf("expected the delay to be capped at %s, got %s", capped.MaxDelay, delay)
+	}
+
+	rateLimited := &commontypes.ProviderError{Kind: commontypes.ErrorKindRateLimit, RetryAfter: 700 * time.Millisecond}
+	if delay, retry := policy.nextDelay(rateLimited, 1); !retry || delay != 700*time.Millisecond {
+		t.Fatalf("expected retry-after to be honoured, got %s (retry %v)", delay, retry)
+	}
+
+	rateLimited.RetryAfter = time.Minute
+	if _, retry := policy.nextDelay(rateLimited, 1); retry {
+		t.Fatalf("expected no retry when retry-after exceeds the cap")
+	}
+
+	if _, retry := policy.nextDelay(&commontypes.ProviderError{Kind: commontypes.ErrorKindAuth, StatusCode: 401}, 1); retry {
+		t.Fatalf("expected auth errors not to be retried")
+	}
+}
+
+// bodyModel sends a fixed body so retries can check it is resent.
+type bodyModel struct {
+	backendURL string
+	body       string
+}
+
+func (m *bodyModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, "POST", m.backendURL, strings.NewReader("payload"))
+}
+
+func (m *bodyModel) HandleStreamedLine(line []byte) {}
+
+func (m *bodyModel) HandleBodyBytes(body []byte) {
+	m.body = string(body)
+}
+
+func (m *bodyModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {}
+
+func dropConnection(t *testing.T, w http.ResponseWriter) {
+	t.Helper()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatalf("response writer cannot be hijacked")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		t.Fatalf("hijack failed: %v", err)
+	}
+	buf.Flush()
+	conn.Close()
+}
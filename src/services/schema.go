@@ -0,0 +1,239 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LoadSchema reads a JSON Schema from a file.
+func LoadSchema(path string) (map[string]interface{}, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema: %w", err)
+	}
+	return ParseSchema(bytes)
+}
+
+// ParseSchema reads a JSON Schema, which must be a JSON object.
+func ParseSchema(bytes []byte) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(bytes, &schema); err != nil {
+		return nil, fmt.Errorf("schema is not a JSON object: %w", err)
+	}
+	return schema, nil
+}
+
+// ValidateJSON checks a decoded JSON value against a schema. It covers the
+// keywords models are asked to follow: type, enum, const, properties,
+// required, additionalProperties, items, anyOf and the length, size and range
+// limits. Other keywords are not checked.
+func ValidateJSON(value interface{}, schema map[string]interface{}) error {
+	return validateValue(value, schema, "$")
+}
+
+func validateValue(value interface{}, schema map[string]interface{}, path string) error {
+	if types, ok := schemaTypes(schema["type"]); ok {
+		matched := false
+		for _, schemaType := range types {
+			if hasType(value, schemaType) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonType(value))
+		}
+	}
+
+	if options, ok := schema["enum"].([]interface{}); ok {
+		if !slices.ContainsFunc(options, func(option interface{}) bool { return jsonEqual(option, value) }) {
+			return fmt.Errorf("%s: %s is not one of the allowed values", path, encodeValue(value))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s: expected %s", path, encodeValue(constant))
+	}
+
+	if options, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, option := range options {
+			optionSchema, _ := option.(map[string]interface{})
+			err := validateValue(value, optionSchema, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fmt.Errorf("%s: matches none of anyOf, first mismatch: %w", path, firstErr)
+		}
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return validateObject(typed, schema, path)
+	case []interface{}:
+		return validateArray(typed, schema, path)
+	case string:
+		return validateString(typed, schema, path)
+	case float64:
+		return validateNumber(typed, schema, path)
+	}
+	return nil
+}
+
+func validateObject(object map[string]interface{}, schema map[string]interface{}, path string) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, present := object[key]; !present {
+				return fmt.Errorf("%s: missing required property %q", path, key)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		propertyPath := path + "." + key
+		if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+			if err := validateValue(object[key], propertySchema, propertyPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: property %q is not allowed", path, key)
+			}
+		case map[string]interface{}:
+			if err := validateValue(object[key], additional, propertyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateArray(array []interface{}, schema map[string]interface{}, path string) error {
+	if minimum, ok := schemaNumber(schema, "minItems"); ok && float64(len(array)) < minimum {
+		return fmt.Errorf("%s: expected at least %g items, got %d", path, minimum, len(array))
+	}
+	if maximum, ok := schemaNumber(schema, "maxItems"); ok && float64(len(array)) > maximum {
+		return fmt.Errorf("%s: expected at most %g items, got %d", path, maximum, len(array))
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range array {
+			if err := validateValue(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(text string, schema map[string]interface{}, path string) error {
+	length := float64(len([]rune(text)))
+	if minimum, ok := schemaNumber(schema, "minLength"); ok && length < minimum {
+		return fmt.Errorf("%s: expected at least %g characters", path, minimum)
+	}
+	if maximum, ok := schemaNumber(schema, "maxLength"); ok && length > maximum {
+		return fmt.Errorf("%s: expected at most %g characters", path, maximum)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		expression, err := regexp.Compile(pattern)
+		if err == nil && !expression.MatchString(text) {
+			return fmt.Errorf("%s: %q does not match %s", path, text, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(number float64, schema map[string]interface{}, path string) error {
+	if minimum, ok := schemaNumber(schema, "minimum"); ok && number < minimum {
+		return fmt.Errorf("%s: %g is below the minimum %g", path, number, minimum)
+	}
+	if maximum, ok := schemaNumber(schema, "maximum"); ok && number > maximum {
+		return fmt.Errorf("%s: %g is above the maximum %g", path, number, maximum)
+	}
+	return nil
+}
+
+// schemaTypes reads the type keyword, a single type or a list of them.
+func schemaTypes(value interface{}) ([]string, bool) {
+	switch typed := value.(type) {
+	case string:
+		return []string{typed}, true
+	case []interface{}:
+		types := []string{}
+		for _, entry := range typed {
+			if name, ok := entry.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types, len(types) > 0
+	}
+	return nil, false
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	number, ok := schema[keyword].(float64)
+	return number, ok
+}
+
+func hasType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	}
+	return jsonType(value) == schemaType
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	return encodeValue(a) == encodeValue(b)
+}
+
+func encodeValue(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONReportsThePathOfAMismatch(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["name", "tags"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"count": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("expected the schema to parse, got %v", err)
+	}
+
+	cases := []struct {
+		value    string
+		mismatch string
+	}{
+		{`{"name": "owl", "count": 2, "tags": ["a"]}`, ""},
+		{`{"name": "owl"}`, `missing required property "tags"`},
+		{`{"name": "", "tags": []}`, "$.name: expected at least 1 characters"},
+		{`{"name": "owl", "count": 1.5, "tags": []}`, "$.count: expected integer, got number"},
+		{`{"name": "owl", "tags": ["a", "c"]}`, "$.tags[1]"},
+		{`{"name": "owl", "tags": [], "extra": true}`, `property "extra" is not allowed`},
+		{`["owl"]`, "$: expected object, got array"},
+	}
+	for _, c := range cases {
+		var value interface{}
+		if err := json.Unmarshal([]byte(c.value), &value); err != nil {
+			t.Fatalf("bad test value %s: %v", c.value, err)
+		}
+		err := ValidateJSON(value, schema)
+		if c.mismatch == "" {
+			if err != nil {
+				t.Fatalf("expected %s to match, got %v", c.value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.mismatch) {
+			t.Fatalf("expected %s to fail with %q, got %v", c.value, c.mismatch, err)
+		}
+	}
+}
+
+func TestValidateJSONAnyOfAndTypeLists(t *testing.T) {
+	schema := map[string]interface{}{
+		"anyOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": []interface{}{"number", "null"}, "maximum": 10.0},
+		},
+	}
+	for _, value := range []interface{}{"ok", 3.0, nil} {
+		if err := ValidateJSON(value, schema); err != nil {
+			t.Fatalf("expected %v to match, got %v", value, err)
+		}
+	}
+	if err := ValidateJSON(11.0, schema); err == nil {
+		t.Fatalf("expected 11 to match no option")
+	}
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"owl/common_types"
+	"owl/data"
+	"owl/logger"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// structuredValueKey holds the answer when the schema does not describe an
+// object, providers only take object schemas for tools and response formats.
+const structuredValueKey = "value"
+
+// ErrSchemaMismatch is returned by StructuredQuery when the repaired answer
+// still does not match the schema.
+var ErrSchemaMismatch = errors.New("answer does not match the schema")
+
+// StructuredSchema returns the schema sent to the provider for a structured
+// query. Schemas that do not describe an object are wrapped in one.
+func StructuredSchema(schema map[string]interface{}) map[string]interface{} {
+	if !wrapsAnswer(schema) {
+		return schema
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           map[string]interface{}{structuredValueKey: schema},
+		"required":             []string{structuredValueKey},
+		"additionalProperties": false,
+	}
+}
+
+func wrapsAnswer(schema map[string]interface{}) bool {
+	if schema["type"] == "object" {
+		return false
+	}
+	_, hasProperties := schema["properties"]
+	return schema["type"] != nil || !hasProperties
+}
+
+// StructuredAnswer reads the JSON out of an answer and validates it against
+// the schema. Code fences and text around the JSON are dropped and an answer
+// wrapped by StructuredSchema is unwrapped.
+func StructuredAnswer(answer string, schema map[string]interface{}) (json.RawMessage, error) {
+	text := extractJSON(answer)
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return nil, fmt.Errorf("answer is not JSON: %w", err)
+	}
+
+	if wrapsAnswer(schema) {
+		if object, ok := value.(map[string]interface{}); ok && len(object) == 1 {
+			if wrapped, ok := object[structuredValueKey]; ok {
+				value = wrapped
+			}
+		}
+	}
+
+	if err := ValidateJSON(value, schema); err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func extractJSON(answer string) string {
+	text := strings.TrimSpace(answer)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+		return strings.TrimSpace(text)
+	}
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start >= 0 && end > start {
+		return text[start : end+1]
+	}
+	return text
+}
+
+// StructuredRepairPrompt asks the model to correct an answer that did not
+// match the schema.
+func StructuredRepairPrompt(answer string, err error) string {
+	return fmt.Sprintf("Your previous answer did not match the JSON schema: %v\n\nPrevious answer:\n%s\n\nAnswer again with only the corrected JSON.", err, strings.TrimSpace(answer))
+}
+
+// StructuredQuery sends an awaited query whose answer must match the schema
+// of the modifiers and returns the validated JSON. An answer that does not
+// match is sent back once with the mismatch before the query fails. The
+// answer is read from the history the response handler stores.
+func StructuredQuery(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) (json.RawMessage, error) {
+	if modifiers == nil || modifiers.Schema == nil {
+		return nil, errors.New("structured query without a schema")
+	}
+
+	answer, err := structuredTurn(ctx, prompt, model, historyRepository, historyCount, context, modifiers, modelName)
+	if err != nil {
+		return nil, err
+	}
+	result, validationErr := StructuredAnswer(answer, modifiers.Schema)
+	if validationErr == nil {
+		return result, nil
+	}
+
+	logger.Screen(fmt.Sprintf("answer did not match the schema, asking for a repair: %v", validationErr), color.RGB(250, 150, 150))
+	repairModifiers := &commontypes.PayloadModifiers{
+		Web:              modifiers.Web,
+		ToolGroupFilters: modifiers.ToolGroupFilters,
+		Schema:           modifiers.Schema,
+	}
+	answer, err = structuredTurn(ctx, StructuredRepairPrompt(answer, validationErr), model, historyRepository, historyCount, context, repairModifiers, modelName)
+	if err != nil {
+		return nil, err
+	}
+	result, validationErr = StructuredAnswer(answer, modifiers.Schema)
+	if validationErr != nil {
+		return nil, fmt.Errorf("%w after a repair: %v", ErrSchemaMismatch, validationErr)
+	}
+	return result, nil
+}
+
+// structuredTurn sends one query and returns the answer it stored.
+func structuredTurn(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) (string, error) {
+	before, _ := lastHistory(historyRepository, context)
+	if err := AwaitedQuery(ctx, prompt, model, historyRepository, historyCount, context, modifiers, modelName); err != nil {
+		return "", err
+	}
+	after, err := lastHistory(historyRepository, context)
+	if err != nil {
+		return "", err
+	}
+	if after == nil || (before != nil && after.Id == before.Id) {
+		return "", errors.New("the model did not answer")
+	}
+	return after.Response, nil
+}
+
+func lastHistory(historyRepository data.HistoryRepository, context *data.Context) (*data.History, error) {
+	history, err := historyRepository.GetHistoryByContextId(context.Id, 1)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the answer: %w", err)
+	}
+	if len(history) == 0 {
+		return nil, nil
+	}
+	return &history[len(history)-1], nil
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	commontypes "owl/common_types"
+	"owl/data"
+)
+
+func TestStructuredAnswerUnwrapsAndStripsFences(t *testing.T) {
+	schema := map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+	wrapped := StructuredSchema(schema)
+	if wrapped["type"] != "object" {
+		t.Fatalf("expected an array schema to be wrapped in an object, got %+v", wrapped)
+	}
+
+	result, err := StructuredAnswer("```json\n{\"value\": [\"a\", \"b\"]}\n```", schema)
+	if err != nil || string(result) != `["a","b"]` {
+		t.Fatalf("expected the unwrapped array, got %s, %v", result, err)
+	}
+
+	objectSchema := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"value": map[string]interface{}{"type": "string"}}}
+	if StructuredSchema(objectSchema)["properties"] == nil || StructuredSchema(objectSchema)["required"] != nil {
+		t.Fatalf("expected an object schema to be sent as is")
+	}
+	result, err = StructuredAnswer(`Here you go: {"value": "x"}`, objectSchema)
+	if err != nil || string(result) != `{"value":"x"}` {
+		t.Fatalf("expected the object to be kept, got %s, %v", result, err)
+	}
+}
+
+// answerRepository stores the answers of a stubbed query with ids, the way
+// a response handler would.
+type answerRepository struct {
+	recordingRepository
+}
+
+func (r *answerRepository) InsertHistory(history data.History) (int64, error) {
+	history.Id = int64(len(r.history) + 1)
+	r.history = append(r.history, history)
+	return history.Id, nil
+}
+
+func TestStructuredQueryRepairsAMismatchOnce(t *testing.T) {
+	repository := &answerRepository{}
+	answers := []string{`{"name": 4}`, `{"name": "owl"}`}
+	prompts := []string{}
+	SetAwaitedQueryHook(func(ctx context.Context, prompt string, model commontypes.Model, historyRepository data.HistoryRepository, historyCount int, context *data.Context, modifiers *commontypes.PayloadModifiers, modelName string) error {
+		if modifiers.Schema == nil {
+			t.Fatalf("expected every turn to carry the schema")
+		}
+		prompts = append(prompts, prompt)
+		historyRepository.InsertHistory(data.History{ContextId: context.Id, Prompt: prompt, Response: answers[len(prompts)-1]})
+		return nil
+	})
+	defer SetAwaitedQueryHook(nil)
+
+	schema := map[string]interface{}{"type": "object", "required": []interface{}{"name"}, "properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}}}
+	result, err := StructuredQuery(context.Background(), "name it", nil, repository, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{Schema: schema}, "stub")
+
+	if err != nil || string(result) != `{"name":"owl"}` {
+		t.Fatalf("expected the repaired answer, got %s, %v", result, err)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "$.name: expected string") {
+		t.Fatalf("expected one repair prompt with the mismatch, got %q", prompts)
+	}
+
+	answers = []string{`{}`, `{}`}
+	prompts = nil
+	repository.history = nil
+	if _, err := StructuredQuery(context.Background(), "name it", nil, repository, 10, &data.Context{Id: 1}, &commontypes.PayloadModifiers{Schema: schema}, "stub"); err == nil {
+		t.Fatalf("expected a failure after the repair also mismatched")
+	}
+	if len(prompts) != 2 {
+		t.Fatalf("expected a single repair, got %d prompts", len(prompts))
+	}
+}
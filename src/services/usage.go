@@ -0,0 +1,199 @@
+package services
+
+import (
+	"fmt"
+	"owl/data"
+	"owl/logger"
+	"owl/registry"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UsageLine is the spend of one group in a usage report. Tokens of models
+// without a price are counted in UnpricedTokens and left out of Cost.
+type UsageLine struct {
+	Key              string
+	Messages         int
+	PromptTokens     int
+	CompletionTokens int
+	CacheReadTokens  int
+	CacheWriteTokens int
+	Cost             float64
+	UnpricedTokens   int
+}
+
+func (line *UsageLine) add(row data.UsageRow, models []registry.ModelSpec) {
+	line.Messages++
+	line.PromptTokens += row.PromptTokens
+	line.CompletionTokens += row.CompletionTokens
+	line.CacheReadTokens += row.CacheReadTokens
+	line.CacheWriteTokens += row.CacheWriteTokens
+
+	pricing, ok := registry.PricingFor(models, row.Model)
+	if !ok {
+		line.UnpricedTokens += row.PromptTokens + row.CompletionTokens + row.CacheReadTokens + row.CacheWriteTokens
+		return
+	}
+	line.Cost += pricing.Cost(row.PromptTokens, row.CompletionTokens, row.CacheReadTokens, row.CacheWriteTokens)
+}
+
+// UsageReport groups spend by context, model, day and agent. Groups are
+// sorted by cost, days by date.
+type UsageReport struct {
+	Total     UsageLine
+	ByContext []UsageLine
+	ByModel   []UsageLine
+	ByDay     []UsageLine
+	ByAgent   []UsageLine
+}
+
+// BuildUsageReport prices rows with the registry's pricing table.
+func BuildUsageReport(rows []data.UsageRow, models []registry.ModelSpec) UsageReport {
+	contexts := map[string]*UsageLine{}
+	modelLines := map[string]*UsageLine{}
+	days := map[string]*UsageLine{}
+	agents := map[string]*UsageLine{}
+
+	report := UsageReport{Total: UsageLine{Key: "total"}}
+	for _, row := range rows {
+		report.Total.add(row, models)
+
+		contextName := row.ContextName
+		if contextName == "" {
+			contextName = fmt.Sprintf("#%d", row.ContextId)
+		}
+		agent := row.Agent
+		if agent == "" {
+			agent = "(none)"
+		}
+		day := "(unknown)"
+		if !row.Created.IsZero() {
+			day = row.Created.Local().Format(time.DateOnly)
+		}
+
+		usageLine(contexts, contextName).add(row, models)
+		usageLine(modelLines, row.Model).add(row, models)
+		usageLine(days, day).add(row, models)
+		usageLine(agents, agent).add(row, models)
+	}
+
+	report.ByContext = sortedByCost(contexts)
+	report.ByModel = sortedByCost(modelLines)
+	report.ByAgent = sortedByCost(agents)
+	report.ByDay = sortedByKey(days)
+	return report
+}
+
+func usageLine(lines map[string]*UsageLine, key string) *UsageLine {
+	line, ok := lines[key]
+	if !ok {
+		line = &UsageLine{Key: key}
+		lines[key] = line
+	}
+	return line
+}
+
+func sortedByCost(lines map[string]*UsageLine) []UsageLine {
+	sorted := sortedByKey(lines)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Cost > sorted[j].Cost
+	})
+	return sorted
+}
+
+func sortedByKey(lines map[string]*UsageLine) []UsageLine {
+	sorted := make([]UsageLine, 0, len(lines))
+	for _, line := range lines {
+		sorted = append(sorted, *line)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// Format renders the report as the plain text tables printed by owl -usage.
+func (report UsageReport) Format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Total: %s over %d messages", FormatCost(report.Total.Cost), report.Total.Messages)
+	if report.Total.UnpricedTokens > 0 {
+		fmt.Fprintf(&b, " (%d tokens of unpriced models not included)", report.Total.UnpricedTokens)
+	}
+	b.WriteString("\n")
+
+	sections := []struct {
+		title string
+		lines []UsageLine
+	}{
+		{"By context", report.ByContext},
+		{"By model", report.ByModel},
+		{"By day", report.ByDay},
+		{"By agent", report.ByAgent},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(&b, "\n%s\n", section.title)
+		width := 0
+		for _, line := range section.lines {
+			width = max(width, len(line.Key))
+		}
+		for _, line := range section.lines {
+			fmt.Fprintf(&b, "  %-*s  %10s  %5d msgs  %9d in  %9d out  %9d cached", width, line.Key, FormatCost(line.Cost), line.Messages, line.PromptTokens, line.CompletionTokens, line.CacheReadTokens+line.CacheWriteTokens)
+			if line.UnpricedTokens > 0 {
+				b.WriteString("  (unpriced)")
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// FormatCost renders USD with more precision for small amounts, so single
+// messages do not all show as $0.00.
+func FormatCost(cost float64) string {
+	if cost > 0 && cost < 0.01 {
+		return fmt.Sprintf("$%.4f", cost)
+	}
+	return fmt.Sprintf("$%.2f", cost)
+}
+
+// MessageCost prices one history row, false when its model has no price.
+func MessageCost(history data.History, models []registry.ModelSpec) (float64, bool) {
+	pricing, ok := registry.PricingFor(models, history.Model)
+	if !ok {
+		return 0, false
+	}
+	return pricing.Cost(history.PromptTokens, history.CompletionTokens, history.CacheReadTokens, history.CacheWriteTokens), true
+}
+
+// Spend returns the priced cost of everything sent since the given time.
+func Spend(historyRepository data.HistoryRepository, since time.Time) (float64, error) {
+	return spendSince(historyRepository, since, registryModels())
+}
+
+// spendSince prices the per model totals summed by the repository, tokens of
+// models without a price are left out like in the usage report.
+func spendSince(historyRepository data.HistoryRepository, since time.Time, models []registry.ModelSpec) (float64, error) {
+	totals, err := historyRepository.GetUsageTotals(since)
+	if err != nil {
+		return 0, err
+	}
+	spent := 0.0
+	for _, total := range totals {
+		if pricing, ok := registry.PricingFor(models, total.Model); ok {
+			spent += pricing.Cost(total.PromptTokens, total.CompletionTokens, total.CacheReadTokens, total.CacheWriteTokens)
+		}
+	}
+	return spent, nil
+}
+
+// registryModels is the registry used for pricing and compaction thresholds. A
+// broken config file is reported by the picker already, here the built-in
+// entries are used instead.
+func registryModels() []registry.ModelSpec {
+	config, err := registry.Current()
+	if err != nil {
+		logger.Debug.Printf("could not read model registry: %v", err)
+	}
+	return config.Models
+}
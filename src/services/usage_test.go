@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/registry"
+)
+
+type usageRepository struct {
+	recordingRepository
+	usage []data.UsageRow
+}
+
+func (r *usageRepository) GetUsage(since time.Time) ([]data.UsageRow, error) {
+	rows := []data.UsageRow{}
+	for _, row := range r.usage {
+		if !row.Created.Before(since) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (r *usageRepository) GetUsageTotals(since time.Time) ([]data.UsageTotal, error) {
+	rows, _ := r.GetUsage(since)
+	totals := []data.UsageTotal{}
+	for _, row := range rows {
+		totals = append(totals, data.UsageTotal{Model: row.Model, Messages: 1, PromptTokens: row.PromptTokens, CompletionTokens: row.CompletionTokens, CacheReadTokens: row.CacheReadTokens, CacheWriteTokens: row.CacheWriteTokens})
+	}
+	return totals, nil
+}
+
+func TestBuildUsageReport_GroupsAndPricesRows(t *testing.T) {
+	day := time.Date(2026, 3, 2, 12, 0, 0, 0, time.Local)
+	rows := []data.UsageRow{
+		{ContextId: 1, ContextName: "work", Model: "sonnet", Agent: "developer", Created: day, PromptTokens: 1_000_000, CompletionTokens: 100_000},
+		{ContextId: 1, ContextName: "work", Model: "claude-haiku-4-5-20251001", Agent: "developer", Created: day.AddDate(0, 0, 1), PromptTokens: 1_000_000, CacheReadTokens: 1_000_000},
+		{ContextId: 2, ContextName: "misc", Model: "gpt-5.5", Created: day, PromptTokens: 500},
+	}
+
+	report := BuildUsageReport(rows, registry.Builtins())
+
+	// sonnet 3 + 1.5, haiku 1 + 0.1
+	if math.Abs(report.Total.Cost-5.6) > 1e-9 {
+		t.Fatalf("expected a total of $5.60, got %f", report.Total.Cost)
+	}
+	if report.Total.Messages != 3 || report.Total.UnpricedTokens != 500 {
+		t.Fatalf("unexpected total %+v", report.Total)
+	}
+	if len(report.ByContext) != 2 || report.ByContext[0].Key != "work" {
+		t.Fatalf("expected work to be the most expensive context, got %+v", report.ByContext)
+	}
+	if len(report.ByModel) != 3 || report.ByModel[0].Key != "sonnet" {
+		t.Fatalf("unexpected models %+v", report.ByModel)
+	}
+	if len(report.ByDay) != 2 || report.ByDay[0].Key != "2026-03-02" || report.ByDay[0].Messages != 2 {
+		t.Fatalf("unexpected days %+v", report.ByDay)
+	}
+	if len(report.ByAgent) != 2 || report.ByAgent[0].Key != "developer" || report.ByAgent[1].Key != "(none)" {
+		t.Fatalf("unexpected agents %+v", report.ByAgent)
+	}
+}
+
+func useBudget(t *testing.T, budget Budget) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	SetBudget(budget)
+	t.Cleanup(func() { SetBudget(Budget{}) })
+}
+
+func TestAwaitedQuery_BlocksWhenDailyBudgetIsSpent(t *testing.T) {
+	useFastRetries(t)
+	useBudget(t, Budget{Daily: 1, Block: true})
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		fmt.Fprint(w, "answer")
+	}))
+	defer backend.Close()
+
+	repository := &usageRepository{usage: []data.UsageRow{
+		{Model: "opus", Created: time.Now().Add(-48 * time.Hour), PromptTokens: 10_000_000},
+		{Model: "opus", Created: time.Now(), PromptTokens: 300_000},
+	}}
+	err := AwaitedQuery(context.Background(), "hello", &bodyModel{backendURL: backend.URL}, repository, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "opus")
+
+	var budgetError *BudgetExceededError
+	if !errors.As(err, &budgetError) || budgetError.Period != "daily" || budgetError.Spent != 1.5 {
+		t.Fatalf("expected the daily budget to block, got %v", err)
+	}
+	if attempts.Load() != 0 {
+		t.Fatalf("expected nothing to be sent, got %d requests", attempts.Load())
+	}
+	if DescribeError(err) != "daily budget of $1.00 exceeded, $1.50 spent (raise OWL_BUDGET_DAILY or wait until tomorrow)" {
+		t.Fatalf("unexpected description %q", DescribeError(err))
+	}
+}
+
+func TestStreamedQuery_OnlyWarnsWhenBudgetIsNotBlocking(t *testing.T) {
+	useFastRetries(t)
+	useBudget(t, Budget{Monthly: 1})
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		fmt.Fprint(w, "data: done\n\n")
+	}))
+	defer backend.Close()
+
+	repository := &usageRepository{usage: []data.UsageRow{
+		{Model: "opus", Created: time.Now(), PromptTokens: 1_000_000},
+	}}
+	err := StreamedQuery(context.Background(), "hello", &bodyModel{backendURL: backend.URL}, repository, 0, &data.Context{Id: 1}, &commontypes.PayloadModifiers{}, "opus")
+
+	if err != nil {
+		t.Fatalf("expected the query to be sent with a warning, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("expected one request, got %d", attempts.Load())
+	}
+}
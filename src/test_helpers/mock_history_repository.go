@@ -1,11 +1,19 @@
 package testhelpers
 
-import "owl/data"
+import (
+	"owl/data"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
 
 type MockHistoryRepository struct {
+	mu        sync.Mutex
 	Histories map[int64][]data.History
 	Contexts  map[int64]data.Context
 	Preferred map[int64]string
+	Summaries map[int64][]data.Summary
 }
 
 func NewMockHistoryRepository() *MockHistoryRepository {
@@ -13,34 +21,100 @@ func NewMockHistoryRepository() *MockHistoryRepository {
 		Histories: make(map[int64][]data.History),
 		Contexts:  make(map[int64]data.Context),
 		Preferred: make(map[int64]string),
+		Summaries: make(map[int64][]data.Summary),
 	}
 }
 
 func (m *MockHistoryRepository) GetContextById(contextId int64) (data.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.Contexts[contextId], nil
 }
 
+func (m *MockHistoryRepository) FindContext(contextId int64) (*data.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok || !ctx.DeletedAt.IsZero() {
+		return nil, nil
+	}
+	return &ctx, nil
+}
+
 func (m *MockHistoryRepository) InsertHistory(history data.History) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if history.Id == 0 {
+		history.Id = int64(len(m.Histories[history.ContextId]) + 1)
+	}
 	m.Histories[history.ContextId] = append(m.Histories[history.ContextId], history)
-	return int64(len(m.Histories[history.ContextId])), nil
+	return history.Id, nil
 }
 
 func (m *MockHistoryRepository) InsertContext(context data.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Contexts[context.Id] = context
 	return context.Id, nil
 }
 
 func (m *MockHistoryRepository) GetHistoryByContextId(contextId int64, maxCount int) ([]data.History, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	h := m.Histories[contextId]
+	// Like the repositories, the latest rows are kept in chronological order
 	if maxCount > 0 && len(h) > maxCount {
-		h = h[:maxCount]
+		h = h[len(h)-maxCount:]
 	}
 	result := make([]data.History, len(h))
 	copy(result, h)
 	return result, nil
 }
 
+func (m *MockHistoryRepository) GetContextHistory(contextId int64) ([]data.History, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]data.History{}, m.Histories[contextId]...), nil
+}
+
+// ImportContext stores the context under the next free id and renumbers its
+// rows from 1, rows without ids continue the previous row.
+func (m *MockHistoryRepository) ImportContext(context data.Context, histories []data.History) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	context.Id = 0
+	for id := range m.Contexts {
+		context.Id = max(context.Id, id)
+	}
+	context.Id++
+
+	newIds := map[int64]int64{}
+	rows := make([]data.History, 0, len(histories))
+	for i, history := range histories {
+		history.ContextId = context.Id
+		history.Id = int64(i + 1)
+		switch {
+		case histories[i].Id == 0:
+			history.ParentId = int64(i)
+		default:
+			history.ParentId = newIds[histories[i].ParentId]
+			newIds[histories[i].Id] = history.Id
+		}
+		rows = append(rows, history)
+	}
+	activeLeafId := int64(len(rows))
+	if id, ok := newIds[context.ActiveLeafId]; ok {
+		activeLeafId = id
+	}
+	context.ActiveLeafId = activeLeafId
+	m.Contexts[context.Id] = context
+	m.Histories[context.Id] = rows
+	return context.Id, nil
+}
+
 func (m *MockHistoryRepository) GetContextByName(name string) (*data.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, ctx := range m.Contexts {
 		if ctx.Name == name {
 			copyCtx := ctx
@@ -51,6 +125,8 @@ func (m *MockHistoryRepository) GetContextByName(name string) (*data.Context, er
 }
 
 func (m *MockHistoryRepository) GetAllContexts() ([]data.Context, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	result := make([]data.Context, 0, len(m.Contexts))
 	for _, ctx := range m.Contexts {
 		result = append(result, ctx)
@@ -60,28 +136,216 @@ func (m *MockHistoryRepository) GetAllContexts() ([]data.Context, error) {
 
 func (m *MockHistoryRepository) DeleteContext(contextId int64) (int64, error) { return 0, nil }
 func (m *MockHistoryRepository) DeleteHistory(historyId int64) (int64, error) { return 0, nil }
+func (m *MockHistoryRepository) GetDeletedContexts() ([]data.Context, error) {
+	return []data.Context{}, nil
+}
+func (m *MockHistoryRepository) RestoreContext(contextId int64) error        { return nil }
+func (m *MockHistoryRepository) PurgeContext(contextId int64) (int64, error) { return 0, nil }
+func (m *MockHistoryRepository) PurgeTrash(deletedBefore time.Time) (int64, error) {
+	return 0, nil
+}
 func (m *MockHistoryRepository) UpdateSystemPrompt(contextId int64, systemPrompt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return nil
 }
 
 func (m *MockHistoryRepository) UpdatePreferredModel(contextId int64, model string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Preferred[contextId] = model
 	return nil
 }
 
 func (m *MockHistoryRepository) UpdatePreferredAgent(contextId int64, agent string) error {
-	ctx := m.Contexts[contextId]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
 	ctx.PreferredAgent = agent
 	m.Contexts[contextId] = ctx
 	return nil
 }
 
 func (m *MockHistoryRepository) UpdatePreferredSkills(contextId int64, skills string) error {
-	ctx := m.Contexts[contextId]
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
 	ctx.PreferredSkills = skills
 	m.Contexts[contextId] = ctx
 	return nil
 }
 
+func (m *MockHistoryRepository) RenameContext(contextId int64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, ctx := range m.Contexts {
+		if id != contextId && ctx.Name == name {
+			return data.ErrContextNameTaken
+		}
+	}
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
+	ctx.Name = name
+	m.Contexts[contextId] = ctx
+	return nil
+}
+
+func (m *MockHistoryRepository) UpdateTags(contextId int64, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
+	ctx.Tags = data.NormalizeTags(tags)
+	m.Contexts[contextId] = ctx
+	return nil
+}
+
+func (m *MockHistoryRepository) UpdateFolder(contextId int64, folder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
+	ctx.Folder = data.NormalizeFolder(folder)
+	m.Contexts[contextId] = ctx
+	return nil
+}
+
+func (m *MockHistoryRepository) UpdateGenerationSettings(contextId int64, settings data.GenerationSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
+	ctx.Generation = settings
+	m.Contexts[contextId] = ctx
+	return nil
+}
+
 func (m *MockHistoryRepository) ArchiveContext(contextId int64, archived bool) error { return nil }
 func (m *MockHistoryRepository) ArchiveHistory(historyId int64, archived bool) error { return nil }
+
+// GetUsage reports every stored history row, Created is parsed from the row.
+func (m *MockHistoryRepository) GetUsage(since time.Time) ([]data.UsageRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := []data.UsageRow{}
+	for contextId, histories := range m.Histories {
+		for _, h := range histories {
+			created := data.ParseCreated(h.Created)
+			if created.Before(since) {
+				continue
+			}
+			usage = append(usage, data.UsageRow{
+				HistoryId:        h.Id,
+				ContextId:        contextId,
+				ContextName:      m.Contexts[contextId].Name,
+				Model:            h.Model,
+				Agent:            h.Agent,
+				Created:          created,
+				PromptTokens:     h.PromptTokens,
+				CompletionTokens: h.CompletionTokens,
+				CacheReadTokens:  h.CacheReadTokens,
+				CacheWriteTokens: h.CacheWriteTokens,
+			})
+		}
+	}
+	return usage, nil
+}
+
+// GetUsageTotals sums GetUsage per model.
+func (m *MockHistoryRepository) GetUsageTotals(since time.Time) ([]data.UsageTotal, error) {
+	rows, _ := m.GetUsage(since)
+	byModel := map[string]int{}
+	totals := []data.UsageTotal{}
+	for _, row := range rows {
+		i, ok := byModel[row.Model]
+		if !ok {
+			i = len(totals)
+			byModel[row.Model] = i
+			totals = append(totals, data.UsageTotal{Model: row.Model})
+		}
+		totals[i].Messages++
+		totals[i].PromptTokens += row.PromptTokens
+		totals[i].CompletionTokens += row.CompletionTokens
+		totals[i].CacheReadTokens += row.CacheReadTokens
+		totals[i].CacheWriteTokens += row.CacheWriteTokens
+	}
+	return totals, nil
+}
+
+func (m *MockHistoryRepository) InsertSummary(summary data.Summary) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Summaries[summary.ContextId] = append(m.Summaries[summary.ContextId], summary)
+	return int64(len(m.Summaries[summary.ContextId])), nil
+}
+
+func (m *MockHistoryRepository) GetLatestSummary(contextId int64) (*data.Summary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summaries := m.Summaries[contextId]
+	if len(summaries) == 0 {
+		return nil, nil
+	}
+	latest := summaries[len(summaries)-1]
+	return &latest, nil
+}
+
+func (m *MockHistoryRepository) GetHistoryTree(contextId int64) (data.HistoryTree, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return data.NewHistoryTree(m.Histories[contextId]), nil
+}
+
+func (m *MockHistoryRepository) UpdateActiveLeaf(contextId int64, historyId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, ok := m.Contexts[contextId]
+	if !ok {
+		return nil
+	}
+	ctx.ActiveLeafId = historyId
+	m.Contexts[contextId] = ctx
+	return nil
+}
+
+// SearchHistory matches rows whose prompt or response contains the query,
+// ignoring case, in context and insertion order.
+func (m *MockHistoryRepository) SearchHistory(query string, filters data.SearchFilters) ([]data.SearchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	contextIds := make([]int64, 0, len(m.Histories))
+	for contextId := range m.Histories {
+		contextIds = append(contextIds, contextId)
+	}
+	slices.Sort(contextIds)
+
+	needle := strings.ToLower(query)
+	results := []data.SearchResult{}
+	for _, contextId := range contextIds {
+		if filters.ContextId > 0 && filters.ContextId != contextId {
+			continue
+		}
+		for _, h := range m.Histories[contextId] {
+			if !strings.Contains(strings.ToLower(h.Prompt+" "+h.Response), needle) {
+				continue
+			}
+			results = append(results, data.SearchResult{HistoryId: h.Id, ContextId: contextId, ContextName: m.Contexts[contextId].Name, Snippet: h.Prompt, Created: h.Created})
+		}
+	}
+	return results, nil
+}
@@ -12,12 +12,14 @@ type TextEvent struct {
 }
 
 type FinalEvent struct {
-	ContextID int64
-	Prompt    string
-	Response  string
-	ModelName string
-	Usage     *commontypes.TokenUsage
-	ToolUse   []data.ToolUse
+	ContextID   int64
+	Prompt      string
+	Response    string
+	ModelName   string
+	Usage       *commontypes.TokenUsage
+	ToolUse     []data.ToolUse
+	Thinking    []data.Thinking
+	Attachments []data.Attachment
 }
 
 type MockResponseHandler struct {
@@ -36,16 +38,18 @@ func (m *MockResponseHandler) RecievedText(text string, color *string) {
 	m.TextEvents = append(m.TextEvents, TextEvent{Text: text, Color: color})
 }
 
-func (m *MockResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
+func (m *MockResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.FinalEvents = append(m.FinalEvents, FinalEvent{
-		ContextID: contextId,
-		Prompt:    prompt,
-		Response:  response,
-		ModelName: modelName,
-		Usage:     usage,
-		ToolUse:   toolUse,
+		ContextID:   contextId,
+		Prompt:      prompt,
+		Response:    response,
+		ModelName:   modelName,
+		Usage:       usage,
+		ToolUse:     toolUse,
+		Thinking:    thinking,
+		Attachments: attachments,
 	})
 }
 
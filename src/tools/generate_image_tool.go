@@ -1,11 +1,11 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	commontypes "owl/common_types"
 	"owl/data"
 	"owl/logger"
-	open_ai_responses "owl/models/open-ai-responses"
 	"owl/services"
 
 	"github.com/fatih/color"
@@ -13,10 +13,16 @@ import (
 
 var MODELNAME = "generate_image_tool"
 
+// ImageModel builds the model that answers the image prompts. The OpenAI
+// responses model sets it when it is linked in, tools cannot import it
+// directly since that model runs the tools.
+var ImageModel func(responseHandler commontypes.ResponseHandler) commontypes.Model
+
 type GenerateImageTool struct {
 	ResponseHandler   commontypes.ResponseHandler
 	HistoryRepository *data.HistoryRepository
 	Context           *data.Context
+	requestCtx        context.Context
 }
 
 type GenerateImageInput struct {
@@ -28,12 +34,22 @@ func (tool *GenerateImageTool) SetHistory(repo *data.HistoryRepository, context
 	tool.HistoryRepository = repo
 }
 
+// SetRequestContext makes the image request part of the query that called the
+// tool, see RequestContextTool.
+func (tool *GenerateImageTool) SetRequestContext(ctx context.Context) {
+	tool.requestCtx = ctx
+}
+
 func (tool *GenerateImageTool) Run(i map[string]string) (string, error) {
 	prompt, exists := i["Prompt"]
 	if !exists {
 		return "", fmt.Errorf("Could not parse FileWriteInput from input")
 	}
 
+	if ImageModel == nil {
+		return "", fmt.Errorf("no image generation model is available")
+	}
+
 	logger.Screen(fmt.Sprintf("Asked to generate image with prompt: %v", prompt), color.RGB(150, 150, 150))
 
 	toolHandler := ToolResponseHandler{
@@ -41,9 +57,16 @@ func (tool *GenerateImageTool) Run(i map[string]string) (string, error) {
 	}
 	toolHandler.Init()
 
-	model := &open_ai_responses.OpenAiResponseModel{ResponseHandler: &toolHandler}
+	model := ImageModel(&toolHandler)
 
-	services.AwaitedQuery(prompt, model, *tool.HistoryRepository, 0, tool.Context, &commontypes.PayloadModifiers{}, MODELNAME)
+	requestCtx := tool.requestCtx
+	if requestCtx == nil {
+		requestCtx = context.Background()
+	}
+	err := services.AwaitedQuery(requestCtx, prompt, model, *tool.HistoryRepository, 0, tool.Context, &commontypes.PayloadModifiers{}, MODELNAME)
+	if err != nil {
+		return "", fmt.Errorf("image generation failed: %w", err)
+	}
 	//I need to await the answer on the channel toolHandler.ResponseChannel and then return with that value.
 	response := <-toolHandler.ResponseChannel
 	return response, nil
@@ -0,0 +1,48 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	commontypes "owl/common_types"
+	"owl/data"
+	"owl/logger"
+	"testing"
+)
+
+// unreachableImageModel fails the test when the image query is sent.
+type unreachableImageModel struct {
+	t *testing.T
+}
+
+func (m unreachableImageModel) CreateRequest(ctx context.Context, context *data.Context, prompt string, streaming bool, history []data.History, modifiers *commontypes.PayloadModifiers) (*http.Request, error) {
+	m.t.Fatalf("expected no image request after the query was cancelled")
+	return nil, nil
+}
+
+func (m unreachableImageModel) HandleStreamedLine(line []byte)                                 {}
+func (m unreachableImageModel) HandleBodyBytes(body []byte)                                    {}
+func (m unreachableImageModel) SetResponseHandler(responseHandler commontypes.ResponseHandler) {}
+
+func TestGenerateImageTool_UsesTheContextOfTheQuery(t *testing.T) {
+	if logger.Debug == nil {
+		logger.Debug = log.New(io.Discard, "", 0)
+	}
+	previous := ImageModel
+	ImageModel = func(responseHandler commontypes.ResponseHandler) commontypes.Model {
+		return unreachableImageModel{t: t}
+	}
+	t.Cleanup(func() { ImageModel = previous })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var repository data.HistoryRepository
+	runner := ToolRunner{HistoryRepository: &repository, Context: &data.Context{Id: 3}, RequestCtx: ctx}
+	_, err := runner.ExecuteTool(data.Context{Id: 3}, data.ToolUse{Id: "call_1", Name: "image_generator"}, map[string]string{"Prompt": "an owl at dusk"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled query to cancel the image request, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"fmt"
+	"owl/data"
+	"owl/embeddings"
+	"owl/logger"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// PastConversationsTool looks up turns of earlier conversations that are
+// semantically close to a query, from the history rows embedded when
+// OWL_EMBED_HISTORY is set.
+type PastConversationsTool struct {
+	repository *data.HistoryRepository
+	search     func(historyRepository data.HistoryRepository, query string) ([]data.EmbeddingMatch, error)
+}
+
+func (tool *PastConversationsTool) SetHistory(repo *data.HistoryRepository, context *data.Context) {
+	tool.repository = repo
+}
+
+func (tool *PastConversationsTool) GetName() string {
+	return "search_past_conversations"
+}
+
+func (tool *PastConversationsTool) GetGroups() []ToolGroup {
+	return []ToolGroup{ToolGroupDeveloper, ToolGroupManager, ToolGroupPlanner, ToolGroupSecretary}
+}
+
+func (tool *PastConversationsTool) GetDefinition() (Tool, string) {
+	return Tool{
+		Name:         tool.GetName(),
+		Description:  "Searches earlier conversations with the user for the turns closest in meaning to a query and returns the question and answer of each, with the name of the conversation it came from. Use it when the user refers to something discussed before or when an earlier answer would help.",
+		Groups:       tool.GetGroups(),
+		Dependencies: []ToolDependency{ToolDependencyLocalExec},
+		InputSchema: InputSchema{
+			Type: "object",
+			Properties: map[string]Property{
+				"Query": {
+					Type:        "string",
+					Description: "What to look for, described in a sentence or a few keywords.",
+				},
+			},
+			Required: []string{"Query"},
+		},
+	}, LOCAL
+}
+
+func (tool *PastConversationsTool) Run(i map[string]string) (string, error) {
+	query := strings.TrimSpace(i["Query"])
+	if query == "" {
+		return "", fmt.Errorf("Query is required")
+	}
+
+	logger.Screen(fmt.Sprintf("Searching past conversations for: %s", query), color.RGB(150, 150, 150))
+
+	search := tool.search
+	if search == nil {
+		search = embeddings.SearchHistory
+	}
+	matches, err := search(tool.historyRepository(), query)
+	if err != nil {
+		return "", fmt.Errorf("Search failed: %s", err)
+	}
+	if len(matches) == 0 {
+		return fmt.Sprintf("No earlier conversations match '%s'. History is only searchable once it has been embedded with OWL_EMBED_HISTORY set.", query), nil
+	}
+
+	names := tool.contextNames()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Earlier conversations matching '%s':\n", query)
+	for _, match := range matches {
+		_, contextId, historyId, _ := embeddings.ParseHistoryReference(match.Reference)
+		fmt.Fprintf(&b, "\n----\nConversation: %s, message #%d (distance %.3f)\n%s\n", contextName(names, contextId), historyId, match.Distance, match.Text)
+	}
+	return b.String(), nil
+}
+
+// historyRepository is the repository of the user the tool runs for, nil
+// when none was set.
+func (tool *PastConversationsTool) historyRepository() data.HistoryRepository {
+	if tool.repository == nil {
+		return nil
+	}
+	return *tool.repository
+}
+
+func (tool *PastConversationsTool) contextNames() map[int64]string {
+	if tool.historyRepository() == nil {
+		return map[int64]string{}
+	}
+	return embeddings.ContextNames(tool.historyRepository())
+}
+
+func contextName(names map[int64]string, contextId int64) string {
+	if name := names[contextId]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%d", contextId)
+}
+
+func init() {
+	Register(&PastConversationsTool{})
+}
@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"owl/data"
+	"owl/embeddings"
+	"strings"
+	"testing"
+)
+
+type contextNameRepository struct {
+	data.HistoryRepository
+	names map[int64]string
+}
+
+// Only GetAllContexts is implemented: GetContextById would un-archive the
+// context of every match.
+func (r contextNameRepository) GetAllContexts() ([]data.Context, error) {
+	contexts := []data.Context{}
+	for id, name := range r.names {
+		contexts = append(contexts, data.Context{Id: id, Name: name})
+	}
+	return contexts, nil
+}
+
+func TestPastConversationsToolNamesTheConversationOfEachMatch(t *testing.T) {
+	var repository data.HistoryRepository = contextNameRepository{names: map[int64]string{3: "refactoring"}}
+	tool := &PastConversationsTool{
+		search: func(historyRepository data.HistoryRepository, query string) ([]data.EmbeddingMatch, error) {
+			if _, ok := historyRepository.(contextNameRepository); !ok {
+				t.Fatalf("expected the search to run for the repository of the tool")
+			}
+			if query != "retry backoff" {
+				t.Fatalf("unexpected query %q", query)
+			}
+			return []data.EmbeddingMatch{
+				{Text: "Q: how do we retry?\n\nA: with jittered backoff", Distance: 0.21, Reference: embeddings.HistoryReference("ada", 3, 42)},
+				{Text: "Q: and the cap?", Distance: 0.4, Reference: embeddings.HistoryReference("ada", 9, 7)},
+			}, nil
+		},
+	}
+	tool.SetHistory(&repository, nil)
+
+	output, err := tool.Run(map[string]string{"Query": " retry backoff "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"Conversation: refactoring, message #42", "with jittered backoff", "Conversation: 9, message #7"} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("expected output to contain %q, got: %s", want, output)
+		}
+	}
+}
+
+func TestPastConversationsToolRequiresAQuery(t *testing.T) {
+	tool := &PastConversationsTool{search: func(data.HistoryRepository, string) ([]data.EmbeddingMatch, error) {
+		t.Fatalf("search should not run without a query")
+		return nil, nil
+	}}
+	if _, err := tool.Run(map[string]string{"Query": "  "}); err == nil {
+		t.Fatalf("expected an error for an empty query")
+	}
+}
+
+func TestPastConversationsToolSaysWhenNothingMatches(t *testing.T) {
+	tool := &PastConversationsTool{search: func(data.HistoryRepository, string) ([]data.EmbeddingMatch, error) { return nil, nil }}
+	output, err := tool.Run(map[string]string{"Query": "kubernetes"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(output, "OWL_EMBED_HISTORY") {
+		t.Fatalf("expected a hint about OWL_EMBED_HISTORY, got: %s", output)
+	}
+}
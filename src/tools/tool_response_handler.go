@@ -18,9 +18,9 @@ func (toolResponseHandler *ToolResponseHandler) RecievedText(text string, color
 	//TODO: Implement streaming tool use
 }
 
-func (toolResponseHandler *ToolResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
+func (toolResponseHandler *ToolResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	if toolResponseHandler.ResponseHandler != nil {
-		toolResponseHandler.ResponseHandler.FinalText(contextId, prompt, response, toolUse, modelName, usage)
+		toolResponseHandler.ResponseHandler.FinalText(contextId, prompt, response, toolUse, modelName, usage, thinking, attachments)
 	}
 	toolResponseHandler.ResponseChannel = make(chan string, 100)
 	toolResponseHandler.ResponseChannel <- response
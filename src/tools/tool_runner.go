@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"fmt"
 	commontypes "owl/common_types"
 	"owl/data"
@@ -20,10 +21,18 @@ type ToolModel interface {
 	GetGroups() []ToolGroup
 }
 
+// RequestContextTool is implemented by tools that make requests of their own,
+// they are given the context of the query so a cancelled query cancels them.
+type RequestContextTool interface {
+	SetRequestContext(ctx context.Context)
+}
+
 type ToolRunner struct {
 	ResponseHandler   *commontypes.ResponseHandler
 	HistoryRepository *data.HistoryRepository
 	Context           *data.Context
+	// RequestCtx is the context of the query the tool is called in
+	RequestCtx context.Context
 }
 
 type ToolRegistry struct {
@@ -54,12 +63,42 @@ func GetTool(name string) (ToolModel, error) {
 	return tool, nil
 }
 
-func (runner *ToolRunner) ExecuteTool(ctx data.Context, name string, rawInput map[string]string) (string, error) {
+// ExecuteTool runs the tool of a call. The response handler hears of the call
+// before the tool runs and of its result once it has answered.
+func (runner *ToolRunner) ExecuteTool(ctx data.Context, call data.ToolUse, rawInput map[string]string) (string, error) {
+	var handler commontypes.ResponseHandler
+	if runner.ResponseHandler != nil {
+		handler = *runner.ResponseHandler
+	}
+	if handler != nil {
+		commontypes.SendToolCalled(handler, call)
+	}
+
+	result, err := runner.runTool(call.Name, rawInput)
+
+	if handler != nil {
+		call.Result = data.ToolResult{ToolUseId: call.Id, Content: result, Success: err == nil}
+		if err != nil {
+			call.Result.Content = err.Error()
+		}
+		commontypes.SendToolAnswered(handler, call)
+	}
+	return result, err
+}
+
+func (runner *ToolRunner) runTool(name string, rawInput map[string]string) (string, error) {
 	tool, err := GetTool(name)
 	if err != nil {
 		return "", err
 	}
 	tool.SetHistory(runner.HistoryRepository, runner.Context)
+	if contextTool, ok := tool.(RequestContextTool); ok {
+		requestCtx := runner.RequestCtx
+		if requestCtx == nil {
+			requestCtx = context.Background()
+		}
+		contextTool.SetRequestContext(requestCtx)
+	}
 
 	return tool.Run(rawInput)
 }
@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// chatgptConversation is a conversation of the conversations.json in a
+// ChatGPT data export. Messages form a tree in mapping; current_node is the
+// last message of the branch that was shown.
+type chatgptConversation struct {
+	Title            string                 `json:"title"`
+	CreateTime       float64                `json:"create_time"`
+	CurrentNode      string                 `json:"current_node"`
+	DefaultModelSlug string                 `json:"default_model_slug"`
+	Mapping          map[string]chatgptNode `json:"mapping"`
+}
+
+type chatgptNode struct {
+	Message *chatgptMessage `json:"message"`
+	Parent  string          `json:"parent"`
+}
+
+type chatgptMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+func parseChatGPT(raw []json.RawMessage) ([]Export, error) {
+	exports := make([]Export, 0, len(raw))
+	for _, item := range raw {
+		var conversation chatgptConversation
+		if err := json.Unmarshal(item, &conversation); err != nil {
+			return nil, err
+		}
+		exports = append(exports, conversation.export())
+	}
+	return exports, nil
+}
+
+func (conversation chatgptConversation) export() Export {
+	builder := conversationBuilder{defaultModel: conversation.DefaultModelSlug}
+	for _, message := range conversation.branch() {
+		text := message.text()
+		if text == "" || message.Metadata.Hidden {
+			continue
+		}
+		created := unixTime(message.CreateTime)
+		switch message.Author.Role {
+		case "user":
+			builder.prompt(text, created)
+		case "assistant":
+			builder.response(text, message.Metadata.ModelSlug, created)
+		}
+	}
+
+	return Export{
+		Version: FormatVersion,
+		Context: Context{Name: conversationName(conversation.Title, "ChatGPT", unixTime(conversation.CreateTime))},
+		Turns:   builder.turns,
+	}
+}
+
+// branch returns the messages from the root to current_node.
+func (conversation chatgptConversation) branch() []chatgptMessage {
+	messages := []chatgptMessage{}
+	seen := map[string]bool{}
+	for id := conversation.CurrentNode; id != "" && !seen[id]; {
+		seen[id] = true
+		node, ok := conversation.Mapping[id]
+		if !ok {
+			break
+		}
+		if node.Message != nil {
+			messages = append(messages, *node.Message)
+		}
+		id = node.Parent
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// text joins the text parts of a message. Images, browsing results and
+// reasoning summaries are left out.
+func (message chatgptMessage) text() string {
+	switch message.Content.ContentType {
+	case "text", "multimodal_text":
+	default:
+		return ""
+	}
+
+	parts := []string{}
+	for _, raw := range message.Content.Parts {
+		var part string
+		if err := json.Unmarshal(raw, &part); err == nil && strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n\n"))
+}
@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// claudeConversation is a conversation of the conversations.json in a
+// Claude.ai data export. The export has no model names.
+type claudeConversation struct {
+	Name         string          `json:"name"`
+	CreatedAt    string          `json:"created_at"`
+	ChatMessages []claudeMessage `json:"chat_messages"`
+}
+
+type claudeMessage struct {
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	CreatedAt string `json:"created_at"`
+	Content   []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Attachments []struct {
+		FileName         string `json:"file_name"`
+		ExtractedContent string `json:"extracted_content"`
+	} `json:"attachments"`
+}
+
+func parseClaude(raw []json.RawMessage) ([]Export, error) {
+	exports := make([]Export, 0, len(raw))
+	for _, item := range raw {
+		var conversation claudeConversation
+		if err := json.Unmarshal(item, &conversation); err != nil {
+			return nil, err
+		}
+		exports = append(exports, conversation.export())
+	}
+	return exports, nil
+}
+
+func (conversation claudeConversation) export() Export {
+	builder := conversationBuilder{}
+	for _, message := range conversation.ChatMessages {
+		text := message.text()
+		if text == "" {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339Nano, message.CreatedAt)
+		switch message.Sender {
+		case "human":
+			builder.prompt(text, created)
+		case "assistant":
+			builder.response(text, "", created)
+		}
+	}
+
+	created, _ := time.Parse(time.RFC3339Nano, conversation.CreatedAt)
+	return Export{
+		Version: FormatVersion,
+		Context: Context{Name: conversationName(conversation.Name, "Claude.ai", created)},
+		Turns:   builder.turns,
+	}
+}
+
+// text joins the text blocks of a message, falling back to its text field,
+// and appends the extracted content of its attachments.
+func (message claudeMessage) text() string {
+	parts := []string{}
+	for _, block := range message.Content {
+		if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+			parts = append(parts, block.Text)
+		}
+	}
+	if len(parts) == 0 && strings.TrimSpace(message.Text) != "" {
+		parts = append(parts, message.Text)
+	}
+	for _, attachment := range message.Attachments {
+		if strings.TrimSpace(attachment.ExtractedContent) != "" {
+			parts = append(parts, fmt.Sprintf("Attachment %s:\n\n%s", attachment.FileName, attachment.ExtractedContent))
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n\n"))
+}
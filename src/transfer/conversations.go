@@ -0,0 +1,120 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// ReadAny reads an owl export or the conversations.json of a ChatGPT or
+// Claude.ai data export, one Export per conversation. Conversations from
+// ChatGPT and Claude.ai are archived when archive is set, so they do not
+// crowd the context list.
+func ReadAny(r io.Reader, archive bool) ([]Export, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if !bytes.HasPrefix(trimmed, []byte("[")) {
+		export, err := Read(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		return []Export{export}, nil
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(trimmed, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, err)
+	}
+	if len(raw) == 0 {
+		return []Export{}, nil
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(raw[0], &probe); err != nil {
+		return nil, ErrUnknownFormat
+	}
+
+	var exports []Export
+	switch {
+	case probe["mapping"] != nil:
+		exports, err = parseChatGPT(raw)
+	case probe["chat_messages"] != nil:
+		exports, err = parseClaude(raw)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range exports {
+		exports[i].Context.Archived = archive
+	}
+	return exports, nil
+}
+
+// conversationBuilder pairs the user and assistant messages of a
+// conversation into turns. Consecutive assistant messages are joined into
+// the answer of the last prompt.
+type conversationBuilder struct {
+	defaultModel string
+	turns        []Turn
+	answered     bool
+}
+
+func (builder *conversationBuilder) prompt(text string, created time.Time) {
+	builder.turns = append(builder.turns, Turn{Prompt: text, Created: formatCreated(created), Model: builder.defaultModel})
+	builder.answered = false
+}
+
+func (builder *conversationBuilder) response(text string, model string, created time.Time) {
+	if len(builder.turns) == 0 {
+		builder.turns = append(builder.turns, Turn{Created: formatCreated(created), Model: builder.defaultModel})
+	}
+	turn := &builder.turns[len(builder.turns)-1]
+	if builder.answered {
+		turn.Response += "\n\n" + text
+	} else {
+		turn.Response = text
+	}
+	if model != "" {
+		turn.Model = model
+	}
+	builder.answered = true
+}
+
+func formatCreated(created time.Time) string {
+	if created.IsZero() {
+		return ""
+	}
+	return created.UTC().Format(time.RFC3339Nano)
+}
+
+// unixTime reads the fractional unix seconds ChatGPT uses for timestamps.
+func unixTime(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)).UTC()
+}
+
+// conversationName is the title of a conversation, or the source and date
+// when it has none.
+func conversationName(title string, source string, created time.Time) string {
+	if name := strings.Join(strings.Fields(title), " "); name != "" {
+		return name
+	}
+	if created.IsZero() {
+		return source + " conversation"
+	}
+	return fmt.Sprintf("%s conversation %s", source, created.Format("2006-01-02 15:04"))
+}
@@ -0,0 +1,106 @@
+package transfer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const chatgptExport = `[{
+	"title": "Retry strategy",
+	"create_time": 1709296200.5,
+	"current_node": "a2",
+	"default_model_slug": "gpt-4o",
+	"mapping": {
+		"root": {"message": null, "parent": null},
+		"sys": {"message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}, "metadata": {"is_visually_hidden_from_conversation": true}}, "parent": "root"},
+		"u1": {"message": {"author": {"role": "user"}, "create_time": 1709296200.5, "content": {"content_type": "text", "parts": ["How should we retry?"]}, "metadata": {}}, "parent": "sys"},
+		"a1": {"message": {"author": {"role": "assistant"}, "create_time": 1709296210, "content": {"content_type": "text", "parts": ["With jittered backoff."]}, "metadata": {"model_slug": "gpt-4o"}}, "parent": "u1"},
+		"u2": {"message": {"author": {"role": "user"}, "create_time": 1709296300, "content": {"content_type": "multimodal_text", "parts": [{"content_type": "image_asset_pointer"}, "And this screenshot?"]}, "metadata": {}}, "parent": "a1"},
+		"u2b": {"message": {"author": {"role": "user"}, "create_time": 1709296290, "content": {"content_type": "text", "parts": ["An edited prompt that is not shown"]}, "metadata": {}}, "parent": "a1"},
+		"t2": {"message": {"author": {"role": "tool"}, "content": {"content_type": "text", "parts": ["tool output"]}, "metadata": {}}, "parent": "u2"},
+		"a2": {"message": {"author": {"role": "assistant"}, "create_time": 1709296310, "content": {"content_type": "text", "parts": ["It shows a 429."]}, "metadata": {"model_slug": "o1"}}, "parent": "t2"}
+	}
+}]`
+
+const claudeExport = `[{
+	"uuid": "c1",
+	"name": "",
+	"created_at": "2024-05-02T08:00:00.000000Z",
+	"chat_messages": [
+		{"sender": "human", "text": "Summarize this", "created_at": "2024-05-02T08:00:01.000000Z", "content": [{"type": "text", "text": "Summarize this"}], "attachments": [{"file_name": "notes.txt", "extracted_content": "retry notes"}]},
+		{"sender": "assistant", "text": "", "created_at": "2024-05-02T08:00:05.000000Z", "content": [{"type": "text", "text": "Part one."}, {"type": "tool_use", "text": ""}]},
+		{"sender": "assistant", "text": "Part two.", "created_at": "2024-05-02T08:00:06.000000Z", "content": []}
+	]
+}]`
+
+func TestReadAnyPairsChatGPTTurnsOnTheShownBranch(t *testing.T) {
+	exports, err := ReadAny(strings.NewReader(chatgptExport), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 1 {
+		t.Fatalf("expected one conversation, got %d", len(exports))
+	}
+
+	export := exports[0]
+	if export.Context.Name != "Retry strategy" || !export.Context.Archived {
+		t.Fatalf("unexpected context %+v", export.Context)
+	}
+	if len(export.Turns) != 2 {
+		t.Fatalf("expected two turns, got %+v", export.Turns)
+	}
+
+	first, second := export.Turns[0], export.Turns[1]
+	if first.Prompt != "How should we retry?" || first.Response != "With jittered backoff." || first.Model != "gpt-4o" {
+		t.Fatalf("unexpected first turn %+v", first)
+	}
+	if first.Created != "2024-03-01T12:30:00.5Z" {
+		t.Fatalf("expected the original timestamp, got %q", first.Created)
+	}
+	if second.Prompt != "And this screenshot?" || second.Response != "It shows a 429." || second.Model != "o1" {
+		t.Fatalf("unexpected second turn %+v", second)
+	}
+}
+
+func TestReadAnyJoinsClaudeAnswersAndAttachments(t *testing.T) {
+	exports, err := ReadAny(strings.NewReader(claudeExport), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := exports[0]
+	if export.Context.Name != "Claude.ai conversation 2024-05-02 08:00" || export.Context.Archived {
+		t.Fatalf("unexpected context %+v", export.Context)
+	}
+	if len(export.Turns) != 1 {
+		t.Fatalf("expected one turn, got %+v", export.Turns)
+	}
+
+	turn := export.Turns[0]
+	if turn.Prompt != "Summarize this\n\nAttachment notes.txt:\n\nretry notes" {
+		t.Fatalf("unexpected prompt %q", turn.Prompt)
+	}
+	if turn.Response != "Part one.\n\nPart two." || turn.Model != "" {
+		t.Fatalf("unexpected answer %+v", turn)
+	}
+	if turn.Created != "2024-05-02T08:00:01Z" {
+		t.Fatalf("expected the original timestamp, got %q", turn.Created)
+	}
+}
+
+func TestReadAnyKeepsOwlExportsAsTheyAre(t *testing.T) {
+	exports, err := ReadAny(strings.NewReader(`{"owl_export": 1, "context": {"name": "review"}, "turns": [{"prompt": "hi", "response": "hello", "usage": {}}]}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exports) != 1 || exports[0].Context.Name != "review" || exports[0].Context.Archived {
+		t.Fatalf("unexpected exports %+v", exports)
+	}
+}
+
+func TestReadAnyRefusesUnknownArrays(t *testing.T) {
+	if _, err := ReadAny(strings.NewReader(`[{"messages": []}]`), true); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("expected an unknown format error, got %v", err)
+	}
+}
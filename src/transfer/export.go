@@ -0,0 +1,159 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"owl/data"
+)
+
+type jsonlContext struct {
+	Type    string  `json:"type"`
+	Version int     `json:"owl_export"`
+	Context Context `json:"context"`
+}
+
+type jsonlTurn struct {
+	Type string `json:"type"`
+	Turn
+}
+
+const (
+	jsonlTypeContext = "context"
+	jsonlTypeTurn    = "turn"
+)
+
+// Write writes the export in format: md, json or jsonl. JSONL starts with a
+// context line followed by one line per turn.
+func Write(w io.Writer, export Export, format string) error {
+	switch format {
+	case FormatMarkdown:
+		_, err := io.WriteString(w, Markdown(export))
+		return err
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(export)
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(jsonlContext{Type: jsonlTypeContext, Version: export.Version, Context: export.Context}); err != nil {
+			return err
+		}
+		for _, turn := range export.Turns {
+			if err := encoder.Encode(jsonlTurn{Type: jsonlTypeTurn, Turn: turn}); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format %q, use md, json or jsonl", format)
+	}
+}
+
+// Markdown renders the active branch of the export for reading, e.g. in a
+// code review. It cannot be imported again.
+func Markdown(export Export) string {
+	var b strings.Builder
+	context := export.Context
+	fmt.Fprintf(&b, "# %s\n\n", context.Name)
+
+	settings := []string{}
+	if context.PreferredModel != "" {
+		settings = append(settings, fmt.Sprintf("- Model: `%s`", context.PreferredModel))
+	}
+	if context.PreferredAgent != "" {
+		settings = append(settings, fmt.Sprintf("- Agent: `%s`", context.PreferredAgent))
+	}
+	if context.PreferredSkills != "" {
+		settings = append(settings, fmt.Sprintf("- Skills: `%s`", context.PreferredSkills))
+	}
+	if context.Folder != "" {
+		settings = append(settings, fmt.Sprintf("- Folder: `%s`", context.Folder))
+	}
+	if len(context.Tags) > 0 {
+		settings = append(settings, fmt.Sprintf("- Tags: %s", "#"+strings.Join(context.Tags, " #")))
+	}
+	if context.Generation != nil {
+		settings = append(settings, fmt.Sprintf("- Generation: `%s`", context.Generation))
+	}
+	if len(settings) > 0 {
+		b.WriteString(strings.Join(settings, "\n") + "\n\n")
+	}
+	if context.SystemPrompt != "" {
+		b.WriteString("## System prompt\n\n")
+		b.WriteString(fenced("text", context.SystemPrompt))
+		b.WriteString("\n")
+	}
+
+	branch := export.ActiveBranch()
+	switch hidden := len(export.Turns) - len(branch); {
+	case hidden == 1:
+		b.WriteString("_1 turn on another branch is not shown_\n\n")
+	case hidden > 1:
+		fmt.Fprintf(&b, "_%d turns on other branches are not shown_\n\n", hidden)
+	}
+
+	for i, turn := range branch {
+		b.WriteString("---\n\n")
+		fmt.Fprintf(&b, "## Q%d", i+1)
+		if turn.Created != "" {
+			if created := data.ParseCreated(turn.Created); !created.IsZero() {
+				fmt.Fprintf(&b, " · %s", created.Local().Format("2006-01-02 15:04"))
+			}
+		}
+		b.WriteString("\n\n")
+		if strings.TrimSpace(turn.Prompt) != "" {
+			b.WriteString(strings.TrimSpace(turn.Prompt) + "\n\n")
+		}
+		if len(turn.Attachments) > 0 {
+			fmt.Fprintf(&b, "_Attached: %s_\n\n", data.AttachmentNames(turn.Attachments))
+		}
+
+		b.WriteString("## A")
+		if turn.Model != "" {
+			fmt.Fprintf(&b, " · %s", turn.Model)
+		}
+		if turn.Agent != "" {
+			fmt.Fprintf(&b, " · %s", turn.Agent)
+		}
+		if turn.Interrupted {
+			b.WriteString(" · interrupted")
+		}
+		b.WriteString("\n\n")
+		if strings.TrimSpace(turn.Response) != "" {
+			b.WriteString(strings.TrimSpace(turn.Response) + "\n\n")
+		}
+
+		for _, toolUse := range turn.ToolUses {
+			status := "ok"
+			if !toolUse.Result.Success {
+				status = "failed"
+			}
+			fmt.Fprintf(&b, "<details>\n<summary>Tool %s (%s)</summary>\n\n", toolUse.Name, status)
+			b.WriteString("Input:\n\n")
+			b.WriteString(fenced("json", toolUse.Input))
+			b.WriteString("\nResult:\n\n")
+			b.WriteString(fenced("text", toolUse.Result.Content))
+			b.WriteString("\n</details>\n\n")
+		}
+
+		usage := turn.Usage
+		if usage != (Usage{}) {
+			fmt.Fprintf(&b, "_Tokens: %d in, %d out, %d cache read, %d cache write_\n\n",
+				usage.PromptTokens, usage.CompletionTokens, usage.CacheReadTokens, usage.CacheWriteTokens)
+		}
+	}
+	return b.String()
+}
+
+// fenced puts content in a code block with a fence longer than any run of
+// backticks in it.
+func fenced(language string, content string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("%s%s\n%s\n%s\n", fence, language, strings.TrimRight(content, "\n"), fence)
+}
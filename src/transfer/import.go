@@ -0,0 +1,153 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"owl/data"
+)
+
+var ErrUnknownFormat = errors.New("not an owl export in json or jsonl, markdown exports cannot be imported")
+
+// Read parses a JSON or JSONL export.
+func Read(r io.Reader) (Export, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return Export{}, err
+	}
+
+	var export Export
+	if err := json.Unmarshal(content, &export); err != nil || export.Version == 0 {
+		export, err = readJSONL(content)
+		if err != nil {
+			return Export{}, err
+		}
+	}
+	if export.Version > FormatVersion {
+		return Export{}, fmt.Errorf("the export has version %d, this owl reads up to version %d", export.Version, FormatVersion)
+	}
+	if export.Context.Name == "" {
+		return Export{}, errors.New("the export has no context name")
+	}
+	return export, nil
+}
+
+func readJSONL(content []byte) (Export, error) {
+	export := Export{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		var entry struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return Export{}, ErrUnknownFormat
+		}
+
+		switch entry.Type {
+		case jsonlTypeContext:
+			var context jsonlContext
+			if err := json.Unmarshal(raw, &context); err != nil {
+				return Export{}, fmt.Errorf("line %d: %w", line, err)
+			}
+			export.Version = context.Version
+			export.Context = context.Context
+		case jsonlTypeTurn:
+			if export.Version == 0 {
+				return Export{}, fmt.Errorf("line %d: a turn before the context line", line)
+			}
+			var turn jsonlTurn
+			if err := json.Unmarshal(raw, &turn); err != nil {
+				return Export{}, fmt.Errorf("line %d: %w", line, err)
+			}
+			export.Turns = append(export.Turns, turn.Turn)
+		default:
+			return Export{}, ErrUnknownFormat
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Export{}, err
+	}
+	if export.Version == 0 {
+		return Export{}, ErrUnknownFormat
+	}
+	return export, nil
+}
+
+// Save stores the export as a new context with all its branches and returns
+// it. When the name is taken the context gets a numbered name, "review (2)".
+// The context and its turns are stored in one transaction, a failed import
+// leaves nothing behind.
+func Save(repository data.HistoryRepository, export Export) (data.Context, error) {
+	name, err := freeName(repository, export.Context.Name)
+	if err != nil {
+		return data.Context{}, err
+	}
+
+	context := data.Context{
+		Name:            name,
+		SystemPrompt:    export.Context.SystemPrompt,
+		PreferredModel:  export.Context.PreferredModel,
+		PreferredAgent:  export.Context.PreferredAgent,
+		PreferredSkills: export.Context.PreferredSkills,
+		Tags:            export.Context.Tags,
+		Folder:          export.Context.Folder,
+		Archived:        export.Context.Archived,
+	}
+	if export.Context.Generation != nil {
+		context.Generation = *export.Context.Generation
+	}
+	// The context counts as created with its first turn
+	if len(export.Turns) > 0 {
+		context.Created = data.ParseCreated(export.Turns[0].Created)
+	}
+
+	histories := make([]data.History, 0, len(export.Turns))
+	for _, turn := range export.Turns {
+		histories = append(histories, turn.history())
+	}
+	// The active turn is an id of the export, the repository maps it
+	imported := context
+	imported.ActiveLeafId = export.Context.ActiveTurn
+	context.Id, err = repository.ImportContext(imported, histories)
+	if err != nil {
+		return data.Context{}, err
+	}
+	return context, nil
+}
+
+// freeName numbers name until no context has it. Contexts in the trash count
+// as taken, restoring one would otherwise bring back a second context of the
+// same name.
+func freeName(repository data.HistoryRepository, name string) (string, error) {
+	contexts, err := repository.GetAllContexts()
+	if err != nil {
+		return "", err
+	}
+	trashed, err := repository.GetDeletedContexts()
+	if err != nil {
+		return "", err
+	}
+	contexts = append(contexts, trashed...)
+	taken := map[string]bool{}
+	for _, context := range contexts {
+		taken[context.Name] = true
+	}
+
+	candidate := name
+	for i := 2; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return candidate, nil
+}
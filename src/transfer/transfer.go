@@ -0,0 +1,241 @@
+// Package transfer exports contexts to Markdown, JSON and JSONL and imports
+// the JSON and JSONL exports into any HistoryRepository.
+package transfer
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"owl/data"
+)
+
+// FormatVersion is written into every JSON and JSONL export. Imports of a
+// newer version are refused. Version 1 exports hold only the active branch,
+// their turns have no ids.
+const FormatVersion = 2
+
+// Export formats.
+const (
+	FormatMarkdown = "md"
+	FormatJSON     = "json"
+	FormatJSONL    = "jsonl"
+)
+
+// Export is a context with the turns of all its branches, oldest first.
+type Export struct {
+	Version int     `json:"owl_export"`
+	Context Context `json:"context"`
+	Turns   []Turn  `json:"turns"`
+}
+
+// Context holds the settings of an exported context.
+type Context struct {
+	Name            string   `json:"name"`
+	SystemPrompt    string   `json:"system_prompt,omitempty"`
+	PreferredModel  string   `json:"preferred_model,omitempty"`
+	PreferredAgent  string   `json:"preferred_agent,omitempty"`
+	PreferredSkills string   `json:"preferred_skills,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Folder          string   `json:"folder,omitempty"`
+	Archived        bool     `json:"archived,omitempty"`
+	// ActiveTurn is the id of the last turn of the branch that is continued
+	ActiveTurn int64 `json:"active_turn,omitempty"`
+	// Generation is nil when the context uses the model defaults
+	Generation *data.GenerationSettings `json:"generation,omitempty"`
+}
+
+// Turn is one exported history row. Id and ParentId are the ids of the
+// exporting repository, they only link the turns of the export.
+type Turn struct {
+	Id              int64     `json:"id,omitempty"`
+	ParentId        int64     `json:"parent_id,omitempty"`
+	Prompt          string    `json:"prompt"`
+	Response        string    `json:"response"`
+	ResponseContent string    `json:"response_content,omitempty"`
+	ToolResults     string    `json:"tool_results,omitempty"`
+	Model           string    `json:"model,omitempty"`
+	Agent           string    `json:"agent,omitempty"`
+	Created         string    `json:"created,omitempty"`
+	Usage           Usage     `json:"usage"`
+	ToolUses        []ToolUse `json:"tool_uses,omitempty"`
+	Archived        bool      `json:"archived,omitempty"`
+	Interrupted     bool      `json:"interrupted,omitempty"`
+	// Thinking keeps the signatures, so an imported turn can be sent back
+	// to Claude
+	Thinking []data.Thinking `json:"thinking,omitempty"`
+	// Attachments are references, their content stays in the attachment
+	// store of the exporting machine
+	Attachments []data.Attachment `json:"attachments,omitempty"`
+}
+
+// Usage is the token usage of a turn.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	CacheReadTokens  int `json:"cache_read_tokens"`
+	CacheWriteTokens int `json:"cache_write_tokens"`
+}
+
+// ToolUse is a tool call of a turn with its result.
+type ToolUse struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Input      string     `json:"input"`
+	CallerType string     `json:"caller_type,omitempty"`
+	Result     ToolResult `json:"result"`
+}
+
+type ToolResult struct {
+	Content string `json:"content"`
+	Success bool   `json:"success"`
+}
+
+// Load reads the named context and the turns of all its branches from the
+// repository. The context is looked up among all contexts, as
+// GetContextByName would unarchive it.
+func Load(repository data.HistoryRepository, name string) (Export, error) {
+	contexts, err := repository.GetAllContexts()
+	if err != nil {
+		return Export{}, err
+	}
+	idx := slices.IndexFunc(contexts, func(context data.Context) bool { return context.Name == name })
+	if idx < 0 {
+		return Export{}, fmt.Errorf("no context named %s", name)
+	}
+	context := contexts[idx]
+
+	histories, err := repository.GetContextHistory(context.Id)
+	if err != nil {
+		return Export{}, err
+	}
+
+	export := Export{
+		Version: FormatVersion,
+		Context: Context{
+			Name:            context.Name,
+			SystemPrompt:    context.SystemPrompt,
+			PreferredModel:  context.PreferredModel,
+			PreferredAgent:  context.PreferredAgent,
+			PreferredSkills: context.PreferredSkills,
+			Tags:            context.Tags,
+			Folder:          context.Folder,
+			Archived:        context.Archived,
+			ActiveTurn:      context.ActiveLeafId,
+		},
+		Turns: make([]Turn, 0, len(histories)),
+	}
+	if !context.Generation.IsZero() {
+		generation := context.Generation
+		export.Context.Generation = &generation
+	}
+	for _, history := range histories {
+		export.Turns = append(export.Turns, turnOf(history))
+	}
+	return export, nil
+}
+
+func turnOf(history data.History) Turn {
+	turn := Turn{
+		Id:              history.Id,
+		ParentId:        history.ParentId,
+		Prompt:          history.Prompt,
+		Response:        history.Response,
+		ResponseContent: history.ResponseContent,
+		ToolResults:     history.ToolResults,
+		Model:           history.Model,
+		Agent:           history.Agent,
+		Usage: Usage{
+			PromptTokens:     history.PromptTokens,
+			CompletionTokens: history.CompletionTokens,
+			CacheReadTokens:  history.CacheReadTokens,
+			CacheWriteTokens: history.CacheWriteTokens,
+		},
+		Archived:    history.Archived,
+		Interrupted: history.Interrupted,
+		Thinking:    history.Thinking,
+		Attachments: history.Attachments,
+	}
+	if created := data.ParseCreated(history.Created); !created.IsZero() {
+		turn.Created = created.UTC().Format(time.RFC3339Nano)
+	}
+	for _, toolUse := range history.ToolUse {
+		turn.ToolUses = append(turn.ToolUses, ToolUse{
+			Id:         toolUse.Id,
+			Name:       toolUse.Name,
+			Input:      toolUse.Input,
+			CallerType: toolUse.CallerType,
+			Result: ToolResult{
+				Content: toolUse.Result.Content,
+				Success: toolUse.Result.Success,
+			},
+		})
+	}
+	return turn
+}
+
+func (turn Turn) history() data.History {
+	history := data.History{
+		Id:               turn.Id,
+		ParentId:         turn.ParentId,
+		Prompt:           turn.Prompt,
+		Response:         turn.Response,
+		ResponseContent:  turn.ResponseContent,
+		ToolResults:      turn.ToolResults,
+		Model:            turn.Model,
+		Agent:            turn.Agent,
+		Created:          turn.Created,
+		PromptTokens:     turn.Usage.PromptTokens,
+		CompletionTokens: turn.Usage.CompletionTokens,
+		CacheReadTokens:  turn.Usage.CacheReadTokens,
+		CacheWriteTokens: turn.Usage.CacheWriteTokens,
+		Archived:         turn.Archived,
+		Interrupted:      turn.Interrupted,
+		Thinking:         turn.Thinking,
+		Attachments:      turn.Attachments,
+	}
+	for _, toolUse := range turn.ToolUses {
+		history.ToolUse = append(history.ToolUse, data.ToolUse{
+			Id:         toolUse.Id,
+			Name:       toolUse.Name,
+			Input:      toolUse.Input,
+			CallerType: toolUse.CallerType,
+			Result: data.ToolResult{
+				ToolUseId: toolUse.Id,
+				Content:   toolUse.Result.Content,
+				Success:   toolUse.Result.Success,
+			},
+		})
+	}
+	return history
+}
+
+// ActiveBranch returns the turns from the first one to ActiveTurn, or to the
+// last turn when the export does not name one. Turns without ids, as in
+// version 1 exports, are one branch.
+func (export Export) ActiveBranch() []Turn {
+	if len(export.Turns) == 0 || export.Turns[0].Id == 0 {
+		return export.Turns
+	}
+
+	byId := make(map[int64]int, len(export.Turns))
+	for i, turn := range export.Turns {
+		byId[turn.Id] = i
+	}
+	idx, ok := byId[export.Context.ActiveTurn]
+	if !ok {
+		idx = len(export.Turns) - 1
+	}
+
+	branch := []Turn{}
+	for seen := 0; seen < len(export.Turns); seen++ {
+		branch = append(branch, export.Turns[idx])
+		parent, ok := byId[export.Turns[idx].ParentId]
+		if !ok {
+			break
+		}
+		idx = parent
+	}
+	slices.Reverse(branch)
+	return branch
+}
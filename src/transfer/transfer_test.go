@@ -0,0 +1,267 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"owl/data"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// memoryRepository keeps contexts and history rows in memory, rows without
+// a parent continue the active branch like in the repositories.
+type memoryRepository struct {
+	data.HistoryRepository
+	contexts  []data.Context
+	trashed   []data.Context
+	histories []data.History
+}
+
+func (r *memoryRepository) InsertContext(context data.Context) (int64, error) {
+	context.Id = int64(len(r.contexts) + 1)
+	r.contexts = append(r.contexts, context)
+	return context.Id, nil
+}
+
+func (r *memoryRepository) GetAllContexts() ([]data.Context, error) {
+	return append([]data.Context{}, r.contexts...), nil
+}
+
+func (r *memoryRepository) GetDeletedContexts() ([]data.Context, error) {
+	return append([]data.Context{}, r.trashed...), nil
+}
+
+func (r *memoryRepository) ArchiveContext(contextId int64, archived bool) error {
+	r.contexts[contextId-1].Archived = archived
+	return nil
+}
+
+func (r *memoryRepository) UpdateActiveLeaf(contextId int64, historyId int64) error {
+	r.contexts[contextId-1].ActiveLeafId = historyId
+	return nil
+}
+
+func (r *memoryRepository) InsertHistory(history data.History) (int64, error) {
+	history.Id = int64(len(r.histories) + 1)
+	if history.ParentId == 0 {
+		history.ParentId = r.contexts[history.ContextId-1].ActiveLeafId
+	}
+	r.histories = append(r.histories, history)
+	r.contexts[history.ContextId-1].ActiveLeafId = history.Id
+	return history.Id, nil
+}
+
+func (r *memoryRepository) ArchiveHistory(historyId int64, archived bool) error {
+	r.histories[historyId-1].Archived = archived
+	return nil
+}
+
+func (r *memoryRepository) GetContextHistory(contextId int64) ([]data.History, error) {
+	histories := []data.History{}
+	for _, history := range r.histories {
+		if history.ContextId == contextId {
+			histories = append(histories, history)
+		}
+	}
+	return histories, nil
+}
+
+// ImportContext maps the ids of the rows like the repositories.
+func (r *memoryRepository) ImportContext(context data.Context, histories []data.History) (int64, error) {
+	contextId, _ := r.InsertContext(context)
+	newIds := map[int64]int64{}
+	for _, history := range histories {
+		oldId := history.Id
+		history.ContextId = contextId
+		parentId := newIds[history.ParentId]
+		if oldId != 0 && history.ParentId == 0 {
+			// A new root, not a continuation of the active branch
+			r.contexts[contextId-1].ActiveLeafId = 0
+		}
+		history.ParentId = parentId
+		newIds[oldId], _ = r.InsertHistory(history)
+	}
+	if leafId, ok := newIds[context.ActiveLeafId]; ok {
+		r.contexts[contextId-1].ActiveLeafId = leafId
+	}
+	return contextId, nil
+}
+
+func reviewRepository(t *testing.T) *memoryRepository {
+	t.Helper()
+	repository := &memoryRepository{}
+	contextId, _ := repository.InsertContext(data.Context{
+		Name:            "review",
+		SystemPrompt:    "You review Go code.",
+		PreferredModel:  "opus",
+		PreferredAgent:  "developer",
+		PreferredSkills: "go,review",
+		Tags:            []string{"go", "review"},
+		Folder:          "work/owl",
+		Generation:      data.GenerationSettings{MaxTokens: 4000, StopSequences: []string{"END"}},
+	})
+	repository.InsertHistory(data.History{
+		ContextId:        contextId,
+		Prompt:           "Is this safe?",
+		Response:         "Mostly, see ```go\nx := 1\n```",
+		Thinking:         []data.Thinking{{Text: "check the bounds", Signature: "sig-1"}},
+		Attachments:      []data.Attachment{{Name: "main.go", Source: "/src/main.go", MediaType: "text/plain", Hash: "ab12", Size: 12}},
+		Model:            "opus",
+		Agent:            "developer",
+		Created:          "2024-03-01T12:30:00Z",
+		PromptTokens:     120,
+		CompletionTokens: 80,
+		CacheReadTokens:  10,
+		CacheWriteTokens: 5,
+		ToolUse: []data.ToolUse{{
+			Id:         "toolu_1",
+			Name:       "read_file",
+			Input:      `{"Path":"main.go"}`,
+			CallerType: "assistant",
+			Result:     data.ToolResult{ToolUseId: "toolu_1", Content: "package main", Success: true},
+		}},
+	})
+	historyId, _ := repository.InsertHistory(data.History{ContextId: contextId, Prompt: "Thanks", Response: "You're welcome", Created: "2024-03-01T12:31:00Z", Interrupted: true})
+	repository.ArchiveHistory(historyId, true)
+	// An edit of the second prompt on its own branch, the first stays active
+	repository.InsertHistory(data.History{ContextId: contextId, ParentId: 1, Prompt: "Thank you!", Response: "Glad to help", Created: "2024-03-01T12:32:00Z"})
+	repository.UpdateActiveLeaf(contextId, historyId)
+	repository.ArchiveContext(contextId, true)
+	return repository
+}
+
+func TestExportsRoundTripThroughJSONAndJSONL(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatJSONL} {
+		t.Run(format, func(t *testing.T) {
+			export, err := Load(reviewRepository(t), "review")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err := Write(&out, export, format); err != nil {
+				t.Fatal(err)
+			}
+			if format == FormatJSONL && strings.Count(out.String(), "\n") != 4 {
+				t.Fatalf("expected a context line and three turn lines, got:\n%s", out.String())
+			}
+
+			read, err := Read(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := &memoryRepository{}
+			context, err := Save(target, read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if context.Name != "review" || !context.Archived {
+				t.Fatalf("unexpected imported context %+v", context)
+			}
+
+			imported, err := Load(target, "review")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(imported, export) {
+				t.Fatalf("expected the import to match the export\n got: %+v\nwant: %+v", imported, export)
+			}
+			if imported.Turns[2].ParentId != imported.Turns[0].Id || imported.Context.ActiveTurn != imported.Turns[1].Id {
+				t.Fatalf("expected the edit to stay on its own branch, got %+v", imported)
+			}
+		})
+	}
+}
+
+func TestSaveStoresVersion1ExportsAsOneBranch(t *testing.T) {
+	export, err := Read(strings.NewReader(`{"type":"context","owl_export":1,"context":{"name":"old"}}
+{"type":"turn","prompt":"one","response":"1"}
+{"type":"turn","prompt":"two","response":"2"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repository := &memoryRepository{}
+	context, err := Save(repository, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	histories, _ := repository.GetContextHistory(context.Id)
+	if len(histories) != 2 || histories[1].ParentId != histories[0].Id || repository.contexts[0].ActiveLeafId != histories[1].Id {
+		t.Fatalf("expected the turns to follow each other, got %+v", histories)
+	}
+}
+
+func TestSaveNumbersTakenContextNames(t *testing.T) {
+	repository := reviewRepository(t)
+	export, _ := Load(repository, "review")
+
+	for _, want := range []string{"review (2)", "review (3)"} {
+		context, err := Save(repository, export)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if context.Name != want {
+			t.Fatalf("expected %q, got %q", want, context.Name)
+		}
+	}
+}
+
+func TestSaveSkipsNamesOfTrashedContexts(t *testing.T) {
+	repository := reviewRepository(t)
+	export, _ := Load(repository, "review")
+	repository.trashed = []data.Context{{Id: 99, Name: "review (2)"}}
+
+	context, err := Save(repository, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Name != "review (3)" {
+		t.Fatalf("expected the name of the trashed context to be skipped, got %q", context.Name)
+	}
+}
+
+func TestMarkdownKeepsSettingsToolsAndUsage(t *testing.T) {
+	export, _ := Load(reviewRepository(t), "review")
+	markdown := Markdown(export)
+
+	for _, want := range []string{
+		"# review",
+		"- Model: `opus`",
+		"- Generation: `max_tokens=4000 stop=\"END\"`",
+		"You review Go code.",
+		"<summary>Tool read_file (ok)</summary>",
+		"_Tokens: 120 in, 80 out, 10 cache read, 5 cache write_",
+		"## A · opus · developer\n",
+		"## A · interrupted\n",
+		"_Attached: main.go_",
+		"_1 turn on another branch is not shown_",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Fatalf("expected the markdown to contain %q, got:\n%s", want, markdown)
+		}
+	}
+	if strings.Contains(markdown, "Thank you!") {
+		t.Fatalf("expected only the active branch, got:\n%s", markdown)
+	}
+
+	if _, err := Read(strings.NewReader(markdown)); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("expected markdown to be refused, got %v", err)
+	}
+}
+
+func TestFencedOutgrowsBackticksInTheContent(t *testing.T) {
+	got := fenced("text", "see ```go\nx\n```")
+	if !strings.HasPrefix(got, "````text\n") || !strings.HasSuffix(got, "\n````\n") {
+		t.Fatalf("unexpected fence %q", got)
+	}
+}
+
+func TestReadRefusesNewerVersions(t *testing.T) {
+	_, err := Read(strings.NewReader(`{"owl_export": 99, "context": {"name": "x"}}`))
+	if err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+}
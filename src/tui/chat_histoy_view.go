@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"owl/data"
 	"owl/services"
+	"slices"
 	"strings"
 
 	"github.com/atotto/clipboard"
@@ -23,6 +24,7 @@ const (
 type chatHistoryViewModel struct {
 	shared       *sharedState
 	history      []data.History
+	tree         data.HistoryTree
 	viewport     viewport.Model
 	cursor       int
 	mode         historyViewMode
@@ -33,10 +35,20 @@ type chatHistoryViewModel struct {
 	height       int
 	err          error
 	showArchived bool
+	// focusHistoryId puts the cursor on that message once the history has
+	// loaded, zero leaves the cursor where it is.
+	focusHistoryId int64
 }
 
 type historyArchivedMsg struct{}
 
+// historyTreeLoadedMsg carries the active branch and the tree it is part of,
+// so the view can show and switch between sibling branches.
+type historyTreeLoadedMsg struct {
+	history []data.History
+	tree    data.HistoryTree
+}
+
 func newChatHistoryViewModel(shared *sharedState) *chatHistoryViewModel {
 	vp := viewport.New(shared.width, shared.height-5)
 	vp.YPosition = 0
@@ -68,8 +80,43 @@ func (m *chatHistoryViewModel) loadHistory() tea.Cmd {
 		if err != nil {
 			return errorMsg{err}
 		}
-		return historyLoadedMsg(history)
+
+		tree, err := m.shared.config.Repository.GetHistoryTree(m.shared.selectedCtx.Id)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return historyTreeLoadedMsg{history: history, tree: tree}
+	}
+}
+
+// switchBranch activates the newest branch under the sibling step positions
+// away from the selected message.
+func (m *chatHistoryViewModel) switchBranch(h data.History, step int) tea.Cmd {
+	siblings := m.tree.Siblings(h.Id)
+	idx := slices.Index(siblings, h.Id)
+	next := idx + step
+	if idx < 0 || next < 0 || next >= len(siblings) {
+		return nil
+	}
+
+	leaf := m.tree.LatestLeaf(siblings[next])
+	return func() tea.Msg {
+		err := m.shared.config.Repository.UpdateActiveLeaf(m.shared.selectedCtx.Id, leaf)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return m.loadHistory()()
+	}
+}
+
+// branchLabel shows the position of a message among its siblings, empty when
+// nothing branches off at it.
+func (m *chatHistoryViewModel) branchLabel(h data.History) string {
+	siblings := m.tree.Siblings(h.Id)
+	if len(siblings) < 2 {
+		return ""
 	}
+	return fmt.Sprintf("‹%d/%d›", slices.Index(siblings, h.Id)+1, len(siblings))
 }
 
 func (m *chatHistoryViewModel) toggleArchive(historyId int64, currentStatus bool) tea.Cmd {
@@ -187,6 +234,14 @@ func (m *chatHistoryViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					h := visibleHistory[m.expandedIdx]
 					return m, m.toggleArchive(h.Id, h.Archived)
 				}
+			case "[", "]":
+				if m.expandedIdx >= 0 && m.expandedIdx < len(visibleHistory) {
+					step := 1
+					if msg.String() == "[" {
+						step = -1
+					}
+					return m, m.switchBranch(visibleHistory[m.expandedIdx], step)
+				}
 			}
 			// Allow scrolling in expanded view
 			m.viewport, vpCmd = m.viewport.Update(msg)
@@ -271,6 +326,32 @@ func (m *chatHistoryViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, m.toggleArchive(h.Id, h.Archived)
 			}
 
+		case "E":
+			// Edit the prompt and send it again as a new branch
+			if m.cursor < len(visibleHistory) && strings.TrimSpace(visibleHistory[m.cursor].Prompt) != "" {
+				chatView := newChatViewModel(m.shared)
+				chatView.startEdit(visibleHistory[m.cursor])
+				return chatView, tea.Sequence(
+					chatView.Init(),
+					func() tea.Msg {
+						return tea.WindowSizeMsg{
+							Width:  m.shared.width,
+							Height: m.shared.height,
+						}
+					},
+				)
+			}
+
+		case "[", "]":
+			// Switch to the previous or next sibling branch
+			if m.cursor < len(visibleHistory) {
+				step := 1
+				if msg.String() == "[" {
+					step = -1
+				}
+				return m, m.switchBranch(visibleHistory[m.cursor], step)
+			}
+
 		case "H":
 			// Toggle visibility of archived items
 			m.showArchived = !m.showArchived
@@ -286,9 +367,19 @@ func (m *chatHistoryViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, m.loadHistory()
 		}
 
-	case historyLoadedMsg:
-		m.history = []data.History(msg)
+	case historyTreeLoadedMsg:
+		m.history = msg.history
+		m.tree = msg.tree
 		m.loading = false
+		if m.focusHistoryId != 0 {
+			if idx := slices.IndexFunc(m.getVisibleHistory(), func(h data.History) bool { return h.Id == m.focusHistoryId }); idx >= 0 {
+				m.cursor = idx
+			}
+			m.focusHistoryId = 0
+		}
+		if m.cursor >= len(m.getVisibleHistory()) {
+			m.cursor = max(0, len(m.getVisibleHistory())-1)
+		}
 		m.updateContent()
 		m.scrollToSelection()
 
@@ -384,11 +475,17 @@ func (m *chatHistoryViewModel) renderCompactMode(visible []data.History) string
 			response = response[:m.width-23] + "..."
 		}
 
-		// Format: cursor [archived] [#] prompt | response [code]
-		line := fmt.Sprintf("%s%s[%d]%s%s %s",
+		branch := m.branchLabel(h)
+		if branch != "" {
+			branch = " " + dimStyle.Render(branch)
+		}
+
+		// Format: cursor [archived] [#] ‹branch› prompt | response [code]
+		line := fmt.Sprintf("%s%s[%d]%s%s%s %s",
 			cursor,
 			archivedPrefix,
 			i+1,
+			branch,
 			codeIndicator,
 			toolSummary,
 			dimStyle.Render("Q:"))
@@ -455,7 +552,12 @@ func (m *chatHistoryViewModel) renderExpandedMode(visible []data.History) string
 	if h.Archived {
 		archivedStatus = errorStyle.Render(" [ARCHIVED]")
 	}
+	branchStatus := ""
+	if branch := m.branchLabel(h); branch != "" {
+		branchStatus = dimStyle.Render(" branch " + branch)
+	}
 	b.WriteString(headerStyle.Render(fmt.Sprintf("Message %d of %d%s", m.expandedIdx+1, len(visible), archivedStatus)))
+	b.WriteString(branchStatus)
 	b.WriteString("\n\n")
 
 	// Check if has code
@@ -526,9 +628,9 @@ func (m *chatHistoryViewModel) View() string {
 	var help string
 	switch m.mode {
 	case historyCompactMode:
-		help = "↑/↓/j/k navigate • enter/e expand • a archive • H toggle archived • c code • y copy • g top • G bottom • r refresh • esc/q back"
+		help = "↑/↓/j/k navigate • enter/e expand • E edit as new branch • [/] switch branch • a archive • H toggle archived • c code • y copy • g top • G bottom • r refresh • esc/q back"
 	case historyExpandedMode:
-		help = "a archive • c view code • y copy • esc/q back"
+		help = "a archive • [/] switch branch • c view code • y copy • esc/q back"
 	case historyCodeViewMode:
 		help = "y copy code • esc/q back"
 	}
@@ -1,6 +1,7 @@
 package tui
 
 import (
+	"context"
 	"fmt"
 	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbles/textarea"
@@ -18,11 +19,13 @@ import (
 	"owl/logger"
 	"owl/openai_auth"
 	picker "owl/picker"
+	"owl/registry"
 	"owl/services"
 	"owl/tools"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -73,10 +76,12 @@ type chatViewModel struct {
 	currentPrompt   string
 	responseChan    chan string
 	doneChan        chan struct{}
+	cancelQuery     context.CancelFunc
 	mode            chatMode
 
 	// Model selection
 	availableModels  []string
+	modelSpecs       []registry.ModelSpec
 	selectedModelIdx int
 	modelCursor      int
 	availableAgents  []agents.Definition
@@ -84,15 +89,23 @@ type chatViewModel struct {
 
 	historyCount     int
 	statusMessage    string
+	statusIsError    bool
 	statusVersion    int
 	showUsagePanel   bool
 	usagePanelPinned bool
+	showThinking     bool
 	contextUsage     commontypes.TokenUsage
 	lastUsage        *commontypes.TokenUsage
+	contextCost      usageCost
+	lastCost         usageCost
+	budgetLines      []string
 	questionPrompt   *questionPromptState
 	fileDisplay      *fileDisplayState
 	selectedPDF      string
 	selectedSkills   []string
+	// editing is the earlier message whose prompt is being rewritten. The
+	// next send continues from its parent, which starts a new branch.
+	editing *data.History
 }
 
 const (
@@ -120,6 +133,7 @@ type chatChunkMsg struct {
 	text         string
 	responseChan chan string
 	doneChan     chan struct{}
+	errChan      chan error
 	prompt       string
 }
 
@@ -156,18 +170,9 @@ func newChatViewModel(shared *sharedState) *chatViewModel {
 	vp := viewport.New(shared.width, shared.height-10)
 	vp.YPosition = 0
 
-	availableModels := []string{
-		"sonnet",
-		"codex",
-		"codex-chat",
-		"grok",
-		"opus",
-		"gpt",
-		"gpt-chat",
-		"haiku",
-		"ollama",
-		"claude",
-	}
+	modelSpecs := picker.LoadRegistry()
+	availableModels := registry.Aliases(modelSpecs)
+	availableModels = append(availableModels, fallbackChainNames()...)
 
 	availableAgents := agents.List()
 	selectedAgentIdx := 0
@@ -212,6 +217,7 @@ func newChatViewModel(shared *sharedState) *chatViewModel {
 		width:            shared.width,
 		height:           shared.height,
 		availableModels:  availableModels,
+		modelSpecs:       modelSpecs,
 		selectedModelIdx: selectedModelIdx,
 		availableAgents:  availableAgents,
 		selectedAgentIdx: selectedAgentIdx,
@@ -298,6 +304,14 @@ func (m *chatViewModel) listenForFileDisplayPrompts() tea.Cmd {
 	}
 }
 
+// stopQuery releases the cancel func of the query that just ended.
+func (m *chatViewModel) stopQuery() {
+	if m.cancelQuery != nil {
+		m.cancelQuery()
+		m.cancelQuery = nil
+	}
+}
+
 func (m *chatViewModel) loadHistory() tea.Cmd {
 	return func() tea.Msg {
 		history, err := m.shared.config.Repository.GetHistoryByContextId(
@@ -313,16 +327,57 @@ func (m *chatViewModel) loadHistory() tea.Cmd {
 	}
 }
 
-func (m *chatViewModel) sendMessage(prompt string) tea.Cmd {
+// startEdit puts the prompt of an earlier message in the input. Until it is
+// sent or cancelled only the messages before it are shown.
+func (m *chatViewModel) startEdit(h data.History) {
+	m.editing = &h
+	m.mode = chatInputMode
+	m.textarea.SetValue(h.Prompt)
+	m.textarea.Focus()
+}
+
+// cancelEdit drops a pending edit, false when there was none.
+func (m *chatViewModel) cancelEdit() bool {
+	if m.editing == nil {
+		return false
+	}
+	m.editing = nil
+	m.textarea.Reset()
+	m.updateViewportContent()
+	return true
+}
+
+// shownHistory is the active branch, cut off at the message being edited.
+func (m *chatViewModel) shownHistory() []data.History {
+	if m.editing == nil {
+		return m.history
+	}
+	for i, h := range m.history {
+		if h.Id == m.editing.Id {
+			return m.history[:i]
+		}
+	}
+	return m.history
+}
+
+func (m *chatViewModel) sendMessage(ctx context.Context, prompt string) tea.Cmd {
+	var branchFrom *data.History
+	if m.editing != nil {
+		edited := *m.editing
+		branchFrom = &edited
+	}
+
 	return func() tea.Msg {
 		responseChan := make(chan string, 100)
 		doneChan := make(chan struct{})
+		errChan := make(chan error, 1)
 
 		handler := &tuiResponseHandler{
 			responseChan: responseChan,
 			doneChan:     doneChan,
 			fullResponse: "",
 			Repository:   m.shared.config.Repository,
+			Agent:        m.currentAgent().Name,
 		}
 
 		modelName := m.availableModels[m.selectedModelIdx]
@@ -343,6 +398,15 @@ func (m *chatViewModel) sendMessage(prompt string) tea.Cmd {
 		logger.Debug.Printf("MODEL SELECTION: %s (actual: %s)", modelName, actualModelName)
 
 		go func() {
+			if branchFrom != nil {
+				err := m.shared.config.Repository.UpdateActiveLeaf(m.shared.selectedCtx.Id, branchFrom.ParentId)
+				if err != nil {
+					errChan <- err
+					handler.finish()
+					return
+				}
+			}
+
 			selectedAgent := m.currentAgent()
 			contextForRequest := *m.shared.selectedCtx
 			skillsPrompt := loadSkillsPromptByNames(m.selectedSkills)
@@ -351,7 +415,8 @@ func (m *chatViewModel) sendMessage(prompt string) tea.Cmd {
 				contextForRequest.SystemPrompt = composePromptSections(contextForRequest.SystemPrompt, skillsPrompt)
 			}
 
-			services.StreamedQuery(
+			err := services.StreamedQuery(
+				ctx,
 				prompt,
 				model,
 				m.shared.config.Repository,
@@ -365,14 +430,18 @@ func (m *chatViewModel) sendMessage(prompt string) tea.Cmd {
 				},
 				actualModelName,
 			)
+			if err != nil {
+				errChan <- err
+			}
+			handler.finish()
 		}()
 
-		waitCmd := waitForChatActivity(responseChan, doneChan, prompt)
+		waitCmd := waitForChatActivity(responseChan, doneChan, errChan, prompt)
 		return waitCmd()
 	}
 }
 
-func waitForChatActivity(responseChan chan string, doneChan chan struct{},
+func waitForChatActivity(responseChan chan string, doneChan chan struct{}, errChan chan error,
 	prompt string) tea.Cmd {
 
 	logger.Debug.Println("waitForChatActivity started")
@@ -382,21 +451,33 @@ func waitForChatActivity(responseChan chan string, doneChan chan struct{},
 		case text, ok := <-responseChan:
 			// logger.Debug.Printf("responseChan: %v: %s", ok, text)
 			if !ok {
-				return chatCompleteMsg{prompt: prompt}
+				return chatResult(errChan, prompt)
 			}
 			return chatChunkMsg{
 				text:         text,
 				responseChan: responseChan,
 				doneChan:     doneChan,
+				errChan:      errChan,
 				prompt:       prompt,
 			}
 		case <-doneChan:
 			logger.Debug.Printf("doneChan from waitForChatActivity")
-			return chatCompleteMsg{prompt: prompt}
+			return chatResult(errChan, prompt)
 		}
 	}
 }
 
+// chatResult is sent once the query has closed its channels. The error is
+// written before the channels close, so it is always visible here.
+func chatResult(errChan chan error, prompt string) tea.Msg {
+	select {
+	case err := <-errChan:
+		return chatErrorMsg{err: err}
+	default:
+		return chatCompleteMsg{prompt: prompt}
+	}
+}
+
 func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var (
 		tiCmd tea.Cmd
@@ -418,6 +499,7 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 		m.statusMessage = cleaned
+		m.statusIsError = false
 		m.statusVersion++
 		currentVersion := m.statusVersion
 		logger.Debug.Printf("Received status: %s", cleaned)
@@ -430,6 +512,7 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case clearStatusMsg:
 		if msg.version == m.statusVersion {
 			m.statusMessage = ""
+			m.statusIsError = false
 		}
 		return m, nil
 
@@ -446,21 +529,27 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case chatChunkMsg:
 		m.currentResponse += msg.text
 		m.updateViewportContent()
-		return m, waitForChatActivity(msg.responseChan, msg.doneChan, msg.prompt)
+		return m, waitForChatActivity(msg.responseChan, msg.doneChan, msg.errChan, msg.prompt)
 
 	case chatCompleteMsg:
 		logger.Debug.Println("got chatCompleteMsg")
+		m.stopQuery()
+		m.editing = nil
 		m.sending = false
 		m.loading = false
 		m.statusMessage = ""
 		return m, m.loadHistory()
 
 	case chatErrorMsg:
-		m.err = msg.err
+		m.stopQuery()
+		m.editing = nil
 		m.loading = false
 		m.sending = false
-		m.statusMessage = ""
-		return m, nil
+		m.currentResponse = ""
+		m.statusMessage = services.DescribeError(msg.err)
+		m.statusIsError = true
+		m.statusVersion++
+		return m, tea.Batch(m.loadHistory(), m.clearStatusAfterDelay(m.statusVersion))
 
 	case authCommandResultMsg:
 		m.sending = false
@@ -493,6 +582,10 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 		if m.sending {
+			if msg.String() == "esc" && m.cancelQuery != nil {
+				m.cancelQuery()
+				m.statusMessage = "Cancelling..."
+			}
 			return m, nil
 		}
 
@@ -504,6 +597,9 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 
 			case "esc", "q":
+				if m.cancelEdit() {
+					return m, nil
+				}
 				listView := newListViewModel(m.shared.config)
 				return listView, tea.Sequence(
 					listView.Init(),
@@ -590,6 +686,11 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.applyLayout()
 				m.updateViewportContent()
 				return m, nil
+
+			case "t":
+				m.showThinking = !m.showThinking
+				m.updateViewportContent()
+				return m, nil
 			}
 
 			if shouldUpdateViewport {
@@ -622,6 +723,11 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					model := m.availableModels[m.selectedModelIdx]
 					_ = m.shared.config.Repository.UpdatePreferredModel(m.shared.selectedCtx.Id, model)
 					m.shared.selectedCtx.PreferredModel = model
+					if err := picker.CheckModelSwitch(model, m.shared.selectedCtx.Generation, true); err != nil {
+						m.statusMessage = fmt.Sprintf("%s, change it with /settings", err)
+						m.statusVersion++
+						return m, m.clearStatusAfterDelay(m.statusVersion)
+					}
 				}
 				return m, nil
 			}
@@ -660,6 +766,9 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, tea.Quit
 
 		case "esc":
+			if m.cancelEdit() {
+				return m, nil
+			}
 			listView := newListViewModel(m.shared.config)
 			return listView, tea.Sequence(
 				listView.Init(),
@@ -700,7 +809,9 @@ func (m *chatViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.currentPrompt = prompt
 				m.currentResponse = ""
 				m.textarea.Reset()
-				return m, m.sendMessage(prompt)
+				ctx, cancel := context.WithCancel(context.Background())
+				m.cancelQuery = cancel
+				return m, m.sendMessage(ctx, prompt)
 			}
 
 		case "ctrl+u":
@@ -795,6 +906,10 @@ func (m *chatViewModel) handleSlashCommand(raw string) tea.Cmd {
 		return m.handleSkillsSlashCommand(parts)
 	}
 
+	if parts[0] == "/settings" {
+		return m.handleSettingsSlashCommand(parts)
+	}
+
 	if parts[0] != "/auth" {
 		return func() tea.Msg {
 			return authCommandResultMsg{err: fmt.Errorf("unsupported command: %s", parts[0])}
@@ -921,6 +1036,39 @@ func (m *chatViewModel) handleSkillsSlashCommand(parts []string) tea.Cmd {
 	}
 }
 
+func (m *chatViewModel) handleSettingsSlashCommand(parts []string) tea.Cmd {
+	usage := fmt.Errorf("usage: /settings <show|set|reset> [%s] [value|default]", strings.Join(data.GenerationSettingNames, "|"))
+	if len(parts) < 2 || m.shared.selectedCtx == nil {
+		return func() tea.Msg { return authCommandResultMsg{err: usage} }
+	}
+	settings := m.shared.selectedCtx.Generation
+
+	switch strings.ToLower(parts[1]) {
+	case "show":
+		return func() tea.Msg { return authCommandResultMsg{text: fmt.Sprintf("settings: %s", settings)} }
+	case "reset":
+		settings = data.GenerationSettings{}
+	case "set":
+		if len(parts) < 4 {
+			return func() tea.Msg { return authCommandResultMsg{err: usage} }
+		}
+		if err := settings.Set(strings.ToLower(parts[2]), strings.Join(parts[3:], " ")); err != nil {
+			return func() tea.Msg { return authCommandResultMsg{err: err} }
+		}
+		if err := picker.CheckGeneration(m.availableModels[m.selectedModelIdx], settings, true); err != nil {
+			return func() tea.Msg { return authCommandResultMsg{err: err} }
+		}
+	default:
+		return func() tea.Msg { return authCommandResultMsg{err: usage} }
+	}
+
+	if err := m.shared.config.Repository.UpdateGenerationSettings(m.shared.selectedCtx.Id, settings); err != nil {
+		return func() tea.Msg { return authCommandResultMsg{err: fmt.Errorf("could not store the settings: %w", err)} }
+	}
+	m.shared.selectedCtx.Generation = settings
+	return func() tea.Msg { return authCommandResultMsg{text: fmt.Sprintf("settings: %s", settings)} }
+}
+
 func newQuestionPromptState(prompt interaction.QuestionPrompt) questionPromptState {
 	title := strings.TrimSpace(prompt.Request.Title)
 	if title == "" {
@@ -1175,10 +1323,12 @@ func (m *chatViewModel) View() string {
 
 	status := ""
 	if m.sending {
-		status = sendingStyle.Render(" Sending...")
+		status = sendingStyle.Render(" Sending... (esc to cancel)")
 	}
 
-	if m.statusMessage != "" {
+	if m.statusMessage != "" && m.statusIsError {
+		status = errorStyle.Render(fmt.Sprintf("%s %s", status, m.statusMessage))
+	} else if m.statusMessage != "" {
 		status = dimStyle.Render(fmt.Sprintf("%s %s", status, m.statusMessage))
 	}
 
@@ -1189,8 +1339,11 @@ func (m *chatViewModel) View() string {
 	case chatInputMode:
 		modeIndicator = dimStyle.Render(" [INPUT]")
 	}
+	if m.editing != nil {
+		modeIndicator += dimStyle.Render(" [EDIT: sends a new branch, esc cancels]")
+	}
 
-	currentModel := displayModelName(m.availableModels[m.selectedModelIdx])
+	currentModel := m.displayModelName(m.availableModels[m.selectedModelIdx])
 	pdfName := "none"
 	if strings.TrimSpace(m.selectedPDF) != "" {
 		pdfName = filepath.Base(m.selectedPDF)
@@ -1199,9 +1352,9 @@ func (m *chatViewModel) View() string {
 
 	helpText := ""
 	if m.mode == chatNormalMode {
-		helpText = "i: input • d/u: scroll • g/G: top/bottom • +/-: history • ctrl+g: model • ctrl+a: history • ctrl+t: usage • esc: back"
+		helpText = "i: input • d/u: scroll • g/G: top/bottom • +/-: history • t: thinking • ctrl+g: model • ctrl+a: history • ctrl+t: usage • esc: back"
 	} else {
-		helpText = "tab/shift+tab: agent • ctrl+n: normal • ctrl+w: send • /auth openai ... • /pdf set|show|clear • /skills list|set|show|clear • ctrl+g: model • ctrl+u/d: scroll • ctrl+a: history • ctrl+t: usage • esc: back"
+		helpText = "tab/shift+tab: agent • ctrl+n: normal • ctrl+w: send • /auth openai ... • /pdf set|show|clear • /skills list|set|show|clear • /settings show|set|reset • ctrl+g: model • ctrl+u/d: scroll • ctrl+a: history • ctrl+t: usage • esc: back"
 	}
 
 	agent := m.currentAgent()
@@ -1395,10 +1548,11 @@ func (m *chatViewModel) updateViewportContent() {
 
 	var b strings.Builder
 
-	for _, h := range m.history {
+	for _, h := range m.shownHistory() {
 		pStyle := userPromptStyle
 		rStyle := aiResponseStyle
 		archivedPrefix := ""
+		interruptedSuffix := ""
 		hasPrompt := strings.TrimSpace(h.Prompt) != ""
 
 		if h.Archived {
@@ -1406,14 +1560,23 @@ func (m *chatViewModel) updateViewportContent() {
 			rStyle = dimStyle
 			archivedPrefix = "[ARCHIVED] "
 		}
+		if h.Interrupted {
+			interruptedSuffix = "\n" + dimStyle.Render("(interrupted)")
+		}
 
 		if hasPrompt {
 			b.WriteString(pStyle.Render(fmt.Sprintf("%sYou: %s", archivedPrefix, h.Prompt)))
 			b.WriteString("\n\n")
 		}
 
+		if thinking := data.ThinkingText(h.Thinking); m.showThinking && thinking != "" {
+			b.WriteString(dimStyle.Width(m.viewport.Width - 4).Render("Thinking:\n" + thinking))
+			b.WriteString("\n\n")
+		}
+
 		rendered := renderMarkdown(h.Response, m.viewport.Width-4)
 		b.WriteString(rStyle.Render(rendered))
+		b.WriteString(interruptedSuffix)
 		if len(h.ToolUse) > 0 {
 			b.WriteString("\n")
 			b.WriteString(dimStyle.Render(renderToolUseSummary(h.ToolUse)))
@@ -1492,7 +1655,7 @@ func (m *chatViewModel) renderModelSelector() string {
 			style = selectedItemStyle
 		}
 
-		modelName := displayModelName(model)
+		modelName := m.displayModelName(model)
 		if i == m.selectedModelIdx {
 			modelName += " ✓"
 		}
@@ -1508,35 +1671,105 @@ func (m *chatViewModel) renderModelSelector() string {
 	return b.String()
 }
 
-func displayModelName(model string) string {
-	switch model {
-	case "gpt":
-		return "gpt (responses)"
-	case "codex":
-		return "codex (responses)"
-	case "gpt-chat":
-		return "gpt-chat (chat completions)"
-	case "codex-chat":
-		return "codex-chat (chat completions)"
+// fallbackChainNames lists the chains of the model registry so they can be
+// picked like a model.
+func fallbackChainNames() []string {
+	chains, err := picker.LoadFallbackChains()
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(chains))
+	for name := range chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// displayModelName tells the two OpenAI APIs apart in the model selector.
+func (m *chatViewModel) displayModelName(model string) string {
+	spec, ok := registry.Lookup(m.modelSpecs, model)
+	if !ok {
+		return model
+	}
+	switch {
+	case spec.Provider == registry.ProviderOpenAIResponses || picker.UsesCodexLogin(model):
+		return fmt.Sprintf("%s (responses)", model)
+	case spec.Provider == registry.ProviderOpenAIChat:
+		return fmt.Sprintf("%s (chat completions)", model)
 	default:
 		return model
 	}
 }
 
+// usageCost is the priced part of some messages and whether any of them used
+// a model without a price.
+type usageCost struct {
+	cost     float64
+	unpriced bool
+}
+
+func (c *usageCost) add(h data.History, models []registry.ModelSpec) {
+	if cost, ok := services.MessageCost(h, models); ok {
+		c.cost += cost
+	} else if historyToUsage(h) != nil {
+		c.unpriced = true
+	}
+}
+
+func (c usageCost) String() string {
+	if c.unpriced && c.cost == 0 {
+		return "Cost: — (unpriced)"
+	}
+	if c.unpriced {
+		return fmt.Sprintf("Cost: %s + unpriced", services.FormatCost(c.cost))
+	}
+	return fmt.Sprintf("Cost: %s", services.FormatCost(c.cost))
+}
+
 func (m *chatViewModel) recalculateUsage() {
 	var total commontypes.TokenUsage
 	var last *commontypes.TokenUsage
+	var totalCost usageCost
+	var lastCost usageCost
 	for _, h := range m.history {
 		total.PromptTokens += h.PromptTokens
 		total.CompletionTokens += h.CompletionTokens
 		total.CacheReadTokens += h.CacheReadTokens
 		total.CacheWriteTokens += h.CacheWriteTokens
+		totalCost.add(h, m.modelSpecs)
 	}
 	if len(m.history) > 0 {
 		last = historyToUsage(m.history[len(m.history)-1])
+		lastCost.add(m.history[len(m.history)-1], m.modelSpecs)
 	}
 	m.contextUsage = total
 	m.lastUsage = last
+	m.contextCost = totalCost
+	m.lastCost = lastCost
+	m.budgetLines = m.spendAgainstBudget()
+}
+
+// spendAgainstBudget reads today's and this month's spend, only when a budget
+// is configured since it scans every context.
+func (m *chatViewModel) spendAgainstBudget() []string {
+	budget := services.CurrentBudget()
+	if budget.Daily <= 0 && budget.Monthly <= 0 {
+		return nil
+	}
+	now := time.Now()
+	lines := []string{}
+	if budget.Daily > 0 {
+		if spent, err := services.Spend(m.shared.config.Repository, services.StartOfDay(now)); err == nil {
+			lines = append(lines, fmt.Sprintf("Today: %s / %s", services.FormatCost(spent), services.FormatCost(budget.Daily)))
+		}
+	}
+	if budget.Monthly > 0 {
+		if spent, err := services.Spend(m.shared.config.Repository, services.StartOfMonth(now)); err == nil {
+			lines = append(lines, fmt.Sprintf("Month: %s / %s", services.FormatCost(spent), services.FormatCost(budget.Monthly)))
+		}
+	}
+	return lines
 }
 
 func historyToUsage(h data.History) *commontypes.TokenUsage {
@@ -1569,17 +1802,26 @@ func (m *chatViewModel) renderUsagePanel() string {
 	b.WriteString("\n\n")
 	b.WriteString(usageMetricLabelStyle.Render("Context Total"))
 	b.WriteString("\n")
-	for _, line := range usageLines(&m.contextUsage) {
+	for _, line := range append(usageLines(&m.contextUsage), m.contextCost.String()) {
 		b.WriteString(usageMetricValueStyle.Render(line))
 		b.WriteString("\n")
 	}
 	b.WriteString("\n")
 	b.WriteString(usageMetricLabelStyle.Render("Last Message"))
 	b.WriteString("\n")
-	for _, line := range usageLines(m.lastUsage) {
+	for _, line := range append(usageLines(m.lastUsage), m.lastCost.String()) {
 		b.WriteString(usageMetricValueStyle.Render(line))
 		b.WriteString("\n")
 	}
+	if len(m.budgetLines) > 0 {
+		b.WriteString("\n")
+		b.WriteString(usageMetricLabelStyle.Render("Budget"))
+		b.WriteString("\n")
+		for _, line := range m.budgetLines {
+			b.WriteString(usageMetricValueStyle.Render(line))
+			b.WriteString("\n")
+		}
+	}
 	b.WriteString("\n" + usageMetricLabelStyle.Render("Toggle: ctrl+t"))
 	return strings.TrimSuffix(b.String(), "\n")
 }
@@ -1780,6 +2022,18 @@ type tuiResponseHandler struct {
 	doneChan     chan struct{}
 	fullResponse string
 	Repository   data.HistoryRepository
+	Agent        string
+	closeOnce    sync.Once
+}
+
+// finish closes the channels the chat view waits on. It is safe to call more
+// than once, a cancelled or failed query never reaches FinalText.
+func (h *tuiResponseHandler) finish() {
+	h.closeOnce.Do(func() {
+		logger.Debug.Println("closing doneChan and responseChan")
+		close(h.doneChan)
+		close(h.responseChan)
+	})
 }
 
 func (h *tuiResponseHandler) RecievedText(text string, color *string) {
@@ -1787,7 +2041,7 @@ func (h *tuiResponseHandler) RecievedText(text string, color *string) {
 	h.responseChan <- text
 }
 
-func (h *tuiResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage) {
+func (h *tuiResponseHandler) FinalText(contextId int64, prompt string, response string, toolUse []data.ToolUse, modelName string, usage *commontypes.TokenUsage, thinking []data.Thinking, attachments []data.Attachment) {
 	h.fullResponse = response
 
 	history := data.History{
@@ -1797,7 +2051,10 @@ func (h *tuiResponseHandler) FinalText(contextId int64, prompt string, response
 		Abbreviation: "",
 		TokenCount:   0,
 		Model:        modelName,
+		Agent:        h.Agent,
 		ToolUse:      toolUse,
+		Thinking:     thinking,
+		Attachments:  attachments,
 	}
 
 	if usage != nil {
@@ -1807,11 +2064,9 @@ func (h *tuiResponseHandler) FinalText(contextId int64, prompt string, response
 		history.CacheWriteTokens = usage.CacheWriteTokens
 	}
 
-	_, err := h.Repository.InsertHistory(history)
+	_, err := services.SaveHistory(h.Repository, history)
 	if err != nil {
 		println(fmt.Sprintf("Error while trying to save history: %s", err))
-	} else {
-		logger.HistoryPersisted(contextId)
 	}
 
 	code := services.ExtractCodeBlocks(response)
@@ -1824,9 +2079,7 @@ func (h *tuiResponseHandler) FinalText(contextId int64, prompt string, response
 
 	logger.Debug.Println("Final text in tui response channel")
 	if len(toolUse) == 0 {
-		logger.Debug.Println("closing doneChan and responseChan")
-		close(h.doneChan)
-		close(h.responseChan)
+		h.finish()
 	} else {
 		logger.Debug.Println("not closing doneChan and responseChan because of expected response to tool call answers.")
 	}
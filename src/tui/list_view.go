@@ -2,7 +2,9 @@ package tui
 
 import (
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -21,6 +23,16 @@ type listViewModel struct {
 	textInput     textinput.Model
 	inputMode     inputMode
 	showingPrompt bool
+	searchQuery   string
+	searchResults []data.SearchResult
+	searchCursor  int
+	trash         []data.Context
+	trashCursor   int
+	tagFilter     string
+	modelFilter   string
+	agentFilter   string
+	order         data.ContextOrder
+	notice        string
 }
 
 type listMode int
@@ -31,11 +43,21 @@ const (
 	confirmDeleteMode
 	inputDialogMode
 	showPromptMode
+	searchResultsMode
+	trashMode
+	confirmPurgeMode
 )
 
 const (
 	inputNewContext inputMode = iota
 	inputSystemPrompt
+	inputSearch
+	inputRename
+	inputTags
+	inputFolder
+	inputTagFilter
+	inputModelFilter
+	inputAgentFilter
 )
 
 type contextsLoadedMsg []contextItem
@@ -43,7 +65,23 @@ type contextCreatedMsg struct{ id int64 }
 type contextDeletedMsg struct{}
 type contextArchivedMsg struct{}
 type promptUpdatedMsg struct{}
+type contextUpdatedMsg struct{}
+
+// contextUpdateFailedMsg reports an update the user can correct, such as a
+// name that is taken, without leaving the list.
+type contextUpdateFailedMsg struct{ err error }
 type errorMsg struct{ err error }
+type searchResultsMsg []data.SearchResult
+type trashLoadedMsg []data.Context
+type contextRestoredMsg struct{}
+type contextPurgedMsg struct{}
+
+// searchJumpMsg opens the history of a context on the message a search
+// result points at.
+type searchJumpMsg struct {
+	context   data.Context
+	historyId int64
+}
 
 func newListViewModel(config TUIConfig) *listViewModel {
 	shared := &sharedState{
@@ -64,6 +102,7 @@ func newListViewModel(config TUIConfig) *listViewModel {
 		listOffset: 0,
 		mode:       normalMode,
 		textInput:  ti,
+		order:      data.OrderLastUsed,
 	}
 }
 
@@ -71,22 +110,27 @@ func (m *listViewModel) Init() tea.Cmd {
 	return m.loadContexts()
 }
 
+// loadContexts lists the contexts that are not archived in the chosen order,
+// narrowed to the tag, model and agent filters.
 func (m *listViewModel) loadContexts() tea.Cmd {
+	filter := m.filter()
+	order := m.order
 	return func() tea.Msg {
 		contexts, err := m.shared.config.Repository.GetAllContexts()
 		if err != nil {
 			return errorMsg{err}
 		}
+		contexts = data.FilterContexts(contexts, filter)
+		data.SortContexts(contexts, order)
 
 		var items []contextItem
 		for _, ctx := range contexts {
 			if ctx.Archived {
 				continue
 			}
-			history, _ := m.shared.config.Repository.GetHistoryByContextId(ctx.Id, 1000)
 			items = append(items, contextItem{
 				context:      ctx,
-				messageCount: len(history),
+				messageCount: ctx.MessageCount,
 			})
 		}
 
@@ -115,6 +159,36 @@ func (m *listViewModel) deleteContext(contextId int64) tea.Cmd {
 	}
 }
 
+func (m *listViewModel) loadTrash() tea.Cmd {
+	return func() tea.Msg {
+		trash, err := m.shared.config.Repository.GetDeletedContexts()
+		if err != nil {
+			return errorMsg{err}
+		}
+		return trashLoadedMsg(trash)
+	}
+}
+
+func (m *listViewModel) restoreContext(contextId int64) tea.Cmd {
+	return func() tea.Msg {
+		err := m.shared.config.Repository.RestoreContext(contextId)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return contextRestoredMsg{}
+	}
+}
+
+func (m *listViewModel) purgeContext(contextId int64) tea.Cmd {
+	return func() tea.Msg {
+		_, err := m.shared.config.Repository.PurgeContext(contextId)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return contextPurgedMsg{}
+	}
+}
+
 func (m *listViewModel) archiveContext(contextId int64) tea.Cmd {
 	return func() tea.Msg {
 		err := m.shared.config.Repository.ArchiveContext(contextId, true)
@@ -135,12 +209,78 @@ func (m *listViewModel) updateSystemPrompt(contextId int64, prompt string) tea.C
 	}
 }
 
+func (m *listViewModel) renameContext(contextId int64, name string) tea.Cmd {
+	return func() tea.Msg {
+		err := m.shared.config.Repository.RenameContext(contextId, name)
+		if err != nil {
+			return contextUpdateFailedMsg{err}
+		}
+		return contextUpdatedMsg{}
+	}
+}
+
+func (m *listViewModel) updateTags(contextId int64, tags []string) tea.Cmd {
+	return func() tea.Msg {
+		err := m.shared.config.Repository.UpdateTags(contextId, tags)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return contextUpdatedMsg{}
+	}
+}
+
+func (m *listViewModel) updateFolder(contextId int64, folder string) tea.Cmd {
+	return func() tea.Msg {
+		err := m.shared.config.Repository.UpdateFolder(contextId, folder)
+		if err != nil {
+			return errorMsg{err}
+		}
+		return contextUpdatedMsg{}
+	}
+}
+
+func (m *listViewModel) search(query string) tea.Cmd {
+	return func() tea.Msg {
+		results, err := m.shared.config.Repository.SearchHistory(query, data.SearchFilters{})
+		if err != nil {
+			return errorMsg{err}
+		}
+		return searchResultsMsg(results)
+	}
+}
+
+// jumpToResult loads the context of a search result and, when the match sits
+// on another branch, makes the newest branch through it the active one.
+func (m *listViewModel) jumpToResult(result data.SearchResult) tea.Cmd {
+	return func() tea.Msg {
+		repository := m.shared.config.Repository
+		context, err := repository.GetContextById(result.ContextId)
+		if err != nil {
+			return errorMsg{err}
+		}
+
+		tree, err := repository.GetHistoryTree(context.Id)
+		if err != nil {
+			return errorMsg{err}
+		}
+		if !slices.Contains(tree.Path(context.ActiveLeafId), result.HistoryId) {
+			leaf := tree.LatestLeaf(result.HistoryId)
+			if err := repository.UpdateActiveLeaf(context.Id, leaf); err != nil {
+				return errorMsg{err}
+			}
+			context.ActiveLeafId = leaf
+		}
+		return searchJumpMsg{context: context, historyId: result.HistoryId}
+	}
+}
+
 func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		if m.loading {
 			return m, nil
 		}
+		m.notice = ""
 
 		// Handle input dialog mode
 		if m.mode == inputDialogMode {
@@ -150,6 +290,29 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.textInput.SetValue("")
 				m.mode = normalMode
 
+				// Tags, folder and filter can be cleared with an empty value
+				if len(m.shared.contexts) > 0 {
+					contextId := m.shared.contexts[m.cursor].context.Id
+					switch m.inputMode {
+					case inputTags:
+						return m, tea.Sequence(
+							m.updateTags(contextId, data.ParseTags(value)),
+							m.loadContexts(),
+						)
+					case inputFolder:
+						return m, tea.Sequence(
+							m.updateFolder(contextId, value),
+							m.loadContexts(),
+						)
+					}
+				}
+				if m.setFilter(value) {
+					m.cursor = 0
+					m.listOffset = 0
+					m.loading = true
+					return m, m.loadContexts()
+				}
+
 				if value != "" {
 					switch m.inputMode {
 					case inputNewContext:
@@ -165,6 +328,18 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 								m.loadContexts(),
 							)
 						}
+					case inputSearch:
+						m.searchQuery = value
+						m.loading = true
+						return m, m.search(value)
+					case inputRename:
+						if len(m.shared.contexts) > 0 {
+							contextId := m.shared.contexts[m.cursor].context.Id
+							return m, tea.Sequence(
+								m.renameContext(contextId, value),
+								m.loadContexts(),
+							)
+						}
 					}
 				}
 				return m, nil
@@ -204,6 +379,57 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
+		// Handle confirm purge mode
+		if m.mode == confirmPurgeMode {
+			switch msg.String() {
+			case "y", "Y":
+				m.mode = trashMode
+				if len(m.trash) > 0 {
+					contextId := m.trash[m.trashCursor].Id
+					return m, tea.Sequence(
+						m.purgeContext(contextId),
+						m.loadTrash(),
+					)
+				}
+				return m, nil
+			case "n", "N", "esc":
+				m.mode = trashMode
+				return m, nil
+			}
+			return m, nil
+		}
+
+		// Handle trash mode
+		if m.mode == trashMode {
+			switch msg.String() {
+			case "up", "k":
+				if m.trashCursor > 0 {
+					m.trashCursor--
+				}
+			case "down", "j":
+				if m.trashCursor < len(m.trash)-1 {
+					m.trashCursor++
+				}
+			case "u", "enter":
+				if len(m.trash) > 0 {
+					contextId := m.trash[m.trashCursor].Id
+					return m, tea.Sequence(
+						m.restoreContext(contextId),
+						m.loadTrash(),
+						m.loadContexts(),
+					)
+				}
+			case "x":
+				if len(m.trash) > 0 {
+					m.mode = confirmPurgeMode
+				}
+			case "esc", "t", "q":
+				m.mode = normalMode
+				m.trash = nil
+			}
+			return m, nil
+		}
+
 		// Handle show prompt mode
 		if m.mode == showPromptMode {
 			switch msg.String() {
@@ -214,6 +440,31 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
+		// Handle search results mode
+		if m.mode == searchResultsMode {
+			switch msg.String() {
+			case "up", "k":
+				if m.searchCursor > 0 {
+					m.searchCursor--
+				}
+			case "down", "j":
+				if m.searchCursor < len(m.searchResults)-1 {
+					m.searchCursor++
+				}
+			case "enter":
+				if len(m.searchResults) > 0 {
+					m.loading = true
+					return m, m.jumpToResult(m.searchResults[m.searchCursor])
+				}
+			case "/":
+				m.openSearchInput()
+			case "esc", "q":
+				m.mode = normalMode
+				m.searchResults = nil
+			}
+			return m, nil
+		}
+
 		// Normal mode key handling
 		switch msg.String() {
 		case "ctrl+c", "q":
@@ -285,6 +536,45 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.textInput.Focus()
 			}
 
+		case "R":
+			// Rename context
+			if len(m.shared.contexts) > 0 {
+				m.openContextInput(inputRename, m.shared.contexts[m.cursor].context.Name, "Enter context name...")
+			}
+
+		case "T":
+			// Set tags
+			if len(m.shared.contexts) > 0 {
+				tags := strings.Join(m.shared.contexts[m.cursor].context.Tags, " ")
+				m.openContextInput(inputTags, tags, "Enter tags separated by spaces or commas...")
+			}
+
+		case "f":
+			// Move to a folder
+			if len(m.shared.contexts) > 0 {
+				m.openContextInput(inputFolder, m.shared.contexts[m.cursor].context.Folder, "Enter folder, e.g. work/owl...")
+			}
+
+		case "F":
+			// Filter by tag
+			m.openContextInput(inputTagFilter, m.tagFilter, "Show contexts with tag (empty shows all)...")
+
+		case "M":
+			// Filter by preferred model
+			m.openContextInput(inputModelFilter, m.modelFilter, "Show contexts with preferred model (empty shows all)...")
+
+		case "A":
+			// Filter by preferred agent
+			m.openContextInput(inputAgentFilter, m.agentFilter, "Show contexts with agent (empty shows all)...")
+
+		case "o":
+			// Next sort order
+			m.order = m.order.Next()
+			m.cursor = 0
+			m.listOffset = 0
+			m.loading = true
+			return m, m.loadContexts()
+
 		case "s":
 			// Show system prompt
 			if len(m.shared.contexts) > 0 {
@@ -310,12 +600,52 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.mode = confirmDeleteMode
 			}
 
+		case "/":
+			// Search the history of every context
+			m.openSearchInput()
+
+		case "t":
+			// Show the deleted contexts
+			m.loading = true
+			return m, m.loadTrash()
+
 		case "r":
 			// Refresh contexts
 			m.loading = true
 			return m, m.loadContexts()
 		}
 
+	case searchResultsMsg:
+		m.loading = false
+		m.searchResults = []data.SearchResult(msg)
+		m.searchCursor = 0
+		m.mode = searchResultsMode
+
+	case trashLoadedMsg:
+		m.loading = false
+		m.trash = []data.Context(msg)
+		if m.trashCursor >= len(m.trash) {
+			m.trashCursor = max(0, len(m.trash)-1)
+		}
+		m.mode = trashMode
+
+	case searchJumpMsg:
+		m.loading = false
+		m.mode = normalMode
+		context := msg.context
+		m.shared.selectedCtx = &context
+		historyView := newChatHistoryViewModel(m.shared)
+		historyView.focusHistoryId = msg.historyId
+		return historyView, tea.Sequence(
+			historyView.Init(),
+			func() tea.Msg {
+				return tea.WindowSizeMsg{
+					Width:  m.shared.width,
+					Height: m.shared.height,
+				}
+			},
+		)
+
 	case contextsLoadedMsg:
 		m.shared.contexts = []contextItem(msg)
 		m.loading = false
@@ -336,9 +666,21 @@ func (m *listViewModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case contextArchivedMsg:
 		// Context archived, will be refreshed by loadContexts
 
+	case contextRestoredMsg:
+		// Context restored, will be refreshed by loadTrash and loadContexts
+
+	case contextPurgedMsg:
+		// Context purged, will be refreshed by loadTrash
+
 	case promptUpdatedMsg:
 		// Prompt updated, will be refreshed by loadContexts
 
+	case contextUpdatedMsg:
+		// Name, tags or folder updated, will be refreshed by loadContexts
+
+	case contextUpdateFailedMsg:
+		m.notice = msg.err.Error()
+
 	case errorMsg:
 		m.shared.err = msg.err
 		m.loading = false
@@ -370,6 +712,7 @@ func (m *listViewModel) View() string {
 
 	// Header
 	b.WriteString(headerStyle.Render("🦉 OWL Contexts"))
+	b.WriteString(" " + dimStyle.Render(m.describeListing()))
 	b.WriteString("\n\n")
 
 	// Show input dialog if in input mode
@@ -378,6 +721,22 @@ func (m *listViewModel) View() string {
 		if m.inputMode == inputSystemPrompt {
 			title = "Set System Prompt"
 		}
+		switch m.inputMode {
+		case inputSearch:
+			title = "Search History"
+		case inputRename:
+			title = "Rename Context"
+		case inputTags:
+			title = "Set Tags"
+		case inputFolder:
+			title = "Move to Folder"
+		case inputTagFilter:
+			title = "Filter by Tag"
+		case inputModelFilter:
+			title = "Filter by Model"
+		case inputAgentFilter:
+			title = "Filter by Agent"
+		}
 
 		b.WriteString(headerStyle.Render(title))
 		b.WriteString("\n\n")
@@ -390,7 +749,7 @@ func (m *listViewModel) View() string {
 	// Show confirm delete dialog
 	if m.mode == confirmDeleteMode && len(m.shared.contexts) > 0 {
 		ctx := m.shared.contexts[m.cursor].context
-		b.WriteString(errorStyle.Render(fmt.Sprintf("Delete context '%s'?", ctx.Name)))
+		b.WriteString(errorStyle.Render(fmt.Sprintf("Move context '%s' to the trash?", ctx.Name)))
 		b.WriteString("\n\n")
 		b.WriteString(helpStyle.Render("y: yes • n: no • esc: cancel"))
 		return b.String()
@@ -413,8 +772,29 @@ func (m *listViewModel) View() string {
 		return b.String()
 	}
 
+	if m.mode == searchResultsMode {
+		b.WriteString(m.renderSearchResults())
+		return b.String()
+	}
+
+	// Show confirm purge dialog
+	if m.mode == confirmPurgeMode && len(m.trash) > 0 {
+		ctx := m.trash[m.trashCursor]
+		b.WriteString(errorStyle.Render(fmt.Sprintf("Permanently delete context '%s' and its history?", ctx.Name)))
+		b.WriteString("\n\n")
+		b.WriteString(helpStyle.Render("y: yes • n: no • esc: cancel"))
+		return b.String()
+	}
+
+	if m.mode == trashMode {
+		b.WriteString(m.renderTrash())
+		return b.String()
+	}
+
 	// Context list (normal mode)
-	if len(m.shared.contexts) == 0 {
+	if len(m.shared.contexts) == 0 && m.filter() != (data.ContextFilter{}) {
+		b.WriteString(dimStyle.Render("No contexts match the filters. Press 'F', 'M' or 'A' to change them."))
+	} else if len(m.shared.contexts) == 0 {
 		b.WriteString(dimStyle.Render("No contexts found. Press 'n' to create one."))
 	} else {
 		maxVisible := m.maxVisibleItems()
@@ -442,12 +822,23 @@ func (m *listViewModel) View() string {
 				style = selectedItemStyle
 			}
 
-			line := fmt.Sprintf("%s %s (%d messages)",
+			folder := ""
+			if item.context.Folder != "" {
+				folder = item.context.Folder + "/"
+			}
+			line := fmt.Sprintf("%s %s%s (%d messages, %s tokens, %s)",
 				cursor,
+				dimStyle.Render(folder),
 				item.context.Name,
 				item.messageCount,
+				formatTokenCount(item.context.TotalTokens),
+				formatAge(item.context.LastActivity(), time.Now()),
 			)
 
+			if len(item.context.Tags) > 0 {
+				line += " " + dimStyle.Render("#"+strings.Join(item.context.Tags, " #"))
+			}
+
 			if item.context.SystemPrompt != "" {
 				preview := item.context.SystemPrompt
 				if len(preview) > 40 {
@@ -463,13 +854,180 @@ func (m *listViewModel) View() string {
 
 	// Footer
 	b.WriteString("\n")
+	if m.notice != "" {
+		b.WriteString(errorStyle.Render(m.notice))
+		b.WriteString("\n")
+	}
 	b.WriteString(helpStyle.Render(
-		"↑/k up • ↓/j down • enter select • n new • p set prompt • s show prompt • a archive • d delete • c copy • r refresh • q quit",
+		"↑/k up • ↓/j down • enter select • n new • R rename • T tags • f folder • F filter by tag • p set prompt • s show prompt • a archive • d delete • t trash • o sort • M filter by model • A filter by agent • c copy • / search • r refresh • q quit",
 	))
 
 	return b.String()
 }
 
+// setFilter applies the value of a filter input, it reports false for the
+// other inputs.
+func (m *listViewModel) setFilter(value string) bool {
+	switch m.inputMode {
+	case inputTagFilter:
+		m.tagFilter = ""
+		if tags := data.ParseTags(value); len(tags) > 0 {
+			m.tagFilter = tags[0]
+		}
+	case inputModelFilter:
+		m.modelFilter = strings.TrimSpace(value)
+	case inputAgentFilter:
+		m.agentFilter = strings.TrimSpace(value)
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *listViewModel) filter() data.ContextFilter {
+	return data.ContextFilter{Tag: m.tagFilter, Model: m.modelFilter, Agent: m.agentFilter}
+}
+
+// describeListing names the sort order and the filters in use, for the
+// header.
+func (m *listViewModel) describeListing() string {
+	parts := []string{"by " + strings.ReplaceAll(string(m.order), "_", " ")}
+	if m.tagFilter != "" {
+		parts = append(parts, "#"+m.tagFilter)
+	}
+	if m.modelFilter != "" {
+		parts = append(parts, "model "+m.modelFilter)
+	}
+	if m.agentFilter != "" {
+		parts = append(parts, "agent "+m.agentFilter)
+	}
+	return strings.Join(parts, " • ")
+}
+
+// formatTokenCount shortens large counts, 12345 becomes 12.3k.
+func formatTokenCount(tokens int) string {
+	switch {
+	case tokens >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(tokens)/1_000_000)
+	case tokens >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(tokens)/1_000)
+	}
+	return fmt.Sprintf("%d", tokens)
+}
+
+// formatAge says how long ago t was in the largest whole unit.
+func formatAge(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "never used"
+	}
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+}
+
+// openContextInput opens the input dialog with the current value to edit.
+func (m *listViewModel) openContextInput(mode inputMode, value string, placeholder string) {
+	m.mode = inputDialogMode
+	m.inputMode = mode
+	m.textInput.SetValue(value)
+	m.textInput.Placeholder = placeholder
+	m.textInput.Focus()
+}
+
+func (m *listViewModel) openSearchInput() {
+	m.mode = inputDialogMode
+	m.inputMode = inputSearch
+	m.textInput.SetValue("")
+	m.textInput.Placeholder = "Search the history..."
+	m.textInput.Focus()
+}
+
+func (m *listViewModel) renderSearchResults() string {
+	var b strings.Builder
+	b.WriteString(headerStyle.Render(fmt.Sprintf("Search: %s", m.searchQuery)))
+	b.WriteString("\n\n")
+
+	if len(m.searchResults) == 0 {
+		b.WriteString(dimStyle.Render("No messages match the search."))
+	} else {
+		// Each result takes two lines, keep the cursor in view
+		maxVisible := max(1, m.maxVisibleItems()/2)
+		start := max(0, m.searchCursor-maxVisible+1)
+		end := min(len(m.searchResults), start+maxVisible)
+		for i := start; i < end; i++ {
+			result := m.searchResults[i]
+			cursor := " "
+			style := itemStyle
+			if i == m.searchCursor {
+				cursor = ">"
+				style = selectedItemStyle
+			}
+			b.WriteString(style.Render(fmt.Sprintf("%s %s", cursor, result.ContextName)))
+			b.WriteString(" " + dimStyle.Render(result.Created))
+			b.WriteString("\n")
+			b.WriteString(itemStyle.Render("  " + renderSnippet(result.Snippet)))
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString("\n")
+	b.WriteString(helpStyle.Render("↑/k up • ↓/j down • enter open • / new search • esc back"))
+	return b.String()
+}
+
+func (m *listViewModel) renderTrash() string {
+	var b strings.Builder
+	b.WriteString(headerStyle.Render("Trash"))
+	b.WriteString("\n\n")
+
+	if len(m.trash) == 0 {
+		b.WriteString(dimStyle.Render("The trash is empty."))
+	} else {
+		retention := data.TrashRetention()
+		maxVisible := m.maxVisibleItems()
+		start := max(0, m.trashCursor-maxVisible+1)
+		end := min(len(m.trash), start+maxVisible)
+		for i := start; i < end; i++ {
+			ctx := m.trash[i]
+			cursor := " "
+			style := itemStyle
+			if i == m.trashCursor {
+				cursor = ">"
+				style = selectedItemStyle
+			}
+			daysLeft := max(0, int(time.Until(ctx.DeletedAt.Add(retention)).Hours()/24))
+			b.WriteString(style.Render(fmt.Sprintf("%s %s", cursor, ctx.Name)))
+			b.WriteString(" " + dimStyle.Render(fmt.Sprintf("deleted %s, purged in %d days", ctx.DeletedAt.Local().Format("2006-01-02 15:04"), daysLeft)))
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString("\n")
+	b.WriteString(helpStyle.Render("↑/k up • ↓/j down • u/enter restore • x delete permanently • esc/t back"))
+	return b.String()
+}
+
+// renderSnippet puts a search snippet on one line and highlights the words
+// between the match marks.
+func renderSnippet(snippet string) string {
+	parts := strings.Split(strings.Join(strings.Fields(snippet), " "), data.SnippetMark)
+	for i := range parts {
+		if i%2 == 1 {
+			parts[i] = searchMatchStyle.Render(parts[i])
+		} else {
+			parts[i] = dimStyle.Render(parts[i])
+		}
+	}
+	return strings.Join(parts, "")
+}
+
 func (m *listViewModel) maxVisibleItems() int {
 	height := m.shared.height
 	if height <= 0 {
@@ -39,6 +39,10 @@ var (
 			Foreground(errorColor).
 			Bold(true)
 
+	searchMatchStyle = lipgloss.NewStyle().
+				Foreground(accentColor).
+				Bold(true)
+
 	userPromptStyle = lipgloss.NewStyle().
 			PaddingLeft(2).
 			Foreground(accentColor).